@@ -1,24 +1,224 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/ipc"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/output"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/overload"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/rollup"
 )
 
+type sinkFlags []string
+
+func (s *sinkFlags) String() string     { return strings.Join(*s, ",") }
+func (s *sinkFlags) Set(v string) error { *s = append(*s, v); return nil }
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <ipc-type>\n", os.Args[0])
+	outputPath := flag.String("output", ipc.DefaultOutputFilePath, "file to write aggregated logs to")
+	rotateSize := flag.Int64("rotate-size", 0, "rotate the output file once it reaches this many bytes, 0 to disable")
+	rotateAge := flag.Duration("rotate-age", 0, "rotate the output file once it is this old, 0 to disable")
+	maxFiles := flag.Int("max-files", 0, "number of rotated files to keep, 0 to keep all")
+	compression := flag.String("compress", string(output.NoCompression), "compression for rotated files (none, gzip or zstd)")
+	syncSpec := flag.String("fsync", string(output.SyncNone), "fsync policy: none, interval:DURATION or every:N")
+	appendOutput := flag.Bool("append", false, "append to an existing output file instead of truncating it")
+	var sinks sinkFlags
+	flag.Var(&sinks, "sink", "output sink, repeatable: file, stdout, http=URL, syslog=stdout|NETWORK://ADDRESS, ring=CAPACITY or rollup[=BUCKET_WIDTH] [default: file]")
+	sinkBuffer := flag.Int("sink-buffer", output.DefaultSinkBufferSize, "per-sink buffer size when writing to several sinks")
+	overloadPolicy := flag.String("overload", string(overload.Block), "what to do when the output falls behind: block, drop or spill")
+	spillPath := flag.String("spill-path", overload.DefaultConfig().SpillPath, "file to spill entries to with -overload spill")
+	options := ipc.DefaultOptions()
+	options.Endpoints.RegisterFlags(flag.CommandLine)
+	flag.IntVar(&options.Datagram.BatchSize, "recv-batch", options.Datagram.BatchSize, "datagrams to read per recvmmsg on the datagram transports, 1 for one recvmsg per datagram")
+	flag.IntVar(&options.Datagram.MaxSize, "max-datagram", options.Datagram.MaxSize, "largest datagram read in full, larger ones are counted as truncated")
+	flag.IntVar(&options.Datagram.ReadBuffer, "rcvbuf", options.Datagram.ReadBuffer, "socket receive buffer size (SO_RCVBUF) of the datagram transports, 0 for the system default")
+	flag.IntVar(&options.QueueSize, "queue", options.QueueSize, "capacity of the queues between receiver and output")
+	flag.StringVar(&options.CertDir, "cert-dir", options.CertDir, "directory with the certificates for tcp+tls (see cmd/gencerts)")
+	allowUIDs := flag.String("allow-uids", "", "comma-separated uids allowed to connect to unixsock besides our own, when "+ipc.TokenEnv+" is set")
+	httpAddr := flag.String("http-addr", "", "address to serve /metrics (plus /logs with a ring sink, /stats with a rollup sink) on, e.g. :9100 (disabled if empty)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <ipc-type>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "IPC types: %s\n", strings.Join(ipc.IPCTypes(), ", "))
+		flag.PrintDefaults()
+		ipc.PrintEnvUsage(flag.CommandLine)
+	}
+	if err := ipc.SetFlagsFromEnv(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	ipcType := flag.Arg(0)
+
+	syncPolicy, err := output.ParseSyncPolicy(*syncSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid fsync policy: %v\n", err)
+		os.Exit(1)
+	}
+	switch output.Compression(*compression) {
+	case output.NoCompression, output.GzipCompression, output.ZstdCompression:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown compression: %s\n", *compression)
+		os.Exit(1)
+	}
+	fileConfig := output.FileOutputConfig{
+		Path:        *outputPath,
+		MaxSize:     *rotateSize,
+		MaxAge:      *rotateAge,
+		MaxFiles:    *maxFiles,
+		Compression: output.Compression(*compression),
+		Sync:        syncPolicy,
+		Append:      *appendOutput,
+	}
+
+	mux := http.NewServeMux()
+	if len(sinks) == 0 {
+		sinks = sinkFlags{"file"}
+	}
+	var resolved []output.Sink
+	for _, spec := range sinks {
+		sink, err := resolveSink(spec, fileConfig, mux)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid sink %q: %v\n", spec, err)
+			os.Exit(1)
+		}
+		resolved = append(resolved, sink)
+	}
+	// A single sink is used directly, the fan-out (and its extra hop) is only needed for several.
+	out := resolved[0].Output
+	var fanOut *output.FanOut
+	if len(resolved) > 1 {
+		fanOut = output.NewFanOut(*sinkBuffer, resolved...)
+		out = fanOut
+	}
+
+	policy, err := overload.ParsePolicy(*overloadPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid overload policy: %v\n", err)
 		os.Exit(1)
 	}
-	ipcType := os.Args[1]
 
-	agg, ok := ipc.GetAggregator(ipcType)
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Unknown IPC type: %s\n", ipcType)
+	if err := options.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid transport settings: %v\n", err)
 		os.Exit(1)
 	}
 
-	agg.Run()
+	uids, err := parseUIDs(*allowUIDs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -allow-uids: %v\n", err)
+		os.Exit(1)
+	}
+	options.Token = os.Getenv(ipc.TokenEnv)
+	options.AllowedUIDs = uids
+
+	agg, err := ipc.GetAggregator(ipcType, out, overload.Config{Policy: policy, SpillPath: *spillPath}, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if *httpAddr != "" {
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			agg.WriteMetrics(w)
+		})
+		go func() {
+			log.Printf("metrics available at %s/metrics", *httpAddr)
+			log.Fatal(http.ListenAndServe(*httpAddr, mux))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = agg.Run(ctx)
+	if fanOut != nil {
+		log.Printf("entries dropped per sink: %v", fanOut.Dropped())
+	}
+	if err != nil {
+		log.Printf("aggregator failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+func resolveSink(spec string, fileConfig output.FileOutputConfig, mux *http.ServeMux) (output.Sink, error) {
+	kind, arg, _ := strings.Cut(spec, "=")
+	switch kind {
+	case "file":
+		return output.Sink{Name: spec, Output: output.NewFileOutput(fileConfig)}, nil
+	case "stdout":
+		return output.Sink{Name: spec, Output: output.NewStdoutOutput()}, nil
+	case "http":
+		if arg == "" {
+			return output.Sink{}, fmt.Errorf("missing URL")
+		}
+		return output.Sink{Name: spec, Output: output.NewHTTPOutput(arg, output.DefaultHTTPBatchSize, output.DefaultHTTPLinger)}, nil
+	case "syslog":
+		if arg == "" || arg == "stdout" {
+			return output.Sink{Name: spec, Output: output.NewSyslogOutput(os.Stdout)}, nil
+		}
+		network, address, found := strings.Cut(arg, "://")
+		if !found {
+			return output.Sink{}, fmt.Errorf("expected NETWORK://ADDRESS, got %q", arg)
+		}
+		so, err := output.DialSyslogOutput(network, address)
+		if err != nil {
+			return output.Sink{}, err
+		}
+		return output.Sink{Name: spec, Output: so}, nil
+	case "ring":
+		capacity, err := strconv.Atoi(arg)
+		if err != nil || capacity <= 0 {
+			return output.Sink{}, fmt.Errorf("invalid capacity: %q", arg)
+		}
+		ring := output.NewRingBuffer(capacity)
+		mux.Handle("/logs", ring.Handler())
+		return output.Sink{Name: spec, Output: ring}, nil
+	case "rollup":
+		config := rollup.DefaultConfig()
+		if arg != "" {
+			width, err := time.ParseDuration(arg)
+			if err != nil {
+				return output.Sink{}, fmt.Errorf("invalid bucket width: %v", err)
+			}
+			config.BucketWidth = width
+		}
+		if err := config.Validate(); err != nil {
+			return output.Sink{}, err
+		}
+		r := rollup.New(config)
+		mux.Handle("/stats", r.Handler())
+		return output.Sink{Name: spec, Output: r}, nil
+	default:
+		return output.Sink{}, fmt.Errorf("unknown sink type: %q", kind)
+	}
+}
+
+func parseUIDs(s string) ([]uint32, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var uids []uint32
+	for _, field := range strings.Split(s, ",") {
+		uid, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		uids = append(uids, uint32(uid))
+	}
+	return uids, nil
 }
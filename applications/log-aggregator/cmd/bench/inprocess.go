@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/ipc"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/overload"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/procstat"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
+)
+
+// countingOutput only counts, so the output costs next to nothing and the run measures the transport.
+type countingOutput struct {
+	received atomic.Uint64
+	last     atomic.Int64 // wall clock of the latest entry, in unix nanoseconds
+}
+
+func (c *countingOutput) Write(events <-chan model.LogEntry) error {
+	for range events {
+		c.received.Add(1)
+		c.last.Store(time.Now().UnixNano())
+	}
+	return nil
+}
+
+// runInProcess runs the aggregator and the producers on goroutines of this process, which leaves out process scheduling and
+// the cost of the file output. CPU time and context switches are those of the whole process.
+func runInProcess(c benchCase, s settings) (Result, error) {
+	dir, err := os.MkdirTemp("", "log-bench-")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+	options, err := s.options(dir)
+	if err != nil {
+		return Result{}, err
+	}
+
+	out := &countingOutput{}
+	agg, err := ipc.GetAggregator(c.transport, out, overload.DefaultConfig(), options)
+	if err != nil {
+		return Result{}, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exited, aggExited := context.WithCancel(context.Background())
+	aggErr := make(chan error, 1)
+	go func() {
+		aggErr <- agg.Run(ctx)
+		aggExited()
+	}()
+	if err := waitReady(exited, c.transport, options); err != nil {
+		cancel()
+		if runErr := <-aggErr; runErr != nil {
+			return Result{}, runErr
+		}
+		return Result{}, err
+	}
+
+	publisherConfig := publisher.DefaultConfig()
+	publisherConfig.Batch.Size = s.batch
+	producers := make([]*ipc.Producer, s.producers)
+	for i := range producers {
+		if producers[i], err = ipc.GetProducer(c.transport, s.workload(c), publisherConfig, options); err != nil {
+			return Result{}, err
+		}
+	}
+
+	before, err := procstat.Read(0)
+	if err != nil {
+		return Result{}, err
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, p := range producers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Run()
+		}()
+	}
+	wg.Wait()
+
+	var m measurement
+	for _, p := range producers {
+		stats := p.Stats()
+		m.sent += stats.Published.Load()
+		m.dropped += stats.Dropped.Load() + stats.Oversized.Load()
+	}
+	waitSettled(out.received.Load, m.sent, s.settle)
+	after, err := procstat.Read(0)
+	if err != nil {
+		return Result{}, err
+	}
+
+	cancel()
+	if err := <-aggErr; err != nil {
+		return Result{}, err
+	}
+	m.received = out.received.Load()
+	if last := out.last.Load(); last != 0 {
+		m.elapsed = time.Unix(0, last).Sub(start)
+	}
+	m.socketDrops = agg.ReceiverStats().SocketDrops.Load()
+	m.latency = agg.Latencies().Summary()
+	m.usage = after.Sub(before)
+	return s.result(c, inProcess, m), nil
+}
@@ -0,0 +1,190 @@
+// Command bench runs producers and an aggregator over every IPC type, sweeping message sizes and rates, and reports
+// throughput, loss, delivery latency, CPU time and context switches per run.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/ipc"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/workload"
+)
+
+const (
+	inProcess  = "inprocess"
+	subprocess = "subprocess"
+)
+
+// settings are the parts of a run that stay the same across the sweep.
+type settings struct {
+	producers     int
+	count         int
+	duration      time.Duration
+	batch         int
+	recvBatch     int
+	queue         int
+	settle        time.Duration
+	certDir       string
+	aggregatorBin string
+	producerBin   string
+}
+
+// benchCase is one point of the sweep.
+type benchCase struct {
+	transport string
+	size      string
+	rate      int // per producer, 0 for unthrottled
+}
+
+func (c benchCase) String() string {
+	return fmt.Sprintf("transport=%s size=%s rate=%d", c.transport, c.size, c.rate)
+}
+
+func main() {
+	transports := flag.String("ipc", strings.Join(ipc.ProducerTypes(), ","), "comma-separated IPC types to run")
+	sizes := flag.String("sizes", "100,1000", "comma-separated message size distributions, in the producer's -size format")
+	rates := flag.String("rates", "0", "comma-separated rates in messages per second per producer, 0 for unthrottled")
+	mode := flag.String("mode", inProcess, "run aggregator and producers as goroutines of this process (inprocess) or as separate processes (subprocess)")
+	var s settings
+	flag.IntVar(&s.producers, "producers", 4, "number of producers per run")
+	flag.IntVar(&s.count, "count", 50000, "messages per producer, 0 for no limit")
+	flag.DurationVar(&s.duration, "duration", 10*time.Second, "time limit per producer, 0 for no limit")
+	flag.IntVar(&s.batch, "batch", publisher.DefaultBatchConfig().Size, "entries per writev/sendmmsg on the producers")
+	flag.IntVar(&s.recvBatch, "recv-batch", ipc.DefaultOptions().Datagram.BatchSize, "datagrams per recvmmsg on the aggregator")
+	flag.IntVar(&s.queue, "queue", ipc.DefaultQueueSize, "capacity of the queues inside producers and aggregator")
+	flag.DurationVar(&s.settle, "settle", time.Second, "how long to wait for entries still in flight once the producers are done")
+	flag.StringVar(&s.aggregatorBin, "aggregator-bin", "cmd/aggregator/aggregator", "aggregator binary for -mode subprocess")
+	flag.StringVar(&s.producerBin, "producer-bin", "cmd/producer/producer", "producer binary for -mode subprocess")
+	format := flag.String("format", "csv", "report format: csv or json")
+	outPath := flag.String("out", "", "file to write the report to (default stdout)")
+	verbose := flag.Bool("v", false, "show the logs of aggregator and producers")
+	flag.Parse()
+
+	cases, err := sweep(*transports, *sizes, *rates)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if s.producers <= 0 {
+		fmt.Fprintf(os.Stderr, "-producers must be positive, got %d\n", s.producers)
+		os.Exit(1)
+	}
+	if s.count == 0 && s.duration == 0 {
+		fmt.Fprintln(os.Stderr, "-count and -duration can't both be 0, the producers would never stop")
+		os.Exit(1)
+	}
+	var run func(benchCase, settings) (Result, error)
+	switch *mode {
+	case inProcess:
+		run = runInProcess
+	case subprocess:
+		run = runSubprocess
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown mode: %s\n", *mode)
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		if out, err = os.Create(*outPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	report, err := newReport(*format, out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if slices.ContainsFunc(cases, func(c benchCase) bool { return c.transport == "tcp+tls" }) {
+		dir, err := os.MkdirTemp("", "log-bench-certs-")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+		if err := auth.GenerateTestCertificates(dir, time.Hour); err != nil {
+			fmt.Fprintf(os.Stderr, "Generating certificates: %v\n", err)
+			os.Exit(1)
+		}
+		s.certDir = dir
+	}
+
+	// The in-process aggregator and producers log their statistics on every run, which would drown the progress lines.
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	failed := 0
+	for i, c := range cases {
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s %s\n", i+1, len(cases), *mode, c)
+		result, err := run(c, s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "  failed: %v\n", err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %.0f msgs/s, lost %d of %d, p99 %.1fus, %.2fus CPU per message\n",
+			result.MsgsPerSec, result.Lost, result.Sent, result.LatencyP99Us, result.CPUPerMsgUs)
+		if err := report.Write(result); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := report.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Writing report: %v\n", err)
+		os.Exit(1)
+	}
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d runs failed\n", failed, len(cases))
+		os.Exit(1)
+	}
+}
+
+// sweep is the cross product of transports, sizes and rates, in that nesting order.
+func sweep(transports, sizes, rates string) ([]benchCase, error) {
+	var cases []benchCase
+	for _, transport := range strings.Split(transports, ",") {
+		if !slices.Contains(ipc.ProducerTypes(), transport) {
+			return nil, fmt.Errorf("not an IPC type with a producer: %q (have %s)", transport, strings.Join(ipc.ProducerTypes(), ", "))
+		}
+		for _, size := range strings.Split(sizes, ",") {
+			if _, err := workload.ParseSizeDistribution(size); err != nil {
+				return nil, fmt.Errorf("invalid message size %q: %w", size, err)
+			}
+			for _, r := range strings.Split(rates, ",") {
+				rate, err := strconv.Atoi(r)
+				if err != nil || rate < 0 {
+					return nil, fmt.Errorf("invalid rate %q", r)
+				}
+				cases = append(cases, benchCase{transport: transport, size: size, rate: rate})
+			}
+		}
+	}
+	return cases, nil
+}
+
+func (s settings) workload(c benchCase) workload.Config {
+	sizes, _ := workload.ParseSizeDistribution(c.size) // validated by sweep
+	config := workload.DefaultConfig()
+	config.Rate = c.rate
+	config.Count = s.count
+	config.Duration = s.duration
+	config.Sizes = sizes
+	return config
+}
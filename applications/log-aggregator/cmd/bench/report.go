@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// Result is one row of the report. The JSON names double as the CSV header.
+type Result struct {
+	Transport string `json:"transport"`
+	Mode      string `json:"mode"`
+	Producers int    `json:"producers"`
+	Size      string `json:"size"`
+	Rate      int    `json:"rate"` // per producer, 0 for unthrottled
+	// Sent counts the entries the producers wrote to the transport, Received those that came out of the aggregator's receiver.
+	Sent      uint64  `json:"sent"`
+	Received  uint64  `json:"received"`
+	Lost      uint64  `json:"lost"`
+	LossRatio float64 `json:"loss_ratio"`
+	// Dropped counts the entries the producers never sent: dropped from the reconnect buffer, or too large for the transport.
+	Dropped     uint64  `json:"dropped"`
+	SocketDrops uint64  `json:"socket_drops"`
+	Seconds     float64 `json:"seconds"` // from the start of the producers to the last entry received
+	MsgsPerSec  float64 `json:"msgs_per_sec"`
+
+	LatencyMeanUs float64 `json:"latency_mean_us"`
+	LatencyP50Us  float64 `json:"latency_p50_us"`
+	LatencyP99Us  float64 `json:"latency_p99_us"`
+	LatencyP999Us float64 `json:"latency_p999_us"`
+
+	// CPU time and context switches of aggregator and producers together.
+	CPUUserSec   float64 `json:"cpu_user_s"`
+	CPUSystemSec float64 `json:"cpu_system_s"`
+	// The split between aggregator and producers, only known in subprocess mode.
+	AggregatorCPUSec    float64 `json:"aggregator_cpu_s"`
+	ProducerCPUSec      float64 `json:"producer_cpu_s"`
+	CPUPerMsgUs         float64 `json:"cpu_per_msg_us"`
+	VoluntarySwitches   uint64  `json:"voluntary_ctxt_switches"`
+	InvoluntarySwitches uint64  `json:"nonvoluntary_ctxt_switches"`
+}
+
+type report interface {
+	Write(Result) error
+	Close() error
+}
+
+func newReport(format string, w io.Writer) (report, error) {
+	switch format {
+	case "csv":
+		return &csvReport{w: csv.NewWriter(w)}, nil
+	case "json":
+		return &jsonReport{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// csvReport writes every row as soon as it is known, so a long sweep can be followed along and a failed one still
+// leaves the rows so far.
+type csvReport struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (r *csvReport) Write(result Result) error {
+	v := reflect.ValueOf(result)
+	if !r.headerWritten {
+		header := make([]string, v.NumField())
+		for i := range header {
+			header[i] = v.Type().Field(i).Tag.Get("json")
+		}
+		r.w.Write(header)
+		r.headerWritten = true
+	}
+	record := make([]string, v.NumField())
+	for i := range record {
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Float64:
+			record[i] = strconv.FormatFloat(f.Float(), 'f', 3, 64)
+		default:
+			record[i] = fmt.Sprint(f.Interface())
+		}
+	}
+	r.w.Write(record)
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func (r *csvReport) Close() error {
+	return nil
+}
+
+// jsonReport writes a single array once the sweep is done.
+type jsonReport struct {
+	w       io.Writer
+	results []Result
+}
+
+func (r *jsonReport) Write(result Result) error {
+	r.results = append(r.results, result)
+	return nil
+}
+
+func (r *jsonReport) Close() error {
+	encoder := json.NewEncoder(r.w)
+	encoder.SetIndent("", "  ")
+	if r.results == nil {
+		r.results = []Result{}
+	}
+	return encoder.Encode(r.results)
+}
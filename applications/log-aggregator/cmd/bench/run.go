@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/ipc"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/latency"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/procstat"
+)
+
+const readyTimeout = 5 * time.Second
+
+// options gives every run its own endpoints, so runs don't trip over leftovers of the previous one (or over an aggregator
+// someone left running on the defaults).
+func (s settings) options(dir string) (ipc.Options, error) {
+	options := ipc.DefaultOptions()
+	options.QueueSize = s.queue
+	options.Datagram.BatchSize = s.recvBatch
+	options.CertDir = s.certDir
+	options.Endpoints.SocketPath = filepath.Join(dir, "log.sock")
+	options.Endpoints.FIFOPath = filepath.Join(dir, "log_fifo")
+	port, err := freePort()
+	if err != nil {
+		return ipc.Options{}, err
+	}
+	options.Endpoints.Address = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if port, err = freePort(); err != nil {
+		return ipc.Options{}, err
+	}
+	options.Endpoints.TLSAddress = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	return options, options.Validate()
+}
+
+// freePort finds a loopback port that is free for both TCP and UDP, since tcp and udp share the -addr endpoint.
+func freePort() (int, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		ln.Close()
+		if err == nil {
+			conn.Close()
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free port for both tcp and udp")
+}
+
+// waitReady waits until the aggregator's receiver is up, so the producers don't start out in reconnect backoff.
+// ctx is cancelled if the aggregator gives up before that.
+func waitReady(ctx context.Context, transport string, options ipc.Options) error {
+	deadline := time.Now().Add(readyTimeout)
+	for !ready(transport, options) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("aggregator not ready after %s", readyTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("aggregator exited before it was ready")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func ready(transport string, options ipc.Options) bool {
+	e := options.Endpoints
+	switch transport {
+	case "unixsock", "tcp":
+		network, address := "unix", e.SocketPath
+		if transport == "tcp" {
+			network, address = "tcp", e.Address
+		}
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	case "tcp+tls":
+		// A complete handshake, a bare connect would be counted as a rejected connection.
+		config, err := auth.ClientTLSConfig(options.CertDir)
+		if err != nil {
+			return false
+		}
+		conn, err := tls.Dial("tcp", e.TLSAddress, config)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	case "unixgram":
+		if _, err := os.Stat(e.SocketPath); err != nil {
+			return false
+		}
+	case "udp":
+		// Nothing answers on UDP, but a port without a socket sends back an ICMP error, which shows up as ECONNREFUSED on a
+		// connected socket. The empty probe datagram decodes to nothing on the receiving end.
+		conn, err := net.Dial("udp", e.Address)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		conn.Write(nil)
+		conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			return false
+		}
+	case "fifo":
+		// Opening for writing without blocking fails with ENXIO as long as there is no reader.
+		f, err := os.OpenFile(e.FIFOPath, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return false
+		}
+		f.Close()
+	}
+	return true
+}
+
+// waitSettled waits for the entries still in flight once the producers are done: until everything sent has been received,
+// or nothing new arrived for settle. Datagram transports lose entries, so the latter is the usual way out for them.
+func waitSettled(received func() uint64, sent uint64, settle time.Duration) {
+	last, lastChange := received(), time.Now()
+	for last < sent && time.Since(lastChange) < settle {
+		time.Sleep(10 * time.Millisecond)
+		if n := received(); n != last {
+			last, lastChange = n, time.Now()
+		}
+	}
+}
+
+// measurement is what a run observed, in whatever way its mode observes it.
+type measurement struct {
+	sent, received, dropped, socketDrops uint64
+	elapsed                              time.Duration
+	latency                              latency.Summary
+	usage                                procstat.Usage // everything: aggregator and producers
+	aggregatorCPU, producerCPU           time.Duration  // only known when they run as separate processes
+}
+
+func (s settings) result(c benchCase, mode string, m measurement) Result {
+	r := Result{
+		Transport:           c.transport,
+		Mode:                mode,
+		Producers:           s.producers,
+		Size:                c.size,
+		Rate:                c.rate,
+		Sent:                m.sent,
+		Received:            m.received,
+		Dropped:             m.dropped,
+		SocketDrops:         m.socketDrops,
+		Seconds:             m.elapsed.Seconds(),
+		LatencyMeanUs:       micros(m.latency.Mean),
+		LatencyP50Us:        micros(m.latency.P50),
+		LatencyP99Us:        micros(m.latency.P99),
+		LatencyP999Us:       micros(m.latency.P999),
+		CPUUserSec:          m.usage.User.Seconds(),
+		CPUSystemSec:        m.usage.System.Seconds(),
+		AggregatorCPUSec:    m.aggregatorCPU.Seconds(),
+		ProducerCPUSec:      m.producerCPU.Seconds(),
+		VoluntarySwitches:   m.usage.Voluntary,
+		InvoluntarySwitches: m.usage.Involuntary,
+	}
+	if m.sent > m.received {
+		r.Lost = m.sent - m.received
+		r.LossRatio = float64(r.Lost) / float64(m.sent)
+	}
+	if m.elapsed > 0 {
+		r.MsgsPerSec = float64(m.received) / m.elapsed.Seconds()
+	}
+	if m.received > 0 {
+		r.CPUPerMsgUs = micros(m.usage.CPU()) / float64(m.received)
+	}
+	return r
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
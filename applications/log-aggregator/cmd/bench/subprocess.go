@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/ipc"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/latency"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/procstat"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// runSubprocess runs the aggregator and producer binaries, the way they run in an experiment. The aggregator writes to
+// /dev/null, so the JSON encoding is part of the measurement but the disk is not. Its counters come from /metrics, its CPU
+// time and context switches from /proc while it is still running, and the producers' from wait4 once they have exited.
+func runSubprocess(c benchCase, s settings) (Result, error) {
+	dir, err := os.MkdirTemp("", "log-bench-")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+	options, err := s.options(dir)
+	if err != nil {
+		return Result{}, err
+	}
+	port, err := freePort()
+	if err != nil {
+		return Result{}, err
+	}
+	metricsURL := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/metrics"
+
+	args := append(endpointFlags(options),
+		"-output", os.DevNull,
+		"-http-addr", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		"-recv-batch", strconv.Itoa(s.recvBatch),
+		c.transport)
+	agg := exec.Command(s.aggregatorBin, args...)
+	var aggLog bytes.Buffer
+	agg.Stdout, agg.Stderr = &aggLog, &aggLog
+	if err := agg.Start(); err != nil {
+		return Result{}, err
+	}
+	exited, aggExited := context.WithCancel(context.Background())
+	aggErr := make(chan error, 1)
+	go func() {
+		aggErr <- agg.Wait()
+		aggExited()
+	}()
+	defer func() {
+		// Whatever happened, don't leave the aggregator behind.
+		agg.Process.Kill()
+		<-exited.Done()
+	}()
+	failed := func(err error) (Result, error) {
+		return Result{}, fmt.Errorf("%w\n%s", err, aggLog.String())
+	}
+
+	if err := waitReady(exited, c.transport, options); err != nil {
+		return failed(err)
+	}
+	// The metrics server is started before the receiver, so it is up by now.
+	if _, err := scrape(metricsURL); err != nil {
+		return failed(err)
+	}
+
+	before, err := procstat.Read(agg.Process.Pid)
+	if err != nil {
+		return failed(err)
+	}
+	start := time.Now()
+	producers := make([]*exec.Cmd, s.producers)
+	logs := make([]bytes.Buffer, s.producers)
+	for i := range producers {
+		producers[i] = exec.Command(s.producerBin, s.producerArgs(c, options)...)
+		producers[i].Stdout, producers[i].Stderr = &logs[i], &logs[i]
+		if err := producers[i].Start(); err != nil {
+			return failed(err)
+		}
+	}
+	var m measurement
+	for i, p := range producers {
+		if err := p.Wait(); err != nil {
+			return failed(fmt.Errorf("producer: %w\n%s", err, logs[i].String()))
+		}
+		published, dropped, err := publisherStats(logs[i].String())
+		if err != nil {
+			return failed(err)
+		}
+		m.sent += published
+		m.dropped += dropped
+		usage := procstat.FromRusage(p.ProcessState.SysUsage().(*syscall.Rusage))
+		m.producerCPU += usage.CPU()
+		m.usage = m.usage.Add(usage)
+	}
+
+	// /metrics is only polled every 10ms, which is as precise as the end of the run gets.
+	var scrapeErr error
+	received := func() uint64 {
+		metrics, err := scrape(metricsURL)
+		if err != nil {
+			scrapeErr = err
+			return 0
+		}
+		return uint64(metrics["log_receiver_received_total"])
+	}
+	last, end := received(), time.Now()
+	waitSettled(func() uint64 {
+		if n := received(); n != last {
+			last, end = n, time.Now()
+		}
+		return last
+	}, m.sent, s.settle)
+	if scrapeErr != nil {
+		return failed(scrapeErr)
+	}
+	after, err := procstat.Read(agg.Process.Pid)
+	if err != nil {
+		return failed(err)
+	}
+	metrics, err := scrape(metricsURL)
+	if err != nil {
+		return failed(err)
+	}
+
+	agg.Process.Signal(os.Interrupt)
+	select {
+	case err := <-aggErr:
+		if err != nil {
+			return failed(fmt.Errorf("aggregator: %w", err))
+		}
+	case <-time.After(shutdownTimeout):
+		return failed(fmt.Errorf("aggregator did not shut down within %s", shutdownTimeout))
+	}
+
+	aggUsage := after.Sub(before)
+	m.aggregatorCPU = aggUsage.CPU()
+	m.usage = m.usage.Add(aggUsage)
+	m.received = uint64(metrics["log_receiver_received_total"])
+	m.socketDrops = uint64(metrics["log_receiver_socket_drops_total"])
+	m.elapsed = end.Sub(start)
+	m.latency = latency.Summary{
+		Count: uint64(metrics["log_delivery_latency_seconds_count"]),
+		P50:   seconds(metrics[`log_delivery_latency_seconds{quantile="0.5"}`]),
+		P99:   seconds(metrics[`log_delivery_latency_seconds{quantile="0.99"}`]),
+		P999:  seconds(metrics[`log_delivery_latency_seconds{quantile="0.999"}`]),
+	}
+	if m.latency.Count > 0 {
+		m.latency.Mean = seconds(metrics["log_delivery_latency_seconds_sum"] / float64(m.latency.Count))
+	}
+	return s.result(c, subprocess, m), nil
+}
+
+func endpointFlags(options ipc.Options) []string {
+	e := options.Endpoints
+	return []string{
+		"-socket-path", e.SocketPath,
+		"-addr", e.Address,
+		"-tls-addr", e.TLSAddress,
+		"-fifo-path", e.FIFOPath,
+		"-queue", strconv.Itoa(options.QueueSize),
+		"-cert-dir", options.CertDir,
+	}
+}
+
+func (s settings) producerArgs(c benchCase, options ipc.Options) []string {
+	return append(endpointFlags(options),
+		"-rate", strconv.Itoa(c.rate),
+		"-count", strconv.Itoa(s.count),
+		"-duration", s.duration.String(),
+		"-size", c.size,
+		"-batch", strconv.Itoa(s.batch),
+		c.transport)
+}
+
+var publisherStatsPattern = regexp.MustCompile(`publisher: .*published=(\d+) .*dropped=(\d+) oversized=(\d+)`)
+
+// publisherStats picks the counters out of the summary line a producer logs when it is done.
+func publisherStats(log string) (published, dropped uint64, err error) {
+	match := publisherStatsPattern.FindStringSubmatch(log)
+	if match == nil {
+		return 0, 0, fmt.Errorf("no publisher statistics in the producer's output:\n%s", log)
+	}
+	published, _ = strconv.ParseUint(match[1], 10, 64)
+	droppedEntries, _ := strconv.ParseUint(match[2], 10, 64)
+	oversized, _ := strconv.ParseUint(match[3], 10, 64)
+	return published, droppedEntries + oversized, nil
+}
+
+// scrape reads the aggregator's metrics into a map by name. The transport label is left out, there is only one, and the
+// quantile label is kept, e.g. log_delivery_latency_seconds{quantile="0.99"}.
+func scrape(url string) (map[string]float64, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return parseMetrics(resp.Body)
+}
+
+func parseMetrics(r io.Reader) (map[string]float64, error) {
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("malformed metric line %q", line)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed metric line %q", line)
+		}
+		name, labels, _ := strings.Cut(series, "{")
+		for _, label := range strings.Split(strings.TrimSuffix(labels, "}"), ",") {
+			if strings.HasPrefix(label, "quantile=") {
+				name += "{" + label + "}"
+			}
+		}
+		metrics[name] = v
+	}
+	return metrics, scanner.Err()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
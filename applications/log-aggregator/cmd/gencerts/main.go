@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
+)
+
+// gencerts writes a test CA plus server and client certificates for the tcp+tls transport.
+func main() {
+	dir := flag.String("dir", auth.DefaultCertDir, "directory to write the certificates and keys to")
+	validFor := flag.Duration("valid-for", 30*24*time.Hour, "validity period of the certificates")
+	flag.Parse()
+
+	if err := auth.GenerateTestCertificates(*dir, *validFor); err != nil {
+		fmt.Fprintf(os.Stderr, "Generating certificates: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Test certificates written to %s\n", *dir)
+}
@@ -1,29 +1,95 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/ipc"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/workload"
 )
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <ipc-type> <message-size>\n", os.Args[0])
+	defaults := workload.DefaultConfig()
+	rate := flag.Int("rate", defaults.Rate, "messages per second, 0 for unthrottled max-throughput mode")
+	burst := flag.Int("burst", defaults.Burst, "messages sent back-to-back per tick (the overall rate stays the same)")
+	duration := flag.Duration("duration", defaults.Duration, "how long to produce for, 0 for no time limit")
+	count := flag.Int("count", 0, "number of messages to produce, 0 for no limit")
+	sizeSpec := flag.String("size", fmt.Sprint(workload.DefaultMessageSize), "message size distribution: N, fixed:N, uniform:MIN-MAX or exp:MEAN[-CAP]")
+	payload := flag.String("payload", string(defaults.Payload), "payload content (fixed or random)")
+	publisherDefaults := publisher.DefaultConfig()
+	reconnectDefaults := publisherDefaults.Reconnect
+	backoffMin := flag.Duration("backoff-min", reconnectDefaults.InitialBackoff, "wait before the first reconnect attempt, doubled after every failed one")
+	backoffMax := flag.Duration("backoff-max", reconnectDefaults.MaxBackoff, "upper bound for the wait between reconnect attempts")
+	bufferSize := flag.Int("buffer", reconnectDefaults.BufferSize, "entries to buffer while disconnected from the aggregator, the oldest are dropped beyond that")
+	bufferPath := flag.String("buffer-path", "", "keep the buffer in this file instead of in memory, so it survives producer restarts")
+	flushTimeout := flag.Duration("flush-timeout", reconnectDefaults.FlushTimeout, "how long to keep trying to deliver buffered entries after the workload is done")
+	batchSize := flag.Int("batch", publisherDefaults.Batch.Size, "entries to write with a single writev/sendmmsg, 1 for one write per entry")
+	linger := flag.Duration("linger", publisherDefaults.Batch.Linger, "how long a batch waits to fill up, 0 to only batch entries that are already queued")
+	options := ipc.DefaultOptions()
+	options.Endpoints.RegisterFlags(flag.CommandLine)
+	flag.IntVar(&options.QueueSize, "queue", options.QueueSize, "capacity of the queue between the workload and the publisher")
+	flag.StringVar(&options.CertDir, "cert-dir", options.CertDir, "directory with the certificates for tcp+tls (see cmd/gencerts)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <ipc-type>\n", os.Args[0])
+		flag.PrintDefaults()
+		ipc.PrintEnvUsage(flag.CommandLine)
+	}
+	if err := ipc.SetFlagsFromEnv(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	ipcType := flag.Arg(0)
+
+	sizes, err := workload.ParseSizeDistribution(*sizeSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid message size: %v\n", err)
+		os.Exit(1)
+	}
+	config := workload.Config{
+		Rate:     *rate,
+		Burst:    *burst,
+		Duration: *duration,
+		Count:    *count,
+		Sizes:    sizes,
+		Payload:  workload.PayloadKind(*payload),
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid workload: %v\n", err)
+		os.Exit(1)
+	}
+
+	publisherConfig := publisher.Config{
+		Reconnect: publisher.ReconnectConfig{
+			InitialBackoff: *backoffMin,
+			MaxBackoff:     *backoffMax,
+			BufferSize:     *bufferSize,
+			BufferPath:     *bufferPath,
+			FlushTimeout:   *flushTimeout,
+		},
+		Batch: publisher.BatchConfig{Size: *batchSize, Linger: *linger},
+	}
+	if err := publisherConfig.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid publisher settings: %v\n", err)
 		os.Exit(1)
 	}
-	ipcType := os.Args[1]
 
-	messageSize := 0
-	_, err := fmt.Sscanf(os.Args[2], "%d", &messageSize)
-	if err != nil || messageSize <= 0 {
-		fmt.Fprintf(os.Stderr, "Invalid message size: %s\n", os.Args[2])
+	if err := options.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid transport settings: %v\n", err)
 		os.Exit(1)
 	}
+	options.Token = os.Getenv(ipc.TokenEnv)
 
-	prod, ok := ipc.GetProducer(ipcType, messageSize)
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Unknown IPC type: %s\n", ipcType)
+	prod, err := ipc.GetProducer(ipcType, config, publisherConfig, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
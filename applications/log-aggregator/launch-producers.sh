@@ -3,12 +3,12 @@
 N=5  # number of producers
 IPC_TYPE=udp
 MSG_SIZE=100
+RATE=10 # messages per second per producer, 0 for unthrottled
 
 for i in $(seq 1 $N); do
     echo "Starting producer $i..."
-    ./cmd/producer/producer "$IPC_TYPE" "$MSG_SIZE" &
+    ./cmd/producer/producer -size "$MSG_SIZE" -rate "$RATE" "$IPC_TYPE" &
 done
 
 wait
 echo "All instances finished."
-
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCerts(tb testing.TB) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	if err := GenerateTestCertificates(dir, time.Hour); err != nil {
+		tb.Fatal(err)
+	}
+	return dir
+}
+
+// tlsServer accepts a single connection and reports the outcome of its handshake.
+func tlsServer(t *testing.T, config *tls.Config) (string, <-chan error) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	result := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		result <- conn.(*tls.Conn).Handshake()
+	}()
+	return ln.Addr().String(), result
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := testCerts(t)
+	serverConfig, err := ServerTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := ClientTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, result := tlsServer(t, serverConfig)
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-result; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+
+	// A client that trusts the CA but has no certificate of its own is turned away.
+	addr, result = tlsServer(t, serverConfig)
+	noCert := clientConfig.Clone()
+	noCert.Certificates = nil
+	if conn, err := tls.Dial("tcp", addr, noCert); err == nil {
+		// With TLS 1.3 the client may only learn about the rejection on its first read.
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err := <-result; err == nil {
+		t.Fatal("server accepted a client without a certificate")
+	}
+
+	// Certificates from another CA are rejected too.
+	other, err := ClientTLSConfig(testCerts(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, result = tlsServer(t, serverConfig)
+	if conn, err := tls.Dial("tcp", addr, other); err == nil {
+		conn.Close()
+		t.Fatal("client trusted a server certificate from another CA")
+	}
+	if err := <-result; err == nil {
+		t.Fatal("server accepted a client certificate from another CA")
+	}
+}
+
+func TestTokenHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		client, server string
+		ok             bool
+	}{
+		{"secret", "secret", true},
+		{"wrong", "secret", false},
+		{"", "secret", false},
+	} {
+		client, server := net.Pipe()
+		serverErr := make(chan error, 1)
+		go func() {
+			err := ServerHandshake(server, tc.server)
+			if err != nil {
+				server.Close()
+			}
+			serverErr <- err
+		}()
+		clientErr := ClientHandshake(client, tc.client)
+		client.Close()
+		if err := <-serverErr; (err == nil) != tc.ok || (clientErr == nil) != tc.ok {
+			t.Fatalf("token %q: server=%v client=%v", tc.client, err, clientErr)
+		}
+		if !tc.ok && !errors.Is(clientErr, ErrUnauthorized) {
+			t.Fatalf("token %q: expected ErrUnauthorized, got %v", tc.client, clientErr)
+		}
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cred, err := CheckPeer(conn.(*net.UnixConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Pid == 0 {
+		t.Fatal("expected the peer's pid")
+	}
+}
@@ -0,0 +1,165 @@
+// Package auth secures the transports between producers and the aggregator: mutual TLS for tcp,
+// and a shared-token handshake plus a peer credentials check for unix sockets.
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The files GenerateTestCertificates writes into its directory, and the TLS configs load from it.
+const (
+	CACertFile     = "ca.pem"
+	ServerCertFile = "server.pem"
+	ServerKeyFile  = "server-key.pem"
+	ClientCertFile = "client.pem"
+	ClientKeyFile  = "client-key.pem"
+)
+
+// DefaultCertDir is where cmd/gencerts puts the certificates by default.
+const DefaultCertDir = "certs"
+
+// GenerateTestCertificates creates a throwaway CA, a server certificate for localhost/127.0.0.1 and a client certificate,
+// all signed by the CA. They are meant for local experiments only: the keys are written unencrypted.
+func GenerateTestCertificates(dir string, validFor time.Duration) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	notBefore := time.Now().Add(-time.Minute)
+	notAfter := notBefore.Add(validFor)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "log-aggregator test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, CACertFile), "CERTIFICATE", caDER, 0644); err != nil {
+		return err
+	}
+
+	for _, leaf := range []struct {
+		cn       string
+		usage    x509.ExtKeyUsage
+		certFile string
+		keyFile  string
+	}{
+		{"aggregator", x509.ExtKeyUsageServerAuth, ServerCertFile, ServerKeyFile},
+		{"producer", x509.ExtKeyUsageClientAuth, ClientCertFile, ClientKeyFile},
+	} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: serialNumber(),
+			Subject:      pkix.Name{CommonName: leaf.cn},
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{leaf.usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(filepath.Join(dir, leaf.certFile), "CERTIFICATE", der, 0644); err != nil {
+			return err
+		}
+		if err := writePEM(filepath.Join(dir, leaf.keyFile), "PRIVATE KEY", keyDER, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serialNumber() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err) // crypto/rand does not fail on Linux
+	}
+	return n
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+func loadCA(dir string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(filepath.Join(dir, CACertFile))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", filepath.Join(dir, CACertFile))
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig is the aggregator's side of mutual TLS: it only accepts producers with a client certificate signed by the CA in dir.
+func ServerTLSConfig(dir string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, ServerCertFile), filepath.Join(dir, ServerKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// ClientTLSConfig is the producer's side of mutual TLS: it presents the client certificate in dir and verifies the aggregator against the CA.
+func ClientTLSConfig(dir string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, ClientCertFile), filepath.Join(dir, ClientKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// HandshakeTimeout bounds how long either side waits for the other during a token handshake (or a TLS handshake).
+const HandshakeTimeout = 5 * time.Second
+
+// The handshake is a single line each way: the producer sends "AUTH <token>\n", the aggregator answers "OK\n",
+// or closes the connection. Only after the answer does the producer start sending entries, so a rejected producer
+// finds out on connect instead of on a later write.
+const (
+	authPrefix = "AUTH "
+	authOK     = "OK\n"
+	// maxTokenLineLen caps what the aggregator reads from a peer that has not authenticated yet.
+	maxTokenLineLen = 512
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ClientHandshake sends token over conn and waits for the aggregator to accept it.
+func ClientHandshake(conn net.Conn, token string) error {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, authPrefix+token+"\n"); err != nil {
+		return err
+	}
+	reply := make([]byte, len(authOK))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		// The aggregator closes the connection on a wrong token.
+		return fmt.Errorf("%w: token rejected (%v)", ErrUnauthorized, err)
+	}
+	if string(reply) != authOK {
+		return fmt.Errorf("%w: unexpected reply %q", ErrUnauthorized, reply)
+	}
+	return nil
+}
+
+// ServerHandshake reads the producer's token from conn and acknowledges it if it matches.
+func ServerHandshake(conn net.Conn, token string) error {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	line, err := readLine(conn, maxTokenLineLen)
+	if err != nil {
+		return err
+	}
+	got, found := bytes.CutPrefix(line, []byte(authPrefix))
+	if !found || subtle.ConstantTimeCompare(got, []byte(token)) != 1 {
+		return ErrUnauthorized
+	}
+	_, err = io.WriteString(conn, authOK)
+	return err
+}
+
+// readLine reads up to the first newline one byte at a time, so that nothing after the line is consumed:
+// the entries that follow it are read by the receiver's scanner.
+func readLine(r io.Reader, limit int) ([]byte, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for len(line) < limit {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, fmt.Errorf("%w: handshake line too long", ErrUnauthorized)
+}
+
+// CheckPeer looks up the credentials of the process on the other end of a unix socket (SO_PEERCRED) and only lets it through
+// if it runs as the same user as the aggregator or as one of allowedUIDs.
+// Unlike file permissions on the socket, this can't be sidestepped by a process that got hold of an already connected socket
+// through another path: the credentials are the ones captured by the kernel at connect time.
+func CheckPeer(conn *net.UnixConn, allowedUIDs []uint32) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	if cred.Uid != uint32(os.Getuid()) && !slices.Contains(allowedUIDs, cred.Uid) {
+		return cred, fmt.Errorf("%w: peer pid %d runs as uid %d", ErrUnauthorized, cred.Pid, cred.Uid)
+	}
+	return cred, nil
+}
@@ -1,51 +1,138 @@
 package ipc
 
 import (
-	"os"
-	"os/signal"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/latency"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/output"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/overload"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/receiver"
 )
 
-const aggregatorBufferSize = 100
-
 type Aggregator struct {
-	receiver receiver.Receiver
+	transport     string
+	receiver      receiver.Receiver
+	output        output.Output
+	overload      overload.Config
+	overloadStats overload.Stats
+	latencies     *latency.Histogram
+	queueSize     int
 }
 
-func NewAggregator(receiver receiver.Receiver) *Aggregator {
+// NewAggregator connects receiver and output with channels of queueSize entries.
+func NewAggregator(transport string, receiver receiver.Receiver, output output.Output, overload overload.Config, queueSize int) *Aggregator {
 	return &Aggregator{
-		receiver: receiver,
+		transport: transport,
+		receiver:  receiver,
+		output:    output,
+		overload:  overload,
+		latencies: latency.NewHistogram(),
+		queueSize: queueSize,
 	}
 }
 
-func (u *Aggregator) Run() {
-	events := make(chan model.LogEntry, aggregatorBufferSize)
-	done := make(chan struct{})
+func (u *Aggregator) Transport() string {
+	return u.transport
+}
+
+// Latencies is the histogram of producer-to-receiver delivery latencies observed so far.
+func (u *Aggregator) Latencies() *latency.Histogram {
+	return u.latencies
+}
+
+func (u *Aggregator) ReceiverStats() *receiver.Stats {
+	return u.receiver.Stats()
+}
+
+// Run receives until ctx is cancelled (or the receiver or output fail), then shuts down front to back:
+// the receiver stops accepting and drains in-flight data, the remaining entries flow through to the output, and the output is flushed.
+// Every stage closes the channel it writes to only once it has stopped writing, so nothing is ever sent on a closed channel.
+func (u *Aggregator) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	received := make(chan model.LogEntry, u.queueSize)
+	events := make(chan model.LogEntry, u.queueSize)
+
+	governor, err := overload.NewGovernor(u.overload, events, &u.overloadStats)
+	if err != nil {
+		return err
+	}
 
+	receiveErr := make(chan error, 1)
 	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
-		close(events)
+		defer close(received)
+		if err := u.receiver.Receive(ctx, received); err != nil {
+			receiveErr <- fmt.Errorf("receiver: %w", err)
+			return
+		}
+		receiveErr <- nil
 	}()
 
-	go launchFileOutputCollector(events, done)
+	dispatchErr := make(chan error, 1)
 	go func() {
-		if err := u.receiver.Receive(events); err != nil {
-			panic(err)
-		}
+		dispatchErr <- u.dispatch(received, governor, events)
 	}()
 
-	<-done
+	outputErr := u.output.Write(events)
+	if outputErr != nil {
+		outputErr = fmt.Errorf("output: %w", outputErr)
+		// Nothing consumes entries anymore: stop the receiver and discard what is still on its way, so the stages upstream can finish.
+		cancel()
+		for range events {
+		}
+	}
+
+	err = errors.Join(<-receiveErr, <-dispatchErr, outputErr)
+	log.Printf("delivery latency [transport=%s]: %s", u.transport, u.latencies.Summary())
+	log.Printf("receiver [transport=%s]: %s", u.transport, u.receiver.Stats())
+	log.Printf("overload [transport=%s, policy=%s]: %s", u.transport, u.overload.Policy, &u.overloadStats)
+	return err
+}
+
+// dispatch sits between the receiver and the output. Latencies are recorded here, so output slowness does not end up in them
+// (the receive timestamp was already taken by the receiver), and the overload policy decides what to do when the output falls behind.
+func (u *Aggregator) dispatch(in <-chan model.LogEntry, governor *overload.Governor, out chan<- model.LogEntry) error {
+	defer close(out)
+	for entry := range in {
+		if entry.SentAt != 0 && entry.ReceivedAt != 0 {
+			u.latencies.Record(entry.ReceivedAt - entry.SentAt)
+		}
+		governor.Deliver(entry)
+	}
+	if err := governor.Close(); err != nil {
+		return fmt.Errorf("overload: %w", err)
+	}
+	return nil
 }
 
-func launchFileOutputCollector(events <-chan model.LogEntry, done chan struct{}) {
-	out := output.NewFileOutput(outputFilePath)
-	defer close(done)
-	if err := out.Write(events); err != nil {
-		panic(err)
+// WriteMetrics writes the latency summary and the receiver and overload counters in the Prometheus text format.
+func (u *Aggregator) WriteMetrics(w io.Writer) {
+	latency.WritePrometheus(w, u.transport, u.latencies)
+	rs := u.receiver.Stats()
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"log_receiver_received_total", "Entries decoded by the receiver.", rs.Received.Load()},
+		{"log_receiver_malformed_total", "Payloads the receiver could not decode.", rs.Malformed.Load()},
+		{"log_receiver_truncated_total", "Datagrams larger than the receive buffer.", rs.Truncated.Load()},
+		{"log_receiver_rejected_total", "Connections that failed authentication.", rs.Rejected.Load()},
+		{"log_receiver_oversized_total", "Fifo lines larger than PIPE_BUF, which may have been torn by concurrent writers.", rs.Oversized.Load()},
+		{"log_receiver_older_schema_total", "Entries of an older schema version, upgraded on receipt.", rs.OlderSchema.Load()},
+		{"log_receiver_newer_schema_total", "Entries of a newer schema version, decoded as far as understood.", rs.NewerSchema.Load()},
+		{"log_receiver_reads_total", "Read syscalls (read, recvmsg or recvmmsg) that returned data.", rs.Reads.Load()},
+		{"log_receiver_socket_drops_total", "Datagrams dropped by the kernel on a full socket receive queue (SO_RXQ_OVFL).", rs.SocketDrops.Load()},
+		{"log_overload_delivered_total", "Entries handed to the output directly.", u.overloadStats.Delivered.Load()},
+		{"log_overload_dropped_total", "Entries dropped by the overload policy.", u.overloadStats.Dropped.Load()},
+		{"log_overload_spilled_total", "Entries spilled to disk by the overload policy.", u.overloadStats.Spilled.Load()},
+		{"log_overload_replayed_total", "Spilled entries replayed into the output.", u.overloadStats.Replayed.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s{transport=%q} %d\n", c.name, c.help, c.name, c.name, u.transport, c.value)
 	}
 }
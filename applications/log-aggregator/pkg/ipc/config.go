@@ -0,0 +1,75 @@
+package ipc
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Endpoints are where the aggregator listens and the producers connect to, per IPC type. The defaults are fixed, so
+// producers find a single aggregator without any configuration. Aggregators running side by side each need their own.
+type Endpoints struct {
+	SocketPath       string // unixsock and unixgram
+	Address          string // tcp and udp
+	TLSAddress       string // tcp+tls
+	FIFOPath         string
+	SyslogAddress    string // syslog+udp and syslog+tcp
+	SyslogSocketPath string // syslog+unix and syslog+unixgram
+	GELFAddress      string
+}
+
+// DefaultEndpoints uses unprivileged ports for syslog and GELF, so no root is needed.
+func DefaultEndpoints() Endpoints {
+	return Endpoints{
+		SocketPath:       "/tmp/log.sock",
+		Address:          "127.0.0.1:9000",
+		TLSAddress:       "127.0.0.1:9443",
+		FIFOPath:         "/tmp/log_fifo",
+		SyslogAddress:    "127.0.0.1:5514",
+		SyslogSocketPath: "/tmp/syslog.sock",
+		GELFAddress:      "127.0.0.1:12201",
+	}
+}
+
+// RegisterFlags adds a flag per endpoint to fs, defaulting to the current values.
+func (e *Endpoints) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&e.SocketPath, "socket-path", e.SocketPath, "unix socket path for unixsock and unixgram")
+	fs.StringVar(&e.Address, "addr", e.Address, "address for tcp and udp")
+	fs.StringVar(&e.TLSAddress, "tls-addr", e.TLSAddress, "address for tcp+tls")
+	fs.StringVar(&e.FIFOPath, "fifo-path", e.FIFOPath, "fifo path for fifo")
+	fs.StringVar(&e.SyslogAddress, "syslog-addr", e.SyslogAddress, "address for syslog+udp and syslog+tcp")
+	fs.StringVar(&e.SyslogSocketPath, "syslog-socket-path", e.SyslogSocketPath, "unix socket path for syslog+unix and syslog+unixgram")
+	fs.StringVar(&e.GELFAddress, "gelf-addr", e.GELFAddress, "address for gelf")
+}
+
+// EnvPrefix is the prefix of the environment variables flags can be set with, see SetFlagsFromEnv.
+const EnvPrefix = "LOG_AGGREGATOR_"
+
+// EnvName is the environment variable for a flag: -socket-path is LOG_AGGREGATOR_SOCKET_PATH.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// SetFlagsFromEnv sets every flag in fs that has its environment variable (see EnvName) set. Called before fs.Parse,
+// the environment takes the place of the defaults and the command line still has the last word. Producers and aggregator
+// share the prefix, so one variable configures both sides, e.g. LOG_AGGREGATOR_SOCKET_PATH for an aggregator on another socket.
+func SetFlagsFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, EnvName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// PrintEnvUsage explains SetFlagsFromEnv at the end of a command's usage message.
+func PrintEnvUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(fs.Output(), "\nEvery flag can also be set with an environment variable, e.g. %s for -socket-path.\n", EnvName("socket-path"))
+	fmt.Fprintf(fs.Output(), "Flags on the command line take precedence over the environment.\n")
+}
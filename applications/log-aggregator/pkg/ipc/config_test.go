@@ -0,0 +1,79 @@
+package ipc
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/receiver"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/workload"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *Endpoints, *int) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		endpoints := DefaultEndpoints()
+		endpoints.RegisterFlags(fs)
+		queue := fs.Int("queue", DefaultQueueSize, "")
+		return fs, &endpoints, queue
+	}
+
+	t.Setenv("LOG_AGGREGATOR_SOCKET_PATH", "/tmp/env.sock")
+	t.Setenv("LOG_AGGREGATOR_QUEUE", "500")
+	fs, endpoints, queue := newFlags()
+	if err := SetFlagsFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-queue", "7"}); err != nil {
+		t.Fatal(err)
+	}
+	if endpoints.SocketPath != "/tmp/env.sock" {
+		t.Fatalf("expected the socket path from the environment, got %q", endpoints.SocketPath)
+	}
+	if *queue != 7 {
+		t.Fatalf("expected the command line to take precedence over the environment, got %d", *queue)
+	}
+	if endpoints.Address != DefaultEndpoints().Address {
+		t.Fatalf("expected the default address, got %q", endpoints.Address)
+	}
+
+	t.Setenv("LOG_AGGREGATOR_QUEUE", "lots")
+	fs, _, _ = newFlags()
+	if err := SetFlagsFromEnv(fs); err == nil {
+		t.Fatal("expected an error for an invalid value")
+	}
+}
+
+func TestGetIPC(t *testing.T) {
+	options := DefaultOptions()
+	options.Endpoints.SocketPath = "/tmp/other.sock"
+	for _, ipcType := range IPCTypes() {
+		ipc, ok := getIPC(ipcType, options)
+		if !ok || ipc.receiver == nil {
+			t.Fatalf("%s: no receiver", ipcType)
+		}
+	}
+	if _, ok := getIPC("carrier-pigeon", options); ok {
+		t.Fatal("expected an unknown IPC type")
+	}
+	if _, ok := getIPC("syslog+fifo", options); ok {
+		t.Fatal("expected an unknown syslog network")
+	}
+	if types := ProducerTypes(); len(types) != 6 || types[0] != "unixsock" || types[5] != "fifo" {
+		t.Fatalf("unexpected producer types %v", types)
+	}
+	if _, err := GetProducer("gelf", workload.DefaultConfig(), publisher.DefaultConfig(), options); err == nil {
+		t.Fatal("expected receive-only IPC types to have no producer")
+	}
+
+	ipc, _ := getIPC("unixsock", options)
+	r, err := ipc.receiver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := r.(*receiver.UnixSocketReceiver).Path; path != "/tmp/other.sock" {
+		t.Fatalf("expected the configured socket path, got %q", path)
+	}
+}
@@ -0,0 +1,120 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/receiver"
+)
+
+// fifoMessage is what producer p sends as its seq-th entry. Sizes vary up to just below PIPE_BUF, so that batches have to be
+// split into several atomic writes, and any tearing shows up as a malformed line or a message that does not match.
+func fifoMessage(p, seq int) string {
+	size := 100 + (p*7919+seq*104729)%3800
+	return fmt.Sprintf("%d:%d:", p, seq) + strings.Repeat(string(rune('a'+p)), size)
+}
+
+// TestFIFO_MultipleProducers has several producers write to one fifo at the same time, batching, and coming and going:
+// every producer publishes its entries in two sessions, closing the fifo in between. Every entry must arrive intact,
+// and in order per producer.
+func TestFIFO_MultipleProducers(t *testing.T) {
+	const producers, perProducer = 8, 2000
+	path := filepath.Join(t.TempDir(), "log_fifo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan model.LogEntry, 1024)
+	r := receiver.NewFIFOReceiver(path)
+	errs := make(chan error, 1)
+	go func() { errs <- r.Receive(ctx, events) }()
+	// Producers that show up before the receiver buffer and replay entry by entry, which is not what this test is about.
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			f.Close()
+			break
+		}
+		select {
+		case err := <-errs:
+			t.Fatalf("receiver returned early: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stats []*publisher.Stats
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(rand.IntN(20)) * time.Millisecond)
+			for session := 0; session < 2; session++ {
+				config := publisher.DefaultConfig()
+				config.Batch = publisher.BatchConfig{Size: 32, Linger: 0}
+				pub := publisher.NewFIFOPublisher(path, config)
+				in := make(chan model.LogEntry, 64)
+				go func() {
+					for seq := session * perProducer / 2; seq < (session+1)*perProducer/2; seq++ {
+						in <- model.LogEntry{Source: fmt.Sprintf("producer-%d", p), Level: model.LevelInfo, Message: fifoMessage(p, seq)}
+					}
+					close(in)
+				}()
+				pub.Publish(in)
+				mu.Lock()
+				stats = append(stats, pub.Stats())
+				mu.Unlock()
+			}
+		}()
+	}
+
+	next := make([]int, producers)
+	for received := 0; received < producers*perProducer; received++ {
+		var entry model.LogEntry
+		select {
+		case entry = <-events:
+		case err := <-errs:
+			t.Fatalf("receiver returned early: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d entries, receiver: %s", received, r.Stats())
+		}
+		var p, seq int
+		if _, err := fmt.Sscanf(entry.Message, "%d:%d:", &p, &seq); err != nil || p < 0 || p >= producers {
+			t.Fatalf("unexpected entry %.60q", entry.Message)
+		}
+		if entry.Source != fmt.Sprintf("producer-%d", p) || entry.Message != fifoMessage(p, seq) {
+			t.Fatalf("torn entry from producer %d, seq %d: %.60q", p, seq, entry.Message)
+		}
+		if seq != next[p] {
+			t.Fatalf("producer %d: got seq %d, want %d", p, seq, next[p])
+		}
+		next[p]++
+	}
+	wg.Wait()
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Stats(); s.Malformed.Load() != 0 || s.Oversized.Load() != 0 {
+		t.Fatalf("receiver: %s", s)
+	}
+	var syscalls uint64
+	for _, s := range stats {
+		if s.Dropped.Load() != 0 || s.Oversized.Load() != 0 || s.Buffered.Load() != 0 {
+			t.Fatalf("publisher: %s", s)
+		}
+		syscalls += s.Syscalls.Load()
+	}
+	t.Logf("%d entries in %d writes", producers*perProducer, syscalls)
+}
@@ -1,62 +1,216 @@
 package ipc
 
 import (
+	"fmt"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/output"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/overload"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/receiver"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/workload"
 )
 
-const socketPath = "/tmp/log.sock"
-const networkAddress = "127.0.0.1:9000"
-const fifoPath = "/tmp/log_fifo"
-const outputFilePath = "aggregated_logs.jsonl"
-const defaultMessageSize = 100
+const DefaultOutputFilePath = "aggregated_logs.jsonl"
+
+// DefaultQueueSize is the default capacity of the channels between the stages of producers and aggregator.
+const DefaultQueueSize = 100
+
+// TokenEnv is the environment variable producers and aggregator read the unix socket token from.
+// It is not a flag, so that it does not show up in ps output.
+const TokenEnv = EnvPrefix + "TOKEN"
+
+// Options are the transport settings shared by aggregator and producers. Each IPC type picks what applies to it.
+type Options struct {
+	Endpoints Endpoints
+	Datagram  receiver.DatagramConfig // how the datagram receivers read
+	QueueSize int                     // capacity of the channels between producer and publisher, and receiver and output
+	CertDir   string                  // certificates for tcp+tls, see auth.GenerateTestCertificates
+	// Token enables the handshake on unixsock, together with the SO_PEERCRED check on the aggregator side.
+	Token       string
+	AllowedUIDs []uint32 // users other than the aggregator's own that may connect to an authenticated unixsock
+}
 
+func DefaultOptions() Options {
+	return Options{
+		Endpoints: DefaultEndpoints(),
+		Datagram:  receiver.DefaultDatagramConfig(),
+		QueueSize: DefaultQueueSize,
+		CertDir:   auth.DefaultCertDir,
+	}
+}
+
+func (o Options) Validate() error {
+	if o.QueueSize < 0 {
+		return fmt.Errorf("queue size must not be negative, got %d", o.QueueSize)
+	}
+	return o.Datagram.Validate()
+}
+
+// IPC is how producers and aggregator talk over one IPC type. The ingestion types for standard formats (syslog+*, gelf)
+// only have a receiver: their producers are syslog daemons, logger(1), Docker's gelf log driver and the like.
 type IPC struct {
-	producer   *Producer
-	aggregator *Aggregator
-}
-
-var ipcTypes = map[string]IPC{
-	"unixsock": {
-		producer:   NewProducer(publisher.NewUnixSocketPublisher(socketPath), defaultMessageSize),
-		aggregator: NewAggregator(receiver.NewUnixSocketReceiver(socketPath)),
-	},
-	"tcp": {
-		producer:   NewProducer(publisher.NewTCPSocketPublisher(networkAddress), defaultMessageSize),
-		aggregator: NewAggregator(receiver.NewTCPSocketReceiver(networkAddress)),
-	},
-	"unixgram": {
-		producer:   NewProducer(publisher.NewUnixDatagramSocketPublisher(socketPath), defaultMessageSize),
-		aggregator: NewAggregator(receiver.NewUnixDatagramSocketReceiver(socketPath)),
-	},
-	"udp": {
-		producer:   NewProducer(publisher.NewUDPSocketPublisher(networkAddress), defaultMessageSize),
-		aggregator: NewAggregator(receiver.NewUDPSocketReceiver(networkAddress)),
-	},
-	"fifo": {
-		producer:   NewProducer(publisher.NewFIFOPublisher(fifoPath), defaultMessageSize),
-		aggregator: NewAggregator(receiver.NewFIFOReceiver(fifoPath)),
-	},
-}
-
-func GetAggregator(ipcType string) (*Aggregator, bool) {
-	ipc, exists := getIPC(ipcType)
-	if !exists || ipc.aggregator == nil {
-		return nil, false
-	}
-	return ipc.aggregator, true
-}
-
-func GetProducer(ipcType string, messageSize int) (*Producer, bool) {
-	ipc, exists := getIPC(ipcType)
-	if !exists || ipc.producer == nil {
-		return nil, false
-	}
-	ipc.producer.messageSize = messageSize
-	return ipc.producer, true
-}
-
-func getIPC(ipcType string) (IPC, bool) {
-	ipc, exists := ipcTypes[ipcType]
-	return ipc, exists
+	publisher func(publisher.Config) (publisher.Publisher, error)
+	receiver  func() (receiver.Receiver, error)
+}
+
+// ipcTypes describes every IPC type with the endpoints and settings of one invocation, in the order usage messages list them.
+// Nothing is created until the aggregator or producer asks for its side.
+var ipcTypes = []struct {
+	name string
+	ipc  func(Options) IPC
+}{
+	{"unixsock", func(o Options) IPC {
+		e := o.Endpoints
+		return IPC{
+			publisher: func(c publisher.Config) (publisher.Publisher, error) {
+				if o.Token != "" {
+					return publisher.NewAuthenticatedUnixSocketPublisher(e.SocketPath, o.Token, c), nil
+				}
+				return publisher.NewUnixSocketPublisher(e.SocketPath, c), nil
+			},
+			receiver: func() (receiver.Receiver, error) {
+				if o.Token != "" {
+					return receiver.NewAuthenticatedUnixSocketReceiver(e.SocketPath, receiver.UnixAuth{Token: o.Token, AllowedUIDs: o.AllowedUIDs}), nil
+				}
+				return receiver.NewUnixSocketReceiver(e.SocketPath), nil
+			},
+		}
+	}},
+	{"tcp", func(o Options) IPC {
+		e := o.Endpoints
+		return IPC{
+			publisher: func(c publisher.Config) (publisher.Publisher, error) {
+				return publisher.NewTCPSocketPublisher(e.Address, c), nil
+			},
+			receiver: func() (receiver.Receiver, error) { return receiver.NewTCPSocketReceiver(e.Address), nil },
+		}
+	}},
+	{"tcp+tls", func(o Options) IPC {
+		e := o.Endpoints
+		return IPC{
+			publisher: func(c publisher.Config) (publisher.Publisher, error) {
+				tlsConfig, err := auth.ClientTLSConfig(o.CertDir)
+				if err != nil {
+					return nil, err
+				}
+				return publisher.NewTLSSocketPublisher(e.TLSAddress, tlsConfig, c), nil
+			},
+			receiver: func() (receiver.Receiver, error) {
+				tlsConfig, err := auth.ServerTLSConfig(o.CertDir)
+				if err != nil {
+					return nil, err
+				}
+				return receiver.NewTLSSocketReceiver(e.TLSAddress, tlsConfig), nil
+			},
+		}
+	}},
+	{"unixgram", func(o Options) IPC {
+		e := o.Endpoints
+		return IPC{
+			publisher: func(c publisher.Config) (publisher.Publisher, error) {
+				return publisher.NewUnixDatagramSocketPublisher(e.SocketPath, c), nil
+			},
+			receiver: func() (receiver.Receiver, error) {
+				return receiver.NewUnixDatagramSocketReceiver(e.SocketPath, o.Datagram), nil
+			},
+		}
+	}},
+	{"udp", func(o Options) IPC {
+		e := o.Endpoints
+		return IPC{
+			publisher: func(c publisher.Config) (publisher.Publisher, error) {
+				return publisher.NewUDPSocketPublisher(e.Address, c), nil
+			},
+			receiver: func() (receiver.Receiver, error) { return receiver.NewUDPSocketReceiver(e.Address, o.Datagram), nil },
+		}
+	}},
+	{"fifo", func(o Options) IPC {
+		e := o.Endpoints
+		return IPC{
+			publisher: func(c publisher.Config) (publisher.Publisher, error) {
+				return publisher.NewFIFOPublisher(e.FIFOPath, c), nil
+			},
+			receiver: func() (receiver.Receiver, error) { return receiver.NewFIFOReceiver(e.FIFOPath), nil },
+		}
+	}},
+	{"syslog+udp", syslogIPC("udp")},
+	{"syslog+tcp", syslogIPC("tcp")},
+	{"syslog+unix", syslogIPC("unix")},
+	{"syslog+unixgram", syslogIPC("unixgram")},
+	{"gelf", func(o Options) IPC {
+		e := o.Endpoints
+		return IPC{
+			receiver: func() (receiver.Receiver, error) { return receiver.NewGELFReceiver(e.GELFAddress, o.Datagram), nil },
+		}
+	}},
+}
+
+// syslogIPC receives syslog over one network: the datagram and stream sockets share their address, unix and unixgram their path.
+func syslogIPC(network string) func(Options) IPC {
+	return func(o Options) IPC {
+		address := o.Endpoints.SyslogAddress
+		if network == "unix" || network == "unixgram" {
+			address = o.Endpoints.SyslogSocketPath
+		}
+		return IPC{
+			receiver: func() (receiver.Receiver, error) { return receiver.NewSyslogReceiver(network, address, o.Datagram) },
+		}
+	}
+}
+
+// IPCTypes lists the IPC types, for usage messages.
+func IPCTypes() []string {
+	types := make([]string, len(ipcTypes))
+	for i, t := range ipcTypes {
+		types[i] = t.name
+	}
+	return types
+}
+
+// ProducerTypes lists the IPC types that have a producer, i.e. all but the receive-only ones.
+func ProducerTypes() []string {
+	var types []string
+	for _, t := range ipcTypes {
+		if t.ipc(DefaultOptions()).publisher != nil {
+			types = append(types, t.name)
+		}
+	}
+	return types
+}
+
+func getIPC(ipcType string, o Options) (IPC, bool) {
+	for _, t := range ipcTypes {
+		if t.name == ipcType {
+			return t.ipc(o), true
+		}
+	}
+	return IPC{}, false
+}
+
+func GetAggregator(ipcType string, out output.Output, overload overload.Config, options Options) (*Aggregator, error) {
+	ipc, exists := getIPC(ipcType, options)
+	if !exists {
+		return nil, fmt.Errorf("unknown IPC type: %s", ipcType)
+	}
+	r, err := ipc.receiver()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ipcType, err)
+	}
+	return NewAggregator(ipcType, r, out, overload, options.QueueSize), nil
+}
+
+func GetProducer(ipcType string, config workload.Config, publisherConfig publisher.Config, options Options) (*Producer, error) {
+	ipc, exists := getIPC(ipcType, options)
+	if !exists {
+		return nil, fmt.Errorf("unknown IPC type: %s", ipcType)
+	}
+	if ipc.publisher == nil {
+		return nil, fmt.Errorf("%s is receive-only, it has no producer", ipcType)
+	}
+	p, err := ipc.publisher(publisherConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ipcType, err)
+	}
+	return NewProducer(p, config, options.QueueSize), nil
 }
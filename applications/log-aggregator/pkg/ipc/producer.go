@@ -1,34 +1,41 @@
 package ipc
 
 import (
+	"log"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/latency"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/workload"
 )
 
-const producerBufferSize = 100
-const duration = 5 * time.Second
-const frequency = 10 // events per second
-
 type Producer struct {
-	publisher   publisher.Publisher
-	messageSize int
+	publisher publisher.Publisher
+	workload  workload.Config
+	queueSize int
+}
+
+// NewProducer hands entries to the publisher through a channel of queueSize entries.
+func NewProducer(publisher publisher.Publisher, config workload.Config, queueSize int) *Producer {
+	return &Producer{publisher: publisher, workload: config, queueSize: queueSize}
 }
 
-func NewProducer(publisher publisher.Publisher, messageSize int) *Producer {
-	return &Producer{publisher: publisher, messageSize: messageSize}
+// Stats are the publisher's counters, complete once Run has returned.
+func (p Producer) Stats() *publisher.Stats {
+	return p.publisher.Stats()
 }
 
 func (p Producer) Run() {
 	// Note: Using a buffered channel here to decouple the log event producer from our multiple publisher implementations, which gives us parallelism around blocking system calls, but also a buffer size to tune.
 	// The alternative approach would be to give the publisher Start() and Close() methods and invoke a Publish() method on each event. That introduces runtime coupling, but cuts scheduling overhead.
 	// An interesting thing to test and benchmark perhaps.
-	events := make(chan model.LogEntry, producerBufferSize)
+	events := make(chan model.LogEntry, p.queueSize)
 
 	// Note 2: Using a WaitGroup here to ensure our spawned goroutine joins before we exit.
-	// This is a different approach than the Aggregator which uses a done channel passed into the goroutine.
+	// This is a different approach than the Aggregator which runs its stages on goroutines that report back over error channels.
 	// Not sure which is cleaner, but I find it interesting to demonstrate multiple ways to skin a cat.
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -38,33 +45,23 @@ func (p Producer) Run() {
 		p.publisher.Publish(events)
 	}()
 
-	msg := MessageOfSize(p.messageSize)
-
-	ticker := time.NewTicker(time.Second / time.Duration(frequency))
-	defer ticker.Stop()
-	timeout := time.After(duration)
-	for {
-		select {
-		case <-timeout:
-			close(events)
-			wg.Wait()
-			return
-		case t := <-ticker.C:
-			entry := model.LogEntry{
-				Source:    "producer",
-				Timestamp: t.Unix(),
-				Level:     "INFO",
-				Message:   msg,
-			}
-			events <- entry
+	// The generator calls back on this goroutine, so its ID is the same for every entry.
+	hostname, _ := os.Hostname()
+	pid, goroutine := os.Getpid(), model.GoroutineID()
+	workload.NewGenerator(p.workload).Run(func(message string) {
+		events <- model.LogEntry{
+			Version:   model.SchemaVersion,
+			Source:    "producer",
+			Timestamp: time.Now().Unix(),
+			Level:     model.LevelInfo,
+			Message:   message,
+			Hostname:  hostname,
+			PID:       pid,
+			Goroutine: goroutine,
+			SentAt:    latency.Now(),
 		}
-	}
-}
-
-func MessageOfSize(size int) string {
-	buf := make([]byte, size)
-	for i := 0; i < size; i++ {
-		buf[i] = 'A' + byte(i%26)
-	}
-	return string(buf)
+	})
+	close(events)
+	wg.Wait()
+	log.Printf("publisher: %s", p.publisher.Stats())
 }
@@ -0,0 +1,164 @@
+package ipc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/publisher"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/receiver"
+)
+
+func freeTCPAddr(b *testing.B) string {
+	b.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+type transport struct {
+	name      string
+	receiver  func() receiver.Receiver
+	publisher func(publisher.Config) publisher.Publisher
+}
+
+func benchTransports(b *testing.B) []transport {
+	certs := b.TempDir()
+	if err := auth.GenerateTestCertificates(certs, time.Hour); err != nil {
+		b.Fatal(err)
+	}
+	serverTLS, err := auth.ServerTLSConfig(certs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	clientTLS, err := auth.ClientTLSConfig(certs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tcpAddr, tlsAddr := freeTCPAddr(b), freeTCPAddr(b)
+	sock, authSock := filepath.Join(b.TempDir(), "log.sock"), filepath.Join(b.TempDir(), "auth.sock")
+
+	return []transport{
+		{"tcp", func() receiver.Receiver { return receiver.NewTCPSocketReceiver(tcpAddr) },
+			func(c publisher.Config) publisher.Publisher { return publisher.NewTCPSocketPublisher(tcpAddr, c) }},
+		{"tcp+tls", func() receiver.Receiver { return receiver.NewTLSSocketReceiver(tlsAddr, serverTLS) },
+			func(c publisher.Config) publisher.Publisher {
+				return publisher.NewTLSSocketPublisher(tlsAddr, clientTLS, c)
+			}},
+		{"unixsock", func() receiver.Receiver { return receiver.NewUnixSocketReceiver(sock) },
+			func(c publisher.Config) publisher.Publisher { return publisher.NewUnixSocketPublisher(sock, c) }},
+		{"unixsock+token", func() receiver.Receiver {
+			return receiver.NewAuthenticatedUnixSocketReceiver(authSock, receiver.UnixAuth{Token: "secret"})
+		}, func(c publisher.Config) publisher.Publisher {
+			return publisher.NewAuthenticatedUnixSocketPublisher(authSock, "secret", c)
+		}},
+	}
+}
+
+// BenchmarkTransport measures the throughput of b.N entries from one publisher to one receiver, connection setup included.
+// Comparing tcp with tcp+tls shows what encryption costs per entry, and unixsock with unixsock+token what the handshake costs.
+//
+//	go test ./pkg/ipc -run ^$ -bench Transport -benchtime 200000x
+func BenchmarkTransport(b *testing.B) {
+	message := strings.Repeat("x", 100)
+	for _, tr := range benchTransports(b) {
+		for _, batch := range []int{1, 64} {
+			b.Run(fmt.Sprintf("%s/batch=%d", tr.name, batch), func(b *testing.B) {
+				ctx, cancel := context.WithCancel(context.Background())
+				events := make(chan model.LogEntry, 1024)
+				r := tr.receiver()
+				done := make(chan error, 1)
+				go func() { done <- r.Receive(ctx, events) }()
+				// Give the receiver a moment to bind, the publisher would otherwise start out buffering.
+				time.Sleep(20 * time.Millisecond)
+
+				config := publisher.DefaultConfig()
+				config.Batch = publisher.BatchConfig{Size: batch}
+				p := tr.publisher(config)
+				in := make(chan model.LogEntry, 1024)
+				go p.Publish(in)
+
+				b.SetBytes(int64(len(message)))
+				b.ResetTimer()
+				go func() {
+					for i := 0; i < b.N; i++ {
+						in <- model.LogEntry{Source: "bench", Level: model.LevelInfo, Message: message}
+					}
+					close(in)
+				}()
+				for i := 0; i < b.N; i++ {
+					<-events
+				}
+				b.StopTimer()
+
+				cancel()
+				if err := <-done; err != nil {
+					b.Fatal(err)
+				}
+				if rejected := r.Stats().Rejected.Load(); rejected != 0 {
+					b.Fatalf("%d connections rejected", rejected)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkConnect measures connection setup alone: a plain TCP connect versus a full mutual TLS 1.3 handshake.
+func BenchmarkConnect(b *testing.B) {
+	certs := b.TempDir()
+	if err := auth.GenerateTestCertificates(certs, time.Hour); err != nil {
+		b.Fatal(err)
+	}
+	serverTLS, _ := auth.ServerTLSConfig(certs)
+	clientTLS, _ := auth.ClientTLSConfig(certs)
+
+	for _, tc := range []struct {
+		name   string
+		listen func() (net.Listener, error)
+		dial   func(addr string) (net.Conn, error)
+	}{
+		{"tcp", func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+			func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }},
+		{"tcp+tls", func() (net.Listener, error) { return tls.Listen("tcp", "127.0.0.1:0", serverTLS) },
+			func(addr string) (net.Conn, error) { return tls.Dial("tcp", addr, clientTLS) }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			ln, err := tc.listen()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						if t, ok := conn.(*tls.Conn); ok {
+							t.Handshake()
+						}
+						conn.Close()
+					}()
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				conn, err := tc.dial(ln.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package latency
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Values are bucketed log-linearly: one group of subBuckets buckets per power of two.
+// That keeps the relative error of any reported quantile under 1/subBuckets (~3%) with a fixed, small memory footprint,
+// which is all we need to compare transports against each other.
+const subBucketBits = 5
+const subBuckets = 1 << subBucketBits
+const numBuckets = (64 - subBucketBits + 1) * subBuckets
+
+// Histogram is safe for concurrent use: Record only does atomic adds, so it can sit on the hot path of every receiver.
+type Histogram struct {
+	counts [numBuckets]atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64
+	max    atomic.Uint64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+// Record adds a latency sample in nanoseconds. Negative samples (e.g. clock skew between hosts) are clamped to 0.
+func (h *Histogram) Record(nanos int64) {
+	if nanos < 0 {
+		nanos = 0
+	}
+	v := uint64(nanos)
+	h.counts[bucketIndex(v)].Add(1)
+	h.count.Add(1)
+	h.sum.Add(v)
+	for {
+		cur := h.max.Load()
+		if v <= cur || h.max.CompareAndSwap(cur, v) {
+			break
+		}
+	}
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Quantile returns the upper bound of the bucket holding the q-th quantile, so it errs on the side of reporting higher latency.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	total := h.count.Load()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= rank {
+			return time.Duration(min(bucketUpperBound(i), h.max.Load()))
+		}
+	}
+	return time.Duration(h.max.Load())
+}
+
+type Summary struct {
+	Count uint64
+	Mean  time.Duration
+	P50   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+	Max   time.Duration
+}
+
+func (h *Histogram) Summary() Summary {
+	s := Summary{
+		Count: h.count.Load(),
+		P50:   h.Quantile(0.5),
+		P99:   h.Quantile(0.99),
+		P999:  h.Quantile(0.999),
+		Max:   time.Duration(h.max.Load()),
+	}
+	if s.Count > 0 {
+		s.Mean = time.Duration(h.sum.Load() / s.Count)
+	}
+	return s
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("count=%d mean=%s p50=%s p99=%s p999=%s max=%s", s.Count, s.Mean, s.P50, s.P99, s.P999, s.Max)
+}
+
+func bucketIndex(v uint64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(v) - subBucketBits // >= 1
+	mantissa := v >> (exp - 1)           // in [subBuckets, 2*subBuckets)
+	return exp*subBuckets + int(mantissa-subBuckets)
+}
+
+func bucketUpperBound(i int) uint64 {
+	if i < subBuckets {
+		return uint64(i)
+	}
+	exp := i / subBuckets
+	mantissa := uint64(i%subBuckets + subBuckets)
+	return (mantissa+1)<<(exp-1) - 1
+}
@@ -0,0 +1,62 @@
+package latency
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHistogram_Empty(t *testing.T) {
+	h := NewHistogram()
+	if h.Count() != 0 || h.Quantile(0.99) != 0 {
+		t.Fatalf("expected empty histogram, got %s", h.Summary())
+	}
+}
+
+func TestHistogram_QuantilesWithinRelativeError(t *testing.T) {
+	h := NewHistogram()
+	rng := rand.New(rand.NewSource(42))
+	samples := make([]int64, 100_000)
+	for i := range samples {
+		samples[i] = int64(rng.ExpFloat64() * float64(50*time.Microsecond))
+		h.Record(samples[i])
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	for _, q := range []float64{0.5, 0.99, 0.999} {
+		exact := float64(samples[int(q*float64(len(samples)))-1])
+		got := float64(h.Quantile(q))
+		if got < exact*0.95 || got > exact*1.05 {
+			t.Errorf("p%v: got %v, exact %v", q*100, time.Duration(got), time.Duration(exact))
+		}
+	}
+	if h.Summary().Max != time.Duration(samples[len(samples)-1]) {
+		t.Errorf("max: got %v, want %v", h.Summary().Max, time.Duration(samples[len(samples)-1]))
+	}
+}
+
+func TestHistogram_BucketsAreContiguous(t *testing.T) {
+	for v := uint64(0); v < 1<<16; v++ {
+		i := bucketIndex(v)
+		if v > bucketUpperBound(i) || (i > 0 && v <= bucketUpperBound(i-1)) {
+			t.Fatalf("value %d mapped to bucket %d with bounds (%d, %d]", v, i, bucketUpperBound(i-1), bucketUpperBound(i))
+		}
+	}
+}
+
+func TestHistogram_NegativeSamplesClamped(t *testing.T) {
+	h := NewHistogram()
+	h.Record(-10)
+	if h.Count() != 1 || h.Quantile(1) != 0 {
+		t.Fatalf("expected a single zero sample, got %s", h.Summary())
+	}
+}
+
+func TestNow_Monotonic(t *testing.T) {
+	a := Now()
+	b := Now()
+	if a <= 0 || b < a {
+		t.Fatalf("expected increasing positive timestamps, got %d then %d", a, b)
+	}
+}
@@ -0,0 +1,26 @@
+package latency
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// WritePrometheus writes the histogram as a Prometheus summary, in the plain text exposition format, so it can be scraped without pulling in a client library.
+func WritePrometheus(w io.Writer, transport string, h *Histogram) {
+	s := h.Summary()
+	fmt.Fprintln(w, "# HELP log_delivery_latency_seconds Latency from producer send to aggregator receive.")
+	fmt.Fprintln(w, "# TYPE log_delivery_latency_seconds summary")
+	for _, q := range []struct {
+		label string
+		value float64
+	}{
+		{"0.5", s.P50.Seconds()},
+		{"0.99", s.P99.Seconds()},
+		{"0.999", s.P999.Seconds()},
+	} {
+		fmt.Fprintf(w, "log_delivery_latency_seconds{transport=%q,quantile=%q} %g\n", transport, q.label, q.value)
+	}
+	fmt.Fprintf(w, "log_delivery_latency_seconds_sum{transport=%q} %g\n", transport, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(w, "log_delivery_latency_seconds_count{transport=%q} %d\n", transport, s.Count)
+}
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the severity of an entry. Levels are ordered from least to most severe, and serialize as their names.
+type Level uint8
+
+const (
+	LevelUnset Level = iota // no level given, serialized as ""
+	LevelTrace
+	LevelDebug
+	LevelInfo
+	LevelNotice
+	LevelWarn
+	LevelError
+	LevelCritical
+	LevelAlert
+	LevelEmergency
+)
+
+var levelNames = [...]string{"", "TRACE", "DEBUG", "INFO", "NOTICE", "WARN", "ERROR", "CRITICAL", "ALERT", "EMERGENCY"}
+
+// levelAliases are the other spellings in common use, from syslog keywords to the levels of popular logging libraries.
+var levelAliases = map[string]Level{
+	"WARNING":     LevelWarn,
+	"ERR":         LevelError,
+	"CRIT":        LevelCritical,
+	"FATAL":       LevelCritical,
+	"EMERG":       LevelEmergency,
+	"PANIC":       LevelEmergency,
+	"INFORMATION": LevelInfo,
+}
+
+func (l Level) String() string {
+	if int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel accepts the level names and their aliases in any case. The empty string is LevelUnset.
+func ParseLevel(s string) (Level, bool) {
+	upper := strings.ToUpper(s)
+	for l, name := range levelNames {
+		if upper == name {
+			return Level(l), true
+		}
+	}
+	l, ok := levelAliases[upper]
+	return l, ok
+}
+
+// IsError reports whether entries at this level count as errors, e.g. towards the error rate of a rollup.
+func (l Level) IsError() bool {
+	return l >= LevelError && int(l) < len(levelNames)
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	if int(l) >= len(levelNames) {
+		return nil, fmt.Errorf("invalid level %d", int(l))
+	}
+	return []byte(levelNames[l]), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	level, ok := ParseLevel(string(text))
+	if !ok {
+		return fmt.Errorf("unknown level %q", text)
+	}
+	*l = level
+	return nil
+}
+
+// syslogLevels are the levels of the syslog severities, 0 (emergency) to 7 (debug).
+var syslogLevels = [8]Level{LevelEmergency, LevelAlert, LevelCritical, LevelError, LevelWarn, LevelNotice, LevelInfo, LevelDebug}
+
+// LevelFromSyslog maps a syslog severity, 0 to 7, to its level.
+func LevelFromSyslog(severity int) (Level, bool) {
+	if severity < 0 || severity >= len(syslogLevels) {
+		return LevelUnset, false
+	}
+	return syslogLevels[severity], true
+}
+
+// SyslogSeverity maps a level to the syslog severity, which has no trace level, and uses info for entries without one.
+func (l Level) SyslogSeverity() int {
+	switch {
+	case l == LevelUnset:
+		return 6
+	case l == LevelTrace:
+		return 7
+	}
+	for severity, level := range syslogLevels {
+		if level == l {
+			return severity
+		}
+	}
+	return 6
+}
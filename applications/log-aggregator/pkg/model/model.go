@@ -1,8 +1,41 @@
 package model
 
+// SchemaVersion is the version of the LogEntry schema this build writes, in the "v" field.
+//
+// Version 1 is the original schema, which has no "v" field: source, timestamp, a free-form level string, message, and
+// later sent_at and attributes. Version 2 makes the level one of the Level names and adds the process metadata (hostname,
+// pid, goroutine) and the trace context (trace_id, span_id). Its levels are spelled the way version 1 producers spelled
+// them, and the new fields are simply ignored by version 1 readers, so old aggregators keep reading new producers.
+// Receivers upgrade what they read to this version, see receiver.FormatJSON.
+const SchemaVersion = 2
+
 type LogEntry struct {
+	Version   int    `json:"v,omitempty"`
 	Source    string `json:"source"`
 	Timestamp int64  `json:"timestamp"`
-	Level     string `json:"level"`
+	Level     Level  `json:"level"`
 	Message   string `json:"message"`
+	// Hostname, PID and Goroutine tell where an entry was logged. Producers on other machines (or in other containers)
+	// make the hostname necessary, producers restarting or running several instances the pid.
+	Hostname  string `json:"hostname,omitempty"`
+	PID       int    `json:"pid,omitempty"`
+	Goroutine uint64 `json:"goroutine,omitempty"` // see GoroutineID
+	// TraceID and SpanID tie an entry to the trace and span it was logged in, in the W3C Trace Context format.
+	TraceID TraceID `json:"trace_id,omitzero"`
+	SpanID  SpanID  `json:"span_id,omitzero"`
+	// SentAt is the producer's CLOCK_MONOTONIC reading in nanoseconds (see latency.Now), 0 if the producer did not set it.
+	SentAt int64 `json:"sent_at,omitempty"`
+	// Attributes holds the structured fields that have no place of their own above, e.g. the structured data of a syslog
+	// message or the additional fields of a GELF message.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// ReceivedAt is stamped by the receiver on the same clock. It only lives inside the aggregator and is never serialized.
+	ReceivedAt int64 `json:"-"`
 }
+
+// The structured data elements of the RFC 5424 messages output.SyslogOutput writes, for what has no syslog header field
+// of its own: SyslogMetaID holds goroutine, trace_id and span_id, SyslogAttributesID the attributes. The syslog receiver
+// reads them back into place. 32473 is the private enterprise number RFC 5612 reserves for documentation and examples.
+const (
+	SyslogMetaID       = "log@32473"
+	SyslogAttributesID = "attrs@32473"
+)
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{
+		"":        LevelUnset,
+		"info":    LevelInfo,
+		"WARNING": LevelWarn,
+		"Fatal":   LevelCritical,
+		"emerg":   LevelEmergency,
+		"TRACE":   LevelTrace,
+	} {
+		if got, ok := ParseLevel(s); !ok || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %t, want %v", s, got, ok, want)
+		}
+	}
+	if _, ok := ParseLevel("verbose"); ok {
+		t.Error("expected an unknown level")
+	}
+	for l := LevelUnset; l <= LevelEmergency; l++ {
+		if got, _ := ParseLevel(l.String()); got != l {
+			t.Errorf("%v does not round trip, got %v", l, got)
+		}
+	}
+}
+
+func TestLevel_Syslog(t *testing.T) {
+	for severity := 0; severity < 8; severity++ {
+		l, ok := LevelFromSyslog(severity)
+		if !ok || l.SyslogSeverity() != severity {
+			t.Errorf("severity %d maps to %v and back to %d", severity, l, l.SyslogSeverity())
+		}
+	}
+	if LevelUnset.SyslogSeverity() != 6 || LevelTrace.SyslogSeverity() != 7 {
+		t.Error("expected entries without a level at info and trace at debug")
+	}
+	if !LevelError.IsError() || LevelWarn.IsError() {
+		t.Error("expected ERROR and up to be errors")
+	}
+}
+
+func TestLogEntry_JSON(t *testing.T) {
+	entry := LogEntry{Version: SchemaVersion, Source: "s", Level: LevelWarn, Message: "m", TraceID: NewTraceID(), SpanID: NewSpanID()}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"level":"WARN"`) || !strings.Contains(string(b), `"trace_id":"`+entry.TraceID.String()+`"`) {
+		t.Fatalf("unexpected encoding %s", b)
+	}
+	var decoded LogEntry
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TraceID != entry.TraceID || decoded.SpanID != entry.SpanID || decoded.Level != entry.Level {
+		t.Fatalf("got %+v, want %+v", decoded, entry)
+	}
+
+	// Without a trace context, the fields are left out, so version 1 readers see nothing new but the metadata.
+	b, _ = json.Marshal(LogEntry{Source: "s", Level: LevelInfo})
+	if strings.Contains(string(b), "trace_id") || strings.Contains(string(b), "span_id") {
+		t.Fatalf("expected no trace context in %s", b)
+	}
+	if err := json.Unmarshal([]byte(`{"trace_id":"abc"}`), &decoded); err == nil {
+		t.Fatal("expected an error for a malformed trace id")
+	}
+}
+
+func TestGoroutineID(t *testing.T) {
+	main := GoroutineID()
+	other := make(chan uint64)
+	go func() { other <- GoroutineID() }()
+	if id := <-other; main == 0 || id == 0 || id == main {
+		t.Fatalf("got goroutine ids %d and %d", main, id)
+	}
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"strconv"
+)
+
+// TraceID identifies a trace, as the trace-id of a W3C traceparent: 16 bytes, written as 32 lowercase hex digits.
+// The zero value means no trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace, as the parent-id of a W3C traceparent: 8 bytes, 16 hex digits.
+type SpanID [8]byte
+
+// NewTraceID returns a random trace ID. It does not need to be unpredictable, only unique, so it is not taken from crypto/rand.
+func NewTraceID() TraceID {
+	var id TraceID
+	for id.IsZero() {
+		putRandom(id[:])
+	}
+	return id
+}
+
+func NewSpanID() SpanID {
+	var id SpanID
+	for id.IsZero() {
+		putRandom(id[:])
+	}
+	return id
+}
+
+func putRandom(b []byte) {
+	for i := 0; i < len(b); i += 8 {
+		v := rand.Uint64()
+		for j := i; j < i+8 && j < len(b); j++ {
+			b[j] = byte(v)
+			v >>= 8
+		}
+	}
+}
+
+func ParseTraceID(s string) (TraceID, error) {
+	var id TraceID
+	if err := parseID(id[:], s, "trace"); err != nil {
+		return TraceID{}, err
+	}
+	return id, nil
+}
+
+func ParseSpanID(s string) (SpanID, error) {
+	var id SpanID
+	if err := parseID(id[:], s, "span"); err != nil {
+		return SpanID{}, err
+	}
+	return id, nil
+}
+
+func (id TraceID) IsZero() bool { return id == TraceID{} }
+func (id SpanID) IsZero() bool  { return id == SpanID{} }
+
+func (id TraceID) String() string { return formatID(id[:]) }
+func (id SpanID) String() string  { return formatID(id[:]) }
+
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+func (id SpanID) MarshalText() ([]byte, error)  { return []byte(id.String()), nil }
+
+func (id *TraceID) UnmarshalText(text []byte) (err error) {
+	*id, err = ParseTraceID(string(text))
+	return err
+}
+
+func (id *SpanID) UnmarshalText(text []byte) (err error) {
+	*id, err = ParseSpanID(string(text))
+	return err
+}
+
+// formatID writes the zero ID as "", which is how it is left out of text formats.
+func formatID(id []byte) string {
+	if bytes.Count(id, []byte{0}) == len(id) {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// parseID accepts the empty string as the zero ID, and otherwise exactly 2*len(dst) hex digits.
+func parseID(dst []byte, s, kind string) error {
+	if s == "" {
+		return nil
+	}
+	if len(s) != 2*len(dst) {
+		return fmt.Errorf("invalid %s id %q: want %d hex digits", kind, s, 2*len(dst))
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return fmt.Errorf("invalid %s id %q: %w", kind, s, err)
+	}
+	return nil
+}
+
+// GoroutineID returns the ID of the calling goroutine. The runtime deliberately doesn't expose it, so it is parsed out of
+// the header of the goroutine's stack trace ("goroutine 42 [running]:"), which takes about a microsecond: call it once
+// per goroutine, not once per entry.
+func GoroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	field := bytes.TrimPrefix(buf[:n], []byte("goroutine "))
+	if i := bytes.IndexByte(field, ' '); i >= 0 {
+		field = field[:i]
+	}
+	id, _ := strconv.ParseUint(string(field), 10, 64)
+	return id
+}
@@ -0,0 +1,93 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+const DefaultSinkBufferSize = 1000
+
+type Sink struct {
+	Name       string
+	Output     Output
+	BufferSize int // 0 uses the fan-out's default buffer size
+}
+
+// FanOut delivers every entry to several outputs. Each sink gets its own buffered channel and goroutine,
+// and an entry is dropped for a sink whose buffer is full rather than waiting for it:
+// a slow (or failed) sink loses entries, but never stalls the other sinks or the receivers upstream.
+// The buffer size of each sink is therefore the burst it can absorb without losing anything.
+type FanOut struct {
+	sinks   []Sink
+	dropped []atomic.Uint64
+}
+
+func NewFanOut(defaultBufferSize int, sinks ...Sink) *FanOut {
+	if defaultBufferSize <= 0 {
+		defaultBufferSize = DefaultSinkBufferSize
+	}
+	sinks = append([]Sink(nil), sinks...)
+	for i := range sinks {
+		if sinks[i].BufferSize <= 0 {
+			sinks[i].BufferSize = defaultBufferSize
+		}
+	}
+	return &FanOut{
+		sinks:   sinks,
+		dropped: make([]atomic.Uint64, len(sinks)),
+	}
+}
+
+func (f *FanOut) Write(events <-chan model.LogEntry) error {
+	channels := make([]chan model.LogEntry, len(f.sinks))
+	failed := make([]atomic.Bool, len(f.sinks))
+	errs := make([]error, len(f.sinks))
+
+	var wg sync.WaitGroup
+	for i, sink := range f.sinks {
+		channels[i] = make(chan model.LogEntry, sink.BufferSize)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sink.Output.Write(channels[i]); err != nil {
+				log.Printf("output %s failed: %v", sink.Name, err)
+				errs[i] = fmt.Errorf("output %s: %w", sink.Name, err)
+				failed[i].Store(true)
+			}
+		}()
+	}
+
+	for event := range events {
+		for i, ch := range channels {
+			if failed[i].Load() {
+				f.dropped[i].Add(1)
+				continue
+			}
+			select {
+			case ch <- event:
+			default:
+				f.dropped[i].Add(1)
+			}
+		}
+	}
+
+	for _, ch := range channels {
+		close(ch)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Dropped returns the number of entries each sink missed, keyed by sink name.
+func (f *FanOut) Dropped() map[string]uint64 {
+	dropped := make(map[string]uint64, len(f.sinks))
+	for i, sink := range f.sinks {
+		dropped[sink.Name] = f.dropped[i].Load()
+	}
+	return dropped
+}
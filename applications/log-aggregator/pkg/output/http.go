@@ -0,0 +1,86 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+const DefaultHTTPBatchSize = 500
+const DefaultHTTPLinger = 100 * time.Millisecond
+
+// HTTPOutput forwards entries to an HTTP endpoint as JSON arrays, in batches of up to batchSize entries.
+// A partial batch is sent once it has waited for linger, so a low rate of entries is not held back indefinitely.
+type HTTPOutput struct {
+	url       string
+	client    *http.Client
+	batchSize int
+	linger    time.Duration
+}
+
+func NewHTTPOutput(url string, batchSize int, linger time.Duration) *HTTPOutput {
+	if batchSize <= 0 {
+		batchSize = DefaultHTTPBatchSize
+	}
+	if linger <= 0 {
+		linger = DefaultHTTPLinger
+	}
+	return &HTTPOutput{
+		url:       url,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		batchSize: batchSize,
+		linger:    linger,
+	}
+}
+
+func (ho *HTTPOutput) Write(events <-chan model.LogEntry) error {
+	batch := make([]model.LogEntry, 0, ho.batchSize)
+	ticker := time.NewTicker(ho.linger)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return ho.post(batch)
+			}
+			batch = append(batch, event)
+			if len(batch) < ho.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := ho.post(batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+	}
+}
+
+func (ho *HTTPOutput) post(batch []model.LogEntry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	resp, err := ho.client.Post(ho.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to forward batch: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to forward batch: %s returned %s", ho.url, resp.Status)
+	}
+	return nil
+}
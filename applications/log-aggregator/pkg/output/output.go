@@ -4,40 +4,145 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"os"
+	"time"
 
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
 )
 
+// Output consumes log entries until the channel is closed, returning the first error that made it stop early.
+type Output interface {
+	Write(events <-chan model.LogEntry) error
+}
+
+type FileOutputConfig struct {
+	Path        string
+	MaxSize     int64         // rotate once the active file reaches this many bytes, 0 disables size-based rotation
+	MaxAge      time.Duration // rotate once the active file is this old, 0 disables time-based rotation
+	MaxFiles    int           // number of rotated segments to keep, 0 keeps all of them
+	Compression Compression   // compression applied to rotated segments
+	Sync        SyncPolicy
+	Append      bool // append to an existing file on start instead of truncating it
+}
+
+func DefaultFileOutputConfig(path string) FileOutputConfig {
+	return FileOutputConfig{
+		Path:        path,
+		Compression: NoCompression,
+		Sync:        SyncPolicy{Mode: SyncNone},
+	}
+}
+
 type FileOutput struct {
-	FilePath string
+	config FileOutputConfig
 }
 
-func NewFileOutput(filePath string) *FileOutput {
-	return &FileOutput{FilePath: filePath}
+func NewFileOutput(config FileOutputConfig) *FileOutput {
+	return &FileOutput{config: config}
 }
 
-func (fo *FileOutput) Write(events <-chan model.LogEntry) error {
-	file, err := os.Create(fo.FilePath)
+// Write consumes events until the channel is closed or the first write failure, which is returned.
+func (fo *FileOutput) Write(events <-chan model.LogEntry) (err error) {
+	file, err := openRotatingFile(fo.config)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 
 	writer := bufio.NewWriter(file)
-	defer writer.Flush()
 
-	for event := range events {
-		eventJson, err := json.Marshal(event)
-		if err != nil {
-			fmt.Printf("failed to marshal event: %v\n", err)
-			continue
+	var tick <-chan time.Time
+	if interval := fo.tickInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	sinceSync := 0
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return fo.flush(writer, file, fo.config.Sync.Mode != SyncNone)
+			}
+			line, err := marshalEntry(event)
+			if err != nil {
+				return err
+			}
+			if file.shouldRotate(time.Now(), writer.Buffered(), len(line)) {
+				if err := fo.rotate(writer, file); err != nil {
+					return err
+				}
+				sinceSync = 0
+			}
+			if _, err := writer.Write(line); err != nil {
+				return fmt.Errorf("failed to write to file: %w", err)
+			}
+			sinceSync++
+			if fo.config.Sync.Mode == SyncEveryN && sinceSync >= fo.config.Sync.EveryN {
+				if err := fo.flush(writer, file, true); err != nil {
+					return err
+				}
+				sinceSync = 0
+			}
+		case now := <-tick:
+			if fo.config.Sync.Mode == SyncInterval && sinceSync > 0 {
+				if err := fo.flush(writer, file, true); err != nil {
+					return err
+				}
+				sinceSync = 0
+			}
+			if file.shouldRotate(now, writer.Buffered(), 0) {
+				if err := fo.rotate(writer, file); err != nil {
+					return err
+				}
+				sinceSync = 0
+			}
 		}
-		_, err = writer.WriteString(string(eventJson) + "\n")
-		if err != nil {
-			fmt.Printf("failed to write to file: %v\n", err)
+	}
+}
+
+func (fo *FileOutput) tickInterval() time.Duration {
+	var interval time.Duration
+	if fo.config.Sync.Mode == SyncInterval {
+		interval = fo.config.Sync.Interval
+	}
+	if fo.config.MaxAge > 0 {
+		// An idle output still has to rotate on time, so check at a reasonable fraction of MaxAge.
+		check := min(fo.config.MaxAge/10, time.Second)
+		if interval == 0 || check < interval {
+			interval = check
 		}
 	}
+	return interval
+}
+
+func (fo *FileOutput) rotate(writer *bufio.Writer, file *rotatingFile) error {
+	if err := fo.flush(writer, file, fo.config.Sync.Mode != SyncNone); err != nil {
+		return err
+	}
+	return file.rotate()
+}
 
+func (fo *FileOutput) flush(writer *bufio.Writer, file *rotatingFile, sync bool) error {
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+	if sync {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync file: %w", err)
+		}
+	}
 	return nil
 }
+
+func marshalEntry(event model.LogEntry) ([]byte, error) {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return append(eventJson, '\n'), nil
+}
@@ -0,0 +1,248 @@
+package output
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/klauspost/compress/zstd"
+)
+
+func writeEntries(t *testing.T, config FileOutputConfig, n int) error {
+	t.Helper()
+	events := make(chan model.LogEntry, n)
+	for i := 0; i < n; i++ {
+		events <- model.LogEntry{Source: "test", Timestamp: int64(i), Level: model.LevelInfo, Message: strings.Repeat("x", 100)}
+	}
+	close(events)
+	return NewFileOutput(config).Write(events)
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r interface{ Read([]byte) (int, error) } = f
+	switch filepath.Ext(path) {
+	case ".gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case ".zst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var entry model.LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("torn line in %s: %v", path, err)
+		}
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestFileOutput_DefaultTruncatesOnStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	config := DefaultFileOutputConfig(path)
+
+	if err := writeEntries(t, config, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEntries(t, config, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := countLines(t, path); got != 5 {
+		t.Fatalf("expected 5 lines, got %d", got)
+	}
+}
+
+func TestFileOutput_AppendOnRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	config := DefaultFileOutputConfig(path)
+	config.Append = true
+
+	if err := writeEntries(t, config, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEntries(t, config, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := countLines(t, path); got != 15 {
+		t.Fatalf("expected 15 lines, got %d", got)
+	}
+}
+
+func TestFileOutput_SizeRotationWithCompression(t *testing.T) {
+	for _, compression := range []Compression{NoCompression, GzipCompression, ZstdCompression} {
+		t.Run(string(compression), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.jsonl")
+			config := DefaultFileOutputConfig(path)
+			config.MaxSize = 2000
+			config.Compression = compression
+			config.Sync = SyncPolicy{Mode: SyncEveryN, EveryN: 3}
+
+			if err := writeEntries(t, config, 200); err != nil {
+				t.Fatal(err)
+			}
+
+			segments, _ := filepath.Glob(path + ".*")
+			if len(segments) < 2 {
+				t.Fatalf("expected several rotated segments, got %v", segments)
+			}
+			total := countLines(t, path)
+			for _, segment := range segments {
+				if !strings.HasSuffix(segment, compression.extension()) {
+					t.Fatalf("segment %s was not compressed with %s", segment, compression)
+				}
+				info, err := os.Stat(segment)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compression == NoCompression && info.Size() > config.MaxSize {
+					t.Fatalf("segment %s exceeds max size: %d", segment, info.Size())
+				}
+				total += countLines(t, segment)
+			}
+			if total != 200 {
+				t.Fatalf("expected 200 lines across all segments, got %d", total)
+			}
+		})
+	}
+}
+
+func TestFileOutput_MaxFilesPrunesOldestSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	config := DefaultFileOutputConfig(path)
+	config.MaxSize = 1000
+	config.MaxFiles = 2
+
+	if err := writeEntries(t, config, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(path + ".*")
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 rotated segments to be kept, got %v", segments)
+	}
+}
+
+// Retention only counts and removes rotated segments, not other files next to the output sharing its name.
+func TestFileOutput_MaxFilesKeepsUnrelatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	unrelated := []string{path + ".bak", path + ".lock", path + ".20060102.gz"}
+	for _, name := range unrelated {
+		if err := os.WriteFile(name, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := DefaultFileOutputConfig(path)
+	config.MaxSize = 1000
+	config.MaxFiles = 2
+	config.Compression = GzipCompression
+
+	if err := writeEntries(t, config, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range unrelated {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("unrelated file removed: %v", err)
+		}
+	}
+	segments, _ := filepath.Glob(path + ".*.gz")
+	if len(segments) != 3 {
+		t.Fatalf("expected 2 rotated segments to be kept besides %s, got %v", unrelated[2], segments)
+	}
+}
+
+// A file reopened in append mode keeps its age, so that frequent restarts don't hold off rotation by MaxAge.
+func TestFileOutput_AppendKeepsAgeAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	config := DefaultFileOutputConfig(path)
+	config.Append = true
+	config.MaxAge = 50 * time.Millisecond
+
+	if err := writeEntries(t, config, 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := writeEntries(t, config, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(path + ".*")
+	if len(segments) != 1 || countLines(t, segments[0]) != 1 || countLines(t, path) != 1 {
+		t.Fatalf("expected the file older than MaxAge to be rotated on restart, got %v", segments)
+	}
+}
+
+func TestFileOutput_TimeRotationWhileIdle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	config := DefaultFileOutputConfig(path)
+	config.MaxAge = 50 * time.Millisecond
+
+	events := make(chan model.LogEntry)
+	done := make(chan error)
+	go func() { done <- NewFileOutput(config).Write(events) }()
+
+	events <- model.LogEntry{Source: "test", Level: model.LevelInfo, Message: "before"}
+	time.Sleep(200 * time.Millisecond)
+	close(events)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(path + ".*")
+	if len(segments) != 1 || countLines(t, segments[0]) != 1 {
+		t.Fatalf("expected the idle file to be rotated once, got %v", segments)
+	}
+}
+
+func TestFileOutput_ReturnsOpenError(t *testing.T) {
+	config := DefaultFileOutputConfig(filepath.Join(t.TempDir(), "missing", "out.jsonl"))
+	if err := writeEntries(t, config, 1); err == nil {
+		t.Fatal("expected an error for an unwritable path")
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	valid := map[string]SyncPolicy{
+		"none":           {Mode: SyncNone},
+		"interval:250ms": {Mode: SyncInterval, Interval: 250 * time.Millisecond},
+		"every:100":      {Mode: SyncEveryN, EveryN: 100},
+	}
+	for spec, want := range valid {
+		got, err := ParseSyncPolicy(spec)
+		if err != nil || got != want {
+			t.Errorf("ParseSyncPolicy(%q) = %+v, %v; want %+v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"", "always", "interval:", "interval:-1s", "every:0"} {
+		if _, err := ParseSyncPolicy(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
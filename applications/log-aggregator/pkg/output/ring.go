@@ -0,0 +1,85 @@
+package output
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+// RingBuffer keeps the most recent entries in memory, so they can be inspected over HTTP while an experiment runs.
+type RingBuffer struct {
+	mu      sync.RWMutex
+	entries []model.LogEntry
+	next    int
+	full    bool
+}
+
+func NewRingBuffer(capacity int) *RingBuffer {
+	return &RingBuffer{entries: make([]model.LogEntry, capacity)}
+}
+
+func (rb *RingBuffer) Write(events <-chan model.LogEntry) error {
+	for event := range events {
+		rb.mu.Lock()
+		rb.entries[rb.next] = event
+		rb.next = (rb.next + 1) % len(rb.entries)
+		if rb.next == 0 {
+			rb.full = true
+		}
+		rb.mu.Unlock()
+	}
+	return nil
+}
+
+// Last returns up to limit of the most recent entries accepted by match, oldest first.
+func (rb *RingBuffer) Last(limit int, match func(model.LogEntry) bool) []model.LogEntry {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	size := rb.next
+	if rb.full {
+		size = len(rb.entries)
+	}
+	result := make([]model.LogEntry, 0, min(limit, size))
+	for i := 1; i <= size && len(result) < limit; i++ {
+		entry := rb.entries[(rb.next-i+len(rb.entries))%len(rb.entries)]
+		if match == nil || match(entry) {
+			result = append(result, entry)
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// Handler serves the buffered entries as a JSON array. Supported query parameters: limit (default 100), source and level.
+func (rb *RingBuffer) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit := 100
+		if l := query.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		source := query.Get("source")
+		level, ok := model.ParseLevel(query.Get("level"))
+		if !ok {
+			http.Error(w, "invalid level", http.StatusBadRequest)
+			return
+		}
+
+		entries := rb.Last(limit, func(e model.LogEntry) bool {
+			return (source == "" || e.Source == source) && (level == model.LevelUnset || e.Level == level)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+}
@@ -0,0 +1,287 @@
+package output
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+type Compression string
+
+const (
+	NoCompression   Compression = "none"
+	GzipCompression Compression = "gzip"
+	ZstdCompression Compression = "zstd"
+)
+
+func (c Compression) extension() string {
+	switch c {
+	case GzipCompression:
+		return ".gz"
+	case ZstdCompression:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+type SyncMode string
+
+const (
+	SyncNone     SyncMode = "none"
+	SyncInterval SyncMode = "interval"
+	SyncEveryN   SyncMode = "every"
+)
+
+// SyncPolicy controls when written entries are fsync'ed to disk.
+// SyncNone leaves it to the page cache (and to Close), which is what the file output always did.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration // for SyncInterval
+	EveryN   int           // for SyncEveryN
+}
+
+// ParseSyncPolicy accepts "none", "interval:DURATION" (e.g. interval:1s) and "every:N" (e.g. every:100).
+func ParseSyncPolicy(spec string) (SyncPolicy, error) {
+	mode, arg, _ := strings.Cut(spec, ":")
+	switch SyncMode(mode) {
+	case SyncNone:
+		return SyncPolicy{Mode: SyncNone}, nil
+	case SyncInterval:
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			return SyncPolicy{}, fmt.Errorf("invalid sync interval: %q", arg)
+		}
+		return SyncPolicy{Mode: SyncInterval, Interval: d}, nil
+	case SyncEveryN:
+		var n int
+		if _, err := fmt.Sscanf(arg, "%d", &n); err != nil || n <= 0 {
+			return SyncPolicy{}, fmt.Errorf("invalid sync count: %q", arg)
+		}
+		return SyncPolicy{Mode: SyncEveryN, EveryN: n}, nil
+	default:
+		return SyncPolicy{}, fmt.Errorf("unknown sync policy: %q", spec)
+	}
+}
+
+// rotationLayout is the timestamp a rotated segment is named with, after the path of the file.
+const rotationLayout = "20060102T150405.000000000"
+
+// rotatingFile is the file behind a FileOutput. It tracks the size and age of the active file,
+// renames it out of the way when a limit is hit, and compresses and prunes rotated segments in the background
+// so that a rotation does not stall the output for the duration of the compression.
+type rotatingFile struct {
+	config FileOutputConfig
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	background sync.WaitGroup
+	mu         sync.Mutex // serialises compressAndPrune runs
+	bgErr      error
+}
+
+func openRotatingFile(config FileOutputConfig) (*rotatingFile, error) {
+	rf := &rotatingFile{config: config}
+	if err := rf.open(config.Append); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open(appendMode bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendMode {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(rf.config.Path, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	if appendMode {
+		// A restart must not reset the age of the file it carries on with, or MaxAge would never be reached.
+		rf.openedAt = createdAt(file, info)
+	}
+	return nil
+}
+
+// createdAt returns the creation time of the file, or its modification time where the filesystem doesn't record one.
+func createdAt(file *os.File, info os.FileInfo) time.Time {
+	var stx unix.Statx_t
+	err := unix.Statx(int(file.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_BTIME, &stx)
+	if err == nil && stx.Mask&unix.STATX_BTIME != 0 {
+		return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+	}
+	return info.ModTime()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Sync() error {
+	return rf.file.Sync()
+}
+
+// shouldRotate is checked by the output before writing an entry of the given size (0 when idle), never in the middle of one,
+// so every segment holds whole lines and stays within MaxSize unless a single entry is larger than that.
+// buffered is the number of bytes the caller holds that have not reached the file yet.
+func (rf *rotatingFile) shouldRotate(now time.Time, buffered int, incoming int) bool {
+	size := rf.size + int64(buffered)
+	if size == 0 {
+		return false
+	}
+	if rf.config.MaxSize > 0 && size+int64(incoming) > rf.config.MaxSize {
+		return true
+	}
+	return rf.config.MaxAge > 0 && now.Sub(rf.openedAt) >= rf.config.MaxAge
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file for rotation: %w", err)
+	}
+	rotated := rf.config.Path + "." + time.Now().Format(rotationLayout)
+	if err := os.Rename(rf.config.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate file: %w", err)
+	}
+	if err := rf.open(false); err != nil {
+		return err
+	}
+
+	rf.background.Add(1)
+	go func() {
+		defer rf.background.Done()
+		rf.compressAndPrune(rotated)
+	}()
+	return nil
+}
+
+func (rf *rotatingFile) compressAndPrune(rotated string) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	// The run of a later rotation can get the lock first, and prune this segment before it is compressed.
+	_, err := os.Stat(rotated)
+	pruned := os.IsNotExist(err)
+	if rf.config.Compression != NoCompression && rf.config.Compression != "" && !pruned {
+		if err := compressFile(rotated, rf.config.Compression); err != nil && rf.bgErr == nil {
+			rf.bgErr = err
+		}
+	}
+	if err := rf.prune(); err != nil && rf.bgErr == nil {
+		rf.bgErr = err
+	}
+}
+
+// prune removes the oldest rotated segments beyond MaxFiles. The timestamp suffix makes lexical order chronological.
+func (rf *rotatingFile) prune() error {
+	if rf.config.MaxFiles <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(rf.config.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var segments []string
+	for _, match := range matches {
+		if rf.isSegment(match) {
+			segments = append(segments, match)
+		}
+	}
+	sort.Strings(segments)
+	for len(segments) > rf.config.MaxFiles {
+		if err := os.Remove(segments[0]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove rotated file: %w", err)
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// isSegment reports whether name is a segment rotated out of the file, compressed or not, rather than another file that
+// only shares its prefix, like a backup or a lock file.
+func (rf *rotatingFile) isSegment(name string) bool {
+	stamp, ok := strings.CutPrefix(name, rf.config.Path+".")
+	if !ok {
+		return false
+	}
+	if ext := filepath.Ext(stamp); ext == GzipCompression.extension() || ext == ZstdCompression.extension() {
+		stamp = strings.TrimSuffix(stamp, ext)
+	}
+	_, err := time.Parse(rotationLayout, stamp)
+	return err == nil
+}
+
+// Close closes the active file and waits for pending compressions, reporting the first error any of them ran into.
+func (rf *rotatingFile) Close() error {
+	err := rf.file.Close()
+	rf.background.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return rf.bgErr
+}
+
+func compressFile(path string, compression Compression) (err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open rotated file: %w", err)
+	}
+	defer in.Close()
+
+	target := path + compression.extension()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(target)
+		}
+	}()
+
+	var cw io.WriteCloser
+	switch compression {
+	case GzipCompression:
+		cw = gzip.NewWriter(out)
+	case ZstdCompression:
+		if cw, err = zstd.NewWriter(out); err != nil {
+			return fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown compression: %q", compression)
+	}
+
+	if _, err = io.Copy(cw, in); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err = cw.Close(); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err = out.Close(); err != nil {
+		return fmt.Errorf("failed to close compressed file: %w", err)
+	}
+	return os.Remove(path)
+}
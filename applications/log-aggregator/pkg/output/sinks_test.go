@@ -0,0 +1,158 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+type blockingOutput struct {
+	release chan struct{}
+}
+
+func (b *blockingOutput) Write(events <-chan model.LogEntry) error {
+	<-b.release
+	for range events {
+	}
+	return nil
+}
+
+type countingOutput struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *countingOutput) Write(events <-chan model.LogEntry) error {
+	for range events {
+		c.mu.Lock()
+		c.n++
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func entries(n int) <-chan model.LogEntry {
+	events := make(chan model.LogEntry, n)
+	for i := 0; i < n; i++ {
+		events <- model.LogEntry{Source: "test", Timestamp: int64(i), Level: model.LevelInfo, Message: "hello"}
+	}
+	close(events)
+	return events
+}
+
+func TestFanOut_SlowSinkDoesNotStallOthers(t *testing.T) {
+	slow := &blockingOutput{release: make(chan struct{})}
+	fast := &countingOutput{}
+	fanOut := NewFanOut(10, Sink{Name: "slow", Output: slow}, Sink{Name: "fast", Output: fast, BufferSize: 1000})
+
+	done := make(chan error)
+	go func() { done <- fanOut.Write(entries(1000)) }()
+
+	// The fast sink must receive everything while the slow one is still stuck.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fast.mu.Lock()
+		n := fast.n
+		fast.mu.Unlock()
+		if n == 1000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fast sink only received %d entries", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	dropped := fanOut.Dropped()
+	if dropped["fast"] != 0 || dropped["slow"] != 990 {
+		t.Fatalf("unexpected drops: %v", dropped)
+	}
+}
+
+func TestRingBuffer_KeepsMostRecent(t *testing.T) {
+	ring := NewRingBuffer(5)
+	if err := ring.Write(entries(12)); err != nil {
+		t.Fatal(err)
+	}
+
+	last := ring.Last(10, nil)
+	if len(last) != 5 || last[0].Timestamp != 7 || last[4].Timestamp != 11 {
+		t.Fatalf("unexpected entries: %+v", last)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/logs?limit=2&level=info", nil)
+	rec := httptest.NewRecorder()
+	ring.Handler().ServeHTTP(rec, req)
+	var served []model.LogEntry
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 2 || served[1].Timestamp != 11 {
+		t.Fatalf("unexpected entries served: %+v", served)
+	}
+}
+
+func TestSyslogOutput_RFC5424Lines(t *testing.T) {
+	var buf bytes.Buffer
+	events := make(chan model.LogEntry, 2)
+	events <- model.LogEntry{Source: "my app", Timestamp: 0, Level: model.LevelError, Message: "boom"}
+	events <- model.LogEntry{Source: "", Timestamp: 0, Level: model.LevelInfo, Message: "ok"}
+	close(events)
+
+	so := NewSyslogOutput(&buf)
+	so.hostname = "host"
+	if err := so.Write(events); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "<131>1 1970-01-01T00:00:00Z host my_app - - - boom\n<134>1 1970-01-01T00:00:00Z host - - - - ok\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestHTTPOutput_ForwardsAllEntriesInBatches(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []model.LogEntry
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		batches = append(batches, len(batch))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	if err := NewHTTPOutput(server.URL, 40, time.Second).Write(entries(100)); err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 3 || batches[0] != 40 || batches[2] != 20 {
+		t.Fatalf("unexpected batches: %v", batches)
+	}
+}
+
+func TestHTTPOutput_ReturnsErrorOnBadStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := NewHTTPOutput(server.URL, 10, time.Second).Write(entries(5))
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+}
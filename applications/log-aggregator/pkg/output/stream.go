@@ -0,0 +1,55 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+// WriterOutput writes JSON lines to any io.Writer, e.g. stdout.
+type WriterOutput struct {
+	w io.Writer
+}
+
+func NewWriterOutput(w io.Writer) *WriterOutput {
+	return &WriterOutput{w: w}
+}
+
+func NewStdoutOutput() *WriterOutput {
+	return NewWriterOutput(os.Stdout)
+}
+
+func (wo *WriterOutput) Write(events <-chan model.LogEntry) error {
+	writer := bufio.NewWriter(wo.w)
+	for event := range events {
+		line, err := marshalEntry(event)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(line); err != nil {
+			return fmt.Errorf("failed to write entry: %w", err)
+		}
+		if err := flushWhenIdle(writer, events); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// flushWhenIdle flushes only once the channel has been drained: under load entries are coalesced into few large writes,
+// while a trickle of entries still shows up immediately (which is what you want from e.g. stdout).
+func flushWhenIdle(writer *bufio.Writer, events <-chan model.LogEntry) error {
+	if len(events) > 0 {
+		return nil
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
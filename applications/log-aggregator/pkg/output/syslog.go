@@ -0,0 +1,187 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+const syslogFacilityLocal0 = 16
+
+// SyslogOutput writes entries as RFC 5424 messages.
+// On datagram connections every message is its own datagram, on streams messages are framed with RFC 6587 octet counting,
+// and on plain writers (stdout, files) every message is a line.
+type SyslogOutput struct {
+	w         io.Writer
+	framing   syslogFraming
+	hostname  string
+	closeFunc func() error
+}
+
+type syslogFraming int
+
+const (
+	framingNewline syslogFraming = iota
+	framingOctetCounting
+	framingDatagram
+)
+
+func NewSyslogOutput(w io.Writer) *SyslogOutput {
+	return &SyslogOutput{w: w, framing: framingNewline, hostname: hostname()}
+}
+
+// DialSyslogOutput connects to a syslog receiver over udp, tcp, unix or unixgram.
+func DialSyslogOutput(network, address string) (*SyslogOutput, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog receiver: %w", err)
+	}
+	framing := framingOctetCounting
+	if network == "udp" || network == "unixgram" {
+		framing = framingDatagram
+	}
+	return &SyslogOutput{w: conn, framing: framing, hostname: hostname(), closeFunc: conn.Close}, nil
+}
+
+func (so *SyslogOutput) Write(events <-chan model.LogEntry) error {
+	if so.closeFunc != nil {
+		defer so.closeFunc()
+	}
+
+	if so.framing == framingDatagram {
+		for event := range events {
+			if _, err := so.w.Write([]byte(so.format(event))); err != nil {
+				return fmt.Errorf("failed to write syslog message: %w", err)
+			}
+		}
+		return nil
+	}
+
+	writer := bufio.NewWriter(so.w)
+	for event := range events {
+		msg := so.format(event)
+		var err error
+		if so.framing == framingOctetCounting {
+			_, err = fmt.Fprintf(writer, "%d %s", len(msg), msg)
+		} else {
+			_, err = writer.WriteString(msg + "\n")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write syslog message: %w", err)
+		}
+		if err := flushWhenIdle(writer, events); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write syslog message: %w", err)
+	}
+	return nil
+}
+
+// format renders <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG. Entries without a hostname get
+// ours, and the fields that have no header field go into structured data, see model.SyslogMetaID.
+func (so *SyslogOutput) format(event model.LogEntry) string {
+	pri := syslogFacilityLocal0*8 + event.Level.SyslogSeverity()
+	ts := time.Unix(event.Timestamp, 0).UTC().Format(time.RFC3339)
+	hostname := so.hostname
+	if event.Hostname != "" {
+		hostname = syslogField(event.Hostname)
+	}
+	procID := "-"
+	if event.PID != 0 {
+		procID = strconv.Itoa(event.PID)
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %s - %s %s", pri, ts, hostname, syslogField(event.Source), procID, structuredData(event), event.Message)
+}
+
+// structuredData renders the goroutine, the trace context and the attributes (sorted, for stable output) as SD elements.
+func structuredData(event model.LogEntry) string {
+	var b strings.Builder
+	var meta []string
+	if event.Goroutine != 0 {
+		meta = append(meta, "goroutine", strconv.FormatUint(event.Goroutine, 10))
+	}
+	if !event.TraceID.IsZero() {
+		meta = append(meta, "trace_id", event.TraceID.String())
+	}
+	if !event.SpanID.IsZero() {
+		meta = append(meta, "span_id", event.SpanID.String())
+	}
+	writeSDElement(&b, model.SyslogMetaID, meta)
+
+	names := slices.Sorted(maps.Keys(event.Attributes))
+	attrs := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		attrs = append(attrs, sdName(name), event.Attributes[name])
+	}
+	writeSDElement(&b, model.SyslogAttributesID, attrs)
+
+	if b.Len() == 0 {
+		return "-"
+	}
+	return b.String()
+}
+
+// writeSDElement writes [ID NAME="VALUE" ...] for the name/value pairs in params, nothing if there are none.
+func writeSDElement(b *strings.Builder, id string, params []string) {
+	if len(params) == 0 {
+		return
+	}
+	b.WriteString("[" + id)
+	for i := 0; i < len(params); i += 2 {
+		b.WriteString(" " + params[i] + `="`)
+		sdValueEscaper.WriteString(b, params[i+1])
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+}
+
+var sdValueEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "]", `\]`)
+
+// sdName makes a parameter name of an attribute name: at most 32 printable ASCII characters, other than '=', ']' and '"'.
+func sdName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// syslogField makes a value usable as a header field: printable ASCII without spaces, or "-" for none.
+func syslogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "-"
+	}
+	return syslogField(name)
+}
@@ -0,0 +1,130 @@
+package overload
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+// Policy decides what happens to an entry when the aggregator's output can't keep up with its receiver.
+type Policy string
+
+const (
+	// Block waits for the output. On stream transports that pushes back all the way to the producers,
+	// on datagram transports it makes the kernel drop datagrams once the socket receive buffer is full.
+	Block Policy = "block"
+	// Drop discards the entry and counts it, so the receiver keeps draining its socket at full speed.
+	Drop Policy = "drop"
+	// Spill appends the entry to an on-disk queue, which is replayed into the output as soon as it has room again.
+	Spill Policy = "spill"
+)
+
+type Config struct {
+	Policy    Policy
+	SpillPath string // only used by Spill
+}
+
+func DefaultConfig() Config {
+	return Config{Policy: Block, SpillPath: "aggregator_spill.jsonl"}
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case Block, Drop, Spill:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overload policy: %q", s)
+	}
+}
+
+type Stats struct {
+	Delivered atomic.Uint64 // entries handed to the output directly
+	Dropped   atomic.Uint64 // entries discarded by the Drop policy (or when spilling failed)
+	Spilled   atomic.Uint64 // entries written to the spill queue
+	Replayed  atomic.Uint64 // spilled entries that have since been handed to the output
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("delivered=%d dropped=%d spilled=%d replayed=%d", s.Delivered.Load(), s.Dropped.Load(), s.Spilled.Load(), s.Replayed.Load())
+}
+
+// Governor applies a Policy on the way from a receiver into the output channel.
+// Deliver is meant to be called from a single goroutine; only with the Block policy can it block.
+type Governor struct {
+	policy Policy
+	out    chan<- model.LogEntry
+	stats  *Stats
+
+	spill    *spillQueue
+	replayWg sync.WaitGroup
+}
+
+// NewGovernor counts into the given stats, which the caller keeps a hold of to report them.
+func NewGovernor(config Config, out chan<- model.LogEntry, stats *Stats) (*Governor, error) {
+	g := &Governor{policy: config.Policy, out: out, stats: stats}
+	if config.Policy == Spill {
+		spill, err := openSpillQueue(config.SpillPath)
+		if err != nil {
+			return nil, err
+		}
+		g.spill = spill
+		g.replayWg.Add(1)
+		go g.replay()
+	}
+	return g, nil
+}
+
+func (g *Governor) Deliver(entry model.LogEntry) {
+	switch g.policy {
+	case Drop:
+		select {
+		case g.out <- entry:
+			g.stats.Delivered.Add(1)
+		default:
+			g.stats.Dropped.Add(1)
+		}
+	case Spill:
+		// Once something has been spilled, newer entries queue up behind it, so that replay keeps entries (roughly) in order.
+		if g.spill.empty() {
+			select {
+			case g.out <- entry:
+				g.stats.Delivered.Add(1)
+				return
+			default:
+			}
+		}
+		if err := g.spill.push(entry); err != nil {
+			g.stats.Dropped.Add(1)
+			return
+		}
+		g.stats.Spilled.Add(1)
+	default:
+		g.out <- entry
+		g.stats.Delivered.Add(1)
+	}
+}
+
+// Close replays whatever is still spilled (waiting for the output as needed) and releases the spill queue.
+// It does not close the output channel, which stays owned by the caller.
+func (g *Governor) Close() error {
+	if g.spill == nil {
+		return nil
+	}
+	g.spill.close()
+	g.replayWg.Wait()
+	return g.spill.remove()
+}
+
+func (g *Governor) replay() {
+	defer g.replayWg.Done()
+	for {
+		entry, ok := g.spill.pop()
+		if !ok {
+			return
+		}
+		g.out <- entry
+		g.stats.Replayed.Add(1)
+	}
+}
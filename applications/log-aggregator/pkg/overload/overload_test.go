@@ -0,0 +1,118 @@
+package overload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+func entry(i int) model.LogEntry {
+	return model.LogEntry{Source: "test", Timestamp: int64(i), Level: model.LevelInfo, Message: "hello"}
+}
+
+func TestGovernor_DropCountsWhatDoesNotFit(t *testing.T) {
+	out := make(chan model.LogEntry, 10)
+	var stats Stats
+	g, err := NewGovernor(Config{Policy: Drop}, out, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 25; i++ {
+		g.Deliver(entry(i))
+	}
+	if stats.Delivered.Load() != 10 || stats.Dropped.Load() != 15 {
+		t.Fatalf("unexpected stats: %s", &stats)
+	}
+}
+
+func TestGovernor_SpillReplaysEverything(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spill.jsonl")
+	out := make(chan model.LogEntry, 5)
+	var stats Stats
+	g, err := NewGovernor(Config{Policy: Spill, SpillPath: path}, out, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10_000
+	received := make(chan []model.LogEntry)
+	go func() {
+		var got []model.LogEntry
+		for e := range out {
+			got = append(got, e)
+		}
+		received <- got
+	}()
+
+	for i := 0; i < n; i++ {
+		g.Deliver(entry(i))
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	got := <-received
+
+	if len(got) != n {
+		t.Fatalf("expected %d entries, got %d (%s)", n, len(got), &stats)
+	}
+	if stats.Dropped.Load() != 0 || stats.Spilled.Load() != stats.Replayed.Load() {
+		t.Fatalf("unexpected stats: %s", &stats)
+	}
+	seen := make(map[int64]bool, n)
+	for _, e := range got {
+		seen[e.Timestamp] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("expected %d distinct entries, got %d", n, len(seen))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the spill file to be removed, got %v", err)
+	}
+}
+
+func TestSpillQueue_FIFOAcrossResets(t *testing.T) {
+	q, err := openSpillQueue(filepath.Join(t.TempDir(), "spill.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.remove()
+
+	next := 0
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			if err := q.push(entry(round*100 + i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			e, ok := q.pop()
+			if !ok || e.Timestamp != int64(next) {
+				t.Fatalf("expected entry %d, got %+v (ok=%v)", next, e, ok)
+			}
+			next++
+		}
+		if !q.empty() {
+			t.Fatal("expected the queue to be empty")
+		}
+	}
+
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Fatal("expected pop to report a closed, drained queue")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, s := range []string{"block", "drop", "spill"} {
+		if p, err := ParsePolicy(s); err != nil || string(p) != s {
+			t.Errorf("ParsePolicy(%q) = %q, %v", s, p, err)
+		}
+	}
+	if _, err := ParsePolicy("retry"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,136 @@
+package overload
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+// spillQueue is a FIFO of entries backed by a JSON lines file.
+// Entries are appended at the end and read back from the front, and the file is truncated whenever the queue runs empty,
+// so it only ever grows for as long as the output stays behind.
+type spillQueue struct {
+	path string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	file     *os.File
+	writer   *bufio.Writer
+	readFile *os.File
+	reader   *bufio.Reader
+	pending  int
+	closed   bool
+}
+
+func openSpillQueue(path string) (*spillQueue, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spill file: %w", err)
+	}
+	readFile, err := os.Open(path)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open spill file: %w", err)
+	}
+	q := &spillQueue{
+		path:     path,
+		file:     file,
+		writer:   bufio.NewWriter(file),
+		readFile: readFile,
+		reader:   bufio.NewReader(readFile),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+func (q *spillQueue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending == 0
+}
+
+func (q *spillQueue) push(entry model.LogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.pending++
+	q.cond.Signal()
+	return nil
+}
+
+// pop blocks until an entry is available. It returns false once the queue is closed and fully drained.
+func (q *spillQueue) pop() (model.LogEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for q.pending == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.pending == 0 {
+			return model.LogEntry{}, false
+		}
+
+		var entry model.LogEntry
+		line, err := q.readLine()
+		if err == nil {
+			err = json.Unmarshal(line, &entry)
+		}
+		q.pending--
+		if q.pending == 0 {
+			q.reset()
+		}
+		// A line that can't be read back is skipped rather than wedging the replay.
+		if err == nil {
+			return entry, true
+		}
+	}
+}
+
+func (q *spillQueue) readLine() ([]byte, error) {
+	line, err := q.reader.ReadBytes('\n')
+	if err == io.EOF && q.writer.Buffered() > 0 {
+		// The rest of the entry is still in the write buffer: push it to the file and continue where the read stopped.
+		if err := q.writer.Flush(); err != nil {
+			return nil, err
+		}
+		rest, err := q.reader.ReadBytes('\n')
+		return append(line, rest...), err
+	}
+	return line, err
+}
+
+func (q *spillQueue) reset() {
+	q.writer.Reset(q.file)
+	q.file.Truncate(0)
+	q.file.Seek(0, io.SeekStart)
+	q.readFile.Seek(0, io.SeekStart)
+	q.reader.Reset(q.readFile)
+}
+
+// close wakes up pop, which keeps returning entries until the queue is drained.
+func (q *spillQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *spillQueue) remove() error {
+	q.file.Close()
+	q.readFile.Close()
+	if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spill file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Package procstat reads the CPU time and context switches of a process from /proc.
+package procstat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat. It is part of the kernel ABI and 100 on every architecture
+// Linux supports today, whatever the kernel's internal HZ.
+const clockTicks = 100
+
+// Usage is the resource usage of a process since it started.
+type Usage struct {
+	User   time.Duration // CPU time spent in user mode, all threads
+	System time.Duration // CPU time spent in the kernel, all threads
+	// Voluntary counts context switches where a thread gave up the CPU itself, e.g. blocking in a read.
+	Voluntary uint64
+	// Involuntary counts context switches where a thread was preempted, e.g. at the end of its time slice.
+	Involuntary uint64
+}
+
+func (u Usage) CPU() time.Duration {
+	return u.User + u.System
+}
+
+// Sub returns the usage between an earlier sample and u. Context switches summed over live threads drop when a thread
+// exits, so a counter that went backwards counts as 0 rather than wrapping around.
+func (u Usage) Sub(earlier Usage) Usage {
+	return Usage{
+		User:        u.User - earlier.User,
+		System:      u.System - earlier.System,
+		Voluntary:   delta(u.Voluntary, earlier.Voluntary),
+		Involuntary: delta(u.Involuntary, earlier.Involuntary),
+	}
+}
+
+func delta(now, earlier uint64) uint64 {
+	if now < earlier {
+		return 0
+	}
+	return now - earlier
+}
+
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		User:        u.User + other.User,
+		System:      u.System + other.System,
+		Voluntary:   u.Voluntary + other.Voluntary,
+		Involuntary: u.Involuntary + other.Involuntary,
+	}
+}
+
+// Read samples a running process, 0 for the calling one. CPU times come from /proc/<pid>/stat and cover all threads, past
+// and present. For the calling process, context switches come from getrusage, which covers exited threads too. For any other
+// process they are only reported per thread, in /proc/<pid>/task/<tid>/status, so they are summed over the threads alive at
+// the time of the call.
+func Read(pid int) (Usage, error) {
+	dir := "/proc/self"
+	if pid != 0 {
+		dir = "/proc/" + strconv.Itoa(pid)
+	}
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return Usage{}, err
+	}
+	u, err := parseStat(stat)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	if pid == 0 {
+		var r syscall.Rusage
+		if err := syscall.Getrusage(syscall.RUSAGE_SELF, &r); err != nil {
+			return Usage{}, err
+		}
+		u.Voluntary, u.Involuntary = uint64(r.Nvcsw), uint64(r.Nivcsw)
+		return u, nil
+	}
+	tasks, err := os.ReadDir(filepath.Join(dir, "task"))
+	if err != nil {
+		return Usage{}, err
+	}
+	for _, task := range tasks {
+		status, err := os.ReadFile(filepath.Join(dir, "task", task.Name(), "status"))
+		if err != nil {
+			// The thread exited in the meantime.
+			continue
+		}
+		voluntary, involuntary, err := parseSwitches(status)
+		if err != nil {
+			return Usage{}, err
+		}
+		u.Voluntary += voluntary
+		u.Involuntary += involuntary
+	}
+	return u, nil
+}
+
+// FromRusage converts what wait4 reports for a child that has exited, and whose /proc entry is gone with it.
+// The counters are the same ones /proc reports.
+func FromRusage(r *syscall.Rusage) Usage {
+	return Usage{
+		User:        time.Duration(r.Utime.Nano()),
+		System:      time.Duration(r.Stime.Nano()),
+		Voluntary:   uint64(r.Nvcsw),
+		Involuntary: uint64(r.Nivcsw),
+	}
+}
+
+// parseStat reads utime and stime, fields 14 and 15 of /proc/<pid>/stat. The command name in field 2 is in parentheses
+// and may itself contain spaces and parentheses, so fields are counted from the last closing parenthesis.
+func parseStat(stat []byte) (Usage, error) {
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return Usage{}, fmt.Errorf("procstat: malformed stat %q", stat)
+	}
+	// The fields after the command name start at field 3 (state).
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 13 {
+		return Usage{}, fmt.Errorf("procstat: stat has only %d fields after the command", len(fields))
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return Usage{}, fmt.Errorf("procstat: utime: %w", err)
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return Usage{}, fmt.Errorf("procstat: stime: %w", err)
+	}
+	return Usage{
+		User:   time.Duration(utime) * time.Second / clockTicks,
+		System: time.Duration(stime) * time.Second / clockTicks,
+	}, nil
+}
+
+func parseSwitches(status []byte) (voluntary, involuntary uint64, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		var target *uint64
+		switch name {
+		case "voluntary_ctxt_switches":
+			target = &voluntary
+		case "nonvoluntary_ctxt_switches":
+			target = &involuntary
+		default:
+			continue
+		}
+		if *target, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("procstat: %s: %w", name, err)
+		}
+	}
+	return voluntary, involuntary, scanner.Err()
+}
@@ -0,0 +1,74 @@
+package procstat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStat_CommandWithSpacesAndParentheses(t *testing.T) {
+	stat := []byte("4242 (my (weird) cmd) S 1 4242 4242 0 -1 4194560 1234 0 0 0 250 75 0 0 20 0 8 0 100 0 0\n")
+	u, err := parseStat(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.User != 2500*time.Millisecond || u.System != 750*time.Millisecond {
+		t.Fatalf("got user=%v system=%v", u.User, u.System)
+	}
+}
+
+func TestParseSwitches(t *testing.T) {
+	status := []byte("Name:\tagg\nState:\tS (sleeping)\nvoluntary_ctxt_switches:\t150\nnonvoluntary_ctxt_switches:\t7\n")
+	voluntary, involuntary, err := parseSwitches(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if voluntary != 150 || involuntary != 7 {
+		t.Fatalf("got %d voluntary, %d involuntary", voluntary, involuntary)
+	}
+}
+
+func TestParseSwitches_Malformed(t *testing.T) {
+	if _, _, err := parseSwitches([]byte("voluntary_ctxt_switches:\t-3\n")); err == nil {
+		t.Fatal("expected an error for a negative count")
+	}
+	// A status without the counters, as in a kernel built without them, reports none.
+	voluntary, involuntary, err := parseSwitches([]byte("Name:\tagg\n"))
+	if err != nil || voluntary != 0 || involuntary != 0 {
+		t.Fatalf("got %d voluntary, %d involuntary, err %v", voluntary, involuntary, err)
+	}
+}
+
+func TestUsage_SubClampsSwitches(t *testing.T) {
+	// A thread with many switches exited between the samples.
+	before := Usage{Voluntary: 500, Involuntary: 40}
+	after := Usage{Voluntary: 120, Involuntary: 45}
+	if d := after.Sub(before); d.Voluntary != 0 || d.Involuntary != 5 {
+		t.Fatalf("got %d voluntary, %d involuntary", d.Voluntary, d.Involuntary)
+	}
+}
+
+func TestRead_Self(t *testing.T) {
+	before, err := Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Burn some CPU and block a few times.
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for x := 0; time.Now().Before(deadline); x++ {
+	}
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	after, err := Read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := after.Sub(before)
+	// Ticks are 10ms, so a 50ms busy loop shows up as at least a few of them.
+	if d.CPU() < 20*time.Millisecond {
+		t.Fatalf("expected the busy loop to show up as CPU time, got %v", d.CPU())
+	}
+	if after.Voluntary == 0 {
+		t.Fatal("expected voluntary context switches")
+	}
+}
@@ -0,0 +1,205 @@
+package publisher
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// backlog is the FIFO of encoded entries a publisher keeps while it is disconnected.
+// Pushing onto a full backlog drops its oldest entry: when the aggregator comes back, the most recent logs are the ones worth having.
+type backlog interface {
+	push(line []byte) (droppedOldest bool, err error)
+	peek() (line []byte, ok bool, err error)
+	pop() error
+	len() int
+	reset() error
+	close() error
+}
+
+func newBacklog(config ReconnectConfig) (backlog, error) {
+	if config.BufferPath == "" {
+		return newMemoryBacklog(config.BufferSize), nil
+	}
+	return openFileBacklog(config.BufferPath, config.BufferSize)
+}
+
+// memoryBacklog is a ring of lines.
+type memoryBacklog struct {
+	lines [][]byte
+	head  int
+	n     int
+}
+
+func newMemoryBacklog(capacity int) *memoryBacklog {
+	return &memoryBacklog{lines: make([][]byte, capacity)}
+}
+
+func (m *memoryBacklog) push(line []byte) (bool, error) {
+	dropped := m.n == len(m.lines)
+	if dropped {
+		m.head = (m.head + 1) % len(m.lines)
+		m.n--
+	}
+	m.lines[(m.head+m.n)%len(m.lines)] = line
+	m.n++
+	return dropped, nil
+}
+
+func (m *memoryBacklog) peek() ([]byte, bool, error) {
+	if m.n == 0 {
+		return nil, false, nil
+	}
+	return m.lines[m.head], true, nil
+}
+
+func (m *memoryBacklog) pop() error {
+	if m.n == 0 {
+		return nil
+	}
+	m.lines[m.head] = nil
+	m.head = (m.head + 1) % len(m.lines)
+	m.n--
+	return nil
+}
+
+func (m *memoryBacklog) len() int {
+	return m.n
+}
+
+func (m *memoryBacklog) reset() error {
+	clear(m.lines)
+	m.head, m.n = 0, 0
+	return nil
+}
+
+func (m *memoryBacklog) close() error {
+	return nil
+}
+
+// fileBacklog appends lines to a file and reads them back from a second handle on the same file. The file is truncated
+// whenever it has been read in full, so it only grows for as long as the publisher stays disconnected.
+type fileBacklog struct {
+	capacity int
+	w        *os.File
+	r        *os.File
+	reader   *bufio.Reader
+	head     []byte // the line returned by the last peek, until it is popped
+	n        int
+}
+
+func openFileBacklog(path string, capacity int) (*fileBacklog, error) {
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	b := &fileBacklog{capacity: capacity, w: w, r: r, reader: bufio.NewReader(r)}
+	// Entries left over from a previous run are delivered first.
+	n, err := countLines(r)
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	b.n = n
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		b.close()
+		return nil, err
+	}
+	// Over capacity, e.g. after a restart with a smaller buffer: same rule as for a push onto a full backlog.
+	for b.n > b.capacity {
+		if _, _, err := b.peek(); err != nil {
+			b.close()
+			return nil, err
+		}
+		b.pop()
+	}
+	return b, nil
+}
+
+func countLines(r io.Reader) (int, error) {
+	buf := make([]byte, 64*1024)
+	n := 0
+	for {
+		read, err := r.Read(buf)
+		n += bytes.Count(buf[:read], []byte{'\n'})
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func (f *fileBacklog) push(line []byte) (bool, error) {
+	dropped := false
+	if f.n == f.capacity {
+		if _, _, err := f.peek(); err != nil {
+			return false, err
+		}
+		f.pop()
+		dropped = true
+	}
+	if _, err := f.w.Write(line); err != nil {
+		return dropped, err
+	}
+	f.n++
+	return dropped, nil
+}
+
+func (f *fileBacklog) peek() ([]byte, bool, error) {
+	if f.head != nil {
+		return f.head, true, nil
+	}
+	if f.n == 0 {
+		return nil, false, nil
+	}
+	line, err := f.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, false, fmt.Errorf("reading %s: %w", f.w.Name(), err)
+	}
+	f.head = line
+	return line, true, nil
+}
+
+func (f *fileBacklog) pop() error {
+	if f.head == nil {
+		return nil
+	}
+	f.head = nil
+	f.n--
+	if f.n == 0 {
+		return f.reset()
+	}
+	return nil
+}
+
+func (f *fileBacklog) len() int {
+	return f.n
+}
+
+func (f *fileBacklog) reset() error {
+	f.head = nil
+	f.n = 0
+	if err := f.w.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.reader.Reset(f.r)
+	return nil
+}
+
+// close keeps the file, and with it whatever is still buffered, for the next run.
+func (f *fileBacklog) close() error {
+	f.r.Close()
+	return f.w.Close()
+}
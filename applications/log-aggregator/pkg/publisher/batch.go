@@ -0,0 +1,118 @@
+package publisher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/vecio"
+)
+
+// Config is what every publisher is created with.
+type Config struct {
+	Reconnect ReconnectConfig
+	Batch     BatchConfig
+}
+
+func DefaultConfig() Config {
+	return Config{Reconnect: DefaultReconnectConfig(), Batch: DefaultBatchConfig()}
+}
+
+func (c Config) Validate() error {
+	if err := c.Reconnect.Validate(); err != nil {
+		return err
+	}
+	return c.Batch.Validate()
+}
+
+// BatchConfig controls how entries are coalesced into a single syscall: writev on stream transports, sendmmsg on datagram ones.
+// A batch is written once it has Size entries, or Linger after its first entry, whichever comes first.
+// With a Size of 1 (the default) every entry is written on its own, with one write syscall each.
+type BatchConfig struct {
+	Size int
+	// Linger is how long a batch waits for more entries. With 0 a batch only takes the entries that are already queued,
+	// so batches only form when the publisher falls behind the producer, and no latency is added.
+	Linger time.Duration
+}
+
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{Size: 1, Linger: time.Millisecond}
+}
+
+func (c BatchConfig) Validate() error {
+	if c.Size < 1 {
+		return fmt.Errorf("batch size must be at least 1, got %d", c.Size)
+	}
+	if c.Linger < 0 {
+		return fmt.Errorf("linger must not be negative, got %v", c.Linger)
+	}
+	return nil
+}
+
+// batchWriter writes several entries at once. It returns how many whole entries were written, also when it fails, so that
+// those are not written again, and the number of syscalls that took.
+type batchWriter func(conn io.Writer, lines [][]byte) (written, syscalls int, err error)
+
+// writevBatch writes a batch to a stream with writev. The entries end up back to back in the stream,
+// exactly as with one write per entry. net.Buffers does the same for sockets, but falls back to one write per buffer for a fifo.
+func writevBatch(conn io.Writer, lines [][]byte) (int, int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, 0, fmt.Errorf("writev: %T does not expose its file descriptor", conn)
+	}
+	n, syscalls, err := vecio.Writev(sc, lines)
+	return wholeLines(lines, n), syscalls, err
+}
+
+// pipeBatch writes a batch to a pipe with as few writevs as possible while keeping every one of them atomic: each takes
+// whole entries up to PIPE_BUF bytes in total, so entries from several producers writing to the same fifo never interleave.
+// Every single entry must fit (see reconnecting.maxEntrySize).
+func pipeBatch(conn io.Writer, lines [][]byte) (int, int, error) {
+	written, syscalls := 0, 0
+	for len(lines) > 0 {
+		n, size := 0, 0
+		for n < len(lines) && size+len(lines[n]) <= vecio.PipeBuf {
+			size += len(lines[n])
+			n++
+		}
+		if n == 0 {
+			return written, syscalls, fmt.Errorf("writev: %d byte entry exceeds PIPE_BUF", len(lines[0]))
+		}
+		w, s, err := writevBatch(conn, lines[:n])
+		written += w
+		syscalls += s
+		if err != nil {
+			return written, syscalls, err
+		}
+		lines = lines[n:]
+	}
+	return written, syscalls, nil
+}
+
+// sendmmsgBatch sends a batch with sendmmsg, one datagram per entry, so that batching does not change what the receiver sees.
+func sendmmsgBatch(conn io.Writer, lines [][]byte) (int, int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, 0, fmt.Errorf("sendmmsg: %T does not expose its file descriptor", conn)
+	}
+	return vecio.Sendmmsg(sc, lines)
+}
+
+// joinedBatch copies a batch into one buffer and writes it with a single Write, for connections that don't expose a file descriptor.
+func joinedBatch(conn io.Writer, lines [][]byte) (int, int, error) {
+	n, err := conn.Write(bytes.Join(lines, nil))
+	return wholeLines(lines, n), 1, err
+}
+
+// wholeLines returns how many of the lines the first n bytes written cover completely. An entry cut off midway counts as
+// not written: it goes out again in full, after a fragment the receiver can't parse.
+func wholeLines(lines [][]byte, n int) int {
+	i := 0
+	for i < len(lines) && n >= len(lines[i]) {
+		n -= len(lines[i])
+		i++
+	}
+	return i
+}
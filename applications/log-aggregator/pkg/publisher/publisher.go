@@ -1,122 +1,146 @@
 package publisher
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"io"
-	"log"
 	"net"
 	"os"
+	"syscall"
 
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/vecio"
 )
 
+// Publisher sends entries to the aggregator until events is closed. Losing the aggregator is not fatal:
+// all implementations reconnect and buffer in the meantime, as configured by their ReconnectConfig,
+// and can batch entries into a single syscall as configured by their BatchConfig.
 type Publisher interface {
 	Publish(<-chan model.LogEntry)
+	Stats() *Stats
 }
 
 type UnixSocketPublisher struct {
+	reconnecting
 	socketPath string
+	token      string
 }
 
-func NewUnixSocketPublisher(socketPath string) *UnixSocketPublisher {
-	return &UnixSocketPublisher{socketPath: socketPath}
+func NewUnixSocketPublisher(socketPath string, config Config) *UnixSocketPublisher {
+	return &UnixSocketPublisher{reconnecting: reconnecting{config: config}, socketPath: socketPath}
 }
 
-func (u *UnixSocketPublisher) Publish(events <-chan model.LogEntry) {
-	conn, err := net.Dial("unix", u.socketPath)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
+// NewAuthenticatedUnixSocketPublisher presents token to the aggregator in a handshake on every (re)connect.
+func NewAuthenticatedUnixSocketPublisher(socketPath, token string, config Config) *UnixSocketPublisher {
+	return &UnixSocketPublisher{reconnecting: reconnecting{config: config}, socketPath: socketPath, token: token}
+}
 
-	write(conn, events)
+func (u *UnixSocketPublisher) Publish(events <-chan model.LogEntry) {
+	u.publish(events, func() (io.WriteCloser, error) {
+		conn, err := net.Dial("unix", u.socketPath)
+		if err != nil || u.token == "" {
+			return conn, err
+		}
+		if err := auth.ClientHandshake(conn, u.token); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}, writevBatch)
 }
 
 type UnixDatagramSocketPublisher struct {
+	reconnecting
 	socketPath string
 }
 
-func NewUnixDatagramSocketPublisher(socketPath string) *UnixDatagramSocketPublisher {
-	return &UnixDatagramSocketPublisher{socketPath: socketPath}
+func NewUnixDatagramSocketPublisher(socketPath string, config Config) *UnixDatagramSocketPublisher {
+	return &UnixDatagramSocketPublisher{reconnecting: reconnecting{config: config}, socketPath: socketPath}
 }
 
+// Publish on a datagram socket notices that the aggregator is gone on the next write (ECONNREFUSED), since the socket it was
+// connected to no longer exists. Entries written in between are lost, there is no send buffer to hold on to them.
 func (u *UnixDatagramSocketPublisher) Publish(events <-chan model.LogEntry) {
-	raddr, err := net.ResolveUnixAddr("unixgram", u.socketPath)
-	if err != nil {
-		panic(err)
-	}
-	conn, err := net.DialUnix("unixgram", nil, raddr)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-
-	write(conn, events)
-}
-
-func write(conn io.Writer, events <-chan model.LogEntry) {
-	for entry := range events {
-		b, err := json.Marshal(entry)
-		if err != nil {
-			panic(err)
-		}
-		_, err = conn.Write(append(b, '\n'))
+	u.publish(events, func() (io.WriteCloser, error) {
+		raddr, err := net.ResolveUnixAddr("unixgram", u.socketPath)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-	}
+		return net.DialUnix("unixgram", nil, raddr)
+	}, sendmmsgBatch)
 }
 
 type FIFOPublisher struct {
+	reconnecting
 	fifoPath string
 }
 
-func NewFIFOPublisher(fifoPath string) *FIFOPublisher {
-	return &FIFOPublisher{fifoPath: fifoPath}
+// NewFIFOPublisher writes to a fifo that other producers may be writing to as well. A fifo has no message boundaries, only
+// writes of up to PIPE_BUF bytes are atomic, so entries larger than that are dropped (and counted as oversized) rather than
+// risking them being torn apart by another producer's write.
+func NewFIFOPublisher(fifoPath string, config Config) *FIFOPublisher {
+	return &FIFOPublisher{reconnecting: reconnecting{config: config, maxEntrySize: vecio.PipeBuf}, fifoPath: fifoPath}
 }
 
+// Publish opens the fifo non-blocking: a blocking open would wait for a reader indefinitely, whereas this one fails with ENXIO
+// while there is none, like a refused connection. Once the reader goes away, writes fail with EPIPE.
 func (f *FIFOPublisher) Publish(events <-chan model.LogEntry) {
-	file, err := os.OpenFile(f.fifoPath, os.O_WRONLY, os.ModeNamedPipe)
-	if err != nil {
-		log.Fatal("open fifo for writing:", err)
-	}
-	defer file.Close()
-
-	write(file, events)
+	f.publish(events, func() (io.WriteCloser, error) {
+		// The file is registered with the runtime poller, so writes still block (on the poller) when the pipe is full.
+		// A non-blocking write of up to PIPE_BUF bytes to a full pipe writes nothing and fails with EAGAIN, it is never partial.
+		return os.OpenFile(f.fifoPath, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	}, pipeBatch)
 }
 
 type TCPSocketPublisher struct {
+	reconnecting
 	address string
 }
 
-func NewTCPSocketPublisher(address string) *TCPSocketPublisher {
-	return &TCPSocketPublisher{address: address}
+func NewTCPSocketPublisher(address string, config Config) *TCPSocketPublisher {
+	return &TCPSocketPublisher{reconnecting: reconnecting{config: config}, address: address}
 }
 
 func (t *TCPSocketPublisher) Publish(events <-chan model.LogEntry) {
-	conn, err := net.Dial("tcp", t.address)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
+	t.publish(events, func() (io.WriteCloser, error) {
+		return net.Dial("tcp", t.address)
+	}, writevBatch)
+}
+
+type TLSSocketPublisher struct {
+	reconnecting
+	address string
+	tls     *tls.Config
+}
 
-	write(conn, events)
+// NewTLSSocketPublisher sends entries over TCP with TLS. With a config from auth.ClientTLSConfig it authenticates itself with
+// its client certificate (mutual TLS).
+func NewTLSSocketPublisher(address string, tlsConfig *tls.Config, config Config) *TLSSocketPublisher {
+	return &TLSSocketPublisher{reconnecting: reconnecting{config: config}, address: address, tls: tlsConfig}
+}
+
+// Publish batches by writing the whole batch with one Write: TLS encrypts it into as few records as possible,
+// which is where the savings are. writev is not an option, the bytes on the socket are not the entries anymore.
+func (t *TLSSocketPublisher) Publish(events <-chan model.LogEntry) {
+	t.publish(events, func() (io.WriteCloser, error) {
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: auth.HandshakeTimeout}, Config: t.tls}
+		return dialer.Dial("tcp", t.address)
+	}, joinedBatch)
 }
 
 type UDPSocketPublisher struct {
+	reconnecting
 	address string
 }
 
-func NewUDPSocketPublisher(address string) *UDPSocketPublisher {
-	return &UDPSocketPublisher{address: address}
+func NewUDPSocketPublisher(address string, config Config) *UDPSocketPublisher {
+	return &UDPSocketPublisher{reconnecting: reconnecting{config: config}, address: address}
 }
 
+// Publish over UDP only finds out that nobody is listening from an ICMP port unreachable, which surfaces as ECONNREFUSED
+// on a later write on the connected socket. So reconnects happen, but the datagrams sent before that are lost.
 func (u *UDPSocketPublisher) Publish(events <-chan model.LogEntry) {
-	conn, err := net.Dial("udp", u.address)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-
-	write(conn, events)
+	u.publish(events, func() (io.WriteCloser, error) {
+		return net.Dial("udp", u.address)
+	}, sendmmsgBatch)
 }
@@ -0,0 +1,341 @@
+package publisher
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/vecio"
+)
+
+func testConfig() Config {
+	return Config{
+		Reconnect: ReconnectConfig{InitialBackoff: 5 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, BufferSize: 100, FlushTimeout: 2 * time.Second},
+		Batch:     DefaultBatchConfig(),
+	}
+}
+
+func TestMemoryBacklog_DropsOldest(t *testing.T) {
+	b := newMemoryBacklog(3)
+	for i, line := range []string{"a", "b", "c", "d"} {
+		dropped, _ := b.push([]byte(line))
+		if dropped != (i == 3) {
+			t.Fatalf("push %q: dropped=%t", line, dropped)
+		}
+	}
+	var got string
+	for {
+		line, ok, _ := b.peek()
+		if !ok {
+			break
+		}
+		got += string(line)
+		b.pop()
+	}
+	if got != "bcd" {
+		t.Fatalf("expected bcd, got %q", got)
+	}
+}
+
+func TestFileBacklog_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.jsonl")
+	b, err := openFileBacklog(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		if _, err := b.push([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.close()
+
+	// Reopening with a smaller capacity keeps the newest entries.
+	b, err = openFileBacklog(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	if b.len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", b.len())
+	}
+	var got string
+	for b.len() > 0 {
+		line, _, err := b.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += string(line)
+		if err := b.pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got != "c\nd\n" {
+		t.Fatalf("expected c and d, got %q", got)
+	}
+
+	// Drained: the file was truncated and is reused from the start.
+	b.push([]byte("e\n"))
+	if line, _, err := b.peek(); err != nil || string(line) != "e\n" {
+		t.Fatalf("expected e after truncation, got %q (%v)", line, err)
+	}
+}
+
+func receive(t *testing.T, ln net.Listener, n int) []model.LogEntry {
+	t.Helper()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var entries []model.LogEntry
+	scanner := bufio.NewScanner(conn)
+	for len(entries) < n && scanner.Scan() {
+		var entry model.LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestPublisher_BuffersUntilAggregatorComesUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	p := NewUnixSocketPublisher(path, testConfig())
+	events := make(chan model.LogEntry)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Publish(events)
+	}()
+
+	// Nothing is listening yet: these end up in the buffer instead of killing the publisher.
+	for i := 0; i < 10; i++ {
+		events <- model.LogEntry{Timestamp: int64(i)}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if p.Stats().Connected() {
+		t.Fatal("connected without a listener")
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for i := 10; i < 20; i++ {
+			events <- model.LogEntry{Timestamp: int64(i)}
+		}
+		close(events)
+	}()
+
+	entries := receive(t, ln, 20)
+	<-done
+	if len(entries) != 20 {
+		t.Fatalf("expected 20 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Timestamp != int64(i) {
+			t.Fatalf("entry %d out of order: %d", i, entry.Timestamp)
+		}
+	}
+	s := p.Stats()
+	// Depending on when the reconnect lands, some of the later entries are buffered as well.
+	if s.Buffered.Load() < 10 || s.Replayed.Load() != s.Buffered.Load() || s.Published.Load() != 20 || s.Dropped.Load() != 0 {
+		t.Fatalf("unexpected stats: %s", s)
+	}
+}
+
+func TestPublisher_GivesUpAfterFlushTimeout(t *testing.T) {
+	config := testConfig()
+	config.Reconnect.FlushTimeout = 50 * time.Millisecond
+	p := NewTCPSocketPublisher("127.0.0.1:1", config)
+	events := make(chan model.LogEntry, 5)
+	for i := 0; i < 5; i++ {
+		events <- model.LogEntry{}
+	}
+	close(events)
+
+	start := time.Now()
+	p.Publish(events)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Publish took %v to give up", elapsed)
+	}
+	if p.Stats().Dropped.Load() != 5 {
+		t.Fatalf("expected 5 dropped entries: %s", p.Stats())
+	}
+}
+
+func TestPublisher_Batching(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		network string
+		publish func(path string, config Config) Publisher
+	}{
+		{"writev", "unix", func(path string, config Config) Publisher { return NewUnixSocketPublisher(path, config) }},
+		{"sendmmsg", "unixgram", func(path string, config Config) Publisher { return NewUnixDatagramSocketPublisher(path, config) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log.sock")
+			var read func() ([]byte, error)
+			if tc.network == "unix" {
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ln.Close()
+				conns := make(chan *bufio.Reader, 1)
+				go func() {
+					c, err := ln.Accept()
+					if err == nil {
+						conns <- bufio.NewReader(c)
+					}
+				}()
+				var r *bufio.Reader
+				read = func() ([]byte, error) {
+					if r == nil {
+						r = <-conns
+					}
+					return r.ReadBytes('\n')
+				}
+			} else {
+				conn, err := net.ListenPacket("unixgram", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				read = func() ([]byte, error) {
+					buf := make([]byte, 1024)
+					n, _, err := conn.ReadFrom(buf)
+					return buf[:n], err
+				}
+			}
+
+			config := testConfig()
+			config.Batch = BatchConfig{Size: 16, Linger: 50 * time.Millisecond}
+			p := tc.publish(path, config)
+			events := make(chan model.LogEntry, 64)
+			for i := 0; i < 64; i++ {
+				events <- model.LogEntry{Timestamp: int64(i)}
+			}
+			close(events)
+			go p.Publish(events)
+
+			for i := 0; i < 64; i++ {
+				line, err := read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var entry model.LogEntry
+				if err := json.Unmarshal(line, &entry); err != nil {
+					t.Fatalf("entry %d: %v (%q)", i, err, line)
+				}
+				if entry.Timestamp != int64(i) {
+					t.Fatalf("entry %d out of order: %d", i, entry.Timestamp)
+				}
+			}
+			// All 64 entries were queued up front: 4 full batches, one syscall each. Except that sendmmsg returns early once the
+			// receiver's queue is full, which for a unix datagram socket is only net.unix.max_dgram_qlen (10) datagrams deep.
+			s := p.Stats()
+			if tc.network == "unix" && s.Syscalls.Load() != 4 || s.Syscalls.Load() > 16 {
+				t.Fatalf("unexpected number of syscalls: %s", s)
+			}
+		})
+	}
+}
+
+func TestFIFOPublisher_AtomicWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log_fifo")
+	if err := syscall.Mkfifo(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Without a writer, the reader would read EOF until the publisher has opened the fifo.
+	w, err := os.OpenFile(path, os.O_WRONLY, os.ModeNamedPipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	config := testConfig()
+	config.Batch = BatchConfig{Size: 16, Linger: 50 * time.Millisecond}
+	p := NewFIFOPublisher(path, config)
+	// 16 entries of about 1000 bytes each, with one in the middle too large to ever be written atomically.
+	events := make(chan model.LogEntry, 16)
+	for i := 0; i < 16; i++ {
+		size := 950
+		if i == 8 {
+			size = vecio.PipeBuf
+		}
+		events <- model.LogEntry{Timestamp: int64(i), Message: strings.Repeat("x", size)}
+	}
+	close(events)
+	done := make(chan struct{})
+	go func() {
+		p.Publish(events)
+		close(done)
+	}()
+
+	scanner := bufio.NewScanner(r)
+	for i := 0; i < 16; i++ {
+		if i == 8 {
+			continue
+		}
+		if !scanner.Scan() {
+			t.Fatalf("entry %d: %v", i, scanner.Err())
+		}
+		var entry model.LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Timestamp != int64(i) {
+			t.Fatalf("entry %d: %v (timestamp %d)", i, err, entry.Timestamp)
+		}
+	}
+	<-done
+	// 15 entries of a little over 1000 bytes: no more than 4 fit into PIPE_BUF, so it takes 4 writevs.
+	s := p.Stats()
+	if s.Oversized.Load() != 1 || s.Published.Load() != 15 || s.Syscalls.Load() != 4 {
+		t.Fatalf("unexpected stats: %s", s)
+	}
+}
+
+// shortWriter takes up to limit bytes, then fails.
+type shortWriter struct {
+	limit int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	n := min(len(b), w.limit)
+	w.limit -= n
+	if n < len(b) {
+		return n, syscall.EPIPE
+	}
+	return n, nil
+}
+
+func TestReconnecting_PartialBatchWrite(t *testing.T) {
+	r := &reconnecting{config: testConfig()}
+	lines := [][]byte{[]byte("one\n"), []byte("two\n"), []byte("three\n")}
+	// The first entry and half of the second one make it out before the connection breaks.
+	written, err := r.write(&shortWriter{limit: 6}, lines, joinedBatch)
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if written != 1 {
+		t.Fatalf("expected 1 whole entry written, got %d", written)
+	}
+	if got := r.stats.Published.Load(); got != 1 {
+		t.Fatalf("expected 1 entry published, got %d", got)
+	}
+}
@@ -0,0 +1,374 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+// ReconnectConfig controls what a publisher does when it can't reach the aggregator, e.g. because it is being restarted.
+type ReconnectConfig struct {
+	InitialBackoff time.Duration // wait before the first reconnect attempt, doubled after every failed one
+	MaxBackoff     time.Duration
+	// BufferSize is the number of entries kept while disconnected, the oldest ones are dropped beyond that.
+	BufferSize int
+	// BufferPath keeps the buffer in a file instead of in memory, so that it also survives a restart of the producer.
+	// Every producer needs its own file.
+	BufferPath string
+	// FlushTimeout is how long to keep trying to deliver the buffer once there is nothing new to publish.
+	FlushTimeout time.Duration
+}
+
+func DefaultReconnectConfig() ReconnectConfig {
+	return ReconnectConfig{
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		BufferSize:     10000,
+		FlushTimeout:   10 * time.Second,
+	}
+}
+
+func (c ReconnectConfig) Validate() error {
+	if c.InitialBackoff <= 0 {
+		return fmt.Errorf("initial backoff must be positive, got %v", c.InitialBackoff)
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("max backoff (%v) must not be below the initial backoff (%v)", c.MaxBackoff, c.InitialBackoff)
+	}
+	if c.BufferSize < 1 {
+		return fmt.Errorf("buffer size must be at least 1, got %d", c.BufferSize)
+	}
+	if c.FlushTimeout < 0 {
+		return fmt.Errorf("flush timeout must not be negative, got %v", c.FlushTimeout)
+	}
+	return nil
+}
+
+type Stats struct {
+	connected   atomic.Bool
+	Connects    atomic.Uint64 // successful (re)connects
+	Disconnects atomic.Uint64 // connections given up on after a failed write
+	// Published counts entries written to a connection. On a stream socket a successful write only means the entry made it
+	// into the kernel's send buffer, so entries written just before the aggregator went away can still be lost.
+	Published atomic.Uint64
+	Buffered  atomic.Uint64 // entries that went into the buffer while disconnected
+	Replayed  atomic.Uint64 // buffered entries that have since been written to a connection
+	Dropped   atomic.Uint64 // entries dropped because the buffer was full, or still buffered when the flush timeout ran out
+	Oversized atomic.Uint64 // entries dropped because they exceed the transport's size limit (PIPE_BUF on a fifo)
+	// Syscalls counts the write, writev and sendmmsg calls issued. For single writes it is the number of Write calls,
+	// which can hide a few more syscalls for partial writes on stream sockets.
+	Syscalls atomic.Uint64
+}
+
+// Connected reports whether the publisher currently holds a connection to the aggregator.
+func (s *Stats) Connected() bool {
+	return s.connected.Load()
+}
+
+// SyscallsPerMessage is the average number of write syscalls per published entry.
+func (s *Stats) SyscallsPerMessage() float64 {
+	published := s.Published.Load()
+	if published == 0 {
+		return 0
+	}
+	return float64(s.Syscalls.Load()) / float64(published)
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("connected=%t connects=%d disconnects=%d published=%d buffered=%d replayed=%d dropped=%d oversized=%d syscalls=%d syscalls_per_msg=%.3f",
+		s.Connected(), s.Connects.Load(), s.Disconnects.Load(), s.Published.Load(), s.Buffered.Load(), s.Replayed.Load(), s.Dropped.Load(),
+		s.Oversized.Load(), s.Syscalls.Load(), s.SyscallsPerMessage())
+}
+
+type dialFunc func() (io.WriteCloser, error)
+
+// reconnecting holds the state shared by all publishers: they only differ in how they dial and how they write a batch.
+type reconnecting struct {
+	config Config
+	stats  Stats
+	// maxEntrySize is the largest encoded entry (newline included) the transport can take, 0 for no limit.
+	maxEntrySize int
+	// reportedOversized makes sure the first oversized entry is logged, without logging every single one after it.
+	reportedOversized bool
+}
+
+func (r *reconnecting) Stats() *Stats {
+	return &r.stats
+}
+
+// publish writes every entry from events to a connection obtained from dial. Whenever dialing or writing fails, entries go
+// into the buffer and dialing is retried with jittered exponential backoff. Once connected again, the buffer is written out
+// before any new entry, so entries keep their order. publish returns once events is closed and the buffer has been delivered
+// (or FlushTimeout has passed).
+func (r *reconnecting) publish(events <-chan model.LogEntry, dial dialFunc, writeBatch batchWriter) {
+	buffer, err := newBacklog(r.config.Reconnect)
+	if err != nil {
+		// Without its file the publisher can still do its job, just without surviving a restart.
+		log.Printf("publisher buffer: %v, buffering in memory instead", err)
+		buffer = newMemoryBacklog(r.config.Reconnect.BufferSize)
+	}
+	defer buffer.close()
+	if n := buffer.len(); n > 0 {
+		log.Printf("publisher buffer: replaying %d entries left over from a previous run", n)
+	}
+
+	var conn io.WriteCloser
+	backoff := r.config.Reconnect.InitialBackoff
+	retry := time.NewTimer(0)
+	retry.Stop()
+	defer retry.Stop()
+	var flushDeadline <-chan time.Time
+
+	eventsClosed := func() {
+		events = nil
+		flushDeadline = time.After(r.config.Reconnect.FlushTimeout)
+	}
+	disconnect := func(err error) {
+		log.Printf("publisher: connection lost, reconnecting: %v", err)
+		conn.Close()
+		conn = nil
+		r.stats.connected.Store(false)
+		r.stats.Disconnects.Add(1)
+		retry.Reset(jitter(backoff))
+	}
+
+	connect := func() {
+		c, err := dial()
+		if err != nil {
+			if backoff == r.config.Reconnect.InitialBackoff {
+				log.Printf("publisher: can't connect, retrying: %v", err)
+			}
+			backoff = min(2*backoff, r.config.Reconnect.MaxBackoff)
+			retry.Reset(jitter(backoff))
+			return
+		}
+		conn = c
+		backoff = r.config.Reconnect.InitialBackoff
+		r.stats.connected.Store(true)
+		r.stats.Connects.Add(1)
+		if err := r.replay(buffer, conn); err != nil {
+			disconnect(err)
+		}
+	}
+
+	connect()
+	for {
+		if conn == nil {
+			if events == nil && buffer.len() == 0 {
+				return
+			}
+			select {
+			case entry, ok := <-events:
+				if !ok {
+					eventsClosed()
+					continue
+				}
+				r.buffer(buffer, entry)
+			case <-retry.C:
+				connect()
+			case <-flushDeadline:
+				n := buffer.len()
+				log.Printf("publisher: giving up on %d buffered entries after %v", n, r.config.Reconnect.FlushTimeout)
+				r.stats.Dropped.Add(uint64(n))
+				return
+			}
+			continue
+		}
+
+		if events == nil {
+			// Only get here once everything was written after events had been closed.
+			conn.Close()
+			r.stats.connected.Store(false)
+			return
+		}
+		lines, open := r.collect(events)
+		if !open {
+			eventsClosed()
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		written, err := r.write(conn, lines, writeBatch)
+		if err != nil {
+			// The failed write may or may not have gone out: buffer it, so it is delivered at least once.
+			for _, line := range lines[written:] {
+				r.bufferLine(buffer, line)
+			}
+			disconnect(err)
+		}
+	}
+}
+
+// collect waits for the next entry and, when batching, adds whatever else arrives within the linger time, up to the batch size.
+// open is false once events has been closed, lines may still hold the last entries then.
+func (r *reconnecting) collect(events <-chan model.LogEntry) (lines [][]byte, open bool) {
+	entry, ok := <-events
+	if !ok {
+		return nil, false
+	}
+	lines = r.appendEncoded(lines, entry)
+	size := r.config.Batch.Size
+	if size <= 1 {
+		return lines, true
+	}
+
+	var linger <-chan time.Time
+	if r.config.Batch.Linger > 0 {
+		timer := time.NewTimer(r.config.Batch.Linger)
+		defer timer.Stop()
+		linger = timer.C
+	}
+	for len(lines) < size {
+		if linger == nil {
+			// No linger: take what is already queued, but don't wait for more.
+			select {
+			case entry, ok := <-events:
+				if !ok {
+					return lines, false
+				}
+				lines = r.appendEncoded(lines, entry)
+				continue
+			default:
+				return lines, true
+			}
+		}
+		select {
+		case entry, ok := <-events:
+			if !ok {
+				return lines, false
+			}
+			lines = r.appendEncoded(lines, entry)
+		case <-linger:
+			return lines, true
+		}
+	}
+	return lines, true
+}
+
+func (r *reconnecting) appendEncoded(lines [][]byte, entry model.LogEntry) [][]byte {
+	line, ok := r.encode(entry)
+	if !ok {
+		return lines
+	}
+	return append(lines, line)
+}
+
+// write returns how many of the lines are known to have been written when it fails.
+func (r *reconnecting) write(conn io.Writer, lines [][]byte, writeBatch batchWriter) (int, error) {
+	if len(lines) > 1 && writeBatch != nil {
+		written, syscalls, err := writeBatch(conn, lines)
+		r.stats.Syscalls.Add(uint64(syscalls))
+		r.stats.Published.Add(uint64(written))
+		return written, err
+	}
+	for i, line := range lines {
+		r.stats.Syscalls.Add(1)
+		if _, err := conn.Write(line); err != nil {
+			return i, err
+		}
+		r.stats.Published.Add(1)
+	}
+	return len(lines), nil
+}
+
+// replay writes out the buffer, oldest entry first. An entry is only removed from the buffer once it was written.
+func (r *reconnecting) replay(buffer backlog, conn io.Writer) error {
+	for {
+		line, ok, err := buffer.peek()
+		if err != nil {
+			// A corrupt buffer file should not keep the publisher from publishing new entries.
+			log.Printf("publisher buffer: %v, discarding the rest of it", err)
+			r.stats.Dropped.Add(uint64(buffer.len()))
+			return buffer.reset()
+		}
+		if !ok {
+			return nil
+		}
+		if r.oversized(line) {
+			// E.g. a buffer file left behind by a producer on another transport.
+			if err := buffer.pop(); err != nil {
+				return err
+			}
+			continue
+		}
+		r.stats.Syscalls.Add(1)
+		if _, err := conn.Write(line); err != nil {
+			return err
+		}
+		if err := buffer.pop(); err != nil {
+			return err
+		}
+		r.stats.Published.Add(1)
+		r.stats.Replayed.Add(1)
+	}
+}
+
+func (r *reconnecting) buffer(buffer backlog, entry model.LogEntry) {
+	line, ok := r.encode(entry)
+	if !ok {
+		return
+	}
+	r.bufferLine(buffer, line)
+}
+
+func (r *reconnecting) bufferLine(buffer backlog, line []byte) {
+	dropped, err := buffer.push(line)
+	if err != nil {
+		log.Printf("publisher buffer: dropping entry: %v", err)
+		r.stats.Dropped.Add(1)
+		return
+	}
+	r.stats.Buffered.Add(1)
+	if dropped {
+		r.stats.Dropped.Add(1)
+	}
+}
+
+// encode returns the entry as a line, or false if it can't be published: it does not encode, or is too large for the transport.
+func (r *reconnecting) encode(entry model.LogEntry) ([]byte, bool) {
+	line, err := encode(entry)
+	if err != nil {
+		log.Printf("publisher: dropping entry: %v", err)
+		r.stats.Dropped.Add(1)
+		return nil, false
+	}
+	if r.oversized(line) {
+		return nil, false
+	}
+	return line, true
+}
+
+// oversized drops (and counts) a line over maxEntrySize.
+func (r *reconnecting) oversized(line []byte) bool {
+	if r.maxEntrySize == 0 || len(line) <= r.maxEntrySize {
+		return false
+	}
+	r.stats.Oversized.Add(1)
+	if !r.reportedOversized {
+		r.reportedOversized = true
+		log.Printf("publisher: dropping entry of %d bytes: writes over %d bytes are not atomic on this transport, "+
+			"they could interleave with other producers' entries (further oversized entries are only counted)", len(line), r.maxEntrySize)
+	}
+	return true
+}
+
+func encode(entry model.LogEntry) ([]byte, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// jitter spreads reconnect attempts over [d/2, d), so that producers that lost their connection at the same moment
+// don't all come knocking again at the same moment.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + rand.N(d-half)
+}
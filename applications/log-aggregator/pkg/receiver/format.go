@@ -0,0 +1,161 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+// Format is the wire format a receiver decodes into model.LogEntry.
+type Format int
+
+const (
+	// FormatJSON is our own format: a JSON encoded model.LogEntry per line, or per datagram. Entries of every schema
+	// version are accepted and upgraded to model.SchemaVersion.
+	FormatJSON Format = iota
+	// FormatSyslog accepts RFC 5424 and RFC 3164 messages, told apart per message. On streams, messages are framed with
+	// RFC 6587 octet counting or terminated by a newline (or NUL), again per message.
+	FormatSyslog
+	// FormatGELF is Graylog's GELF 1.1 over datagrams: JSON, optionally gzip or zlib compressed, optionally chunked.
+	FormatGELF
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatSyslog:
+		return "syslog"
+	case FormatGELF:
+		return "gelf"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// decodeFunc turns one payload (a line, a framed message or a datagram) into an entry. ok is false for payloads that
+// carry no entry of their own, like all but the last chunk of a chunked GELF message.
+type decodeFunc func(payload []byte) (entry model.LogEntry, ok bool, err error)
+
+// decoder returns the decodeFunc for one connection or socket. Decoders may keep state (GELF chunks),
+// so every reading goroutine needs its own.
+func (f Format) decoder(stats *Stats) decodeFunc {
+	switch f {
+	case FormatSyslog:
+		return func(payload []byte) (model.LogEntry, bool, error) {
+			entry, err := parseSyslog(payload, time.Now())
+			return entry, err == nil, err
+		}
+	case FormatGELF:
+		return newGELFChunks(stats).decode
+	default:
+		return func(payload []byte) (model.LogEntry, bool, error) {
+			entry, err := decodeJSON(payload, stats)
+			return entry, err == nil, err
+		}
+	}
+}
+
+// jsonEntry is model.LogEntry with the level as it may be spelled on the wire: version 1 levels are free-form.
+type jsonEntry struct {
+	model.LogEntry
+	Level string `json:"level"`
+}
+
+// decodeJSON decodes an entry of any schema version and upgrades it to the current one. A level that is none of the
+// model.Level names is an error in a current entry, but in an entry of another version it is kept in the "level"
+// attribute, so nothing a version 1 producer sent is lost. Entries of a newer version are decoded as far as this version
+// understands them: fields it doesn't know are dropped.
+func decodeJSON(payload []byte, stats *Stats) (model.LogEntry, error) {
+	var wire jsonEntry
+	if err := json.Unmarshal(payload, &wire); err != nil {
+		return model.LogEntry{}, err
+	}
+	entry := wire.LogEntry
+	if level, ok := model.ParseLevel(wire.Level); ok {
+		entry.Level = level
+	} else if entry.Version == model.SchemaVersion {
+		return model.LogEntry{}, fmt.Errorf("unknown level %q", wire.Level)
+	} else {
+		if entry.Attributes == nil {
+			entry.Attributes = make(map[string]string)
+		}
+		entry.Attributes["level"] = wire.Level
+	}
+
+	switch {
+	case entry.Version < model.SchemaVersion:
+		stats.OlderSchema.Add(1)
+	case entry.Version > model.SchemaVersion:
+		stats.NewerSchema.Add(1)
+	}
+	entry.Version = model.SchemaVersion
+	return entry, nil
+}
+
+// split returns how a stream carrying this format is cut into payloads.
+func (f Format) split() bufio.SplitFunc {
+	if f == FormatSyslog {
+		return splitSyslog
+	}
+	return bufio.ScanLines
+}
+
+// splitSyslog handles both framings of RFC 6587: octet counting ("LEN SP MSG") when a message starts with a digit,
+// which a message starting with "<PRI>" never does, and non-transparent framing with a newline or NUL trailer otherwise.
+func splitSyslog(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	// Skip stray trailers between messages, some senders terminate octet counted messages with a newline anyway.
+	start := 0
+	for start < len(data) && (data[start] == '\n' || data[start] == '\r' || data[start] == 0) {
+		start++
+	}
+	if start == len(data) {
+		return start, nil, nil
+	}
+	data = data[start:]
+
+	if data[0] >= '0' && data[0] <= '9' {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			if atEOF || len(data) > 10 {
+				return 0, nil, fmt.Errorf("syslog: invalid octet count %q", truncate(data, 10))
+			}
+			return start, nil, nil
+		}
+		length, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || length <= 0 {
+			return 0, nil, fmt.Errorf("syslog: invalid octet count %q", data[:sp])
+		}
+		// The scanner could never buffer a larger message, and a huge count would overflow the arithmetic below.
+		if length > bufio.MaxScanTokenSize {
+			return 0, nil, fmt.Errorf("syslog: %d byte message exceeds the %d byte limit", length, bufio.MaxScanTokenSize)
+		}
+		if len(data)-sp-1 < length {
+			if atEOF {
+				return 0, nil, fmt.Errorf("syslog: stream ended within a %d byte message", length)
+			}
+			return start, nil, nil
+		}
+		return start + sp + 1 + length, data[sp+1 : sp+1+length], nil
+	}
+
+	if i := bytes.IndexAny(data, "\n\x00"); i >= 0 {
+		return start + i + 1, bytes.TrimSuffix(data[:i], []byte{'\r'}), nil
+	}
+	if atEOF {
+		return start + len(data), data, nil
+	}
+	return start, nil, nil
+}
+
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
@@ -0,0 +1,370 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/output"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2025, time.October, 19, 14, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		msg  string
+		want model.LogEntry
+	}{
+		{
+			name: "rfc5424",
+			msg: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 42 ID47 ` +
+				`[exampleSDID@32473 iut="3" eventSource="App\"lication\]"][origin ip="192.0.2.1"] ` + utf8BOM + `An application event`,
+			want: model.LogEntry{Source: "evntslog", Timestamp: 1065910455, Level: model.LevelNotice, Message: "An application event",
+				Hostname: "mymachine.example.com", PID: 42,
+				Attributes: map[string]string{"facility": "local4", "msgid": "ID47",
+					"exampleSDID@32473.iut": "3", "exampleSDID@32473.eventSource": `App"lication]`, "origin.ip": "192.0.2.1"}},
+		},
+		{
+			name: "rfc5424 nil values",
+			msg:  "<34>1 - host - - - -",
+			want: model.LogEntry{Source: "host", Timestamp: now.Unix(), Level: model.LevelCritical, Hostname: "host",
+				Attributes: map[string]string{"facility": "auth"}},
+		},
+		{
+			name: "rfc5424 from SyslogOutput",
+			msg: `<131>1 2023-11-14T22:13:20Z host app worker-3 - [log@32473 goroutine="7" trace_id="4bf92f3577b34da6a3ce929d0e0e4736" ` +
+				`span_id="00f067aa0ba902b7"][attrs@32473 user="42" path="/a\]b"] failed`,
+			want: model.LogEntry{Source: "app", Timestamp: 1700000000, Level: model.LevelError, Message: "failed", Hostname: "host",
+				Goroutine: 7, TraceID: mustTraceID("4bf92f3577b34da6a3ce929d0e0e4736"), SpanID: mustSpanID("00f067aa0ba902b7"),
+				Attributes: map[string]string{"facility": "local0", "procid": "worker-3", "user": "42", "path": "/a]b"}},
+		},
+		{
+			name: "rfc3164",
+			msg:  "<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8\n",
+			want: model.LogEntry{Source: "su", Timestamp: time.Date(2025, time.October, 11, 22, 14, 15, 0, time.UTC).Unix(), Level: model.LevelCritical,
+				Message: "'su root' failed for lonvick on /dev/pts/8", Hostname: "mymachine", PID: 230,
+				Attributes: map[string]string{"facility": "auth"}},
+		},
+		{
+			// What the C library's syslog(3) writes to /dev/log: no hostname.
+			name: "rfc3164 without hostname",
+			msg:  "<14>Oct  9 08:00:00 myapp: started",
+			want: model.LogEntry{Source: "myapp", Timestamp: time.Date(2025, time.October, 9, 8, 0, 0, 0, time.UTC).Unix(), Level: model.LevelInfo,
+				Message: "started", Attributes: map[string]string{"facility": "user"}},
+		},
+		{
+			name: "rfc3164 from last year",
+			msg:  "<13>Dec 31 23:59:59 host app: late",
+			want: model.LogEntry{Source: "app", Timestamp: time.Date(2024, time.December, 31, 23, 59, 59, 0, time.UTC).Unix(), Level: model.LevelNotice,
+				Message: "late", Hostname: "host", Attributes: map[string]string{"facility": "user"}},
+		},
+		{
+			name: "no PRI",
+			msg:  "just some text",
+			want: model.LogEntry{Timestamp: now.Unix(), Level: model.LevelNotice, Message: "just some text",
+				Attributes: map[string]string{"facility": "user"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseSyslog([]byte(tc.msg), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got  %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+
+	for _, msg := range []string{"", "<999>1 - - - - - -", "<13>1 2003-10-11 host app - - - msg", "<13>1 - host app - - [unterminated", "<13>1 - host"} {
+		if _, err := parseSyslog([]byte(msg), now); err == nil {
+			t.Errorf("expected an error for %q", msg)
+		}
+	}
+}
+
+func TestSplitSyslog(t *testing.T) {
+	stream := "12 <13>1 - - - first\n<13>second\n\n<13>third\x0017 <13>1 - - - - - x<13>unterminated"
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	scanner.Split(splitSyslog)
+	var got []string
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"<13>1 - - - ", "first", "<13>second", "<13>third", "<13>1 - - - - - x", "<13>unterminated"}
+	// The first message claims 12 octets, so "first" spills over into a message of its own: octet counting trusts the length.
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSplitSyslog_InvalidOctetCounts(t *testing.T) {
+	for _, stream := range []string{
+		"9223372036854775807 <13>huge",   // would overflow the end offset
+		"70000 <13>too long to buffer",   // over the scanner's token limit
+		"123456789012345678901234567890", // digits only, no space in sight
+		"123",                            // digits only up to the end of the stream
+	} {
+		scanner := bufio.NewScanner(strings.NewReader(stream))
+		scanner.Split(splitSyslog)
+		for scanner.Scan() {
+		}
+		if scanner.Err() == nil {
+			t.Errorf("expected an error for %q", stream)
+		}
+	}
+}
+
+func gelfChunked(id uint64, message []byte, size int) [][]byte {
+	var chunks [][]byte
+	count := (len(message) + size - 1) / size
+	for seq := 0; seq < count; seq++ {
+		header := []byte{0x1e, 0x0f, 0, 0, 0, 0, 0, 0, 0, 0, byte(seq), byte(count)}
+		binary.BigEndian.PutUint64(header[2:10], id)
+		chunks = append(chunks, append(header, message[seq*size:min((seq+1)*size, len(message))]...))
+	}
+	return chunks
+}
+
+func TestDecodeJSON_SchemaVersions(t *testing.T) {
+	var stats Stats
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    model.LogEntry
+		wantErr bool
+	}{
+		{
+			name:    "version 1",
+			payload: `{"source":"old","timestamp":1,"level":"warning","message":"hi"}`,
+			want:    model.LogEntry{Version: model.SchemaVersion, Source: "old", Timestamp: 1, Level: model.LevelWarn, Message: "hi"},
+		},
+		{
+			name:    "version 1 with an unknown level",
+			payload: `{"source":"old","timestamp":1,"level":"verbose","message":"hi"}`,
+			want: model.LogEntry{Version: model.SchemaVersion, Source: "old", Timestamp: 1, Message: "hi",
+				Attributes: map[string]string{"level": "verbose"}},
+		},
+		{
+			name:    "current version",
+			payload: `{"v":2,"source":"new","timestamp":1,"level":"ERROR","message":"hi","hostname":"h","pid":7,"goroutine":1,"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"}`,
+			want: model.LogEntry{Version: model.SchemaVersion, Source: "new", Timestamp: 1, Level: model.LevelError, Message: "hi",
+				Hostname: "h", PID: 7, Goroutine: 1, TraceID: mustTraceID("4bf92f3577b34da6a3ce929d0e0e4736")},
+		},
+		{
+			name:    "current version with an unknown level",
+			payload: `{"v":2,"source":"new","timestamp":1,"level":"verbose","message":"hi"}`,
+			wantErr: true,
+		},
+		{
+			name:    "newer version",
+			payload: `{"v":3,"source":"newer","timestamp":1,"level":"SEVERE","message":"hi","tenant":"t1"}`,
+			want: model.LogEntry{Version: model.SchemaVersion, Source: "newer", Timestamp: 1, Message: "hi",
+				Attributes: map[string]string{"level": "SEVERE"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeJSON([]byte(tc.payload), &stats)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got  %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+	if stats.OlderSchema.Load() != 2 || stats.NewerSchema.Load() != 1 {
+		t.Fatalf("unexpected schema counts: %s", &stats)
+	}
+}
+
+func TestParseGELF(t *testing.T) {
+	message := []byte(`{"version":"1.1","host":"example.org","short_message":"A short message","full_message":"Backtrace here",` +
+		`"timestamp":1385053862.3072,"level":3,"_user_id":9001,"_some_info":"foo"}`)
+	want := model.LogEntry{Source: "example.org", Hostname: "example.org", Timestamp: 1385053862, Level: model.LevelError, Message: "A short message",
+		Attributes: map[string]string{"full_message": "Backtrace here", "user_id": "9001", "some_info": "foo"}}
+
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(message)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(message)
+	zw.Close()
+
+	for name, payloads := range map[string][][]byte{
+		"plain":   {message},
+		"gzip":    {gz.Bytes()},
+		"zlib":    {zl.Bytes()},
+		"chunked": gelfChunked(42, gz.Bytes(), 20),
+	} {
+		t.Run(name, func(t *testing.T) {
+			decode := FormatGELF.decoder(&Stats{})
+			// Chunks may arrive in any order.
+			for i := len(payloads) - 1; i >= 0; i-- {
+				got, ok, err := decode(payloads[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != (i == 0) {
+					t.Fatalf("payload %d of %d: ok=%v", i, len(payloads), ok)
+				}
+				if ok && !reflect.DeepEqual(got, want) {
+					t.Fatalf("got  %+v\nwant %+v", got, want)
+				}
+			}
+		})
+	}
+
+	if _, _, err := FormatGELF.decoder(&Stats{})([]byte(`{"version":"1.1","short_message":"no host"}`)); err == nil {
+		t.Fatal("expected an error for a message without host")
+	}
+}
+
+func TestParseGELF_Metadata(t *testing.T) {
+	message := []byte(`{"version":"1.1","host":"h","short_message":"m","_pid":1234,` +
+		`"_trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","_span_id":"not-a-span"}`)
+	got, err := parseGELF(message, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PID != 1234 || got.TraceID != mustTraceID("4bf92f3577b34da6a3ce929d0e0e4736") || !got.SpanID.IsZero() {
+		t.Fatalf("unexpected metadata: %+v", got)
+	}
+	// Invalid values stay attributes, valid ones don't.
+	if !reflect.DeepEqual(got.Attributes, map[string]string{"span_id": "not-a-span"}) {
+		t.Fatalf("unexpected attributes: %v", got.Attributes)
+	}
+}
+
+func mustTraceID(s string) model.TraceID {
+	id, err := model.ParseTraceID(s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func mustSpanID(s string) model.SpanID {
+	id, err := model.ParseSpanID(s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func TestGELFChunks_Expire(t *testing.T) {
+	stats := &Stats{}
+	g := newGELFChunks(stats)
+	start := time.Now()
+	chunks := gelfChunked(1, []byte(`{"host":"h","short_message":"m"}`), 10)
+	if msg, err := g.add(chunks[0], start); msg != nil || err != nil {
+		t.Fatalf("got %q, %v for the first chunk", msg, err)
+	}
+	// The rest of the message arrives too late: the first chunk is gone by then and the message never completes.
+	late := start.Add(gelfChunkTimeout + time.Second)
+	for _, chunk := range chunks[1:] {
+		if msg, err := g.add(chunk, late); msg != nil || err != nil {
+			t.Fatalf("got %q, %v for a late chunk", msg, err)
+		}
+	}
+	if got := stats.Malformed.Load(); got != 1 {
+		t.Fatalf("expected the expired message to be counted as malformed, got %d", got)
+	}
+}
+
+// TestSyslogReceiver_FromSyslogOutput sends entries with our own syslog sink to the syslog receivers, on every network.
+func TestSyslogReceiver_FromSyslogOutput(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct{ network, address string }{
+		{"udp", freeAddr(t, "udp")},
+		{"tcp", freeAddr(t, "tcp")},
+		{"unix", filepath.Join(dir, "syslog.sock")},
+		{"unixgram", filepath.Join(dir, "syslog.gram")},
+	} {
+		t.Run(tc.network, func(t *testing.T) {
+			r, err := NewSyslogReceiver(tc.network, tc.address, withBatch(4))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := make(chan model.LogEntry, 10)
+			go r.Receive(ctx, events)
+
+			var out *output.SyslogOutput
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				err = nil
+				if tc.network == "udp" {
+					var probe net.Conn
+					if probe, err = dialUDPWhenBound(tc.address); err == nil {
+						probe.Close()
+					}
+				}
+				if err == nil {
+					if out, err = output.DialSyslogOutput(tc.network, tc.address); err == nil {
+						break
+					}
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("receiver did not come up: %v", err)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			in := make(chan model.LogEntry, 3)
+			sent := []model.LogEntry{
+				{Source: "producer-1", Timestamp: 1700000000, Level: model.LevelInfo, Message: "hello", Hostname: "web-1", PID: 4242,
+					Goroutine: 17, TraceID: mustTraceID("4bf92f3577b34da6a3ce929d0e0e4736"), SpanID: mustSpanID("00f067aa0ba902b7"),
+					Attributes: map[string]string{"user": `"quoted" \\ [bracketed]`}},
+				{Source: "producer-2", Timestamp: 1700000001, Level: model.LevelError, Message: "multi\nline"},
+				{Source: "producer-1", Timestamp: 1700000002, Level: model.LevelDebug, Message: "bye"},
+			}
+			for _, e := range sent {
+				in <- e
+			}
+			close(in)
+			if err := out.Write(in); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range sent {
+				select {
+				case got := <-events:
+					if got.Source != want.Source || got.Timestamp != want.Timestamp || got.Level != want.Level || got.Message != want.Message {
+						t.Fatalf("got %+v, want %+v", got, want)
+					}
+					if got.Attributes["facility"] != "local0" || got.Hostname == "" {
+						t.Fatalf("missing hostname or facility: %+v", got)
+					}
+					if want.Hostname != "" && (got.Hostname != want.Hostname || got.PID != want.PID || got.Goroutine != want.Goroutine ||
+						got.TraceID != want.TraceID || got.SpanID != want.SpanID || got.Attributes["user"] != want.Attributes["user"]) {
+						t.Fatalf("metadata did not survive: got %+v, want %+v", got, want)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timed out waiting for %+v", want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package receiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+const (
+	gelfChunkHeaderSize = 12 // magic (2), message id (8), sequence number (1), sequence count (1)
+	gelfMaxChunks       = 128
+	// gelfChunkTimeout is how long the chunks of a message are kept waiting for the rest, as the GELF spec prescribes.
+	gelfChunkTimeout = 5 * time.Second
+	// gelfMaxPending bounds the memory held by incomplete messages, e.g. when a sender's chunks keep getting lost.
+	gelfMaxPending = 1024
+	// gelfMaxMessageSize bounds what a compressed message may inflate to.
+	gelfMaxMessageSize = 1 << 20
+)
+
+// gelfDefaultLevel is the level of a message without one: the GELF spec says 1 (ALERT).
+const gelfDefaultLevel = 1
+
+// gelfChunks reassembles chunked GELF messages. It is not safe for concurrent use,
+// which is fine as a datagram socket is read by a single goroutine.
+type gelfChunks struct {
+	stats     *Stats
+	pending   map[uint64]*gelfMessage
+	lastSweep time.Time
+}
+
+type gelfMessage struct {
+	chunks    [][]byte
+	received  int
+	firstSeen time.Time
+}
+
+func newGELFChunks(stats *Stats) *gelfChunks {
+	return &gelfChunks{stats: stats, pending: make(map[uint64]*gelfMessage)}
+}
+
+func (g *gelfChunks) decode(payload []byte) (model.LogEntry, bool, error) {
+	if len(payload) >= 2 && payload[0] == 0x1e && payload[1] == 0x0f {
+		message, err := g.add(payload, time.Now())
+		if message == nil || err != nil {
+			return model.LogEntry{}, false, err
+		}
+		payload = message
+	}
+	entry, err := parseGELF(payload, time.Now())
+	return entry, err == nil, err
+}
+
+// add stores a chunk and returns the reassembled message once its last chunk has arrived.
+func (g *gelfChunks) add(chunk []byte, now time.Time) ([]byte, error) {
+	if len(chunk) < gelfChunkHeaderSize {
+		return nil, errors.New("gelf: short chunk header")
+	}
+	id := binary.BigEndian.Uint64(chunk[2:10])
+	seq, count := int(chunk[10]), int(chunk[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil, fmt.Errorf("gelf: invalid chunk %d of %d", seq, count)
+	}
+
+	if now.Sub(g.lastSweep) >= time.Second {
+		g.expire(now)
+		g.lastSweep = now
+	}
+	msg, ok := g.pending[id]
+	if !ok {
+		if len(g.pending) >= gelfMaxPending {
+			return nil, errors.New("gelf: too many incomplete chunked messages")
+		}
+		msg = &gelfMessage{chunks: make([][]byte, count), firstSeen: now}
+		g.pending[id] = msg
+	}
+	if len(msg.chunks) != count {
+		return nil, fmt.Errorf("gelf: chunk count of message %x changed from %d to %d", id, len(msg.chunks), count)
+	}
+	if msg.chunks[seq] == nil {
+		// The receive buffer is reused for the next datagram.
+		msg.chunks[seq] = bytes.Clone(chunk[gelfChunkHeaderSize:])
+		msg.received++
+	}
+	if msg.received < count {
+		return nil, nil
+	}
+	delete(g.pending, id)
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+// expire drops messages whose chunks did not all arrive in time. Each one counts as a malformed payload.
+func (g *gelfChunks) expire(now time.Time) {
+	for id, msg := range g.pending {
+		if now.Sub(msg.firstSeen) > gelfChunkTimeout {
+			delete(g.pending, id)
+			g.stats.Malformed.Add(1)
+		}
+	}
+}
+
+// parseGELF decodes a (reassembled) GELF 1.1 message. The host becomes the entry's source and hostname, short_message its
+// message and the syslog severity in level its level. The additional fields _pid, _trace_id and _span_id go into their
+// fields if they are valid. full_message, the deprecated facility, file and line fields, and the other additional fields
+// (with their leading underscore stripped) end up in the attributes.
+func parseGELF(payload []byte, now time.Time) (model.LogEntry, error) {
+	payload, err := inflateGELF(payload)
+	if err != nil {
+		return model.LogEntry{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var fields map[string]any
+	if err := decoder.Decode(&fields); err != nil {
+		return model.LogEntry{}, fmt.Errorf("gelf: %w", err)
+	}
+
+	host, _ := fields["host"].(string)
+	message, _ := fields["short_message"].(string)
+	if host == "" || message == "" {
+		return model.LogEntry{}, errors.New("gelf: host and short_message are required")
+	}
+	level, _ := model.LevelFromSyslog(gelfDefaultLevel)
+	entry := model.LogEntry{Source: host, Hostname: host, Message: message, Timestamp: now.Unix(), Level: level}
+
+	if ts, ok := fields["timestamp"].(json.Number); ok {
+		seconds, err := ts.Float64()
+		if err != nil {
+			return model.LogEntry{}, fmt.Errorf("gelf: invalid timestamp %q", ts)
+		}
+		entry.Timestamp = int64(math.Floor(seconds))
+	}
+	if level, ok := fields["level"].(json.Number); ok {
+		severity, err := level.Int64()
+		if err != nil {
+			return model.LogEntry{}, fmt.Errorf("gelf: invalid level %q", level)
+		}
+		if entry.Level, ok = model.LevelFromSyslog(int(severity)); !ok {
+			return model.LogEntry{}, fmt.Errorf("gelf: invalid level %q", level)
+		}
+	}
+
+	for name, value := range fields {
+		switch name {
+		case "full_message", "facility", "file", "line":
+		default:
+			if !strings.HasPrefix(name, "_") {
+				continue
+			}
+			name = name[1:]
+		}
+		if setGELFField(&entry, name, gelfValue(value)) {
+			continue
+		}
+		if entry.Attributes == nil {
+			entry.Attributes = make(map[string]string)
+		}
+		entry.Attributes[name] = gelfValue(value)
+	}
+	return entry, nil
+}
+
+// setGELFField sets the entry field an additional field corresponds to, and reports whether there is one and the value is valid.
+func setGELFField(entry *model.LogEntry, name, value string) bool {
+	var err error
+	switch name {
+	case "pid":
+		entry.PID, err = strconv.Atoi(value)
+	case "trace_id":
+		entry.TraceID, err = model.ParseTraceID(value)
+	case "span_id":
+		entry.SpanID, err = model.ParseSpanID(value)
+	default:
+		return false
+	}
+	return err == nil
+}
+
+// gelfValue renders a field value as a string. GELF only allows strings and numbers, numbers keep their original spelling.
+func gelfValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// inflateGELF decompresses a gzip or zlib compressed message. Uncompressed messages are passed through.
+func inflateGELF(payload []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0] == 0x78 && (uint16(payload[0])<<8|uint16(payload[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gelf: %w", err)
+	}
+	defer r.Close()
+	inflated, err := io.ReadAll(io.LimitReader(r, gelfMaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("gelf: %w", err)
+	}
+	if len(inflated) > gelfMaxMessageSize {
+		return nil, fmt.Errorf("gelf: message inflates to more than %d bytes", gelfMaxMessageSize)
+	}
+	return inflated, nil
+}
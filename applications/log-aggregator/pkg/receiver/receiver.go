@@ -2,65 +2,204 @@ package receiver
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/latency"
 	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/vecio"
 )
 
+// DrainTimeout is how long connections that are still open keep being read after the context of Receive is cancelled.
+const DrainTimeout = 2 * time.Second
+
+// Datagram sockets have no end of stream to wait for: whatever is queued in the socket buffer is read well within this.
+const datagramDrainTimeout = 100 * time.Millisecond
+
+// Receiver listens on one IPC mechanism and forwards the decoded entries.
+// Receive runs until ctx is cancelled (or a fatal error), then stops accepting, drains in-flight data for up to DrainTimeout
+// and cleans up after itself (listeners, socket and fifo files). Once it returns, it no longer sends on events,
+// so the caller can safely close the channel. Receive never closes it itself.
 type Receiver interface {
-	Receive(chan<- model.LogEntry) error
+	Receive(ctx context.Context, events chan<- model.LogEntry) error
+	Stats() *Stats
 }
 
 type UnixSocketReceiver struct {
-	Path string
+	receiverStats
+	Path   string
+	auth   *UnixAuth
+	format Format
+}
+
+// UnixAuth makes a unix socket receiver check every producer before reading from it: the peer must run as the aggregator's user
+// or one of AllowedUIDs (SO_PEERCRED), and, if Token is set, it must present the token in a handshake (see auth.ServerHandshake).
+type UnixAuth struct {
+	Token       string
+	AllowedUIDs []uint32
 }
 
 func NewUnixSocketReceiver(path string) *UnixSocketReceiver {
 	return &UnixSocketReceiver{Path: path}
 }
 
-func (u *UnixSocketReceiver) Receive(events chan<- model.LogEntry) error {
+func NewAuthenticatedUnixSocketReceiver(path string, auth UnixAuth) *UnixSocketReceiver {
+	return &UnixSocketReceiver{Path: path, auth: &auth}
+}
+
+func (u *UnixSocketReceiver) authenticate(conn net.Conn) error {
+	if _, err := auth.CheckPeer(conn.(*net.UnixConn), u.auth.AllowedUIDs); err != nil {
+		return err
+	}
+	if u.auth.Token == "" {
+		return nil
+	}
+	return auth.ServerHandshake(conn, u.auth.Token)
+}
+
+func (u *UnixSocketReceiver) Receive(ctx context.Context, events chan<- model.LogEntry) error {
+	if err := removeStaleSocket("unix", u.Path); err != nil {
+		return err
+	}
+	// The listener unlinks the socket file when it is closed.
 	ln, err := net.Listen("unix", u.Path)
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
 
-	handleConnections(ln, events)
-	return nil
+	var authenticate func(net.Conn) error
+	if u.auth != nil {
+		authenticate = u.authenticate
+	}
+	return handleConnections(ctx, ln, u.format, events, &u.stats, authenticate)
 }
 
-func handleConnections(ln net.Listener, events chan<- model.LogEntry) {
+// handleConnections reads entries in the given format from every connection accepted on ln. If authenticate is set,
+// a connection is only read from once authenticate accepted it, and closed otherwise.
+func handleConnections(ctx context.Context, ln net.Listener, format Format, events chan<- model.LogEntry, stats *Stats,
+	authenticate func(net.Conn) error) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	var wg sync.WaitGroup
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			// e.g. EMFILE: back off a little instead of spinning on the error.
+			log.Printf("accept error: %v", err)
+			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
 		go func(c net.Conn) {
-			defer c.Close()
-			scanner := bufio.NewScanner(c)
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(conns, c)
+				mu.Unlock()
+				c.Close()
+			}()
+			if authenticate != nil {
+				if err := authenticate(c); err != nil {
+					log.Printf("rejected connection from %s: %v", c.RemoteAddr(), err)
+					stats.Rejected.Add(1)
+					return
+				}
+			}
+			decode := format.decoder(stats)
+			scanner := bufio.NewScanner(countingReader{c, &stats.Reads})
+			scanner.Split(format.split())
 			for scanner.Scan() {
-				payload := scanner.Text()
-				unmarshalAndWrite(payload, events)
+				decodeAndWrite(decode, scanner.Bytes(), events, stats)
+			}
+			// Errors of the connection itself (resets, the drain deadline) are routine. Framing errors and oversized
+			// entries are not, and the stream can't be resynchronized after them: the sender has to reconnect.
+			var opErr *net.OpError
+			if err := scanner.Err(); err != nil && !errors.As(err, &opErr) {
+				log.Printf("closing connection from %s: %v", c.RemoteAddr(), err)
 			}
 		}(conn)
 	}
+
+	// No new connections from here on. The live ones get DrainTimeout to deliver what they have in flight.
+	deadline := time.Now().Add(DrainTimeout)
+	mu.Lock()
+	for c := range conns {
+		c.SetReadDeadline(deadline)
+	}
+	mu.Unlock()
+	wg.Wait()
+	return nil
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run that did not shut down cleanly.
+// A socket that still has a live listener behind it is left alone (and the subsequent bind fails, as it should).
+func removeStaleSocket(network, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	conn, err := net.Dial(network, path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// drainOnDone keeps reading from a datagram socket for a moment once ctx is cancelled, to empty its receive queue.
+func drainOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now().Add(datagramDrainTimeout)) })
+}
+
+// readErr turns the error that ended a read loop into the error returned from Receive:
+// running into the drain deadline after cancellation is the expected way for a receiver to stop.
+func readErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil && (errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed)) {
+		return nil
+	}
+	return err
 }
 
 type UnixDatagramSocketReceiver struct {
+	receiverStats
 	socketPath string
+	config     DatagramConfig
+	format     Format
 }
 
-func NewUnixDatagramSocketReceiver(socketPath string) *UnixDatagramSocketReceiver {
-	return &UnixDatagramSocketReceiver{socketPath: socketPath}
+func NewUnixDatagramSocketReceiver(socketPath string, config DatagramConfig) *UnixDatagramSocketReceiver {
+	return &UnixDatagramSocketReceiver{socketPath: socketPath, config: config}
 }
 
-func (u *UnixDatagramSocketReceiver) Receive(events chan<- model.LogEntry) error {
+func (u *UnixDatagramSocketReceiver) Receive(ctx context.Context, events chan<- model.LogEntry) error {
+	if err := removeStaleSocket("unixgram", u.socketPath); err != nil {
+		return err
+	}
 	addr, err := net.ResolveUnixAddr("unixgram", u.socketPath)
 	if err != nil {
 		return err
@@ -69,29 +208,123 @@ func (u *UnixDatagramSocketReceiver) Receive(events chan<- model.LogEntry) error
 	if err != nil {
 		return err
 	}
+	// Unlike the stream listener, a datagram socket does not unlink its file on close.
+	defer os.Remove(u.socketPath)
 	defer conn.Close()
+	defer drainOnDone(ctx, conn)()
+
+	readMsg := func(b, oob []byte) (int, int, int, error) {
+		n, oobn, flags, _, err := conn.ReadMsgUnix(b, oob)
+		return n, oobn, flags, err
+	}
+	return readErr(ctx, receiveDatagrams(conn, readMsg, u.config, u.format, events, &u.stats))
+}
+
+// DatagramConfig controls how the datagram receivers read from their socket.
+type DatagramConfig struct {
+	// BatchSize is the number of datagrams to read per recvmmsg. With 1, every datagram is read with its own recvmsg.
+	BatchSize int
+	// MaxSize is the largest datagram read in full. Larger ones are cut short by the kernel and counted as truncated.
+	MaxSize int
+	// ReadBuffer is the socket receive buffer size (SO_RCVBUF), 0 to keep the system default (net.core.rmem_default).
+	// The kernel caps it at net.core.rmem_max.
+	ReadBuffer int
+}
+
+func DefaultDatagramConfig() DatagramConfig {
+	return DatagramConfig{BatchSize: 1, MaxSize: 8192, ReadBuffer: 1 << 20}
+}
+
+func (c DatagramConfig) Validate() error {
+	if c.BatchSize < 1 || c.BatchSize > vecio.MaxBatch {
+		return fmt.Errorf("receive batch size must be between 1 and %d, got %d", vecio.MaxBatch, c.BatchSize)
+	}
+	if c.MaxSize < 1 || c.MaxSize > 65535 {
+		return fmt.Errorf("max datagram size must be between 1 and 65535, got %d", c.MaxSize)
+	}
+	if c.ReadBuffer < 0 {
+		return fmt.Errorf("read buffer size must not be negative, got %d", c.ReadBuffer)
+	}
+	return nil
+}
 
-	conn.SetReadBuffer(1 << 20) // 1MB
+// datagramConn is what both *net.UDPConn and *net.UnixConn offer.
+type datagramConn interface {
+	syscall.Conn
+	SetReadBuffer(bytes int) error
+}
 
-	buf := make([]byte, 8192)
+// receiveDatagrams reads datagrams in the given format until the first read error, one per recvmsg (readMsg) or,
+// with a BatchSize above 1, as many as are queued (up to BatchSize) per recvmmsg.
+func receiveDatagrams(conn datagramConn, readMsg func(b, oob []byte) (n, oobn, flags int, err error), config DatagramConfig,
+	format Format, events chan<- model.LogEntry, stats *Stats) error {
+	if config.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(config.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if err := enableRxqOverflow(conn); err != nil {
+		log.Printf("SO_RXQ_OVFL not available, socket drops will not be reported: %v", err)
+	}
+	decode := format.decoder(stats)
+
+	if config.BatchSize > 1 {
+		batch := vecio.NewRecvBatch(config.BatchSize, config.MaxSize, rxqOverflowOOBSize)
+		for {
+			msgs, err := batch.Recv(conn)
+			if err != nil {
+				return err
+			}
+			stats.Reads.Add(1)
+			for _, m := range msgs {
+				handleDatagram(decode, m.Data, m.OOB, m.Flags, events, stats)
+			}
+		}
+	}
+
+	buf := make([]byte, config.MaxSize)
+	oob := make([]byte, rxqOverflowOOBSize)
 	for {
-		n, _, err := conn.ReadFromUnix(buf)
+		n, oobn, flags, err := readMsg(buf, oob)
 		if err != nil {
 			return err
 		}
-		payload := string(buf[:n])
-		unmarshalAndWrite(payload, events)
+		stats.Reads.Add(1)
+		handleDatagram(decode, buf[:n], oob[:oobn], flags, events, stats)
 	}
 }
 
-func unmarshalAndWrite(payload string, events chan<- model.LogEntry) {
-	var logEntry model.LogEntry
-	if err := json.Unmarshal([]byte(payload), &logEntry); err == nil {
-		events <- logEntry
+func handleDatagram(decode decodeFunc, payload, oob []byte, flags int, events chan<- model.LogEntry, stats *Stats) {
+	stats.recordSocketDrops(oob)
+	if flags&unix.MSG_TRUNC != 0 {
+		stats.Truncated.Add(1)
+		return
 	}
+	decodeAndWrite(decode, payload, events, stats)
 }
 
+func decodeAndWrite(decode decodeFunc, payload []byte, events chan<- model.LogEntry, stats *Stats) {
+	receivedAt := latency.Now()
+	logEntry, ok, err := decode(payload)
+	if err != nil {
+		stats.Malformed.Add(1)
+		return
+	}
+	if !ok {
+		return
+	}
+	// Syslog and GELF are decoded straight into the current schema, and decodeJSON upgrades our own entries to it.
+	logEntry.Version = model.SchemaVersion
+	logEntry.ReceivedAt = receivedAt
+	stats.Received.Add(1)
+	events <- logEntry
+}
+
+// FIFOReceiver reads entries from a named pipe that any number of producers write to. Only writes of up to PIPE_BUF bytes are
+// atomic on a pipe, so lines larger than that are counted as oversized: with several producers they may have been torn apart
+// (and then usually fail to decode as well).
 type FIFOReceiver struct {
+	receiverStats
 	fifoPath string
 }
 
@@ -99,66 +332,152 @@ func NewFIFOReceiver(fifoPath string) *FIFOReceiver {
 	return &FIFOReceiver{fifoPath: fifoPath}
 }
 
-func (f *FIFOReceiver) Receive(events chan<- model.LogEntry) error {
+func (f *FIFOReceiver) Receive(ctx context.Context, events chan<- model.LogEntry) error {
 	if err := syscall.Mkfifo(f.fifoPath, 0666); err != nil && !os.IsExist(err) {
-		log.Fatal("mkfifo error:", err)
+		return fmt.Errorf("mkfifo error: %w", err)
 	}
+	defer os.Remove(f.fifoPath)
 
-	file, err := os.OpenFile(f.fifoPath, os.O_RDONLY, os.ModeNamedPipe)
+	// A blocking open for reading would wait for the first producer. The non-blocking one returns right away,
+	// and reads still wait for data on the runtime poller.
+	file, err := os.OpenFile(f.fifoPath, os.O_RDONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	// A fifo reads EOF as soon as its last writer closes it, i.e. whenever no producer happens to be connected.
+	// Holding a writer ourselves keeps it open across producer churn, and the reader simply waits for the next producer.
+	keepalive, err := os.OpenFile(f.fifoPath, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	if err != nil {
+		return err
+	}
+	defer keepalive.Close()
 
-	scanner := bufio.NewScanner(file)
+	// On cancellation we let go of the fifo: the reader gets EOF once the producers still writing have closed it too,
+	// and they get DrainTimeout to do so.
+	stop := context.AfterFunc(ctx, func() {
+		keepalive.Close()
+		file.SetReadDeadline(time.Now().Add(DrainTimeout))
+	})
+	defer stop()
+
+	reportedOversized := false
+	decode := FormatJSON.decoder(&f.stats)
+	scanner := bufio.NewScanner(countingReader{file, &f.stats.Reads})
 	for scanner.Scan() {
-		payload := scanner.Text()
-		unmarshalAndWrite(payload, events)
+		line := scanner.Bytes()
+		// +1 for the newline the scanner stripped.
+		if len(line)+1 > vecio.PipeBuf {
+			f.stats.Oversized.Add(1)
+			if !reportedOversized {
+				reportedOversized = true
+				log.Printf("fifo: received a %d byte line, writes over PIPE_BUF (%d bytes) are not atomic and may have interleaved "+
+					"with other producers' writes (further oversized lines are only counted)", len(line)+1, vecio.PipeBuf)
+			}
+		}
+		decodeAndWrite(decode, line, events, &f.stats)
 	}
 
-	return scanner.Err()
+	return readErr(ctx, scanner.Err())
 }
 
 type TCPSocketReceiver struct {
+	receiverStats
 	address string
+	format  Format
 }
 
 func NewTCPSocketReceiver(address string) *TCPSocketReceiver {
 	return &TCPSocketReceiver{address: address}
 }
 
-func (t *TCPSocketReceiver) Receive(events chan<- model.LogEntry) error {
+func (t *TCPSocketReceiver) Receive(ctx context.Context, events chan<- model.LogEntry) error {
 	ln, err := net.Listen("tcp", t.address)
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
 
-	handleConnections(ln, events)
-	return nil
+	return handleConnections(ctx, ln, t.format, events, &t.stats, nil)
+}
+
+// TLSSocketReceiver is the TCP receiver behind TLS. With a config from auth.ServerTLSConfig, only producers presenting a client
+// certificate signed by the test CA get through (mutual TLS).
+type TLSSocketReceiver struct {
+	receiverStats
+	address string
+	config  *tls.Config
+}
+
+func NewTLSSocketReceiver(address string, config *tls.Config) *TLSSocketReceiver {
+	return &TLSSocketReceiver{address: address, config: config}
+}
+
+func (t *TLSSocketReceiver) Receive(ctx context.Context, events chan<- model.LogEntry) error {
+	ln, err := tls.Listen("tcp", t.address, t.config)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	// The handshake would otherwise happen implicitly on the first read. Doing it up front lets failed handshakes
+	// (e.g. a producer without a valid certificate) be counted as rejections rather than show up as read errors.
+	handshake := func(conn net.Conn) error {
+		hctx, cancel := context.WithTimeout(ctx, auth.HandshakeTimeout)
+		defer cancel()
+		return conn.(*tls.Conn).HandshakeContext(hctx)
+	}
+	return handleConnections(ctx, ln, FormatJSON, events, &t.stats, handshake)
 }
 
 type UDPSocketReceiver struct {
+	receiverStats
 	address string
+	config  DatagramConfig
+	format  Format
 }
 
-func NewUDPSocketReceiver(address string) *UDPSocketReceiver {
-	return &UDPSocketReceiver{address: address}
+func NewUDPSocketReceiver(address string, config DatagramConfig) *UDPSocketReceiver {
+	return &UDPSocketReceiver{address: address, config: config}
 }
 
-func (u *UDPSocketReceiver) Receive(events chan<- model.LogEntry) error {
-	conn, err := net.ListenPacket("udp", u.address)
+func (u *UDPSocketReceiver) Receive(ctx context.Context, events chan<- model.LogEntry) error {
+	addr, err := net.ResolveUDPAddr("udp", u.address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	buf := make([]byte, 8192)
-	for {
-		n, _, err := conn.ReadFrom(buf)
-		if err != nil {
-			return err
-		}
-		payload := string(buf[:n])
-		unmarshalAndWrite(payload, events)
+	defer drainOnDone(ctx, conn)()
+
+	readMsg := func(b, oob []byte) (int, int, int, error) {
+		n, oobn, flags, _, err := conn.ReadMsgUDP(b, oob)
+		return n, oobn, flags, err
+	}
+	return readErr(ctx, receiveDatagrams(conn, readMsg, u.config, u.format, events, &u.stats))
+}
+
+// NewSyslogReceiver accepts RFC 5424 and RFC 3164 syslog messages on udp, tcp, unix or unixgram, the same networks
+// output.DialSyslogOutput sends on. config applies to the datagram networks, as for their JSON receivers.
+func NewSyslogReceiver(network, address string, config DatagramConfig) (Receiver, error) {
+	switch network {
+	case "udp":
+		return &UDPSocketReceiver{address: address, config: config, format: FormatSyslog}, nil
+	case "tcp":
+		return &TCPSocketReceiver{address: address, format: FormatSyslog}, nil
+	case "unix":
+		return &UnixSocketReceiver{Path: address, format: FormatSyslog}, nil
+	case "unixgram":
+		return &UnixDatagramSocketReceiver{socketPath: address, config: config, format: FormatSyslog}, nil
+	default:
+		return nil, fmt.Errorf("syslog: unsupported network %q", network)
 	}
 }
+
+// NewGELFReceiver accepts GELF messages over UDP, chunked and compressed ones included.
+func NewGELFReceiver(address string, config DatagramConfig) *UDPSocketReceiver {
+	return &UDPSocketReceiver{address: address, config: config, format: FormatGELF}
+}
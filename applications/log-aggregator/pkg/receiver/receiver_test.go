@@ -0,0 +1,309 @@
+package receiver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/auth"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/vecio"
+)
+
+func freeAddr(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.LocalAddr().String()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func encode(t *testing.T, i int) []byte {
+	t.Helper()
+	b, err := json.Marshal(model.LogEntry{Source: "test", Timestamp: int64(i), Level: model.LevelInfo, Message: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, '\n')
+}
+
+// openUntilReady retries until the receiver has come up.
+func openUntilReady(t *testing.T, open func() (io.WriteCloser, error)) io.WriteCloser {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w, err := open()
+		if err == nil {
+			return w
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("receiver did not come up: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// dialUDPWhenBound fails unless a receiver is bound to addr. Dialing UDP succeeds either way, so it sends an empty datagram
+// and waits briefly for the ECONNREFUSED the kernel reports for it when nobody is bound (the receiver counts it as malformed).
+// Probing by binding the address ourselves would race with the receiver binding it.
+func dialUDPWhenBound(addr string) (net.Conn, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.Write(nil)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		conn.Close()
+		return nil, fmt.Errorf("no receiver on %s: %v", addr, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, nil
+}
+
+func withBatch(size int) DatagramConfig {
+	config := DefaultDatagramConfig()
+	config.BatchSize = size
+	return config
+}
+
+type receiverCase struct {
+	name     string
+	receiver func() Receiver
+	open     func() (io.WriteCloser, error)
+	leftover string // file that must be gone after shutdown
+}
+
+func receiverCases(t *testing.T) []receiverCase {
+	dir := t.TempDir()
+	sockPath := filepath.Join(dir, "log.sock")
+	gramPath := filepath.Join(dir, "log.gram")
+	fifoPath := filepath.Join(dir, "log_fifo")
+	tcpAddr := freeAddr(t, "tcp")
+	udpAddr := freeAddr(t, "udp")
+	batchedUDPAddr := freeAddr(t, "udp")
+	batchedGramPath := filepath.Join(dir, "log-batched.gram")
+	dialUDP := func(addr string) func() (io.WriteCloser, error) {
+		return func() (io.WriteCloser, error) { return dialUDPWhenBound(addr) }
+	}
+
+	return []receiverCase{
+		{"unixsock", func() Receiver { return NewUnixSocketReceiver(sockPath) },
+			func() (io.WriteCloser, error) { return net.Dial("unix", sockPath) }, sockPath},
+		{"unixgram", func() Receiver { return NewUnixDatagramSocketReceiver(gramPath, withBatch(1)) },
+			func() (io.WriteCloser, error) { return net.Dial("unixgram", gramPath) }, gramPath},
+		{"unixgram-recvmmsg", func() Receiver { return NewUnixDatagramSocketReceiver(batchedGramPath, withBatch(4)) },
+			func() (io.WriteCloser, error) { return net.Dial("unixgram", batchedGramPath) }, batchedGramPath},
+		{"fifo", func() Receiver { return NewFIFOReceiver(fifoPath) },
+			func() (io.WriteCloser, error) {
+				if _, err := os.Stat(fifoPath); err != nil {
+					return nil, err
+				}
+				return os.OpenFile(fifoPath, os.O_WRONLY, os.ModeNamedPipe)
+			}, fifoPath},
+		{"tcp", func() Receiver { return NewTCPSocketReceiver(tcpAddr) },
+			func() (io.WriteCloser, error) { return net.Dial("tcp", tcpAddr) }, ""},
+		{"udp", func() Receiver { return NewUDPSocketReceiver(udpAddr, withBatch(1)) }, dialUDP(udpAddr), ""},
+		{"udp-recvmmsg", func() Receiver { return NewUDPSocketReceiver(batchedUDPAddr, withBatch(4)) }, dialUDP(batchedUDPAddr), ""},
+	}
+}
+
+func TestReceivers_CleanShutdownAndRestart(t *testing.T) {
+	for _, tc := range receiverCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			// Two rounds: the second one fails to bind if the first one left anything behind.
+			for round := 0; round < 2; round++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				events := make(chan model.LogEntry, 100)
+				r := tc.receiver()
+				errs := make(chan error, 1)
+				go func() { errs <- r.Receive(ctx, events) }()
+
+				w := openUntilReady(t, tc.open)
+				for i := 0; i < 10; i++ {
+					if _, err := w.Write(encode(t, i)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				deadline := time.Now().Add(2 * time.Second)
+				for len(events) < 10 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				// In the second round the writer stays connected while we shut down:
+				// the receiver must not wait for it beyond the drain timeout.
+				if round == 0 {
+					w.Close()
+				}
+				cancel()
+				select {
+				case err := <-errs:
+					if err != nil {
+						t.Fatalf("round %d: Receive returned %v", round, err)
+					}
+				case <-time.After(DrainTimeout + 2*time.Second):
+					t.Fatalf("round %d: Receive did not return after cancellation", round)
+				}
+				w.Close()
+
+				if len(events) != 10 || r.Stats().Received.Load() != 10 {
+					t.Fatalf("round %d: expected 10 entries, got %d (%s)", round, len(events), r.Stats())
+				}
+				// Safe once Receive has returned, which is the whole point.
+				close(events)
+
+				if tc.leftover != "" {
+					if _, err := os.Stat(tc.leftover); !os.IsNotExist(err) {
+						t.Fatalf("round %d: %s was left behind (%v)", round, tc.leftover, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFIFOReceiver_CancelWithoutWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log_fifo")
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- NewFIFOReceiver(path).Receive(ctx, make(chan model.LogEntry)) }()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Receive stayed blocked in open after cancellation")
+	}
+}
+
+func TestFIFOReceiver_SurvivesWriterChurn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log_fifo")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan model.LogEntry, 100)
+	r := NewFIFOReceiver(path)
+	errs := make(chan error, 1)
+	go func() { errs <- r.Receive(ctx, events) }()
+
+	// Producers come and go one after the other. Without a writer of its own, the receiver would read EOF after the first.
+	for i := 0; i < 3; i++ {
+		w := openUntilReady(t, func() (io.WriteCloser, error) {
+			// Non-blocking, opening fails with ENXIO until the receiver has the fifo open for reading.
+			return os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+		})
+		if _, err := w.Write(encode(t, i)); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		select {
+		case entry := <-events:
+			if entry.Timestamp != int64(i) {
+				t.Fatalf("got entry %d, want %d", entry.Timestamp, i)
+			}
+		case err := <-errs:
+			t.Fatalf("receiver returned after producer %d left: %v", i, err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for the entry of producer %d", i)
+		}
+	}
+
+	// A line over PIPE_BUF is still decoded, but flagged: it could have been torn by another producer's write.
+	w := openUntilReady(t, func() (io.WriteCloser, error) { return os.OpenFile(path, os.O_WRONLY, os.ModeNamedPipe) })
+	big, _ := json.Marshal(model.LogEntry{Message: strings.Repeat("x", vecio.PipeBuf)})
+	if _, err := w.Write(append(big, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	<-events
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Stats(); s.Received.Load() != 4 || s.Oversized.Load() != 1 {
+		t.Fatalf("unexpected stats: %s", s)
+	}
+}
+
+func TestUnixSocketReceiver_RemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	// A socket file without a listener behind it, as left by a crashed run.
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- NewUnixSocketReceiver(path).Receive(ctx, make(chan model.LogEntry)) }()
+	openUntilReady(t, func() (io.WriteCloser, error) { return net.Dial("unix", path) }).Close()
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnixSocketReceiver_Token(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	r := NewAuthenticatedUnixSocketReceiver(path, UnixAuth{Token: "secret"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan model.LogEntry, 10)
+	go r.Receive(ctx, events)
+
+	dial := func(token string) (net.Conn, error) {
+		conn := openUntilReady(t, func() (io.WriteCloser, error) { return net.Dial("unix", path) }).(net.Conn)
+		if err := auth.ClientHandshake(conn, token); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	if _, err := dial("wrong"); !errors.Is(err, auth.ErrUnauthorized) {
+		t.Fatalf("expected the wrong token to be rejected, got %v", err)
+	}
+	conn, err := dial("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(encode(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case entry := <-events:
+		if entry.Timestamp != 1 {
+			t.Fatalf("unexpected entry: %+v", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry from the authenticated producer did not arrive")
+	}
+	if r.Stats().Rejected.Load() != 1 {
+		t.Fatalf("expected 1 rejection: %s", r.Stats())
+	}
+}
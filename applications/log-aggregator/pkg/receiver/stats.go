@@ -0,0 +1,100 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+type Stats struct {
+	Received  atomic.Uint64 // payloads decoded and handed on
+	Malformed atomic.Uint64 // payloads that could not be decoded
+	Truncated atomic.Uint64 // datagrams larger than the read buffer, which the kernel cut short
+	// SocketDrops is the kernel's count of datagrams dropped because the socket receive queue was full (SO_RXQ_OVFL).
+	// It is only reported by datagram receivers, and only where the kernel supports it for the socket family.
+	SocketDrops atomic.Uint64
+	Rejected    atomic.Uint64 // connections closed because they failed authentication (token, peer credentials or TLS handshake)
+	// Oversized counts fifo lines larger than PIPE_BUF. Their writes were not atomic, so other producers' data may have torn them.
+	Oversized atomic.Uint64
+	// OlderSchema and NewerSchema count JSON entries of another schema version than model.SchemaVersion. Older ones are
+	// upgraded, newer ones decoded as far as this version understands them.
+	OlderSchema atomic.Uint64
+	NewerSchema atomic.Uint64
+	// Reads counts the read syscalls that returned data: read on streams, recvmsg or recvmmsg on datagram sockets.
+	Reads atomic.Uint64
+}
+
+// SyscallsPerMessage is the average number of read syscalls per received entry.
+func (s *Stats) SyscallsPerMessage() float64 {
+	received := s.Received.Load() + s.Malformed.Load() + s.Truncated.Load()
+	if received == 0 {
+		return 0
+	}
+	return float64(s.Reads.Load()) / float64(received)
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("received=%d malformed=%d truncated=%d socket_drops=%d rejected=%d oversized=%d older_schema=%d newer_schema=%d reads=%d syscalls_per_msg=%.3f",
+		s.Received.Load(), s.Malformed.Load(), s.Truncated.Load(), s.SocketDrops.Load(), s.Rejected.Load(), s.Oversized.Load(),
+		s.OlderSchema.Load(), s.NewerSchema.Load(), s.Reads.Load(), s.SyscallsPerMessage())
+}
+
+// countingReader counts the reads that return data. bufio.Scanner issues one per buffer fill,
+// so this is the number of read syscalls behind a stream, minus the one that hits EOF.
+type countingReader struct {
+	r     io.Reader
+	reads *atomic.Uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.reads.Add(1)
+	}
+	return n, err
+}
+
+type receiverStats struct {
+	stats Stats
+}
+
+func (r *receiverStats) Stats() *Stats {
+	return &r.stats
+}
+
+// enableRxqOverflow asks the kernel to attach the socket's cumulative drop counter to every received datagram.
+func enableRxqOverflow(conn syscall.Conn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+var rxqOverflowOOBSize = unix.CmsgSpace(4)
+
+func (s *Stats) recordSocketDrops(oob []byte) {
+	if len(oob) == 0 {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			s.SocketDrops.Store(uint64(binary.NativeEndian.Uint32(m.Data)))
+		}
+	}
+}
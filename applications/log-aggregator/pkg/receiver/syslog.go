@@ -0,0 +1,280 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+var syslogFacilities = [24]string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// A message without PRI gets the one RFC 3164 prescribes for that case: user.notice.
+const defaultSyslogPriority = 13
+
+const utf8BOM = "\xef\xbb\xbf"
+
+// parseSyslog decodes an RFC 5424 or RFC 3164 message. now fills in missing timestamps and the year RFC 3164 timestamps lack.
+// The app name (or tag) becomes the entry's source, the severity its level, and the hostname and a numeric procid (or pid)
+// go into their fields. Everything else that is present ends up in the attributes: facility, msgid, a procid that is no
+// pid, and every structured data parameter as SD-ID.NAME, except for the elements output.SyslogOutput writes the entry's
+// other fields to (see model.SyslogMetaID), which are read back into them.
+func parseSyslog(payload []byte, now time.Time) (model.LogEntry, error) {
+	msg := strings.TrimRight(string(payload), "\r\n")
+	if msg == "" {
+		return model.LogEntry{}, errors.New("syslog: empty message")
+	}
+
+	priority := defaultSyslogPriority
+	if msg[0] == '<' {
+		end := strings.IndexByte(msg, '>')
+		if end < 2 || end > 4 {
+			return model.LogEntry{}, fmt.Errorf("syslog: invalid PRI in %q", truncate(payload, 8))
+		}
+		p, err := strconv.Atoi(msg[1:end])
+		if err != nil || p < 0 || p > 191 {
+			return model.LogEntry{}, fmt.Errorf("syslog: invalid PRI %q", msg[1:end])
+		}
+		priority = p
+		msg = msg[end+1:]
+	}
+
+	level, _ := model.LevelFromSyslog(priority % 8)
+	entry := model.LogEntry{
+		Level:      level,
+		Attributes: map[string]string{"facility": syslogFacilities[priority/8]},
+	}
+	var err error
+	if rest, ok := strings.CutPrefix(msg, "1 "); ok {
+		err = parseRFC5424(rest, now, &entry)
+	} else {
+		parseRFC3164(msg, now, &entry)
+	}
+	return entry, err
+}
+
+// parseRFC5424 parses what follows "<PRI>1 ": TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG].
+func parseRFC5424(msg string, now time.Time, entry *model.LogEntry) error {
+	var header [5]string
+	for i := range header {
+		field, rest, found := strings.Cut(msg, " ")
+		if !found {
+			return fmt.Errorf("syslog: RFC 5424 header ends after %d fields", i)
+		}
+		header[i], msg = field, rest
+	}
+	timestamp, hostname, appName, procID, msgID := header[0], header[1], header[2], header[3], header[4]
+
+	entry.Timestamp = now.Unix()
+	if timestamp != "-" {
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return fmt.Errorf("syslog: invalid timestamp %q", timestamp)
+		}
+		entry.Timestamp = t.Unix()
+	}
+	if hostname != "-" {
+		entry.Hostname = hostname
+	}
+	setPID(entry, "procid", procID)
+	setAttribute(entry, "msgid", msgID)
+	entry.Source = appName
+	if appName == "-" {
+		entry.Source = entry.Hostname
+	}
+
+	rest, err := parseStructuredData(msg, entry.Attributes)
+	if err != nil {
+		return err
+	}
+	liftStructuredData(entry)
+	if rest != "" {
+		if rest[0] != ' ' {
+			return fmt.Errorf("syslog: no space between structured data and message")
+		}
+		entry.Message = strings.TrimPrefix(rest[1:], utf8BOM)
+	}
+	return nil
+}
+
+// parseStructuredData parses "-" or one or more [SD-ID NAME="VALUE" ...] elements into attrs and returns what follows them.
+func parseStructuredData(msg string, attrs map[string]string) (string, error) {
+	if rest, ok := strings.CutPrefix(msg, "-"); ok {
+		return rest, nil
+	}
+	if !strings.HasPrefix(msg, "[") {
+		return "", errors.New("syslog: missing structured data")
+	}
+	for strings.HasPrefix(msg, "[") {
+		end := strings.IndexAny(msg, " ]")
+		if end < 0 {
+			return "", errors.New("syslog: unterminated structured data")
+		}
+		id := msg[1:end]
+		msg = msg[end:]
+		for strings.HasPrefix(msg, " ") {
+			eq := strings.Index(msg, `="`)
+			if eq < 0 {
+				return "", fmt.Errorf("syslog: invalid parameter in structured data element %q", id)
+			}
+			name := msg[1:eq]
+			value, n, err := parseParamValue(msg[eq+2:])
+			if err != nil {
+				return "", fmt.Errorf("syslog: structured data element %q: %w", id, err)
+			}
+			attrs[id+"."+name] = value
+			msg = msg[eq+2+n:]
+		}
+		if !strings.HasPrefix(msg, "]") {
+			return "", fmt.Errorf("syslog: unterminated structured data element %q", id)
+		}
+		msg = msg[1:]
+	}
+	return msg, nil
+}
+
+// parseParamValue reads a parameter value up to its closing quote, resolving the \" \\ and \] escapes.
+// It returns the value and the number of bytes consumed, closing quote included.
+func parseParamValue(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']'):
+			b.WriteByte(s[i+1])
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated parameter value")
+}
+
+// parseRFC3164 parses what follows "<PRI>" in a BSD syslog message: "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG".
+// The format is a description of existing practice rather than a standard, so parsing is lenient: the hostname is often
+// left out (e.g. by the C library writing to /dev/log), and without a timestamp the whole message is taken as content.
+func parseRFC3164(msg string, now time.Time, entry *model.LogEntry) {
+	entry.Timestamp = now.Unix()
+	t, rest, ok := parseBSDTimestamp(msg, now)
+	if !ok {
+		entry.Message = msg
+		return
+	}
+	entry.Timestamp = t.Unix()
+
+	// The first word is the tag if it ends like one, the hostname otherwise.
+	if first, after, found := strings.Cut(rest, " "); found {
+		if _, _, _, isTag := cutTag(first); isTag {
+			first, after = "", rest
+		}
+		entry.Hostname = first
+		rest = after
+	}
+	tag, pid, content, found := cutTag(rest)
+	if !found {
+		entry.Source = entry.Hostname
+		entry.Message = rest
+		return
+	}
+	entry.Source = tag
+	setPID(entry, "pid", pid)
+	entry.Message = content
+}
+
+// parseBSDTimestamp parses the "Mmm dd hh:mm:ss" timestamp, in local time and in whichever year puts it closest to now
+// (a message from Dec 31 that arrives on Jan 1 is from last year). Some senders use RFC 3339 timestamps instead, which are
+// accepted too.
+func parseBSDTimestamp(msg string, now time.Time) (time.Time, string, bool) {
+	if field, rest, found := strings.Cut(msg, " "); found {
+		if t, err := time.Parse(time.RFC3339Nano, field); err == nil {
+			return t, rest, true
+		}
+	}
+	const layout = "Jan _2 15:04:05"
+	if len(msg) < len(layout)+1 || msg[len(layout)] != ' ' {
+		return time.Time{}, "", false
+	}
+	t, err := time.ParseInLocation(layout, msg[:len(layout)], now.Location())
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, msg[len(layout)+1:], true
+}
+
+// cutTag splits "TAG[PID]: CONTENT" or "TAG: CONTENT". found is false if msg does not start with a tag.
+func cutTag(msg string) (tag, pid, content string, found bool) {
+	end := strings.IndexAny(msg, " :[")
+	if end <= 0 {
+		return "", "", "", false
+	}
+	tag, rest := msg[:end], msg[end:]
+	if rest[0] == '[' {
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			return "", "", "", false
+		}
+		pid, rest = rest[1:end], rest[end+1:]
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return "", "", "", false
+	}
+	return tag, pid, strings.TrimPrefix(rest[1:], " "), true
+}
+
+// setPID sets the entry's pid from a procid, or records the procid as an attribute if it is something else: RFC 5424 allows
+// any value that identifies the process, like a thread or a job name.
+func setPID(entry *model.LogEntry, name, value string) {
+	if pid, err := strconv.Atoi(value); err == nil && pid > 0 {
+		entry.PID = pid
+		return
+	}
+	setAttribute(entry, name, value)
+}
+
+// liftStructuredData moves the parameters of the model.SyslogMetaID element into the fields they came from, and those of
+// model.SyslogAttributesID back into plain attributes. Values that don't parse stay where they are.
+func liftStructuredData(entry *model.LogEntry) {
+	for name, value := range entry.Attributes {
+		id, param, _ := strings.Cut(name, ".")
+		switch id {
+		case model.SyslogAttributesID:
+			entry.Attributes[param] = value
+		case model.SyslogMetaID:
+			var err error
+			switch param {
+			case "goroutine":
+				entry.Goroutine, err = strconv.ParseUint(value, 10, 64)
+			case "trace_id":
+				entry.TraceID, err = model.ParseTraceID(value)
+			case "span_id":
+				entry.SpanID, err = model.ParseSpanID(value)
+			default:
+				continue
+			}
+			if err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		delete(entry.Attributes, name)
+	}
+}
+
+// setAttribute records a header field, unless it is empty or syslog's NILVALUE.
+func setAttribute(entry *model.LogEntry, name, value string) {
+	if value != "" && value != "-" {
+		entry.Attributes[name] = value
+	}
+}
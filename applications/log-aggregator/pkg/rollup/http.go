@@ -0,0 +1,65 @@
+package rollup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+const defaultTop = 10
+
+// Handler serves Query results as JSON. Supported query parameters: from and to, source, level and top (default 10).
+// Times are given as RFC 3339, unix seconds, or a duration relative to now, e.g. from=5m for the last five minutes.
+func (r *Rollup) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		now := time.Now()
+		from, err := parseTime(query.Get("from"), now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTime(query.Get("to"), now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+		top := defaultTop
+		if t := query.Get("top"); t != "" {
+			n, err := strconv.Atoi(t)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid top", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		level, ok := model.ParseLevel(query.Get("level"))
+		if !ok {
+			http.Error(w, "invalid level", http.StatusBadRequest)
+			return
+		}
+
+		result := r.Query(Filter{From: from, To: to, Source: query.Get("source"), Level: level}, top)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if d, err := time.ParseDuration(strings.TrimPrefix(s, "-")); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
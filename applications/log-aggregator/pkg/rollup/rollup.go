@@ -0,0 +1,234 @@
+package rollup
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+const (
+	DefaultBucketWidth = 10 * time.Second
+	DefaultRetention   = time.Hour
+	// DefaultMaxMessages bounds the distinct messages counted per bucket. With random payloads every message is distinct,
+	// and counting them all would make the rollup as big as the logs themselves.
+	DefaultMaxMessages = 1000
+	// maxMessageKeyLen is where messages are cut off before they are counted.
+	maxMessageKeyLen = 120
+)
+
+type Config struct {
+	BucketWidth time.Duration
+	Retention   time.Duration // buckets older than this (relative to the newest one) are discarded
+	MaxMessages int
+}
+
+func DefaultConfig() Config {
+	return Config{BucketWidth: DefaultBucketWidth, Retention: DefaultRetention, MaxMessages: DefaultMaxMessages}
+}
+
+func (c Config) Validate() error {
+	if c.BucketWidth < time.Second || c.BucketWidth%time.Second != 0 {
+		return fmt.Errorf("bucket width must be a whole number of seconds, got %v", c.BucketWidth)
+	}
+	if c.Retention < c.BucketWidth {
+		return fmt.Errorf("retention (%v) must be at least one bucket (%v)", c.Retention, c.BucketWidth)
+	}
+	if c.MaxMessages < 0 {
+		return fmt.Errorf("max messages must not be negative, got %d", c.MaxMessages)
+	}
+	return nil
+}
+
+type seriesKey struct {
+	Source string
+	Level  model.Level
+}
+
+type bucket struct {
+	counts    map[seriesKey]uint64
+	messages  map[string]uint64
+	untracked uint64 // entries whose message did not fit into messages anymore
+}
+
+// Rollup keeps counts per source and level in fixed-width time buckets, as well as the most frequent messages.
+// It is an output, so it sits behind the aggregator like any other sink and sees every entry once.
+// Entries are bucketed by their own timestamp, which producers set in whole seconds.
+type Rollup struct {
+	config Config
+	width  int64 // in seconds
+
+	mu      sync.RWMutex
+	buckets map[int64]*bucket // by bucket start, in unix seconds
+	newest  int64
+	late    uint64 // entries older than the retention window when they arrived
+}
+
+func New(config Config) *Rollup {
+	return &Rollup{config: config, width: int64(config.BucketWidth / time.Second), buckets: make(map[int64]*bucket)}
+}
+
+func (r *Rollup) Write(events <-chan model.LogEntry) error {
+	for event := range events {
+		r.Add(event)
+	}
+	return nil
+}
+
+func (r *Rollup) Add(entry model.LogEntry) {
+	ts := entry.Timestamp
+	if ts == 0 {
+		ts = time.Now().Unix()
+	}
+	start := ts - mod(ts, r.width)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if start > r.newest {
+		r.newest = start
+		r.prune()
+	}
+	if start <= r.newest-r.retentionSeconds() {
+		r.late++
+		return
+	}
+	b, ok := r.buckets[start]
+	if !ok {
+		b = &bucket{counts: make(map[seriesKey]uint64), messages: make(map[string]uint64)}
+		r.buckets[start] = b
+	}
+	b.counts[seriesKey{entry.Source, entry.Level}]++
+
+	msg := entry.Message
+	if len(msg) > maxMessageKeyLen {
+		msg = msg[:maxMessageKeyLen]
+	}
+	if _, tracked := b.messages[msg]; tracked || len(b.messages) < r.config.MaxMessages {
+		b.messages[msg]++
+	} else {
+		b.untracked++
+	}
+}
+
+func (r *Rollup) retentionSeconds() int64 {
+	return int64(r.config.Retention / time.Second)
+}
+
+func (r *Rollup) prune() {
+	for start := range r.buckets {
+		if start <= r.newest-r.retentionSeconds() {
+			delete(r.buckets, start)
+		}
+	}
+}
+
+// mod is the remainder with the sign of the divisor, so that timestamps before the epoch are bucketed downwards too.
+func mod(a, b int64) int64 {
+	return ((a % b) + b) % b
+}
+
+// Filter narrows a Query down. Zero values match everything; From is inclusive and To exclusive.
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Source string
+	Level  model.Level
+}
+
+type Count struct {
+	Source string      `json:"source"`
+	Level  model.Level `json:"level"`
+	Count  uint64      `json:"count"`
+}
+
+type Bucket struct {
+	Start  time.Time `json:"start"`
+	Total  uint64    `json:"total"`
+	Counts []Count   `json:"counts"`
+}
+
+type MessageCount struct {
+	Message string `json:"message"`
+	Count   uint64 `json:"count"`
+}
+
+type Result struct {
+	BucketWidth string   `json:"bucket_width"`
+	Buckets     []Bucket `json:"buckets"`
+	Total       uint64   `json:"total"`
+	Errors      uint64   `json:"errors"`
+	// ErrorRate is the fraction of matching entries at an error level (see model.Level.IsError).
+	ErrorRate   float64        `json:"error_rate"`
+	TopMessages []MessageCount `json:"top_messages"`
+	// Untracked counts matching entries whose message was not counted, because their bucket already tracked MaxMessages messages.
+	// Only available when not filtering by source or level, messages are not counted per series.
+	Untracked uint64 `json:"untracked_messages"`
+	Late      uint64 `json:"late"` // entries ignored so far because they arrived after their bucket was discarded
+}
+
+// Query returns the buckets that start within the filter's time range, oldest first, together with totals and the top
+// messages over the whole range. Buckets are the unit of time filtering: a range is widened to the buckets it touches.
+func (r *Rollup) Query(filter Filter, top int) Result {
+	from, to := int64(-1<<63), int64(1<<63-1)
+	if !filter.From.IsZero() {
+		from = filter.From.Unix() - mod(filter.From.Unix(), r.width)
+	}
+	if !filter.To.IsZero() {
+		to = filter.To.Unix()
+	}
+	bySeries := filter.Source != "" || filter.Level != model.LevelUnset
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := Result{BucketWidth: r.config.BucketWidth.String(), Buckets: []Bucket{}, TopMessages: []MessageCount{}, Late: r.late}
+	messages := make(map[string]uint64)
+	for start, b := range r.buckets {
+		if start < from || start >= to {
+			continue
+		}
+		out := Bucket{Start: time.Unix(start, 0).UTC(), Counts: []Count{}}
+		for key, n := range b.counts {
+			if (filter.Source != "" && key.Source != filter.Source) || (filter.Level != model.LevelUnset && key.Level != filter.Level) {
+				continue
+			}
+			out.Counts = append(out.Counts, Count{Source: key.Source, Level: key.Level, Count: n})
+			out.Total += n
+			if key.Level.IsError() {
+				result.Errors += n
+			}
+		}
+		if out.Total == 0 {
+			continue
+		}
+		slices.SortFunc(out.Counts, func(a, b Count) int {
+			return cmp.Or(cmp.Compare(a.Source, b.Source), cmp.Compare(a.Level, b.Level))
+		})
+		result.Buckets = append(result.Buckets, out)
+		result.Total += out.Total
+		if !bySeries {
+			for msg, n := range b.messages {
+				messages[msg] += n
+			}
+			result.Untracked += b.untracked
+		}
+	}
+	slices.SortFunc(result.Buckets, func(a, b Bucket) int { return a.Start.Compare(b.Start) })
+	if result.Total > 0 {
+		result.ErrorRate = float64(result.Errors) / float64(result.Total)
+	}
+
+	for msg, n := range messages {
+		result.TopMessages = append(result.TopMessages, MessageCount{Message: msg, Count: n})
+	}
+	slices.SortFunc(result.TopMessages, func(a, b MessageCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Message, b.Message))
+	})
+	if len(result.TopMessages) > top {
+		result.TopMessages = result.TopMessages[:top]
+	}
+	return result
+}
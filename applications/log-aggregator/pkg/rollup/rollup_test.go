@@ -0,0 +1,88 @@
+package rollup
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/log-aggregator/pkg/model"
+)
+
+func testRollup(t *testing.T) *Rollup {
+	t.Helper()
+	r := New(Config{BucketWidth: 10 * time.Second, Retention: time.Minute, MaxMessages: 2})
+	for _, e := range []model.LogEntry{
+		{Source: "a", Timestamp: 1000, Level: model.LevelInfo, Message: "started"},
+		{Source: "a", Timestamp: 1005, Level: model.LevelError, Message: "failed"},
+		{Source: "b", Timestamp: 1009, Level: model.LevelInfo, Message: "started"},
+		{Source: "a", Timestamp: 1010, Level: model.LevelInfo, Message: "started"},
+		{Source: "b", Timestamp: 1012, Level: model.LevelError, Message: "failed"},
+		{Source: "b", Timestamp: 1013, Level: model.LevelInfo, Message: "third distinct message"},
+	} {
+		r.Add(e)
+	}
+	return r
+}
+
+func TestRollup_Query(t *testing.T) {
+	res := testRollup(t).Query(Filter{}, 10)
+	if len(res.Buckets) != 2 || res.Buckets[0].Start.Unix() != 1000 || res.Buckets[1].Start.Unix() != 1010 {
+		t.Fatalf("unexpected buckets: %+v", res.Buckets)
+	}
+	if res.Buckets[0].Total != 3 || len(res.Buckets[0].Counts) != 3 {
+		t.Fatalf("unexpected first bucket: %+v", res.Buckets[0])
+	}
+	if res.Total != 6 || res.Errors != 2 || res.ErrorRate != 2.0/6 {
+		t.Fatalf("unexpected totals: total=%d errors=%d rate=%v", res.Total, res.Errors, res.ErrorRate)
+	}
+	// The second bucket only tracks two distinct messages.
+	if res.Untracked != 1 || res.TopMessages[0] != (MessageCount{"started", 3}) || res.TopMessages[1] != (MessageCount{"failed", 2}) {
+		t.Fatalf("unexpected messages: %+v untracked=%d", res.TopMessages, res.Untracked)
+	}
+}
+
+func TestRollup_QueryFilters(t *testing.T) {
+	r := testRollup(t)
+	res := r.Query(Filter{From: time.Unix(1012, 0), To: time.Unix(1020, 0), Source: "b"}, 10)
+	if res.Total != 2 || len(res.Buckets) != 1 || res.ErrorRate != 0.5 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	res = r.Query(Filter{Level: model.LevelError}, 10)
+	if res.Total != 2 || res.Errors != 2 {
+		t.Fatalf("unexpected result for level filter: %+v", res)
+	}
+	if res = r.Query(Filter{To: time.Unix(1000, 0)}, 10); res.Total != 0 || len(res.Buckets) != 0 {
+		t.Fatalf("expected an empty result, got %+v", res)
+	}
+}
+
+func TestRollup_Retention(t *testing.T) {
+	r := testRollup(t)
+	r.Add(model.LogEntry{Source: "a", Timestamp: 1065, Level: model.LevelInfo})
+	// The newest bucket starts at 1060, so with a minute of retention the one at 1000 is gone.
+	r.Add(model.LogEntry{Source: "a", Timestamp: 1001, Level: model.LevelInfo})
+	res := r.Query(Filter{}, 10)
+	if res.Total != 4 || res.Late != 1 || res.Buckets[0].Start.Unix() != 1010 {
+		t.Fatalf("unexpected result: total=%d late=%d buckets=%+v", res.Total, res.Late, res.Buckets)
+	}
+}
+
+func TestRollup_Handler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	testRollup(t).Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats?from=1000&to=1970-01-01T00:16:50Z&top=1", nil))
+	var res Result
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 3 || len(res.TopMessages) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	rec = httptest.NewRecorder()
+	testRollup(t).Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats?from=yesterday", nil))
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "invalid from") {
+		t.Fatalf("expected a bad request, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,220 @@
+// Package vecio issues the vectored and multi-message socket syscalls the standard library does not expose:
+// writev on any file descriptor, and sendmmsg and recvmmsg on datagram sockets. All of them go through syscall.RawConn,
+// so they integrate with the runtime poller (and with deadlines) like regular reads and writes do.
+package vecio
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// MaxBatch is the kernel's limit on iovecs per writev and messages per sendmmsg/recvmmsg (UIO_MAXIOV).
+// Larger batches are split up.
+const MaxBatch = 1024
+
+// PipeBuf is PIPE_BUF on Linux: a write (or writev) of at most this many bytes to a pipe or fifo is atomic, it never
+// interleaves with the writes of other writers. Larger writes can be split up, with other writers' data ending up in between.
+const PipeBuf = 4096
+
+// mmsghdr mirrors struct mmsghdr. Go pads it to the alignment of Msghdr, just like C does.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+func retryEINTR(trap, fd, a1, a2, a3 uintptr) (uintptr, syscall.Errno) {
+	for {
+		r, _, errno := unix.Syscall6(trap, fd, a1, a2, a3, 0, 0)
+		if errno != unix.EINTR {
+			return r, errno
+		}
+	}
+}
+
+func iovec(b []byte) unix.Iovec {
+	iov := unix.Iovec{}
+	if len(b) > 0 {
+		iov.Base = &b[0]
+		iov.SetLen(len(b))
+	}
+	return iov
+}
+
+// Writev writes all of bufs to the stream behind conn, continuing after partial writes.
+// It returns the number of bytes written, also when it fails, and the number of writev syscalls that actually transferred data.
+func Writev(conn syscall.Conn, bufs [][]byte) (written, syscalls int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	iovs := make([]unix.Iovec, 0, min(len(bufs), MaxBatch))
+	for len(bufs) > 0 {
+		iovs = iovs[:0]
+		for _, b := range bufs[:min(len(bufs), MaxBatch)] {
+			iovs = append(iovs, iovec(b))
+		}
+		var n int
+		var opErr error
+		err = raw.Write(func(fd uintptr) bool {
+			r, errno := retryEINTR(unix.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)), 0)
+			if errno == unix.EAGAIN {
+				return false // wait for the poller to report the fd writable
+			}
+			if errno != 0 {
+				opErr = errno
+			}
+			n = int(r)
+			return true
+		})
+		if err != nil {
+			return written, syscalls, err
+		}
+		if opErr != nil {
+			return written, syscalls, opErr
+		}
+		syscalls++
+		written += n
+		bufs = consume(bufs, n)
+	}
+	return written, syscalls, nil
+}
+
+// consume drops the first n written bytes from bufs.
+func consume(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if len(bufs) > 0 && n > 0 {
+		// A partial write in the middle of a buffer: copy the slice header, the caller's buffers stay untouched.
+		bufs = append([][]byte{bufs[0][n:]}, bufs[1:]...)
+	}
+	return bufs
+}
+
+// Sendmmsg sends every buffer as its own datagram on a connected socket. It returns the number of datagrams sent, also when
+// it fails, and the number of sendmmsg syscalls issued.
+func Sendmmsg(conn syscall.Conn, bufs [][]byte) (sent, syscalls int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := min(len(bufs), MaxBatch)
+	iovs := make([]unix.Iovec, n)
+	msgs := make([]mmsghdr, n)
+	for len(bufs) > 0 {
+		batch := bufs[:min(len(bufs), MaxBatch)]
+		for i, b := range batch {
+			iovs[i] = iovec(b)
+			msgs[i] = mmsghdr{}
+			msgs[i].hdr.Iov = &iovs[i]
+			msgs[i].hdr.SetIovlen(1)
+		}
+		var n int
+		var opErr error
+		err = raw.Write(func(fd uintptr) bool {
+			r, errno := retryEINTR(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(batch)), 0)
+			if errno == unix.EAGAIN {
+				return false
+			}
+			if errno != 0 {
+				opErr = errno
+			}
+			n = int(r)
+			return true
+		})
+		if err != nil {
+			return sent, syscalls, err
+		}
+		if opErr != nil {
+			return sent, syscalls, opErr
+		}
+		syscalls++
+		// sendmmsg stops early when the socket buffer fills up: send the rest with another call.
+		sent += n
+		bufs = bufs[n:]
+	}
+	return sent, syscalls, nil
+}
+
+// Message is one datagram received by RecvBatch.
+type Message struct {
+	Data  []byte
+	OOB   []byte
+	Flags int
+}
+
+// RecvBatch reads up to its size in datagrams with a single recvmmsg. Buffers are reused between calls, so the messages
+// it returns are only valid until the next call.
+type RecvBatch struct {
+	bufs [][]byte
+	oobs [][]byte
+	iovs []unix.Iovec
+	msgs []mmsghdr
+	out  []Message
+}
+
+func NewRecvBatch(size, bufSize, oobSize int) *RecvBatch {
+	size = min(size, MaxBatch)
+	b := &RecvBatch{
+		bufs: make([][]byte, size),
+		oobs: make([][]byte, size),
+		iovs: make([]unix.Iovec, size),
+		msgs: make([]mmsghdr, size),
+		out:  make([]Message, size),
+	}
+	for i := range size {
+		b.bufs[i] = make([]byte, bufSize)
+		b.iovs[i] = iovec(b.bufs[i])
+		b.msgs[i].hdr.Iov = &b.iovs[i]
+		b.msgs[i].hdr.SetIovlen(1)
+		if oobSize > 0 {
+			b.oobs[i] = make([]byte, oobSize)
+		}
+	}
+	return b
+}
+
+// Recv blocks until at least one datagram is available (or the read deadline passes) and returns all that are queued,
+// up to the batch size.
+func (b *RecvBatch) Recv(conn syscall.Conn) ([]Message, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	// The kernel overwrites the control length and flags of every message it fills in.
+	for i := range b.msgs {
+		b.msgs[i].len = 0
+		b.msgs[i].hdr.Flags = 0
+		if len(b.oobs[i]) > 0 {
+			b.msgs[i].hdr.Control = &b.oobs[i][0]
+			b.msgs[i].hdr.SetControllen(len(b.oobs[i]))
+		}
+	}
+	var n int
+	var opErr error
+	err = raw.Read(func(fd uintptr) bool {
+		r, errno := retryEINTR(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&b.msgs[0])), uintptr(len(b.msgs)), 0)
+		if errno == unix.EAGAIN {
+			return false
+		}
+		if errno != 0 {
+			opErr = errno
+		}
+		n = int(r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opErr != nil {
+		return nil, opErr
+	}
+	for i := range n {
+		h := b.msgs[i].hdr
+		b.out[i] = Message{Data: b.bufs[i][:b.msgs[i].len], OOB: b.oobs[i][:h.Controllen], Flags: int(h.Flags)}
+	}
+	return b.out[:n], nil
+}
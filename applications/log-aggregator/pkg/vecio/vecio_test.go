@@ -0,0 +1,129 @@
+package vecio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func lines(n int) [][]byte {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = []byte(fmt.Sprintf("line %d\n", i))
+	}
+	return bufs
+}
+
+func TestConsume(t *testing.T) {
+	bufs := [][]byte{[]byte("abc"), []byte("de"), []byte("f")}
+	if got := consume(bufs, 4); len(got) != 2 || string(got[0]) != "e" || string(got[1]) != "f" {
+		t.Fatalf("unexpected remainder: %q", got)
+	}
+	if got := consume(bufs, 6); len(got) != 0 {
+		t.Fatalf("expected everything consumed, got %q", got)
+	}
+	if string(bufs[1]) != "de" {
+		t.Fatal("consume modified the caller's buffers")
+	}
+}
+
+func TestWritev(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := io.ReadAll(c)
+		received <- b
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More than MaxBatch buffers take more than one writev.
+	bufs := lines(MaxBatch + 10)
+	written, syscalls, err := Writev(conn.(*net.TCPConn), bufs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if want := len(bytes.Join(bufs, nil)); written != want {
+		t.Fatalf("expected %d bytes written, got %d", want, written)
+	}
+	if syscalls < 2 {
+		t.Fatalf("expected at least 2 writev calls for %d buffers, got %d", len(bufs), syscalls)
+	}
+	if got := <-received; !bytes.Equal(got, bytes.Join(bufs, nil)) {
+		t.Fatalf("stream differs from the buffers written (%d bytes)", len(got))
+	}
+}
+
+func TestSendmmsgRecvmmsg(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	bufs := lines(20)
+	sent, syscalls, err := Sendmmsg(client, bufs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != len(bufs) {
+		t.Fatalf("expected %d datagrams sent, got %d", len(bufs), sent)
+	}
+	if syscalls != 1 {
+		t.Fatalf("expected a single sendmmsg, got %d", syscalls)
+	}
+
+	batch := NewRecvBatch(8, 64, 0)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	var got [][]byte
+	calls := 0
+	for len(got) < len(bufs) {
+		msgs, err := batch.Recv(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		for _, m := range msgs {
+			got = append(got, bytes.Clone(m.Data))
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 recvmmsg calls for 20 datagrams in batches of 8, got %d", calls)
+	}
+	for i := range bufs {
+		if !bytes.Equal(got[i], bufs[i]) {
+			t.Fatalf("datagram %d: got %q, want %q", i, got[i], bufs[i])
+		}
+	}
+}
+
+func TestRecvBatch_Deadline(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := NewRecvBatch(4, 64, 0).Recv(server); err == nil {
+		t.Fatal("expected the read deadline to end Recv")
+	}
+}
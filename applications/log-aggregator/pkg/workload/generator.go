@@ -0,0 +1,115 @@
+package workload
+
+import (
+	"math/rand"
+	"time"
+)
+
+type Generator struct {
+	config  Config
+	rng     *rand.Rand
+	payload payloadSource
+}
+
+func NewGenerator(config Config) *Generator {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &Generator{
+		config:  config,
+		rng:     rng,
+		payload: newPayloadSource(config.Payload, config.Sizes.Max(), rng),
+	}
+}
+
+// Run calls emit once per generated message until the configured duration or count is reached.
+// Messages are paced against absolute deadlines rather than a time.Ticker, so that high rates are not capped by timer granularity
+// and a slow emit (e.g. a full channel) is caught up on afterwards instead of silently lowering the rate.
+// With Rate == 0 there is no pacing at all and emit is called in a tight loop.
+func (g *Generator) Run(emit func(message string)) int {
+	start := time.Now()
+	var deadline time.Time
+	if g.config.Duration > 0 {
+		deadline = start.Add(g.config.Duration)
+	}
+
+	var interval time.Duration
+	if g.config.Rate > 0 {
+		interval = time.Second * time.Duration(g.config.Burst) / time.Duration(g.config.Rate)
+	}
+
+	sent := 0
+	for tick := 0; ; tick++ {
+		if interval > 0 {
+			next := start.Add(time.Duration(tick) * interval)
+			if !deadline.IsZero() && next.After(deadline) {
+				return sent
+			}
+			if wait := time.Until(next); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		for i := 0; i < g.config.Burst; i++ {
+			if g.done(sent, deadline) {
+				return sent
+			}
+			emit(g.payload.next(g.config.Sizes.Next(g.rng)))
+			sent++
+		}
+	}
+}
+
+func (g *Generator) done(sent int, deadline time.Time) bool {
+	if g.config.Count > 0 && sent >= g.config.Count {
+		return true
+	}
+	// Checking the clock on every message is cheap enough (vDSO) even in unthrottled mode.
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+type payloadSource interface {
+	next(size int) string
+}
+
+func newPayloadSource(kind PayloadKind, maxSize int, rng *rand.Rand) payloadSource {
+	if kind == RandomPayload {
+		return newRandomPayload(maxSize, rng)
+	}
+	return fixedPayload(MessageOfSize(maxSize))
+}
+
+// fixedPayload slices prefixes of one pre-built message, so no allocation happens per message.
+type fixedPayload string
+
+func (f fixedPayload) next(size int) string {
+	return string(f)[:size]
+}
+
+// randomPayload picks random windows out of a pre-generated random buffer.
+// Generating fresh random bytes for every message would make the producer CPU-bound on the RNG rather than on the transport.
+type randomPayload struct {
+	buf string
+	rng *rand.Rand
+}
+
+const randomPayloadAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 "
+
+func newRandomPayload(maxSize int, rng *rand.Rand) *randomPayload {
+	buf := make([]byte, 4*maxSize)
+	for i := range buf {
+		buf[i] = randomPayloadAlphabet[rng.Intn(len(randomPayloadAlphabet))]
+	}
+	return &randomPayload{buf: string(buf), rng: rng}
+}
+
+func (r *randomPayload) next(size int) string {
+	offset := r.rng.Intn(len(r.buf) - size + 1)
+	return r.buf[offset : offset+size]
+}
+
+func MessageOfSize(size int) string {
+	buf := make([]byte, size)
+	for i := 0; i < size; i++ {
+		buf[i] = 'A' + byte(i%26)
+	}
+	return string(buf)
+}
@@ -0,0 +1,161 @@
+package workload
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultRate = 10
+const DefaultDuration = 5 * time.Second
+const DefaultMessageSize = 100
+
+type PayloadKind string
+
+const (
+	FixedPayload  PayloadKind = "fixed"
+	RandomPayload PayloadKind = "random"
+)
+
+type Config struct {
+	Rate     int           // messages per second, 0 means unthrottled
+	Burst    int           // messages sent back-to-back on every tick, e.g. 1
+	Duration time.Duration // 0 means no time limit
+	Count    int           // 0 means no limit on the number of messages
+	Sizes    SizeDistribution
+	Payload  PayloadKind
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Rate:     DefaultRate,
+		Burst:    1,
+		Duration: DefaultDuration,
+		Sizes:    FixedSize(DefaultMessageSize),
+		Payload:  FixedPayload,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("rate must not be negative: %d", c.Rate)
+	}
+	if c.Burst <= 0 {
+		return fmt.Errorf("burst must be positive: %d", c.Burst)
+	}
+	if c.Duration < 0 {
+		return fmt.Errorf("duration must not be negative: %s", c.Duration)
+	}
+	if c.Count < 0 {
+		return fmt.Errorf("count must not be negative: %d", c.Count)
+	}
+	if c.Sizes == nil {
+		return fmt.Errorf("no message size distribution configured")
+	}
+	if c.Payload != FixedPayload && c.Payload != RandomPayload {
+		return fmt.Errorf("unknown payload kind: %q", c.Payload)
+	}
+	return nil
+}
+
+// SizeDistribution decides the size of every generated message. Max is used to size the payload buffers up front.
+type SizeDistribution interface {
+	Next(rng *rand.Rand) int
+	Max() int
+}
+
+type FixedSize int
+
+func (f FixedSize) Next(*rand.Rand) int { return int(f) }
+func (f FixedSize) Max() int            { return int(f) }
+
+type UniformSize struct {
+	Lower int
+	Upper int
+}
+
+func (u UniformSize) Next(rng *rand.Rand) int { return u.Lower + rng.Intn(u.Upper-u.Lower+1) }
+func (u UniformSize) Max() int                { return u.Upper }
+
+// ExponentialSize produces mostly small messages with a long tail, capped at Cap so a single outlier cannot exceed datagram limits.
+type ExponentialSize struct {
+	Mean int
+	Cap  int
+}
+
+func (e ExponentialSize) Next(rng *rand.Rand) int {
+	size := int(rng.ExpFloat64()*float64(e.Mean)) + 1
+	if size > e.Cap {
+		return e.Cap
+	}
+	return size
+}
+
+func (e ExponentialSize) Max() int { return e.Cap }
+
+// ParseSizeDistribution accepts "N" or "fixed:N", "uniform:MIN-MAX" and "exp:MEAN[-CAP]".
+func ParseSizeDistribution(spec string) (SizeDistribution, error) {
+	kind, args, found := strings.Cut(spec, ":")
+	if !found {
+		kind, args = "fixed", spec
+	}
+
+	switch kind {
+	case "fixed":
+		size, err := parsePositive(args)
+		if err != nil {
+			return nil, err
+		}
+		return FixedSize(size), nil
+	case "uniform":
+		lo, hi, err := parseRange(args)
+		if err != nil {
+			return nil, err
+		}
+		return UniformSize{Lower: lo, Upper: hi}, nil
+	case "exp":
+		meanArg, capArg, hasCap := strings.Cut(args, "-")
+		mean, err := parsePositive(meanArg)
+		if err != nil {
+			return nil, err
+		}
+		limit := 8 * mean
+		if hasCap {
+			if limit, err = parsePositive(capArg); err != nil {
+				return nil, err
+			}
+		}
+		return ExponentialSize{Mean: mean, Cap: limit}, nil
+	default:
+		return nil, fmt.Errorf("unknown size distribution: %q", kind)
+	}
+}
+
+func parseRange(s string) (int, int, error) {
+	loArg, hiArg, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("expected MIN-MAX, got %q", s)
+	}
+	lo, err := parsePositive(loArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi, err := parsePositive(hiArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("invalid range %d-%d", lo, hi)
+	}
+	return lo, hi, nil
+}
+
+func parsePositive(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n, nil
+}
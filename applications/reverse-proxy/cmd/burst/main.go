@@ -0,0 +1,105 @@
+// Connection-holding client and burst-wake controller, after the one of the netpoller lab
+// (labs/0102-go-netpoller-epoll). Opens -conns connections through the proxy to an echo backend and holds them idle
+// until told, via the /burst HTTP endpoint, to write one byte to every one of them at once and time how long it takes
+// to come back. That wakes every connection in the proxy at the same moment, which is where the engines differ.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address of the proxy [default: localhost:8080]")
+	numConns := flag.Int("conns", 2000, "connections to hold [default: 2000]")
+	httpAddr := flag.String("http", ":8090", "address of the burst controller [default: :8090]")
+	flag.Parse()
+
+	var mu sync.Mutex
+	conns := make([]net.Conn, 0, *numConns)
+
+	// Dial in small batches rather than all at once, so as not to overflow the accept backlog.
+	const batchSize = 200
+	for start := 0; start < *numConns; start += batchSize {
+		var wg sync.WaitGroup
+		for range min(batchSize, *numConns-start) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", *addr)
+				if err != nil {
+					log.Printf("dial error: %v", err)
+					return
+				}
+				mu.Lock()
+				conns = append(conns, conn)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+	}
+	log.Printf("holding %d connections to %s", len(conns), *addr)
+
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n := len(conns)
+		mu.Unlock()
+		w.Write([]byte(strconv.Itoa(n) + "\n"))
+	})
+
+	http.HandleFunc("POST /burst", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		snapshot := slices.Clone(conns)
+		mu.Unlock()
+
+		latencies := make([]time.Duration, 0, len(snapshot))
+		var latMu sync.Mutex
+		var wg sync.WaitGroup
+		start := time.Now()
+		for _, c := range snapshot {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t0 := time.Now()
+				buf := []byte{1}
+				if _, err := c.Write(buf); err != nil {
+					return
+				}
+				if _, err := c.Read(buf); err != nil {
+					return
+				}
+				latMu.Lock()
+				latencies = append(latencies, time.Since(t0))
+				latMu.Unlock()
+			}()
+		}
+		wg.Wait()
+		total := time.Since(start)
+
+		slices.Sort(latencies)
+		pct := func(p float64) time.Duration {
+			if len(latencies) == 0 {
+				return 0
+			}
+			return latencies[int(float64(len(latencies)-1)*p)]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"conns": strconv.Itoa(len(latencies)),
+			"total": total.String(),
+			"p50":   pct(0.50).String(),
+			"p99":   pct(0.99).String(),
+			"max":   pct(1).String(),
+		})
+	})
+
+	log.Printf("burst controller listening on %s", *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+}
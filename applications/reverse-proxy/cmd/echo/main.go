@@ -1,17 +1,21 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"log"
 	"net"
 )
 
 func main() {
-	listener, err := net.Listen("tcp", ":9000")
+	addr := flag.String("addr", ":9000", "address to listen on [default: :9000]")
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
-		log.Fatalf("Failed to listen on port 9000: %v", err)
+		log.Fatalf("Failed to listen on %s: %v", *addr, err)
 	}
-	log.Println("Echo server listening on port 9000")
+	log.Printf("Echo server listening on %s", *addr)
 
 	for {
 		conn, err := listener.Accept()
@@ -1,40 +1,160 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/admin"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/balancer"
 	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
 	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/engine"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/pool"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/telemetry"
 )
 
 func main() {
 	listenAddr := ":8080"
-	backendAddr := "127.0.0.1:9000"
 
 	connectorType := flag.String("connector", "dial", "backend connector type (pool or dial) [default: dial]")
-	engineType := flag.String("engine", "goroutine", "engine type (goroutine or epoll) [default: goroutine]")
+	engineType := flag.String("engine", "goroutine", "engine type (goroutine, epoll, sharded, uring or http) [default: goroutine]")
+	var sharded engine.ShardedConfig
+	flag.IntVar(&sharded.Loops, "loops", 0, "event loops of the sharded engine, 0 for GOMAXPROCS")
+	flag.BoolVar(&sharded.LockOSThread, "lock-threads", false, "lock each loop of the sharded engine to an OS thread")
+	flag.BoolVar(&sharded.Affinity, "affinity", false, "pin each loop of the sharded engine to a CPU (implies -lock-threads)")
+	backendList := flag.String("backends", "127.0.0.1:9000", "comma separated backend addresses, each optionally followed by =weight")
+	policy := flag.String("balance", "round-robin", "balancing policy ("+strings.Join(balancer.Policies, ", ")+") [default: round-robin]")
+	health := balancer.DefaultHealthConfig()
+	flag.DurationVar(&health.ProbeInterval, "health-interval", health.ProbeInterval, "interval between active TCP health probes of each backend, 0 to disable")
+	flag.DurationVar(&health.ProbeTimeout, "health-timeout", health.ProbeTimeout, "timeout of a health probe")
+	flag.IntVar(&health.EjectAfter, "eject-after", health.EjectAfter, "consecutive connect failures that eject a backend, 0 to disable")
+	flag.DurationVar(&health.EjectTime, "eject-time", health.EjectTime, "base ejection time, multiplied by the number of times the backend was ejected")
+	flag.DurationVar(&health.OutlierInterval, "outlier-interval", health.OutlierInterval, "interval of success rate outlier detection, 0 to disable")
+	poolConfig := pool.DefaultConfig()
+	flag.IntVar(&poolConfig.MinIdle, "pool-min-idle", poolConfig.MinIdle, "idle connections the pool keeps dialed per backend")
+	flag.IntVar(&poolConfig.MaxOpen, "pool-max-open", poolConfig.MaxOpen, "max connections the pool opens per backend")
+	flag.DurationVar(&poolConfig.CheckoutTimeout, "pool-checkout-timeout", poolConfig.CheckoutTimeout, "how long to wait for a pooled connection when max open are in use")
+	flag.DurationVar(&poolConfig.IdleTimeout, "pool-idle-timeout", poolConfig.IdleTimeout, "close pooled connections idle for longer, down to min idle, 0 to disable")
+	flag.DurationVar(&poolConfig.MaxLifetime, "pool-max-lifetime", poolConfig.MaxLifetime, "close pooled connections older than this, 0 to disable")
+	flag.DurationVar(&poolConfig.DialTimeout, "connect-timeout", poolConfig.DialTimeout, "timeout of backend connects, by both connectors")
+	var limits engine.Limits
+	flag.IntVar(&limits.MaxConns, "max-conns", 0, "max client connections open at once, 0 for no limit")
+	flag.StringVar(&limits.Overload, "overload", engine.OverloadReject, "what to do with client connections beyond -max-conns (reject or queue) [default: reject]")
+	flag.IntVar(&limits.MaxConnsPerIP, "max-conns-per-ip", 0, "max client connections open at once from one address, 0 for no limit")
+	flag.DurationVar(&limits.IdleTimeout, "idle-timeout", 5*time.Minute, "close client connections with no data in either direction for this long, 0 to disable")
+	flag.DurationVar(&limits.MaxLifetime, "max-lifetime", 0, "close client connections open for longer, 0 to disable")
+	flag.DurationVar(&limits.HeaderTimeout, "header-timeout", 10*time.Second, "timeout of reading the headers of a request, by the http engine, 0 to disable")
+	var routeFlags []string
+	flag.Func("route", "route of the http engine, as [host][/prefix]=backends, with backends as in -backends (repeatable)", func(v string) error {
+		if !strings.Contains(v, "=") {
+			return fmt.Errorf("route %q is not [host][/prefix]=backends", v)
+		}
+		routeFlags = append(routeFlags, v)
+		return nil
+	})
+	accessLogPath := flag.String("access-log", "-", "file the http engine appends an access log line per request to, - for stdout, empty to disable")
+	adminAddr := flag.String("admin-addr", "127.0.0.1:9100", "address to serve Prometheus metrics (/metrics), pprof (/debug/pprof/) and the backends API (/backends) on [default: 127.0.0.1:9100]")
+	adminTokenFile := flag.String("admin-token-file", "", "file holding the bearer token that authorises changes through the backends API; without one, they are only allowed from loopback addresses")
 	flag.Parse()
 
-	backend, err := resolveConnector(backendAddr, *connectorType)
+	if len(routeFlags) > 0 && *engineType != "http" {
+		log.Fatalf("-route needs the http engine")
+	}
+	if *connectorType == "pool" && *engineType != "http" {
+		log.Printf("the %s engine shuts down every backend connection with its client: the pool only saves the dial, pooled connections are never reused", *engineType)
+	}
+	if err := limits.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	var adminToken string
+	if *adminTokenFile != "" {
+		b, err := os.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatalf("failed to read the admin token: %v", err)
+		}
+		if adminToken = strings.TrimSpace(string(b)); adminToken == "" {
+			log.Fatalf("admin token file %s is empty", *adminTokenFile)
+		}
+	}
+
+	telemetryMetrics, err := telemetry.InitMetrics()
 	if err != nil {
-		log.Fatalf("failed to create connector: %v", err)
+		log.Fatal(err)
+	}
+	newConnector := func(addr string) (connector.BackendConnector, error) {
+		return resolveConnector(addr, *connectorType, poolConfig)
+	}
+	balancers := make(map[string]*balancer.Balancer)
+	newBalancer := func(name, backendList string) *balancer.Balancer {
+		backends, err := balancer.ParseBackends(backendList, newConnector)
+		if err != nil {
+			log.Fatalf("failed to create connector: %v", err)
+		}
+		lb, err := balancer.New(*policy, backends, health)
+		if err != nil {
+			log.Fatalf("failed to create balancer: %v", err)
+		}
+		if err := telemetryMetrics.ObserveBackends(lb); err != nil {
+			log.Fatal(err)
+		}
+		go lb.CheckHealth(context.Background())
+		balancers[name] = lb
+		return lb
+	}
+	backend := newBalancer("default", *backendList)
+	var routes []engine.Route
+	for _, r := range routeFlags {
+		match, backendList, _ := strings.Cut(r, "=")
+		host, prefix, _ := strings.Cut(match, "/")
+		routes = append(routes, engine.Route{Host: host, Prefix: "/" + prefix, Backend: newBalancer(match, backendList)})
 	}
 
-	engine, err := resolveEngine(*engineType)
+	adminHandler := admin.NewHandler(balancers, newConnector, adminToken)
+	adminHandler.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("metrics available at %s/metrics, admin API at %s/backends", *adminAddr, *adminAddr)
+		log.Fatal(http.ListenAndServe(*adminAddr, adminHandler))
+	}()
+
+	if *engineType == "uring" {
+		if err := engine.UringSupported(); err != nil {
+			log.Printf("%v, falling back to the epoll engine", err)
+			*engineType = "epoll"
+		}
+	}
+	sharded.Limits = limits
+	eng, err := resolveEngine(*engineType, sharded, routes, *accessLogPath, limits)
 	if err != nil {
 		log.Fatalf("failed to create engine: %v", err)
 	}
-	engine.Start()
+	if err := telemetryMetrics.ObserveEngine(*engineType, eng); err != nil {
+		log.Fatal(err)
+	}
+	eng.Start()
+
+	if le, ok := eng.(engine.ListeningEngine); ok {
+		addr, err := le.Listen(listenAddr, backend)
+		if err != nil {
+			log.Fatalf("listen failed: %v", err)
+		}
+		log.Printf("Proxy listening on %s, forwarding to %s [connectorType=%s ; engineType=%s ; balance=%s]", addr, *backendList, *connectorType, *engineType, *policy)
+		select {}
+	}
 
 	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatalf("listen failed: %v", err)
 	}
-	log.Printf("Proxy listening on %s, forwarding to %s [connectorType=%s ; engineType=%s]", listenAddr, backendAddr, *connectorType, *engineType)
+	log.Printf("Proxy listening on %s, forwarding to %s [connectorType=%s ; engineType=%s ; balance=%s]", listenAddr, *backendList, *connectorType, *engineType, *policy)
 
 	for {
 		clientConn, err := ln.Accept()
@@ -42,16 +162,16 @@ func main() {
 			log.Printf("accept error: %v", err)
 			continue
 		}
-		engine.Serve(clientConn, backend)
+		eng.Serve(clientConn, backend)
 	}
 }
 
-func resolveConnector(backendAddr string, connectorType string) (connector.BackendConnector, error) {
+func resolveConnector(backendAddr string, connectorType string, poolConfig pool.Config) (connector.BackendConnector, error) {
 	switch connectorType {
 	case "pool":
-		return connector.NewPoolConnector(backendAddr, 10)
+		return connector.NewPoolConnector(backendAddr, poolConfig)
 	case "dial":
-		return connector.NewAlwaysDialConnector(backendAddr), nil
+		return connector.NewAlwaysDialConnector(backendAddr, poolConfig.DialTimeout), nil
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown connector type: %s\n", connectorType)
 		os.Exit(2)
@@ -59,12 +179,30 @@ func resolveConnector(backendAddr string, connectorType string) (connector.Backe
 	return nil, fmt.Errorf("unreachable")
 }
 
-func resolveEngine(engineType string) (engine.Engine, error) {
+func resolveEngine(engineType string, sharded engine.ShardedConfig, routes []engine.Route, accessLogPath string, limits engine.Limits) (engine.Engine, error) {
 	switch engineType {
 	case "goroutine":
-		return &engine.GoroutineEngine{}, nil
+		return &engine.GoroutineEngine{Limits: limits}, nil
 	case "epoll":
-		return engine.NewEpollEngine()
+		return engine.NewEpollEngine(limits)
+	case "sharded":
+		return engine.NewShardedEpollEngine(sharded)
+	case "uring":
+		return engine.NewUringEngine(limits)
+	case "http":
+		var accessLog io.Writer
+		switch accessLogPath {
+		case "":
+		case "-":
+			accessLog = os.Stdout
+		default:
+			f, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				return nil, err
+			}
+			accessLog = f
+		}
+		return engine.NewHTTPEngine(routes, accessLog, limits), nil
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown engine type: %s\n", engineType)
 		os.Exit(2)
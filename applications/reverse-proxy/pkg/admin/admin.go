@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/balancer"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// maxBody bounds the backend lists PUT to /backends.
+const maxBody = 64 << 10
+
+// Backend is how a backend is listed by GET /backends.
+type Backend struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+	State  string `json:"state"`
+	Active int64  `json:"active"`
+	Total  uint64 `json:"total"`
+}
+
+// Handler serves the admin API of the proxy:
+//   - GET /backends lists the backends of every balancer, by name;
+//   - PUT /backends?balancer=name replaces the backends of a balancer with the list in the body, in the format of
+//     balancer.ParseBackends, and lists the new ones;
+//   - /debug/pprof/ serves the runtime profiles.
+//
+// Requests that change the backends must carry the token as "Authorization: Bearer <token>", or, without a token,
+// come from a loopback address.
+type Handler struct {
+	mux          *http.ServeMux
+	balancers    map[string]*balancer.Balancer
+	newConnector func(addr string) (connector.BackendConnector, error)
+	token        string
+}
+
+// NewHandler serves the admin API for the balancers, by name. Backends added with PUT get a connector from
+// newConnector. token authorises the changes to the backends, empty to only allow them from loopback addresses.
+func NewHandler(balancers map[string]*balancer.Balancer, newConnector func(addr string) (connector.BackendConnector, error), token string) *Handler {
+	h := &Handler{mux: http.NewServeMux(), balancers: balancers, newConnector: newConnector, token: token}
+	h.mux.HandleFunc("GET /backends", h.listBackends)
+	h.mux.HandleFunc("PUT /backends", h.authorised(h.updateBackends))
+	h.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	h.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	h.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	h.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	h.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return h
+}
+
+// Handle serves handler at pattern along with the admin API, e.g. the metrics.
+func (h *Handler) Handle(pattern string, handler http.Handler) {
+	h.mux.Handle(pattern, handler)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorised has f serve the requests with the token, or from a loopback address if there is no token, and rejects the
+// others.
+func (h *Handler) authorised(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopback(r.RemoteAddr) {
+			http.Error(w, "changes are only allowed from loopback addresses without a token", http.StatusForbidden)
+			return
+		}
+		f(w, r)
+	}
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (h *Handler) listBackends(w http.ResponseWriter, r *http.Request) {
+	all := make(map[string][]Backend)
+	for name, lb := range h.balancers {
+		all[name] = list(lb)
+	}
+	writeJSON(w, all)
+}
+
+func (h *Handler) updateBackends(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("balancer")
+	lb, ok := h.balancers[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown balancer %q (want one of %v)", name, h.names()), http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := lb.Update(string(body), h.newConnector); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, list(lb))
+}
+
+func (h *Handler) names() []string {
+	var names []string
+	for name := range h.balancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func list(lb *balancer.Balancer) []Backend {
+	var backends []Backend
+	for _, b := range lb.Backends() {
+		backends = append(backends, Backend{Addr: b.Addr, Weight: b.Weight(), State: b.State().String(), Active: b.Active(), Total: b.Total()})
+	}
+	return backends
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
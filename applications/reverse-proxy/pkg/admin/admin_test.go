@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/balancer"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+func newTestHandler(t *testing.T, token string) *Handler {
+	t.Helper()
+	newConnector := func(addr string) (connector.BackendConnector, error) {
+		return connector.NewAlwaysDialConnector(addr, 0), nil
+	}
+	backends, err := balancer.ParseBackends("127.0.0.1:9001", newConnector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := balancer.New("round-robin", backends, balancer.DefaultHealthConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHandler(map[string]*balancer.Balancer{"default": lb}, newConnector, token)
+}
+
+func TestHandler_UpdateBackendsAuthorisation(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		remoteAddr    string
+		authorization string
+		want          int
+	}{
+		{"no token, from loopback", "", "127.0.0.1:40000", "", http.StatusOK},
+		{"no token, from IPv6 loopback", "", "[::1]:40000", "", http.StatusOK},
+		{"no token, from elsewhere", "", "10.0.0.1:40000", "", http.StatusForbidden},
+		{"no token, from elsewhere with one", "", "10.0.0.1:40000", "Bearer secret", http.StatusForbidden},
+		{"token", "secret", "10.0.0.1:40000", "Bearer secret", http.StatusOK},
+		{"wrong token", "secret", "10.0.0.1:40000", "Bearer guess", http.StatusUnauthorized},
+		{"not a bearer token", "secret", "10.0.0.1:40000", "secret", http.StatusUnauthorized},
+		// With a token, loopback clients need it too.
+		{"token missing, from loopback", "secret", "127.0.0.1:40000", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, tt.token)
+			req := httptest.NewRequest(http.MethodPut, "/backends?balancer=default", strings.NewReader("127.0.0.1:9002"))
+			req.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d (%s), want %d", rec.Code, strings.TrimSpace(rec.Body.String()), tt.want)
+			}
+			want := "127.0.0.1:9001"
+			if tt.want == http.StatusOK {
+				want = "127.0.0.1:9002"
+			}
+			if got := h.balancers["default"].Backends()[0].Addr; got != want {
+				t.Errorf("backend %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// Listing the backends needs no token.
+func TestHandler_ListBackends(t *testing.T) {
+	h := newTestHandler(t, "secret")
+	req := httptest.NewRequest(http.MethodGet, "/backends", nil)
+	req.RemoteAddr = net.JoinHostPort("10.0.0.1", "40000")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"addr": "127.0.0.1:9001"`) {
+		t.Errorf("status %d, body %s", rec.Code, rec.Body.String())
+	}
+}
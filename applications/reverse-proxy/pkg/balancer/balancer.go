@@ -0,0 +1,277 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// Backend is one member of the backend set, with the connector used to reach it.
+type Backend struct {
+	Addr string
+
+	weight    atomic.Int64 // changed in place by Update
+	connector connector.BackendConnector
+	active    atomic.Int64  // connections currently handed out
+	total     atomic.Uint64 // connections handed out since start
+	state     atomic.Int32  // a State
+	health    health
+}
+
+func NewBackend(addr string, weight int, conn connector.BackendConnector) *Backend {
+	if weight < 1 {
+		weight = 1
+	}
+	b := &Backend{Addr: addr, connector: conn}
+	b.weight.Store(int64(weight))
+	return b
+}
+
+func (b *Backend) Weight() int { return int(b.weight.Load()) }
+
+func (b *Backend) Connector() connector.BackendConnector { return b.connector }
+
+func (b *Backend) Active() int64 { return b.active.Load() }
+func (b *Backend) Total() uint64 { return b.total.Load() }
+
+// Balancer is a BackendConnector that spreads client connections over the healthy members of a set of backends
+// according to a Policy. See HealthConfig for how backends are taken out of rotation. The set can be changed with
+// Update while connections are being handed out.
+type Balancer struct {
+	set        atomic.Pointer[backendSet]
+	policyName string
+	health     HealthConfig
+	now        func() time.Time // the clock of the health checks, replaced in tests
+	onConnect  func(b *Backend, took time.Duration, err error)
+
+	update   sync.Mutex // serialises Updates
+	ejecting sync.Mutex // serialises ejections, so that concurrent ones can't exceed MaxEjectedPercent together
+	mu       sync.Mutex
+	owner    map[net.Conn]*Backend // the backend every connection handed out came from, for Return and Discard
+}
+
+// backendSet is a set of backends with the policy picking among them, swapped as a whole by Update.
+type backendSet struct {
+	backends []*Backend
+	policy   Policy
+}
+
+// ErrNoBackends is returned by Get when no backend is healthy.
+var ErrNoBackends = errors.New("no healthy backends")
+
+func New(policyName string, backends []*Backend, health HealthConfig) (*Balancer, error) {
+	lb := &Balancer{
+		policyName: policyName,
+		health:     health,
+		now:        time.Now,
+		owner:      make(map[net.Conn]*Backend),
+	}
+	if err := lb.setBackends(backends); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+func (lb *Balancer) setBackends(backends []*Backend) error {
+	if len(backends) == 0 {
+		return fmt.Errorf("no backends")
+	}
+	policy, err := NewPolicy(lb.policyName, backends)
+	if err != nil {
+		return err
+	}
+	lb.set.Store(&backendSet{backends: backends, policy: policy})
+	return nil
+}
+
+func (lb *Balancer) Backends() []*Backend {
+	return lb.set.Load().backends
+}
+
+// OnConnect has f called with the outcome of every connection attempt and the time it took, e.g. to export the
+// latencies. It must be called before the balancer is used.
+func (lb *Balancer) OnConnect(f func(b *Backend, took time.Duration, err error)) {
+	lb.onConnect = f
+}
+
+func (lb *Balancer) Get(client net.Addr) (net.Conn, error) {
+	b := lb.set.Load().policy.Pick(client)
+	if b == nil {
+		return nil, ErrNoBackends
+	}
+	// Counted before connecting, so that least-connections and p2c see the connection while it is being dialed.
+	b.active.Add(1)
+	start := time.Now()
+	conn, err := b.connector.Get(client)
+	if lb.onConnect != nil {
+		lb.onConnect(b, time.Since(start), err)
+	}
+	lb.recordConnect(b, err)
+	if err != nil {
+		b.active.Add(-1)
+		return nil, fmt.Errorf("backend %s: %w", b.Addr, err)
+	}
+	b.total.Add(1)
+
+	lb.mu.Lock()
+	lb.owner[conn] = b
+	lb.mu.Unlock()
+	return conn, nil
+}
+
+func (lb *Balancer) Return(conn net.Conn) {
+	if b := lb.release(conn); b != nil {
+		b.connector.Return(conn)
+	}
+}
+
+func (lb *Balancer) Discard(conn net.Conn) {
+	if b := lb.release(conn); b != nil {
+		b.connector.Discard(conn)
+	}
+}
+
+// release takes a connection handed out off the count of its backend, and returns the backend. Connections the
+// balancer didn't hand out are closed.
+func (lb *Balancer) release(conn net.Conn) *Backend {
+	lb.mu.Lock()
+	b, ok := lb.owner[conn]
+	delete(lb.owner, conn)
+	lb.mu.Unlock()
+	if !ok {
+		conn.Close()
+		return nil
+	}
+	b.active.Add(-1)
+	return b
+}
+
+// Update replaces the set of backends with the one in list, in the format of ParseBackends. Backends that stay in the
+// set keep their connector, counts and health, and take their new weight in place. The others get a connector from
+// newConnector. The connectors of the backends that left the set are closed if they are io.Closers; connections handed
+// out from them are still returned to them.
+func (lb *Balancer) Update(list string, newConnector func(addr string) (connector.BackendConnector, error)) error {
+	specs, err := parseSpecs(list)
+	if err != nil {
+		return err
+	}
+	lb.update.Lock()
+	defer lb.update.Unlock()
+
+	current := make(map[string]*Backend)
+	for _, b := range lb.Backends() {
+		current[b.Addr] = b
+	}
+	var backends []*Backend
+	var created []connector.BackendConnector
+	for _, s := range specs {
+		if b, ok := current[s.addr]; ok {
+			backends = append(backends, b)
+			continue
+		}
+		conn, err := newConnector(s.addr)
+		if err != nil {
+			closeConnectors(created)
+			return fmt.Errorf("backend %s: %w", s.addr, err)
+		}
+		created = append(created, conn)
+		backends = append(backends, NewBackend(s.addr, s.weight, conn))
+	}
+	// The weights are changed before the policy of the new set is built, as the consistent hash ring is laid out by them.
+	oldWeights := make([]int64, len(backends))
+	for i, b := range backends {
+		oldWeights[i] = b.weight.Swap(int64(specs[i].weight))
+	}
+	if err := lb.setBackends(backends); err != nil {
+		for i, b := range backends {
+			b.weight.Store(oldWeights[i])
+		}
+		closeConnectors(created)
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for _, s := range specs {
+		kept[s.addr] = true
+	}
+	var removed []connector.BackendConnector
+	for addr, b := range current {
+		if !kept[addr] {
+			removed = append(removed, b.connector)
+			log.Printf("backend %s: removed", addr)
+		}
+	}
+	closeConnectors(removed)
+	return nil
+}
+
+func closeConnectors(connectors []connector.BackendConnector) {
+	for _, c := range connectors {
+		if closer, ok := c.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+type backendSpec struct {
+	addr   string
+	weight int
+}
+
+// ParseBackends parses a comma separated list of backend addresses, each optionally followed by "=weight", e.g.
+// "10.0.0.1:9000=3,10.0.0.2:9000". Backends without a weight have weight 1.
+func ParseBackends(list string, newConnector func(addr string) (connector.BackendConnector, error)) ([]*Backend, error) {
+	specs, err := parseSpecs(list)
+	if err != nil {
+		return nil, err
+	}
+	var backends []*Backend
+	for _, s := range specs {
+		conn, err := newConnector(s.addr)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", s.addr, err)
+		}
+		backends = append(backends, NewBackend(s.addr, s.weight, conn))
+	}
+	return backends, nil
+}
+
+func parseSpecs(list string) ([]backendSpec, error) {
+	var specs []backendSpec
+	seen := make(map[string]bool)
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		addr, weight := spec, 1
+		if i := strings.LastIndexByte(spec, '='); i >= 0 {
+			w, err := strconv.Atoi(spec[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight in backend %q", spec)
+			}
+			addr, weight = spec[:i], w
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid backend address %q: %w", addr, err)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("duplicate backend %s", addr)
+		}
+		seen[addr] = true
+		specs = append(specs, backendSpec{addr, weight})
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no backends in %q", list)
+	}
+	return specs, nil
+}
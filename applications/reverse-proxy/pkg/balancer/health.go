@@ -0,0 +1,284 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/pool"
+)
+
+// State is the health state of a backend. Only healthy backends are picked.
+type State int32
+
+const (
+	StateHealthy   State = iota
+	StateUnhealthy       // failed the active health probes, until it passes them again
+	StateEjected         // ejected for failing connections (passively or as an outlier), until the ejection expires
+	numStates
+)
+
+var stateNames = [numStates]string{"healthy", "unhealthy", "ejected"}
+
+func (s State) String() string { return stateNames[s] }
+
+// States lists all states, e.g. to report every transition counter.
+func States() []State { return []State{StateHealthy, StateUnhealthy, StateEjected} }
+
+// HealthConfig configures the three ways backends are taken out of rotation:
+//   - active probes: every ProbeInterval each backend is dialed, UnhealthyThreshold consecutive failed probes mark it
+//     unhealthy and HealthyThreshold consecutive successful ones healthy again;
+//   - passive ejection: EjectAfter consecutive failures to connect to a backend eject it;
+//   - outlier detection: every OutlierInterval, backends whose connect success rate over the interval falls more than
+//     OutlierStdDev standard deviations below the mean of the set are ejected.
+//
+// Ejections last EjectTime times the number of times the backend has been ejected, up to MaxEjectTime, and never take
+// more than MaxEjectedPercent of the backends out at once.
+type HealthConfig struct {
+	ProbeInterval      time.Duration // 0 disables active probes
+	ProbeTimeout       time.Duration
+	UnhealthyThreshold int
+	HealthyThreshold   int
+
+	EjectAfter int // 0 disables passive ejection
+
+	OutlierInterval    time.Duration // 0 disables outlier detection
+	OutlierStdDev      float64
+	OutlierMinRequests uint64 // backends with fewer connection attempts in the interval are left out
+	// Fewer backends with enough attempts make the statistics meaningless. A single outlier among n backends is at most
+	// sqrt(n-1) standard deviations below the mean, so at OutlierStdDev 1.9 it takes 5 to eject one at all.
+	OutlierMinBackends int
+
+	EjectTime         time.Duration
+	MaxEjectTime      time.Duration
+	MaxEjectedPercent int
+}
+
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		ProbeInterval:      5 * time.Second,
+		ProbeTimeout:       time.Second,
+		UnhealthyThreshold: 3,
+		HealthyThreshold:   2,
+		EjectAfter:         5,
+		OutlierInterval:    10 * time.Second,
+		OutlierStdDev:      1.9,
+		OutlierMinRequests: 100,
+		OutlierMinBackends: 5,
+		EjectTime:          30 * time.Second,
+		MaxEjectTime:       5 * time.Minute,
+		MaxEjectedPercent:  50,
+	}
+}
+
+// health is the health bookkeeping of a backend.
+type health struct {
+	mu                 sync.Mutex
+	probeFailures      int // consecutive
+	probeSuccesses     int // consecutive
+	connectFailures    int // consecutive
+	ejections          int
+	ejectedUntil       time.Time
+	attempts, failures uint64 // in the current outlier detection interval
+	transitions        [numStates]uint64
+}
+
+func (b *Backend) State() State { return State(b.state.Load()) }
+
+// Transitions returns the number of times the backend has entered each state.
+func (b *Backend) Transitions(to State) uint64 {
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+	return b.health.transitions[to]
+}
+
+// setState must be called with health.mu held.
+func (b *Backend) setState(to State, reason string) {
+	from := b.State()
+	if from == to {
+		return
+	}
+	b.state.Store(int32(to))
+	b.health.transitions[to]++
+	log.Printf("backend %s: %s -> %s (%s)", b.Addr, from, to, reason)
+}
+
+// recordConnect feeds the outcome of a connection attempt to passive ejection and outlier detection.
+func (lb *Balancer) recordConnect(b *Backend, err error) {
+	h := &b.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// A pool running out of connections says nothing about the health of the backend.
+	if errors.Is(err, pool.ErrExhausted) {
+		return
+	}
+	h.attempts++
+	if err == nil {
+		h.connectFailures = 0
+		return
+	}
+	h.failures++
+	h.connectFailures++
+	if lb.health.EjectAfter > 0 && h.connectFailures >= lb.health.EjectAfter && b.State() == StateHealthy {
+		lb.eject(b, "consecutive connect failures")
+	}
+}
+
+// eject must be called with b.health.mu held.
+func (lb *Balancer) eject(b *Backend, reason string) {
+	// Without the lock, two backends failing at once could both see room for one more ejection.
+	lb.ejecting.Lock()
+	defer lb.ejecting.Unlock()
+	if !lb.mayEject() {
+		log.Printf("backend %s: not ejected (%s), too many backends are out already", b.Addr, reason)
+		return
+	}
+	h := &b.health
+	h.ejections++
+	d := lb.health.EjectTime * time.Duration(h.ejections)
+	if d > lb.health.MaxEjectTime {
+		d = lb.health.MaxEjectTime
+	}
+	h.ejectedUntil = lb.now().Add(d)
+	h.connectFailures = 0
+	b.setState(StateEjected, reason)
+}
+
+// mayEject reports whether one more backend can be taken out without exceeding MaxEjectedPercent. It only reads the
+// atomic states, so it can be called while holding the health lock of one backend, and must be called with lb.ejecting
+// held. The backend to eject counts as out
+// already, so that below 100% a set always keeps at least one backend in rotation: the only backend of a set is never
+// ejected, as there would be nothing left to send its clients to. Active probes can still take it out when it is down.
+func (lb *Balancer) mayEject() bool {
+	backends := lb.Backends()
+	out := 1
+	for _, b := range backends {
+		if b.State() != StateHealthy {
+			out++
+		}
+	}
+	return out*100 <= lb.health.MaxEjectedPercent*len(backends)
+}
+
+// CheckHealth runs the active probes, outlier detection and ejection expiry until ctx is done.
+func (lb *Balancer) CheckHealth(ctx context.Context) {
+	tick := time.Second
+	for _, d := range []time.Duration{lb.health.ProbeInterval, lb.health.OutlierInterval, lb.health.EjectTime} {
+		if d > 0 && d < tick {
+			tick = d
+		}
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var lastProbe, lastOutlier time.Time
+	lastOutlier = lb.now()
+	for {
+		now := lb.now()
+		lb.expireEjections(now)
+		if lb.health.ProbeInterval > 0 && now.Sub(lastProbe) >= lb.health.ProbeInterval {
+			lastProbe = now
+			lb.probe(ctx)
+		}
+		if lb.health.OutlierInterval > 0 && now.Sub(lastOutlier) >= lb.health.OutlierInterval {
+			lastOutlier = now
+			lb.detectOutliers()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *Balancer) expireEjections(now time.Time) {
+	for _, b := range lb.Backends() {
+		b.health.mu.Lock()
+		if b.State() == StateEjected && now.After(b.health.ejectedUntil) {
+			b.setState(StateHealthy, "ejection expired")
+		}
+		b.health.mu.Unlock()
+	}
+}
+
+// probe dials all backends concurrently, so that one slow backend doesn't delay the probes of the others.
+func (lb *Balancer) probe(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range lb.Backends() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dialer := net.Dialer{Timeout: lb.health.ProbeTimeout}
+			conn, err := dialer.DialContext(ctx, "tcp", b.Addr)
+			if err == nil {
+				conn.Close()
+			}
+			lb.recordProbe(b, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func (lb *Balancer) recordProbe(b *Backend, err error) {
+	h := &b.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.probeSuccesses = 0
+		h.probeFailures++
+		// An ejected backend that also fails its probes is down, not just misbehaving: it stays out until it passes them.
+		if h.probeFailures >= lb.health.UnhealthyThreshold && b.State() != StateUnhealthy {
+			b.setState(StateUnhealthy, "probe failed: "+err.Error())
+		}
+		return
+	}
+	h.probeFailures = 0
+	h.probeSuccesses++
+	if h.probeSuccesses >= lb.health.HealthyThreshold && b.State() == StateUnhealthy {
+		b.setState(StateHealthy, "probes passed")
+	}
+}
+
+// detectOutliers ejects the healthy backends whose connect success rate over the last interval is an outlier, and
+// starts the next interval.
+func (lb *Balancer) detectOutliers() {
+	rates := make(map[*Backend]float64)
+	for _, b := range lb.Backends() {
+		h := &b.health
+		h.mu.Lock()
+		if b.State() == StateHealthy && h.attempts >= lb.health.OutlierMinRequests && h.attempts > 0 {
+			rates[b] = float64(h.attempts-h.failures) / float64(h.attempts)
+		}
+		h.attempts, h.failures = 0, 0
+		h.mu.Unlock()
+	}
+	if len(rates) < lb.health.OutlierMinBackends || len(rates) == 0 {
+		return
+	}
+
+	var mean, variance float64
+	for _, r := range rates {
+		mean += r
+	}
+	mean /= float64(len(rates))
+	for _, r := range rates {
+		variance += (r - mean) * (r - mean)
+	}
+	threshold := mean - lb.health.OutlierStdDev*math.Sqrt(variance/float64(len(rates)))
+
+	for b, r := range rates {
+		if r >= threshold {
+			continue
+		}
+		b.health.mu.Lock()
+		if b.State() == StateHealthy {
+			lb.eject(b, "success rate outlier")
+		}
+		b.health.mu.Unlock()
+	}
+}
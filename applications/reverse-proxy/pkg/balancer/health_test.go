@@ -0,0 +1,319 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/pool"
+)
+
+// fakeClock is a clock the tests move by hand.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestBalancer balances over backends with the names and the health config, on a fake clock.
+func newTestBalancer(t *testing.T, names string, health HealthConfig) (*Balancer, *fakeClock) {
+	t.Helper()
+	lb, err := New("round-robin", newBackends(names), health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Unix(1_000_000, 0)}
+	lb.now = clock.now
+	return lb, clock
+}
+
+func backendNamed(lb *Balancer, name string) *Backend {
+	for _, b := range lb.Backends() {
+		if b.Addr[:1] == name {
+			return b
+		}
+	}
+	panic("no backend " + name)
+}
+
+var errRefused = errors.New("connection refused")
+
+func TestHealth_ProbeThresholds(t *testing.T) {
+	health := DefaultHealthConfig()
+	health.UnhealthyThreshold, health.HealthyThreshold = 3, 2
+	lb, _ := newTestBalancer(t, "a", health)
+	a := backendNamed(lb, "a")
+
+	// Each step is a probe outcome and the state after it.
+	steps := []struct {
+		err  error
+		want State
+	}{
+		{errRefused, StateHealthy},
+		{errRefused, StateHealthy},
+		{nil, StateHealthy}, // resets the failures
+		{errRefused, StateHealthy},
+		{errRefused, StateHealthy},
+		{errRefused, StateUnhealthy},
+		{nil, StateUnhealthy},
+		{errRefused, StateUnhealthy}, // resets the successes
+		{nil, StateUnhealthy},
+		{nil, StateHealthy},
+	}
+	for i, step := range steps {
+		lb.recordProbe(a, step.err)
+		if got := a.State(); got != step.want {
+			t.Fatalf("probe %d (%v): %s, want %s", i, step.err, got, step.want)
+		}
+	}
+	if n := a.Transitions(StateUnhealthy); n != 1 {
+		t.Errorf("%d transitions to unhealthy, want 1", n)
+	}
+}
+
+// probe dials the backends for real: one that listens, and one that doesn't.
+func TestHealth_Probe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	health := DefaultHealthConfig()
+	health.UnhealthyThreshold = 1
+	up, gone := NewBackend(ln.Addr().String(), 1, &fakeConnector{}), NewBackend(down.Addr().String(), 1, &fakeConnector{})
+	lb, err := New("round-robin", []*Backend{up, gone}, health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.probe(context.Background())
+	if up.State() != StateHealthy || gone.State() != StateUnhealthy {
+		t.Errorf("listening backend %s, closed one %s", up.State(), gone.State())
+	}
+}
+
+func TestHealth_PassiveEjection(t *testing.T) {
+	health := DefaultHealthConfig()
+	health.EjectAfter = 3
+	lb, _ := newTestBalancer(t, "ab", health)
+	a := backendNamed(lb, "a")
+	conn := a.connector.(*fakeConnector)
+
+	connect := func(err error) {
+		conn.err = err
+		lb.recordConnect(a, err)
+	}
+	connect(errRefused)
+	connect(errRefused)
+	connect(nil) // resets the count
+	connect(errRefused)
+	connect(errRefused)
+	// A pool out of connections says nothing about the backend.
+	connect(fmt.Errorf("%w: waited 1s", pool.ErrExhausted))
+	if a.State() != StateHealthy {
+		t.Fatalf("%s after 2 consecutive failures", a.State())
+	}
+	connect(errRefused)
+	if a.State() != StateEjected {
+		t.Fatalf("%s after 3 consecutive failures, want ejected", a.State())
+	}
+
+	// Through Get, the failures of the backend left in rotation count too.
+	b := backendNamed(lb, "b")
+	b.connector.(*fakeConnector).err = errRefused
+	for range 3 {
+		if _, err := lb.Get(clientAddr(0)); !errors.Is(err, errRefused) {
+			t.Fatalf("Get: %v", err)
+		}
+	}
+	if b.State() != StateHealthy {
+		t.Errorf("last backend in rotation %s, want it kept in", b.State())
+	}
+	if _, err := lb.Get(clientAddr(0)); err == nil || b.Active() != 0 {
+		t.Errorf("Get: %v, %d active", err, b.Active())
+	}
+}
+
+func TestHealth_EjectionTime(t *testing.T) {
+	health := DefaultHealthConfig()
+	health.EjectTime, health.MaxEjectTime = 10*time.Second, 25*time.Second
+	lb, clock := newTestBalancer(t, "ab", health)
+	a := backendNamed(lb, "a")
+
+	// Each ejection lasts EjectTime times the number of ejections so far, up to MaxEjectTime.
+	for i, lasts := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second, 25 * time.Second} {
+		a.health.mu.Lock()
+		lb.eject(a, "test")
+		a.health.mu.Unlock()
+		if a.State() != StateEjected {
+			t.Fatalf("ejection %d: %s", i+1, a.State())
+		}
+		clock.advance(lasts)
+		lb.expireEjections(clock.now())
+		if a.State() != StateEjected {
+			t.Fatalf("ejection %d expired after %v, before its end", i+1, lasts)
+		}
+		clock.advance(time.Millisecond)
+		lb.expireEjections(clock.now())
+		if a.State() != StateHealthy {
+			t.Fatalf("ejection %d: %s after %v, want expired", i+1, a.State(), lasts)
+		}
+	}
+	if n := a.Transitions(StateEjected); n != 4 {
+		t.Errorf("%d ejections, want 4", n)
+	}
+}
+
+func TestHealth_MaxEjected(t *testing.T) {
+	tests := []struct {
+		backends string
+		percent  int
+		want     int // backends that can be ejected
+	}{
+		{"a", 50, 0},
+		{"a", 100, 1},
+		{"ab", 50, 1},
+		{"abcd", 50, 2},
+		{"abcde", 50, 2},
+		{"abcde", 10, 0},
+		{"abcdefghij", 10, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d backends at %d%%", len(tt.backends), tt.percent), func(t *testing.T) {
+			health := DefaultHealthConfig()
+			health.MaxEjectedPercent = tt.percent
+			lb, _ := newTestBalancer(t, tt.backends, health)
+			ejected := 0
+			for _, b := range lb.Backends() {
+				b.health.mu.Lock()
+				lb.eject(b, "test")
+				b.health.mu.Unlock()
+				if b.State() == StateEjected {
+					ejected++
+				}
+			}
+			if ejected != tt.want {
+				t.Errorf("%d ejected, want %d", ejected, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealth_MaxEjectedConcurrent(t *testing.T) {
+	health := DefaultHealthConfig()
+	health.MaxEjectedPercent = 50
+	for range 5 {
+		lb, clock := newTestBalancer(t, "abcdefghij", health)
+		// Reading the clock in the middle of an ejection lets the other ejections run.
+		lb.now = func() time.Time {
+			time.Sleep(time.Millisecond)
+			return clock.now()
+		}
+		var wg sync.WaitGroup
+		for _, b := range lb.Backends() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.health.mu.Lock()
+				lb.eject(b, "test")
+				b.health.mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		ejected := 0
+		for _, b := range lb.Backends() {
+			if b.State() == StateEjected {
+				ejected++
+			}
+		}
+		if ejected != 5 {
+			t.Fatalf("%d of 10 backends ejected at once, want 5", ejected)
+		}
+	}
+}
+
+func TestHealth_OutlierDetection(t *testing.T) {
+	tests := []struct {
+		name        string
+		attempts    []uint64 // per backend, in the interval
+		failures    []uint64
+		minBackends int
+		ejected     string
+	}{
+		{"outlier", []uint64{100, 100, 100, 100, 100}, []uint64{0, 1, 0, 2, 50}, 5, "e"},
+		{"uniform failures", []uint64{100, 100, 100, 100, 100}, []uint64{10, 11, 9, 10, 12}, 5, ""},
+		{"too few attempts", []uint64{100, 100, 100, 100, 99}, []uint64{0, 0, 0, 0, 99}, 5, ""},
+		{"too few backends with enough attempts", []uint64{100, 100, 100, 100}, []uint64{0, 0, 0, 100}, 5, ""},
+		// Even allowed to, four backends can't single one out at 1.9 standard deviations, whatever its rate.
+		{"four backends", []uint64{100, 100, 100, 100}, []uint64{0, 0, 0, 100}, 4, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := DefaultHealthConfig()
+			health.OutlierMinBackends = tt.minBackends
+			lb, _ := newTestBalancer(t, "abcde"[:len(tt.attempts)], health)
+			for i, b := range lb.Backends() {
+				b.health.attempts, b.health.failures = tt.attempts[i], tt.failures[i]
+			}
+			lb.detectOutliers()
+			got := ""
+			for _, b := range lb.Backends() {
+				if b.State() == StateEjected {
+					got += b.Addr[:1]
+				}
+				if b.health.attempts != 0 || b.health.failures != 0 {
+					t.Errorf("backend %s: the interval's counts weren't reset", b.Addr)
+				}
+			}
+			if got != tt.ejected {
+				t.Errorf("ejected %q, want %q", got, tt.ejected)
+			}
+		})
+	}
+}
+
+// CheckHealth expires ejections, and probes and detects outliers at their intervals, on its own.
+func TestHealth_CheckHealth(t *testing.T) {
+	health := DefaultHealthConfig()
+	health.ProbeInterval, health.OutlierInterval = 0, 0
+	health.EjectTime = 10 * time.Millisecond
+	lb, err := New("round-robin", newBackends("ab"), health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := backendNamed(lb, "a")
+	a.health.mu.Lock()
+	lb.eject(a, "test")
+	a.health.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		lb.CheckHealth(ctx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); a.State() != StateHealthy; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("ejection didn't expire")
+		}
+	}
+	cancel()
+	<-done
+}
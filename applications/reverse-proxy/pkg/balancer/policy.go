@@ -0,0 +1,221 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy picks the backend for a new client connection among the healthy ones, or returns nil if there are none.
+type Policy interface {
+	Pick(client net.Addr) *Backend
+}
+
+// healthy returns the healthy backends, without copying when all of them are.
+func healthy(backends []*Backend) []*Backend {
+	for i, b := range backends {
+		if b.State() == StateHealthy {
+			continue
+		}
+		up := append([]*Backend(nil), backends[:i]...)
+		for _, b := range backends[i+1:] {
+			if b.State() == StateHealthy {
+				up = append(up, b)
+			}
+		}
+		return up
+	}
+	return backends
+}
+
+// Policies are the names NewPolicy accepts.
+var Policies = []string{"round-robin", "least-conn", "p2c", "hash", "weighted"}
+
+func NewPolicy(name string, backends []*Backend) (Policy, error) {
+	switch name {
+	case "round-robin":
+		return &RoundRobin{backends: backends}, nil
+	case "least-conn":
+		return &LeastConnections{backends: backends}, nil
+	case "p2c":
+		return &PowerOfTwoChoices{backends: backends}, nil
+	case "hash":
+		return NewConsistentHash(backends), nil
+	case "weighted":
+		return NewWeighted(backends), nil
+	default:
+		return nil, fmt.Errorf("unknown balancing policy %q (want one of %v)", name, Policies)
+	}
+}
+
+// RoundRobin hands out the backends in turn, ignoring their weights.
+type RoundRobin struct {
+	backends []*Backend
+	next     atomic.Uint64
+}
+
+func (p *RoundRobin) Pick(client net.Addr) *Backend {
+	n := p.next.Add(1) - 1
+	for i := range uint64(len(p.backends)) {
+		if b := p.backends[(n+i)%uint64(len(p.backends))]; b.State() == StateHealthy {
+			return b
+		}
+	}
+	return nil
+}
+
+// LeastConnections picks the backend with the fewest active connections. Ties are broken by starting the scan at a
+// rotating offset, so that an idle set is filled evenly rather than from the first backend.
+type LeastConnections struct {
+	backends []*Backend
+	next     atomic.Uint64
+}
+
+func (p *LeastConnections) Pick(client net.Addr) *Backend {
+	start := int((p.next.Add(1) - 1) % uint64(len(p.backends)))
+	var best *Backend
+	for i := range p.backends {
+		b := p.backends[(start+i)%len(p.backends)]
+		if b.State() == StateHealthy && (best == nil || b.Active() < best.Active()) {
+			best = b
+		}
+	}
+	return best
+}
+
+// PowerOfTwoChoices samples two distinct backends at random and picks the one with fewer active connections. It gets
+// close to least-connections without looking at every backend, and doesn't herd onto one backend on stale counts.
+type PowerOfTwoChoices struct {
+	backends []*Backend
+}
+
+func (p *PowerOfTwoChoices) Pick(client net.Addr) *Backend {
+	backends := healthy(p.backends)
+	n := len(backends)
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+	i := rand.IntN(n)
+	j := rand.IntN(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := backends[i], backends[j]
+	if b.Active() < a.Active() {
+		return b
+	}
+	return a
+}
+
+// virtualNodes is the number of points each unit of weight puts on the hash ring. More points spread the keys more
+// evenly, at the cost of a bigger ring to search.
+const virtualNodes = 100
+
+// ConsistentHash maps the client IP onto a hash ring, so that a client keeps landing on the same backend, and a backend
+// going out of rotation only moves its own clients, to the next healthy backend along the ring. The port is left out of
+// the key: every connection of a client comes from a different one.
+type ConsistentHash struct {
+	points []uint64 // sorted
+	owners []*Backend
+}
+
+func NewConsistentHash(backends []*Backend) *ConsistentHash {
+	type point struct {
+		hash  uint64
+		owner *Backend
+	}
+	var ring []point
+	for _, b := range backends {
+		for i := 0; i < b.Weight()*virtualNodes; i++ {
+			ring = append(ring, point{hashKey(fmt.Sprintf("%s#%d", b.Addr, i)), b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	p := &ConsistentHash{points: make([]uint64, len(ring)), owners: make([]*Backend, len(ring))}
+	for i, pt := range ring {
+		p.points[i], p.owners[i] = pt.hash, pt.owner
+	}
+	return p
+}
+
+func (p *ConsistentHash) Pick(client net.Addr) *Backend {
+	h := hashKey(clientKey(client))
+	start := sort.Search(len(p.points), func(i int) bool { return p.points[i] >= h })
+	for i := range p.points {
+		if b := p.owners[(start+i)%len(p.points)]; b.State() == StateHealthy {
+			return b
+		}
+	}
+	return nil
+}
+
+func clientKey(client net.Addr) string {
+	switch a := client.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(client.String()); err == nil {
+		return host
+	}
+	return client.String()
+}
+
+// hashKey is FNV-1a followed by the splitmix64 finalizer: FNV alone leaves similar keys (like the virtual nodes of one
+// backend) clustered on the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Weighted is nginx's smooth weighted round-robin: every pick adds each backend's weight to its current score, takes the
+// highest scorer and subtracts the total weight from it. Backends get picked in proportion to their weights, and the
+// picks of a heavy backend are interleaved with the others rather than sent in a burst. Backends out of rotation sit the
+// rounds out.
+type Weighted struct {
+	mu       sync.Mutex
+	backends []*Backend
+	current  []int
+}
+
+func NewWeighted(backends []*Backend) *Weighted {
+	return &Weighted{backends: backends, current: make([]int, len(backends))}
+}
+
+func (p *Weighted) Pick(client net.Addr) *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, total := -1, 0
+	for i, b := range p.backends {
+		if b.State() != StateHealthy {
+			continue
+		}
+		w := b.Weight()
+		p.current[i] += w
+		total += w
+		if best < 0 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	p.current[best] -= total
+	return p.backends[best]
+}
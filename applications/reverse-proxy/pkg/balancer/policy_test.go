@@ -0,0 +1,377 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// fakeConnector hands out in-memory connections, and records whether it has been closed.
+type fakeConnector struct {
+	addr   string
+	err    error // returned by Get, if set
+	closed bool
+}
+
+func (c *fakeConnector) Get(client net.Addr) (net.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, nil
+}
+
+func (c *fakeConnector) Return(conn net.Conn)  { conn.Close() }
+func (c *fakeConnector) Discard(conn net.Conn) { conn.Close() }
+
+func (c *fakeConnector) Close() error {
+	c.closed = true
+	return nil
+}
+
+// newBackends makes a backend named after each letter of names, at port 1 of that host, weighted by the weights if
+// there are any.
+func newBackends(names string, weights ...int) []*Backend {
+	var backends []*Backend
+	for i, name := range strings.Split(names, "") {
+		weight := 1
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		addr := name + ":1"
+		backends = append(backends, NewBackend(addr, weight, &fakeConnector{addr: addr}))
+	}
+	return backends
+}
+
+func clientAddr(i int) net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 40000 + i%1000}
+}
+
+// picks returns the names of the backends picked by n calls of the policy.
+func picks(p Policy, n int) string {
+	var sb strings.Builder
+	for i := range n {
+		if b := p.Pick(clientAddr(i)); b != nil {
+			sb.WriteString(b.Addr[:1])
+		} else {
+			sb.WriteString("-")
+		}
+	}
+	return sb.String()
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name      string
+		backends  string
+		unhealthy string
+		want      string
+	}{
+		{"in turn", "abc", "", "abcabcabc"},
+		{"skips unhealthy", "abc", "b", "accacc"},
+		{"none healthy", "ab", "ab", "----"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := newBackends(tt.backends, 5, 1, 1)
+			setStates(backends, tt.unhealthy, StateUnhealthy)
+			if got := picks(&RoundRobin{backends: backends}, len(tt.want)); got != tt.want {
+				t.Errorf("picked %s, want %s, whatever the weights", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   []int
+		unhealthy string
+		want      string
+	}{
+		{"nginx smooth sequence", []int{5, 1, 1}, "", "aabacaa" + "aabacaa"},
+		{"equal weights", []int{1, 1, 1}, "", "abcabc"},
+		{"heavy backend interleaved", []int{2, 1}, "", "abaaba"},
+		{"unhealthy sits out", []int{5, 1, 1}, "a", "bcbcbc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := newBackends("abc"[:len(tt.weights)], tt.weights...)
+			setStates(backends, tt.unhealthy, StateEjected)
+			if got := picks(NewWeighted(backends), len(tt.want)); got != tt.want {
+				t.Errorf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	tests := []struct {
+		name      string
+		active    []int64
+		unhealthy string
+		want      string
+	}{
+		{"minimum", []int64{3, 1, 2}, "", "b"},
+		{"minimum first", []int64{0, 2, 1}, "", "a"},
+		{"minimum last", []int64{3, 2, 0}, "", "c"},
+		{"unhealthy minimum skipped", []int64{3, 1, 2}, "b", "c"},
+		{"none healthy", []int64{0, 0, 0}, "abc", "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := newBackends("abc")
+			for i, n := range tt.active {
+				backends[i].active.Store(n)
+			}
+			setStates(backends, tt.unhealthy, StateUnhealthy)
+			p := &LeastConnections{backends: backends}
+			// Whatever offset the scan starts at.
+			for i := range len(backends) {
+				if got := picks(p, 1); got != tt.want {
+					t.Errorf("pick %d: picked %s, want %s", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastConnections_SpreadsTies(t *testing.T) {
+	p := &LeastConnections{backends: newBackends("abc")}
+	if got := picks(p, 6); got != "abcabc" {
+		t.Errorf("picked %s from an idle set, want abcabc", got)
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	got := picks(&PowerOfTwoChoices{backends: newBackends("abcd")}, 1000)
+	for _, name := range "abcd" {
+		if n := strings.Count(got, string(name)); n < 150 {
+			t.Errorf("backend %c picked %d times of 1000", name, n)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		unhealthy string
+		allowed   string
+	}{
+		{"some unhealthy", "bd", "ac"},
+		{"one healthy", "abc", "d"},
+		{"none healthy", "abcd", "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := newBackends("abcd")
+			setStates(backends, tt.unhealthy, StateEjected)
+			got := picks(&PowerOfTwoChoices{backends: backends}, 1000)
+			for _, name := range got {
+				if !strings.ContainsRune(tt.allowed, name) {
+					t.Fatalf("picked %c, want one of %s", name, tt.allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestPowerOfTwoChoices_PrefersLessLoaded(t *testing.T) {
+	backends := newBackends("ab")
+	backends[0].active.Store(5)
+	if got := picks(&PowerOfTwoChoices{backends: backends}, 20); got != strings.Repeat("b", 20) {
+		t.Errorf("picked %s, want always b, the less loaded of the only two", got)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	const clients = 2000
+	backends := newBackends("abcd")
+	p := NewConsistentHash(backends)
+	before := picks(p, clients)
+
+	if again := picks(p, clients); again != before {
+		t.Error("the same clients got different backends")
+	}
+	// Different ports of the same client IP land on the same backend.
+	for i := range 10 {
+		addr := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 50000 + i}
+		if b := p.Pick(addr); b != p.Pick(&net.TCPAddr{IP: addr.IP, Port: 1}) {
+			t.Fatalf("port %d got %s", addr.Port, b.Addr)
+		}
+	}
+	for _, name := range "abcd" {
+		if n := strings.Count(before, string(name)); n < clients/8 {
+			t.Errorf("backend %c got %d of %d clients", name, n, clients)
+		}
+	}
+
+	// Taking a backend away only moves its own clients.
+	tests := []struct {
+		name  string
+		after func() Policy
+	}{
+		{"backend removed", func() Policy { return NewConsistentHash([]*Backend{backends[0], backends[1], backends[3]}) }},
+		{"backend out of rotation", func() Policy {
+			backends[2].state.Store(int32(StateUnhealthy))
+			return p
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := picks(tt.after(), clients)
+			for i := range clients {
+				switch {
+				case before[i] != 'c' && after[i] != before[i]:
+					t.Fatalf("client %d moved from %c to %c, though its backend is still there", i, before[i], after[i])
+				case after[i] == 'c':
+					t.Fatalf("client %d still on the removed backend", i)
+				}
+			}
+		})
+	}
+}
+
+func TestConsistentHash_Weights(t *testing.T) {
+	got := picks(NewConsistentHash(newBackends("ab", 3, 1)), 4000)
+	if a := strings.Count(got, "a"); a < 2600 || a > 3400 {
+		t.Errorf("backend of weight 3 got %d of 4000 clients, want about 3000", a)
+	}
+}
+
+func TestBalancer_GetReturn(t *testing.T) {
+	lb, err := New("round-robin", newBackends("ab"), DefaultHealthConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := lb.Backends()[0], lb.Backends()[1]
+	first, err := lb.Get(clientAddr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := lb.Get(clientAddr(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Active() != 1 || b.Active() != 1 {
+		t.Fatalf("%d and %d active, want a connection on each backend", a.Active(), b.Active())
+	}
+	lb.Return(first)
+	lb.Discard(second)
+	if a.Active() != 0 || b.Active() != 0 || a.Total() != 1 || b.Total() != 1 {
+		t.Errorf("after Return and Discard: %d and %d active, %d and %d total", a.Active(), b.Active(), a.Total(), b.Total())
+	}
+
+	// A failed connection isn't counted.
+	refused := errors.New("connection refused")
+	a.connector.(*fakeConnector).err = refused
+	if _, err := lb.Get(clientAddr(2)); !errors.Is(err, refused) {
+		t.Fatalf("Get: %v, want the connector's error", err)
+	}
+	if a.Active() != 0 || a.Total() != 1 {
+		t.Errorf("after a failed Get: %d active, %d total", a.Active(), a.Total())
+	}
+}
+
+func TestParseBackends(t *testing.T) {
+	newConnector := func(addr string) (connector.BackendConnector, error) { return &fakeConnector{addr: addr}, nil }
+	backends, err := ParseBackends(" a:1=3, b:2 ,", newConnector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backends) != 2 || backends[0].Addr != "a:1" || backends[0].Weight() != 3 || backends[1].Addr != "b:2" || backends[1].Weight() != 1 {
+		t.Errorf("parsed %+v", backends)
+	}
+	for _, list := range []string{"", "a:1=0", "a:1=x", "noport", "a:1,a:1"} {
+		if _, err := ParseBackends(list, newConnector); err == nil {
+			t.Errorf("ParseBackends(%q) succeeded", list)
+		}
+	}
+}
+
+func TestBalancer_Update(t *testing.T) {
+	lb, err := New("weighted", newBackends("ab", 2, 1), DefaultHealthConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := lb.Backends()[0], lb.Backends()[1]
+	a.active.Store(3)
+	b.state.Store(int32(StateEjected))
+
+	var created []string
+	newConnector := func(addr string) (connector.BackendConnector, error) {
+		created = append(created, addr)
+		return &fakeConnector{addr: addr}, nil
+	}
+	if err := lb.Update("b:1=5,c:1", newConnector); err != nil {
+		t.Fatal(err)
+	}
+
+	backends := lb.Backends()
+	if len(backends) != 2 || backends[0] != b || backends[1].Addr != "c:1" {
+		t.Fatalf("backends %v, want b (in place) and c", names(backends))
+	}
+	if b.Weight() != 5 || b.State() != StateEjected {
+		t.Errorf("b has weight %d and state %s, want 5 and still ejected", b.Weight(), b.State())
+	}
+	if fmt.Sprint(created) != "[c:1]" {
+		t.Errorf("connectors created for %v, want only c", created)
+	}
+	if !a.connector.(*fakeConnector).closed || b.connector.(*fakeConnector).closed {
+		t.Error("want the connector of the removed backend closed, and only that one")
+	}
+	// b is ejected, so c takes everything, with the weights of the new set.
+	if got := picks(lb.set.Load().policy, 3); got != "ccc" {
+		t.Errorf("picked %s, want ccc", got)
+	}
+
+	for _, list := range []string{"", "b:1,b:1", "b:1=0", "noport"} {
+		if err := lb.Update(list, newConnector); err == nil {
+			t.Errorf("Update(%q) succeeded", list)
+		}
+	}
+	if got := names(lb.Backends()); got != "bc" {
+		t.Errorf("backends %s after failed updates, want bc", got)
+	}
+}
+
+func TestBalancer_UpdateKeepsActiveCounts(t *testing.T) {
+	lb, err := New("round-robin", newBackends("a"), DefaultHealthConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := lb.Get(clientAddr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := lb.Backends()[0]
+	if err := lb.Update("a:1=3", func(addr string) (connector.BackendConnector, error) { return &fakeConnector{addr: addr}, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if lb.Backends()[0] != a || a.Active() != 1 {
+		t.Fatalf("after reweighting: %d active on the backend, want the in-flight connection", a.Active())
+	}
+	lb.Return(conn)
+	if a.Active() != 0 {
+		t.Errorf("%d active after the connection was returned", a.Active())
+	}
+}
+
+func setStates(backends []*Backend, names string, state State) {
+	for _, b := range backends {
+		if strings.Contains(names, b.Addr[:1]) {
+			b.state.Store(int32(state))
+		}
+	}
+}
+func names(backends []*Backend) string {
+	var sb strings.Builder
+	for _, b := range backends {
+		sb.WriteString(b.Addr[:1])
+	}
+	return sb.String()
+}
@@ -1,48 +1,78 @@
 package connector
 
 import (
+	"context"
 	"net"
+	"time"
 
 	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/pool"
 )
 
+// BackendConnector hands out backend connections for client connections. Get is passed the address of the client, so
+// that connectors choosing between several backends can take it into account. Every connection Get hands out must be
+// given back once the client is done with it: to Return if it can carry another client, or to Discard, which closes
+// it, if it can't (e.g. it has been shut down, or a response on it was cut short).
 type BackendConnector interface {
-	Get() (net.Conn, error)
+	Get(client net.Addr) (net.Conn, error)
 	Return(net.Conn)
+	Discard(net.Conn)
 }
 
 type AlwaysDialConnector struct {
 	backendAddr string
+	dialer      net.Dialer
 }
 
-func NewAlwaysDialConnector(backendAddr string) *AlwaysDialConnector {
-	return &AlwaysDialConnector{backendAddr: backendAddr}
+// NewAlwaysDialConnector dials backendAddr for every client, giving up after dialTimeout (0 for the OS's own timeout).
+func NewAlwaysDialConnector(backendAddr string, dialTimeout time.Duration) *AlwaysDialConnector {
+	return &AlwaysDialConnector{backendAddr: backendAddr, dialer: net.Dialer{Timeout: dialTimeout}}
 }
 
-func (adc *AlwaysDialConnector) Get() (net.Conn, error) {
-	return net.Dial("tcp", adc.backendAddr)
+func (adc *AlwaysDialConnector) Get(client net.Addr) (net.Conn, error) {
+	return adc.dialer.Dial("tcp", adc.backendAddr)
 }
 
 func (adc *AlwaysDialConnector) Return(conn net.Conn) {
 	conn.Close()
 }
 
+func (adc *AlwaysDialConnector) Discard(conn net.Conn) {
+	conn.Close()
+}
+
 type PoolConnector struct {
-	pool *pool.ConnPool
+	pool            *pool.ConnPool
+	checkoutTimeout time.Duration
 }
 
-func NewPoolConnector(backendAddr string, size int) (*PoolConnector, error) {
-	p, err := pool.NewConnPool(backendAddr, size)
+func NewPoolConnector(backendAddr string, cfg pool.Config) (*PoolConnector, error) {
+	p, err := pool.NewConnPool(backendAddr, cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &PoolConnector{pool: p}, nil
+	return &PoolConnector{pool: p, checkoutTimeout: cfg.CheckoutTimeout}, nil
 }
 
-func (pc *PoolConnector) Get() (net.Conn, error) {
-	return pc.pool.Get()
+func (pc *PoolConnector) Get(client net.Addr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pc.checkoutTimeout)
+	defer cancel()
+	return pc.pool.Get(ctx)
 }
 
 func (pc *PoolConnector) Return(conn net.Conn) {
 	pc.pool.Return(conn)
 }
+
+func (pc *PoolConnector) Discard(conn net.Conn) {
+	pc.pool.Discard(conn)
+}
+
+func (pc *PoolConnector) Stats() pool.Snapshot {
+	return pc.pool.Stats()
+}
+
+// Close closes the pool. Connections still checked out are closed as they are returned.
+func (pc *PoolConnector) Close() error {
+	pc.pool.Close()
+	return nil
+}
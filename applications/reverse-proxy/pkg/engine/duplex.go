@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// duplex copies both directions between the client and the backend until both are done, and returns the bytes copied
+// upstream (client to backend) and downstream. When one direction reaches EOF, the write side of its destination is shut
+// down, so that its peer sees the EOF too while the other direction carries on: a TCP half-close goes through the proxy
+// as it would without it. An error in either direction aborts both, and is the one returned.
+func duplex(client, backend net.Conn) (upstream, downstream int64, err error) {
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	abort := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			// Unblocks the other direction, which then fails with a deadline error that is not reported.
+			client.SetDeadline(time.Now())
+			backend.SetDeadline(time.Now())
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		if upstream, err = halfDuplex(backend, client); err != nil {
+			abort(err)
+		}
+	}()
+	var downErr error
+	if downstream, downErr = halfDuplex(client, backend); downErr != nil {
+		abort(downErr)
+	}
+	wg.Wait()
+	return upstream, downstream, firstErr
+}
+
+// halfDuplex copies src to dst until EOF and then shuts down the write side of dst. A *net.TCPConn destination copies
+// with ReadFrom, which splice(2)s from a TCP source through a kernel pipe without the data ever reaching user space.
+func halfDuplex(dst, src net.Conn) (int64, error) {
+	var (
+		n   int64
+		err error
+	)
+	if rf, ok := dst.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		return n, err
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		err = cw.CloseWrite()
+	}
+	return n, err
+}
@@ -1,189 +1,74 @@
 package engine
 
 import (
-	"io"
 	"log"
 	"net"
-	"os"
 	"sync"
 
-	"golang.org/x/sys/unix"
-
 	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
 )
 
 type Engine interface {
 	Start()
 	Serve(clientConn net.Conn, backend connector.BackendConnector) error
+	Stats() *Stats
 }
 
-type GoroutineEngine struct{}
-
-func (ge *GoroutineEngine) Start() {
-	// No initialization needed for goroutine engine
-}
-
-func (ge *GoroutineEngine) Serve(clientConn net.Conn, backend connector.BackendConnector) error {
-	go func() {
-		defer clientConn.Close()
-
-		backendConn, err := backend.Get()
-		if err != nil {
-			log.Printf("backend connect failed: %v", err)
-			return
-		}
-		defer backend.Return(backendConn)
-
-		go io.Copy(backendConn, clientConn)
-		io.Copy(clientConn, backendConn)
-	}()
-	return nil
-}
+type GoroutineEngine struct {
+	Limits Limits
 
-type EpollEngine struct {
-	epfd  int
-	conns map[int]*ProxyConn
-	mu    sync.Mutex
+	stats     Stats
+	guardOnce sync.Once
+	guard     *guard
 }
 
-type ProxyConn struct {
-	clientFd   int
-	backendFd  int
-	clientBuf  []byte
-	backendBuf []byte
-}
-
-func NewEpollEngine() (*EpollEngine, error) {
-	epfd, err := unix.EpollCreate1(0)
-	if err != nil {
-		return nil, err
-	}
-	return &EpollEngine{
-		epfd:  epfd,
-		conns: make(map[int]*ProxyConn),
-	}, nil
+func (ge *GoroutineEngine) Start() {
+	ge.init()
 }
 
-func (e *EpollEngine) Start() {
-	go e.Loop()
+func (ge *GoroutineEngine) init() {
+	ge.guardOnce.Do(func() { ge.guard = newGuard(ge.Limits, &ge.stats) })
 }
 
-func (e *EpollEngine) Serve(client net.Conn, backend connector.BackendConnector) error {
-	backendConn, err := backend.Get()
-	if err != nil {
-		log.Printf("backend connect failed: %v", err)
-		return err
-	}
-	// no defer backend.Return(backendConn) here, will be handled in closeConn
-
-	clientFd, err := fdFromConn(client)
-	if err != nil {
-		return err
-	}
-	backendFd, err := fdFromConn(backendConn)
+func (ge *GoroutineEngine) Serve(clientConn net.Conn, backend connector.BackendConnector) error {
+	ge.init()
+	gc, err := ge.guard.admit(clientConn.RemoteAddr())
 	if err != nil {
+		clientConn.Close()
 		return err
 	}
+	go func() {
+		defer clientConn.Close()
 
-	pc := &ProxyConn{
-		clientFd:   clientFd,
-		backendFd:  backendFd,
-		clientBuf:  make([]byte, 32*1024),
-		backendBuf: make([]byte, 32*1024),
-	}
-
-	e.mu.Lock()
-	e.conns[clientFd] = pc
-	e.conns[backendFd] = pc
-	e.mu.Unlock()
-
-	ev := &unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLET}
-	ev.Fd = int32(clientFd)
-	if err := unix.EpollCtl(e.epfd, unix.EPOLL_CTL_ADD, clientFd, ev); err != nil {
-		return err
-	}
-	ev.Fd = int32(backendFd)
-	if err := unix.EpollCtl(e.epfd, unix.EPOLL_CTL_ADD, backendFd, ev); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (e *EpollEngine) Loop() {
-	events := make([]unix.EpollEvent, 128)
-	for {
-		n, err := unix.EpollWait(e.epfd, events, -1)
-		if err != nil && err != unix.EINTR {
-			log.Printf("epoll wait error: %v", err)
-			continue
-		}
-		for i := 0; i < n; i++ {
-			fd := int(events[i].Fd)
-			e.handleEvent(fd, events[i].Events)
-		}
-	}
-}
-
-func (e *EpollEngine) handleEvent(fd int, events uint32) {
-	e.mu.Lock()
-	pc, ok := e.conns[fd]
-	e.mu.Unlock()
-	if !ok {
-		return
-	}
-
-	var srcFd, dstFd int
-	var buf []byte
-
-	if fd == pc.clientFd {
-		srcFd, dstFd, buf = pc.clientFd, pc.backendFd, pc.clientBuf
-	} else {
-		srcFd, dstFd, buf = pc.backendFd, pc.clientFd, pc.backendBuf
-	}
-
-	if events&unix.EPOLLIN != 0 {
-		n, err := unix.Read(srcFd, buf)
+		backendConn, err := backend.Get(clientConn.RemoteAddr())
 		if err != nil {
-			log.Printf("read error fd %d: %v", srcFd, err)
-			e.closeConn(pc)
-			return
-		}
-		if n == 0 {
-			e.closeConn(pc)
+			ge.guard.connectFailed(err)
+			gc.release(err)
+			log.Printf("backend connect failed: %v", err)
 			return
 		}
-		_, err = unix.Write(dstFd, buf[:n])
+		ge.stats.Connections.Add(1)
+
+		// Failing the blocked reads and writes has duplex return, with a deadline error release replaces.
+		gc.track(connIdle(clientConn), func() {
+			clientConn.SetDeadline(aLongTimeAgo)
+			backendConn.SetDeadline(aLongTimeAgo)
+		})
+		upstream, downstream, err := duplex(clientConn, backendConn)
+		err = gc.release(err)
+		ge.stats.Upstream.Add(uint64(upstream))
+		ge.stats.Downstream.Add(uint64(downstream))
 		if err != nil {
-			log.Printf("write error fd %d: %v", dstFd, err)
-			e.closeConn(pc)
-			return
+			ge.stats.countError(err)
+			log.Printf("proxy error for client %s: %v", clientConn.RemoteAddr(), err)
 		}
-	}
-}
-
-func (e *EpollEngine) closeConn(pc *ProxyConn) {
-	unix.Close(pc.clientFd)
-	unix.Close(pc.backendFd)
 
-	e.mu.Lock()
-	delete(e.conns, pc.clientFd)
-	delete(e.conns, pc.backendFd)
-	e.mu.Unlock()
+		// By now the backend connection has been shut down for writing (or aborted), so it can't carry another client.
+		backend.Discard(backendConn)
+	}()
+	return nil
 }
 
-func fdFromConn(c net.Conn) (int, error) {
-	tcpConn, ok := c.(*net.TCPConn)
-	if !ok {
-		return -1, os.ErrInvalid
-	}
-	f, err := tcpConn.File()
-	if err != nil {
-		return -1, err
-	}
-
-	// Dup so we can safely close net.Conn without losing fd
-	fd := int(f.Fd())
-	unix.SetNonblock(fd, true)
-	return fd, nil
+func (ge *GoroutineEngine) Stats() *Stats {
+	return &ge.stats
 }
@@ -0,0 +1,510 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/pool"
+)
+
+var engines = map[string]func(Limits) (Engine, error){
+	"goroutine": func(l Limits) (Engine, error) { return &GoroutineEngine{Limits: l}, nil },
+	"epoll":     func(l Limits) (Engine, error) { return NewEpollEngine(l) },
+	"sharded":   func(l Limits) (Engine, error) { return NewShardedEpollEngine(ShardedConfig{Loops: 4, Limits: l}) },
+	"uring":     func(l Limits) (Engine, error) { return NewUringEngine(l) },
+}
+
+func forEachEngine(t *testing.T, test func(t *testing.T, newEngine func() (Engine, error))) {
+	for name, newEngine := range engines {
+		t.Run(name, func(t *testing.T) {
+			skipUnsupported(t, name)
+			test(t, func() (Engine, error) { return newEngine(Limits{}) })
+		})
+	}
+}
+
+func skipUnsupported(t testing.TB, name string) {
+	if name == "uring" {
+		if err := UringSupported(); err != nil {
+			t.Skip(err)
+		}
+	}
+}
+
+// startProxy serves connections to a listener on a random port with the engine, forwarding to backendAddr.
+func startProxy(t testing.TB, eng Engine, backendAddr string) string {
+	t.Helper()
+	return startProxyWith(t, eng, connector.NewAlwaysDialConnector(backendAddr, 0))
+}
+
+// startProxyWith is startProxy with the connector to the backend.
+func startProxyWith(t testing.TB, eng Engine, backend connector.BackendConnector) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng.Start()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			eng.Serve(conn, backend)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		if c, ok := eng.(io.Closer); ok {
+			c.Close()
+		}
+	})
+	return ln.Addr().String()
+}
+
+func newPoolConnector(t testing.TB, addr string) *connector.PoolConnector {
+	t.Helper()
+	cfg := pool.DefaultConfig()
+	cfg.MinIdle = 0
+	pc, err := connector.NewPoolConnector(addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// startBackend runs handle for every connection to a listener on a random port.
+func startBackend(t testing.TB, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// echo writes back what it reads until EOF, and then closes, which is how the EOF goes back through the proxy.
+func echo(conn net.Conn) { io.Copy(conn, conn) }
+
+func newEchoProxy(t testing.TB, newEngine func() (Engine, error)) (string, Engine) {
+	t.Helper()
+	eng, err := newEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startProxy(t, eng, startBackend(t, echo)), eng
+}
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rng.Uint32())
+	}
+	return b
+}
+
+// transfer describes how a client sends its data through an echo proxy and reads the echo back.
+type transfer struct {
+	data []byte
+	// chunk is the size of the writes, writeDelay the pause after each.
+	chunk      int
+	writeDelay time.Duration
+	// stall is how long the client waits before it starts reading, readDelay the pause after each read of readChunk.
+	stall     time.Duration
+	readChunk int
+	readDelay time.Duration
+}
+
+// run sends the data, shuts down the write side of the connection, and checks that exactly the data comes back,
+// followed by EOF.
+func (tr transfer) run(t testing.TB, proxyAddr string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	chunk := max(tr.chunk, 1)
+	writeErr := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(tr.data); off += chunk {
+			if _, err := conn.Write(tr.data[off:min(off+chunk, len(tr.data))]); err != nil {
+				writeErr <- err
+				return
+			}
+			if tr.writeDelay > 0 {
+				time.Sleep(tr.writeDelay)
+			}
+		}
+		writeErr <- conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	time.Sleep(tr.stall)
+	readChunk := tr.readChunk
+	if readChunk <= 0 {
+		readChunk = 64 * 1024
+	}
+	var got bytes.Buffer
+	buf := make([]byte, readChunk)
+	for {
+		n, err := conn.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read after %d of %d bytes: %v", got.Len(), len(tr.data), err)
+		}
+		if tr.readDelay > 0 {
+			time.Sleep(tr.readDelay)
+		}
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), tr.data) {
+		t.Fatalf("echoed %d bytes, want the %d sent (first difference at %d)", got.Len(), len(tr.data), firstDiff(got.Bytes(), tr.data))
+	}
+}
+
+func firstDiff(a, b []byte) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+func TestEngine_LargeTransfer(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		addr, eng := newEchoProxy(t, newEngine)
+		data := randomBytes(rand.New(rand.NewPCG(1, 1)), 32<<20)
+		transfer{data: data, chunk: 1 << 20}.run(t, addr)
+
+		stats := eng.Stats()
+		if up, down := stats.Upstream.Load(), stats.Downstream.Load(); up != uint64(len(data)) || down != uint64(len(data)) {
+			t.Errorf("upstream=%d downstream=%d bytes, want %d both ways", up, down, len(data))
+		}
+	})
+}
+
+// A client that doesn't read for a while makes the proxy's writes to it fail with EAGAIN once the socket buffers are
+// full, which must hold the backend back rather than lose data.
+func TestEngine_StalledReader(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		addr, _ := newEchoProxy(t, newEngine)
+		data := randomBytes(rand.New(rand.NewPCG(2, 2)), 16<<20)
+		transfer{data: data, chunk: 256 * 1024, stall: 300 * time.Millisecond}.run(t, addr)
+	})
+}
+
+func TestEngine_SlowReader(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		addr, _ := newEchoProxy(t, newEngine)
+		data := randomBytes(rand.New(rand.NewPCG(3, 3)), 4<<20)
+		transfer{data: data, chunk: 64 * 1024, readChunk: 16 * 1024, readDelay: time.Millisecond}.run(t, addr)
+	})
+}
+
+func TestEngine_SlowWriter(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		addr, _ := newEchoProxy(t, newEngine)
+		data := randomBytes(rand.New(rand.NewPCG(4, 4)), 256*1024)
+		transfer{data: data, chunk: 1000, writeDelay: time.Millisecond}.run(t, addr)
+	})
+}
+
+// The backend closing first (EPOLLRDHUP, then EPOLLHUP once the client has closed too) must deliver everything it sent.
+func TestEngine_BackendClosesFirst(t *testing.T) {
+	data := randomBytes(rand.New(rand.NewPCG(5, 5)), 8<<20)
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		eng, err := newEngine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		backendAddr := startBackend(t, func(conn net.Conn) { conn.Write(data) })
+		addr := startProxy(t, eng, backendAddr)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("got %d bytes, want the %d the backend sent", len(got), len(data))
+		}
+	})
+}
+
+func TestEngine_BackendDown(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		eng, err := newEngine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A port that was just free is very likely to refuse connections.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		backendAddr := ln.Addr().String()
+		ln.Close()
+		addr := startProxy(t, eng, backendAddr)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("read from a connection to a down backend succeeded")
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("connection to a down backend was left open")
+		}
+	})
+}
+
+// Backend connections are shut down by the time a client is done, so the engines discard them: each client takes a
+// pool slot that is freed when it is done, and no connection is counted as broken for failing the liveness check.
+func TestEngine_DiscardsPooledBackendConnections(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		eng, err := newEngine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend := newPoolConnector(t, startBackend(t, echo))
+		addr := startProxyWith(t, eng, backend)
+
+		data := randomBytes(rand.New(rand.NewPCG(6, 6)), 1<<10)
+		for range 3 {
+			transfer{data: data}.run(t, addr)
+			for deadline := time.Now().Add(5 * time.Second); backend.Stats().Open != 0; time.Sleep(5 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the backend connection wasn't given back")
+				}
+			}
+		}
+		if s := backend.Stats(); s.Dials != 3 || s.Broken != 0 || s.Idle != 0 {
+			t.Errorf("pool stats %s", s)
+		}
+	})
+}
+
+// Closing the epoll engine stops its loop, which closes the connections still open and gives their backend
+// connections back, and makes Serve refuse new ones.
+func TestEpollEngine_CloseStopsLoop(t *testing.T) {
+	eng, err := NewEpollEngine(Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newPoolConnector(t, startBackend(t, echo))
+	addr := startProxyWith(t, eng, backend)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	eng.Close()
+	if _, err := conn.Read(buf); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read after Close: %v, want the connection closed", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); backend.Stats().Open != 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the backend connection wasn't given back")
+		}
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	if err := eng.Serve(client, backend); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve after Close: %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// TestEngine_ConcurrentRandomTransfers runs many connections at once, with random sizes, chunking and pauses, so that
+// the connections' events interleave in the loop.
+func TestEngine_ConcurrentRandomTransfers(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		addr, _ := newEchoProxy(t, newEngine)
+		seed := uint64(time.Now().UnixNano())
+		t.Logf("seed %d", seed)
+		rng := rand.New(rand.NewPCG(seed, 6))
+
+		var transfers []transfer
+		for range 50 {
+			transfers = append(transfers, randomTransfer(rng, 2<<20))
+		}
+		var wg sync.WaitGroup
+		for i, tr := range transfers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.Run(fmt.Sprint(i), func(t *testing.T) { tr.run(t, addr) })
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func randomTransfer(rng *rand.Rand, maxSize int) transfer {
+	tr := transfer{
+		data:      randomBytes(rng, rng.IntN(maxSize+1)),
+		chunk:     1 + rng.IntN(2*bufferSize),
+		readChunk: 1 + rng.IntN(2*bufferSize),
+	}
+	if rng.IntN(4) == 0 {
+		tr.writeDelay = time.Duration(rng.IntN(200)) * time.Microsecond
+	}
+	if rng.IntN(4) == 0 {
+		tr.readDelay = time.Duration(rng.IntN(200)) * time.Microsecond
+	}
+	if rng.IntN(4) == 0 {
+		tr.stall = time.Duration(rng.IntN(100)) * time.Millisecond
+	}
+	return tr
+}
+
+// FuzzEpollEngine_Transfer echoes a transfer of fuzzed size, chunking and pacing through the epoll engine. The seeds
+// cover the edges around the buffer size and the large and slow cases; go test -fuzz explores from there.
+func FuzzEpollEngine_Transfer(f *testing.F) {
+	f.Add(uint32(0), uint32(1), uint32(1), uint8(0), uint64(1))
+	f.Add(uint32(1), uint32(1), uint32(1), uint8(0), uint64(2))
+	f.Add(uint32(bufferSize), uint32(bufferSize), uint32(bufferSize), uint8(0), uint64(3))
+	f.Add(uint32(bufferSize+1), uint32(bufferSize-1), uint32(7), uint8(0), uint64(4))
+	f.Add(uint32(3*bufferSize+17), uint32(4096), uint32(100), uint8(1), uint64(5))
+	f.Add(uint32(8<<20), uint32(1<<20), uint32(1<<16), uint8(0), uint64(6))
+	f.Add(uint32(4<<20), uint32(1<<16), uint32(1<<14), uint8(2), uint64(7))
+	f.Add(uint32(64*1024), uint32(512), uint32(512), uint8(3), uint64(8))
+
+	addr, _ := newEchoProxy(f, func() (Engine, error) { return NewEpollEngine(Limits{}) })
+	f.Fuzz(func(t *testing.T, size, chunk, readChunk uint32, pacing uint8, seed uint64) {
+		tr := transfer{
+			data:      randomBytes(rand.New(rand.NewPCG(seed, 7)), int(size%(16<<20))),
+			chunk:     chunkSize(chunk),
+			readChunk: chunkSize(readChunk),
+		}
+		// pacing picks the slow side: bit 0 the writer, bit 1 the reader.
+		if pacing&1 != 0 {
+			tr.writeDelay = 100 * time.Microsecond
+		}
+		if pacing&2 != 0 {
+			tr.stall = 50 * time.Millisecond
+			tr.readDelay = 100 * time.Microsecond
+		}
+		tr.run(t, addr)
+	})
+}
+
+// chunkSize maps a fuzzed size to 1 byte to 1MiB, keeping the sizes in that range as they are.
+func chunkSize(v uint32) int {
+	return 1 + int((v-1)%(1<<20))
+}
+
+// TestEngine_Listen proxies through the listeners of the engines that accept connections themselves: one
+// SO_REUSEPORT listener per loop for the sharded engine, which the kernel spreads the connections over, and a multishot
+// accept for the io_uring one.
+func TestEngine_Listen(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, newEngine func() (Engine, error)) {
+		eng, err := newEngine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		le, ok := eng.(ListeningEngine)
+		if !ok {
+			if c, ok := eng.(io.Closer); ok {
+				c.Close()
+			}
+			t.Skip("not a listening engine")
+		}
+		eng.Start()
+		t.Cleanup(func() { eng.(io.Closer).Close() })
+		addr, err := le.Listen("127.0.0.1:0", connector.NewAlwaysDialConnector(startBackend(t, echo), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rng := rand.New(rand.NewPCG(9, 9))
+		var transfers []transfer
+		for range 64 {
+			transfers = append(transfers, transfer{data: randomBytes(rng, 64*1024), chunk: 4096})
+		}
+		var wg sync.WaitGroup
+		for i, tr := range transfers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.Run(fmt.Sprint(i), func(t *testing.T) { tr.run(t, addr.String()) })
+			}()
+		}
+		wg.Wait()
+
+		if n := eng.Stats().Connections.Load(); n != uint64(len(transfers)) {
+			t.Errorf("%d connections proxied, want %d", n, len(transfers))
+		}
+		if sharded, ok := eng.(*ShardedEpollEngine); ok {
+			for i, stats := range sharded.LoopStats() {
+				t.Logf("loop %d: %s", i, stats)
+			}
+		}
+	})
+}
+
+// BenchmarkEngine_Transfer echoes 1MiB through each engine per iteration, on a new connection every time, so that the
+// engines can be compared on the same footing: go test ./pkg/engine -run XXX -bench Transfer
+func BenchmarkEngine_Transfer(b *testing.B) {
+	data := randomBytes(rand.New(rand.NewPCG(10, 10)), 1<<20)
+	for _, name := range slices.Sorted(maps.Keys(engines)) {
+		b.Run(name, func(b *testing.B) {
+			skipUnsupported(b, name)
+			addr, _ := newEchoProxy(b, func() (Engine, error) { return engines[name](Limits{}) })
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				transfer{data: data, chunk: 64 * 1024}.run(b, addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package engine
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+const bufferSize = 32 * 1024
+
+// EpollEngine runs its own edge-triggered epoll loop over the client and backend sockets, bypassing the Go netpoller.
+//
+// With EPOLLET an event only reports that a socket became ready, so every read loops until EAGAIN: what is left unread
+// would not be reported again. Each direction of a connection has a buffer for what was read from its source but not
+// yet written to its destination. When a write would block, the rest stays in the buffer, reading the source stops,
+// and EPOLLOUT is armed on the destination; when it fires, the buffer is flushed, EPOLLOUT disarmed and reading
+// resumes. So a slow reader on one side holds the other side back through its TCP window, rather than through memory
+// in the proxy.
+//
+// EOF on a source (also announced by EPOLLRDHUP) shuts down the write side of its destination once the buffer has been
+// flushed, and the connection is closed when both directions are done, or on the first error (EPOLLERR, EPOLLHUP
+// with nothing more to read, a reset).
+type EpollEngine struct {
+	poller
+	guard   *guard
+	inbox   *inbox // wakes the loop up to stop it
+	conns   map[int]*ProxyConn
+	mu      sync.Mutex
+	stopped bool // the loop has stopped, under mu: no more connections are registered
+	stats   Stats
+	closed  atomic.Bool
+}
+
+// ProxyConn is a proxied connection: the client and backend sockets, and the two directions between them.
+type ProxyConn struct {
+	client, backend *socket
+	up, down        *direction // up copies from the client to the backend, down from the backend to the client
+
+	clientAddr  net.Addr
+	clientConn  net.Conn // nil if the engine accepted the client socket itself
+	backendConn net.Conn
+	connector   connector.BackendConnector
+	guarded     *guarded
+}
+
+// socket is the engine's own fd of one side of a connection, and the events it is registered for.
+type socket struct {
+	fd     int
+	events uint32
+}
+
+type direction struct {
+	src, dst   *socket
+	buf        []byte
+	start, end int // buf[start:end] was read from src and waits to be written to dst
+	eof        bool
+	shut       bool // the write side of dst has been shut down after eof: this direction is done
+	bytes      *atomic.Uint64
+}
+
+const baseEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLET
+
+func newProxyConn(clientFd, backendFd int, stats *Stats) *ProxyConn {
+	pc := &ProxyConn{
+		client:  &socket{fd: clientFd, events: baseEvents},
+		backend: &socket{fd: backendFd, events: baseEvents},
+	}
+	pc.up = &direction{src: pc.client, dst: pc.backend, buf: make([]byte, bufferSize), bytes: &stats.Upstream}
+	pc.down = &direction{src: pc.backend, dst: pc.client, buf: make([]byte, bufferSize), bytes: &stats.Downstream}
+	return pc
+}
+
+func NewEpollEngine(limits Limits) (*EpollEngine, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	in, err := newInbox()
+	if err != nil {
+		unix.Close(epfd)
+		return nil, err
+	}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, in.fd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(in.fd)}); err != nil {
+		unix.Close(in.fd)
+		unix.Close(epfd)
+		return nil, err
+	}
+	e := &EpollEngine{conns: make(map[int]*ProxyConn), inbox: in}
+	e.poller = poller{epfd: epfd, stats: &e.stats}
+	e.guard = newGuard(limits, &e.stats)
+	return e, nil
+}
+
+func (e *EpollEngine) Start() {
+	go e.Loop()
+}
+
+func (e *EpollEngine) Stats() *Stats {
+	return &e.stats
+}
+
+// Close stops the loop, which closes the connections still open as it exits.
+func (e *EpollEngine) Close() error {
+	if !e.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	e.inbox.post(e.stop)
+	e.guard.close()
+	return nil
+}
+
+func (e *EpollEngine) Serve(client net.Conn, backend connector.BackendConnector) error {
+	if e.closed.Load() {
+		client.Close()
+		return net.ErrClosed
+	}
+	gc, err := e.guard.admit(client.RemoteAddr())
+	if err != nil {
+		client.Close()
+		return err
+	}
+	backendConn, err := backend.Get(client.RemoteAddr())
+	if err != nil {
+		e.guard.connectFailed(err)
+		gc.release(err)
+		log.Printf("backend connect failed: %v", err)
+		client.Close()
+		return err
+	}
+
+	clientFd, err := dupFd(client)
+	if err != nil {
+		gc.release(err)
+		client.Close()
+		releaseBackend(backend, backendConn)
+		return err
+	}
+	backendFd, err := dupFd(backendConn)
+	if err != nil {
+		gc.release(err)
+		unix.Close(clientFd)
+		client.Close()
+		releaseBackend(backend, backendConn)
+		return err
+	}
+	pc := newProxyConn(clientFd, backendFd, &e.stats)
+	pc.clientAddr, pc.clientConn, pc.backendConn, pc.connector = client.RemoteAddr(), client, backendConn, backend
+	pc.guard(gc)
+
+	e.stats.Connections.Add(1)
+	// Both sockets are registered under the lock, so that the loop, which looks connections up under it, doesn't see
+	// events of the first one before the second one is registered.
+	e.mu.Lock()
+	if e.stopped { // Close raced with this connection
+		err = net.ErrClosed
+	} else {
+		e.conns[clientFd] = pc
+		e.conns[backendFd] = pc
+		err = e.register(pc)
+	}
+	e.mu.Unlock()
+	if err != nil {
+		e.closeConn(pc, err)
+		return err
+	}
+	return nil
+}
+
+func (e *EpollEngine) Loop() {
+	events := make([]unix.EpollEvent, 128)
+	for !e.isStopped() {
+		n, err := unix.EpollWait(e.epfd, events, -1)
+		if err != nil {
+			if err != unix.EINTR {
+				log.Printf("epoll wait error: %v", err)
+			}
+			continue
+		}
+		for i := 0; i < n; i++ {
+			e.handleEvent(int(events[i].Fd), events[i].Events)
+		}
+	}
+	e.shutdown()
+}
+
+// stop runs on the loop, posted by Close. From then on Serve refuses connections.
+func (e *EpollEngine) stop() {
+	e.mu.Lock()
+	e.stopped = true
+	e.mu.Unlock()
+	e.inbox.close()
+}
+
+func (e *EpollEngine) isStopped() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stopped
+}
+
+// shutdown closes the connections still open once the loop has stopped, and only then the epoll instance, so that its
+// fd number can't be reused by another engine while this one still uses it.
+func (e *EpollEngine) shutdown() {
+	e.mu.Lock()
+	conns := e.conns
+	e.conns = nil
+	e.mu.Unlock()
+	for fd, pc := range conns {
+		if fd == pc.client.fd {
+			e.close(pc, nil)
+		}
+	}
+	unix.Close(e.epfd)
+}
+
+func (e *EpollEngine) handleEvent(fd int, events uint32) {
+	if fd == e.inbox.fd {
+		e.runPending()
+		return
+	}
+	e.mu.Lock()
+	pc, ok := e.conns[fd]
+	e.mu.Unlock()
+	if !ok {
+		return
+	}
+	if done, err := e.handle(pc, fd, events); done {
+		e.closeConn(pc, err)
+	}
+}
+
+func (e *EpollEngine) runPending() {
+	var buf [8]byte
+	unix.Read(e.inbox.fd, buf[:])
+	for _, f := range e.inbox.take() {
+		f()
+	}
+}
+
+func (e *EpollEngine) closeConn(pc *ProxyConn, err error) {
+	e.mu.Lock()
+	delete(e.conns, pc.client.fd)
+	delete(e.conns, pc.backend.fd)
+	e.mu.Unlock()
+	e.close(pc, err)
+}
+
+// poller is an epoll instance and what it takes to move the data of the connections registered with it. It doesn't
+// keep track of the connections: the engines look them up by fd in their own ways.
+type poller struct {
+	epfd  int
+	stats *Stats
+}
+
+// register adds both sockets of the connection. Registering a socket that is already readable queues an event for it,
+// so nothing sent before this is missed.
+func (p *poller) register(pc *ProxyConn) error {
+	for _, s := range []*socket{pc.client, pc.backend} {
+		ev := &unix.EpollEvent{Events: s.events, Fd: int32(s.fd)}
+		if err := unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, s.fd, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle moves the data the events on fd allow, and reports whether the connection is done: both directions are
+// finished, or it failed with err.
+func (p *poller) handle(pc *ProxyConn, fd int, events uint32) (bool, error) {
+	// in is the direction fd is the source of, out the one it is the destination of. Errors and hangups are left to
+	// the reads and writes of both to run into, after they have moved what can still be moved.
+	in, out := pc.up, pc.down
+	if fd == pc.backend.fd {
+		in, out = pc.down, pc.up
+	}
+	var err error
+	if events&(unix.EPOLLIN|unix.EPOLLRDHUP|unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+		err = p.pump(in)
+	}
+	if err == nil && events&(unix.EPOLLOUT|unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+		err = p.pump(out)
+	}
+	if err == nil && events&unix.EPOLLERR != 0 {
+		err = socketError(fd)
+	}
+	return err != nil || (pc.up.shut && pc.down.shut), err
+}
+
+// pump moves data in one direction until the source has nothing more to read or the destination can't take more,
+// and arms EPOLLOUT on the destination in the latter case.
+func (p *poller) pump(d *direction) error {
+	for !d.shut {
+		for d.start < d.end {
+			n, err := unix.Write(d.dst.fd, d.buf[d.start:d.end])
+			if err == unix.EAGAIN {
+				return p.setWritable(d.dst, true)
+			}
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			d.start += n
+			d.bytes.Add(uint64(n))
+		}
+		d.start, d.end = 0, 0
+		if err := p.setWritable(d.dst, false); err != nil {
+			return err
+		}
+
+		if d.eof {
+			d.shut = true
+			if err := unix.Shutdown(d.dst.fd, unix.SHUT_WR); err != nil && err != unix.ENOTCONN {
+				return err
+			}
+			return nil
+		}
+
+		n, err := unix.Read(d.src.fd, d.buf)
+		switch {
+		case err == unix.EAGAIN:
+			return nil
+		case err == unix.EINTR:
+		case err != nil:
+			return err
+		case n == 0:
+			d.eof = true
+		default:
+			d.end = n
+		}
+	}
+	return nil
+}
+
+// setWritable arms or disarms EPOLLOUT on the socket, if that changes its events.
+func (p *poller) setWritable(s *socket, on bool) error {
+	events := uint32(baseEvents)
+	if on {
+		events |= unix.EPOLLOUT
+	}
+	if s.events == events {
+		return nil
+	}
+	s.events = events
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, s.fd, &unix.EpollEvent{Events: events, Fd: int32(s.fd)})
+}
+
+// guard has gc enforce the timeouts on the connection, aborting it by shutting down both sockets.
+func (pc *ProxyConn) guard(gc *guarded) {
+	pc.guarded = gc
+	clientFd := pc.client.fd
+	gc.track(func() (time.Duration, error) { return tcpIdle(clientFd) }, shutdownFds(clientFd, pc.backend.fd))
+}
+
+// close deregisters and closes the sockets of a connection the engine has forgotten about.
+func (p *poller) close(pc *ProxyConn, err error) {
+	if pc.guarded != nil {
+		err = pc.guarded.release(err)
+	}
+	if err != nil {
+		p.stats.countError(err)
+		log.Printf("proxy error for client %s: %v", pc.clientAddr, err)
+	}
+	// Closing a dup'ed fd alone wouldn't take the socket out of the epoll set while the original is open, and a new
+	// connection could get the same fd number in between.
+	for _, s := range []*socket{pc.client, pc.backend} {
+		unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, s.fd, nil)
+		unix.Close(s.fd)
+	}
+	if pc.clientConn != nil {
+		pc.clientConn.Close()
+	}
+	releaseBackend(pc.connector, pc.backendConn)
+}
+
+// releaseBackend gives back the connection the backend fd was dup'ed from. It has been shut down or broken, so it is
+// discarded, like in the GoroutineEngine.
+func releaseBackend(backend connector.BackendConnector, conn net.Conn) {
+	backend.Discard(conn)
+}
+
+func socketError(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return unix.Errno(errno)
+	}
+	return nil
+}
+
+// dupFd returns a non-blocking duplicate of the fd of a connection (or listener) for the engine to own, so that it
+// doesn't interfere with the Go netpoller, which keeps the original. Unlike with (*net.TCPConn).File, no *os.File is
+// left around to close the fd when it is garbage collected.
+func dupFd(c any) (int, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return -1, os.ErrInvalid
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	var dupErr error
+	if err := raw.Control(func(s uintptr) {
+		fd, dupErr = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+	}); err != nil {
+		return -1, err
+	}
+	if dupErr != nil {
+		return -1, dupErr
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
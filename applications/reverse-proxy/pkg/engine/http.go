@@ -0,0 +1,414 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// Route sends the requests for Host (any host if empty) whose path starts with Prefix to Backend.
+type Route struct {
+	Host    string
+	Prefix  string
+	Backend connector.BackendConnector
+}
+
+// HTTPEngine proxies HTTP/1.1 requests rather than bytes. Each client connection is served by a goroutine, which reads
+// the requests on it one after the other (keep-alive), routes each by host and path prefix, and forwards it over a
+// backend connection that is only held for the duration of the request: it goes back to the connector once the
+// response has been read in full, so that with the pool connector one backend connection serves the requests of many
+// clients.
+//
+// Bodies are streamed in both directions. A response body of unknown length is sent chunked to HTTP/1.1 clients, and
+// every read from the backend is flushed to the client. Hop-by-hop headers are dropped, and the client's address is
+// appended to X-Forwarded-For. Upgrades (such as WebSocket) are not supported.
+//
+// The idle timeout also closes keep-alive connections between requests, and the header timeout bounds the time from
+// the first byte of a request to the end of its headers.
+type HTTPEngine struct {
+	routes    []Route
+	accessLog *log.Logger
+	guard     *guard
+	limits    Limits
+	stats     Stats
+}
+
+// httpConn is a client connection of the HTTPEngine.
+type httpConn struct {
+	client  net.Conn
+	gc      *guarded
+	waiting bool // for the next request, when the idle timeout is how keep-alive connections end
+
+	mu      sync.Mutex
+	backend net.Conn // of the request being proxied
+	aborted bool
+}
+
+// NewHTTPEngine routes the requests with the routes, and those no route matches to the backend passed to Serve. The
+// most specific route wins: one for the request's host over one for any host, then the longest prefix. A line per
+// request is written to accessLog, unless it is nil.
+func NewHTTPEngine(routes []Route, accessLog io.Writer, limits Limits) *HTTPEngine {
+	routes = slices.Clone(routes)
+	slices.SortStableFunc(routes, func(a, b Route) int {
+		if (a.Host == "") != (b.Host == "") {
+			if a.Host != "" {
+				return -1
+			}
+			return 1
+		}
+		return len(b.Prefix) - len(a.Prefix)
+	})
+	e := &HTTPEngine{routes: routes, limits: limits}
+	e.guard = newGuard(limits, &e.stats)
+	if accessLog != nil {
+		e.accessLog = log.New(accessLog, "", log.LstdFlags)
+	}
+	return e
+}
+
+func (e *HTTPEngine) Start() {}
+
+func (e *HTTPEngine) Stats() *Stats {
+	return &e.stats
+}
+
+// Close stops enforcing the timeouts. Connections still open are left as they are.
+func (e *HTTPEngine) Close() error {
+	e.guard.close()
+	return nil
+}
+
+func (e *HTTPEngine) Serve(client net.Conn, backend connector.BackendConnector) error {
+	gc, err := e.guard.admit(client.RemoteAddr())
+	if err != nil {
+		client.Close()
+		return err
+	}
+	go e.serve(&httpConn{client: client, gc: gc}, backend)
+	return nil
+}
+
+func (e *HTTPEngine) serve(hc *httpConn, fallback connector.BackendConnector) {
+	defer hc.client.Close()
+	e.stats.Connections.Add(1)
+	hc.gc.track(connIdle(hc.client), hc.abort)
+
+	err := e.serveRequests(hc, fallback)
+	if err = hc.gc.release(err); errors.Is(err, ErrIdleTimeout) && hc.waiting {
+		err = nil
+	}
+	if err != nil {
+		e.stats.countError(err)
+		log.Printf("proxy error for client %s: %v", hc.client.RemoteAddr(), err)
+	}
+}
+
+func (e *HTTPEngine) serveRequests(hc *httpConn, fallback connector.BackendConnector) error {
+	r := bufio.NewReader(hc.client)
+	w := bufio.NewWriter(&countingWriter{w: hc.client, n: &e.stats.Downstream})
+	for {
+		hc.waiting = true
+		if _, err := r.Peek(1); err != nil {
+			// EOF between requests is the client closing its keep-alive connection, a deadline error the guard doing it.
+			return nil
+		}
+		hc.waiting = false
+		if e.limits.HeaderTimeout > 0 {
+			hc.setReadDeadline(time.Now().Add(e.limits.HeaderTimeout))
+		}
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				hc.gc.expire(ErrHeaderTimeout)
+				return err
+			}
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				writeError(w, http.StatusBadRequest)
+				return fmt.Errorf("bad request: %w", err)
+			}
+			return nil
+		}
+		hc.setReadDeadline(time.Time{})
+		keepAlive, err := e.proxy(hc, w, req, e.route(req, fallback))
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+// abort fails what the connection is blocked on, reading or writing the client or the backend, for the guard.
+func (hc *httpConn) abort() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.aborted = true
+	hc.client.SetDeadline(aLongTimeAgo)
+	if hc.backend != nil {
+		hc.backend.SetDeadline(aLongTimeAgo)
+	}
+}
+
+// setReadDeadline sets the client's read deadline, unless abort set it already.
+func (hc *httpConn) setReadDeadline(t time.Time) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.aborted {
+		hc.client.SetReadDeadline(t)
+	}
+}
+
+// setBackend makes conn the backend connection abort fails, or none if nil. The connection is only given back to the
+// connector after this, so that abort can't fail it once another client has it.
+func (hc *httpConn) setBackend(conn net.Conn) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.backend = conn
+}
+
+func (e *HTTPEngine) route(req *http.Request, fallback connector.BackendConnector) connector.BackendConnector {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, r := range e.routes {
+		if (r.Host == "" || strings.EqualFold(r.Host, host)) && strings.HasPrefix(req.URL.Path, r.Prefix) {
+			return r.Backend
+		}
+	}
+	return fallback
+}
+
+// proxy forwards one request and its response, and reports whether the client connection can carry another request.
+func (e *HTTPEngine) proxy(hc *httpConn, w *bufio.Writer, req *http.Request, backend connector.BackendConnector) (bool, error) {
+	e.stats.Requests.Add(1)
+	clientAddr := hc.client.RemoteAddr()
+	entry := accessEntry{start: time.Now(), client: clientAddr, req: req, status: http.StatusBadGateway, upstream: "-"}
+	defer e.log(&entry)
+
+	keepAlive := !req.Close
+	prepareRequest(req, clientAddr)
+	if req.ContentLength != 0 && strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		// Answered here rather than by the backend, so that the response read from it is the final one.
+		req.Header.Del("Expect")
+		w.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+		if err := w.Flush(); err != nil {
+			return false, err
+		}
+	}
+
+	backendConn, err := backend.Get(clientAddr)
+	entry.connected = time.Now()
+	if err != nil {
+		e.guard.connectFailed(err)
+		log.Printf("backend connect failed: %v", err)
+		writeError(w, http.StatusBadGateway)
+		return false, nil
+	}
+	entry.upstream = backendConn.RemoteAddr().String()
+	reusable := false
+	hc.setBackend(backendConn)
+	defer func() {
+		hc.setBackend(nil)
+		if reusable {
+			backend.Return(backendConn)
+		} else {
+			backend.Discard(backendConn)
+		}
+	}()
+
+	bw := bufio.NewWriter(&countingWriter{w: backendConn, n: &e.stats.Upstream})
+	if err := req.Write(bw); err != nil {
+		writeError(w, http.StatusBadGateway)
+		return false, fmt.Errorf("write request to %s: %w", entry.upstream, err)
+	}
+	if err := bw.Flush(); err != nil {
+		writeError(w, http.StatusBadGateway)
+		return false, fmt.Errorf("write request to %s: %w", entry.upstream, err)
+	}
+	br := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(br, req)
+	entry.firstByte = time.Now()
+	if err != nil {
+		writeError(w, http.StatusBadGateway)
+		return false, fmt.Errorf("read response from %s: %w", entry.upstream, err)
+	}
+	defer resp.Body.Close()
+	entry.status = resp.StatusCode
+
+	keepAlive, entry.bytes, err = writeResponse(w, resp, req, keepAlive)
+	if err != nil {
+		return false, err
+	}
+	// Whatever the backend sent beyond the response would be mistaken for the next one.
+	reusable = !resp.Close && br.Buffered() == 0
+	return keepAlive, nil
+}
+
+// hopHeaders only concern one connection, and are not forwarded.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// prepareRequest makes the request read from the client one to send to the backend.
+func prepareRequest(req *http.Request, clientAddr net.Addr) {
+	removeHopHeaders(req.Header)
+	if ip, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// An empty one keeps Request.Write from sending Go's own.
+		req.Header.Set("User-Agent", "")
+	}
+	// The backend connection is kept alive, whatever the client asked for its own.
+	req.Close = false
+}
+
+// writeResponse writes the response to the client, framing the body for it: with its length if known, chunked
+// otherwise, or up to the end of the connection for HTTP/1.0 clients. It reports whether the client connection can
+// carry another request, and the size of the body.
+func writeResponse(w *bufio.Writer, resp *http.Response, req *http.Request, keepAlive bool) (bool, int64, error) {
+	removeHopHeaders(resp.Header)
+	hasBody := req.Method != http.MethodHead && resp.StatusCode >= 200 &&
+		resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+	chunked := false
+	if hasBody {
+		switch {
+		case resp.ContentLength >= 0:
+			resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		case req.ProtoAtLeast(1, 1):
+			chunked = true
+			resp.Header.Set("Transfer-Encoding", "chunked")
+		default:
+			keepAlive = false
+		}
+	}
+	if !keepAlive {
+		resp.Header.Set("Connection", "close")
+	} else if !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+
+	w.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+	resp.Header.Write(w)
+	w.WriteString("\r\n")
+	var n int64
+	if hasBody {
+		var dst io.Writer = w
+		var cw io.WriteCloser
+		if chunked {
+			cw = httputil.NewChunkedWriter(w)
+			dst = cw
+		}
+		var err error
+		if n, err = flushCopy(dst, w, resp.Body); err != nil {
+			return false, n, err
+		}
+		if chunked {
+			cw.Close()
+			resp.Trailer.Write(w)
+			w.WriteString("\r\n")
+		}
+	}
+	return keepAlive, n, w.Flush()
+}
+
+var copyBuffers = sync.Pool{New: func() any { return new([bufferSize]byte) }}
+
+// flushCopy copies src to dst, flushing w after every read, so that a streamed body isn't held back in the buffer.
+func flushCopy(dst io.Writer, w *bufio.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[bufferSize]byte)
+	defer copyBuffers.Put(buf)
+	var n int64
+	for {
+		nr, rerr := src.Read(buf[:])
+		if nr > 0 {
+			nw, err := dst.Write(buf[:nr])
+			n += int64(nw)
+			if err != nil {
+				return n, err
+			}
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+func writeError(w *bufio.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+	w.Flush()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(uint64(n))
+	return n, err
+}
+
+// accessEntry is what the access log records of a request: the upstream timing splits the total into the time to get
+// a backend connection (connect: a dial, or a checkout from the pool), the time from then to the response's headers
+// (ttfb), and the rest, the body.
+type accessEntry struct {
+	start, connected, firstByte time.Time
+	client                      net.Addr
+	req                         *http.Request
+	status                      int
+	bytes                       int64
+	upstream                    string
+}
+
+func (e *HTTPEngine) log(entry *accessEntry) {
+	if e.accessLog == nil {
+		return
+	}
+	since := func(from, to time.Time) string {
+		if from.IsZero() || to.IsZero() {
+			return "-"
+		}
+		return to.Sub(from).Round(time.Microsecond).String()
+	}
+	now := time.Now()
+	e.accessLog.Printf("%s %q %d %d host=%s upstream=%s connect=%s ttfb=%s total=%s",
+		entry.client, entry.req.Method+" "+entry.req.RequestURI+" "+entry.req.Proto, entry.status, entry.bytes,
+		entry.req.Host, entry.upstream, since(entry.start, entry.connected), since(entry.connected, entry.firstByte),
+		since(entry.start, now))
+}
@@ -0,0 +1,268 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// startHTTPBackend serves handler, and counts the connections made to it.
+func startHTTPBackend(t *testing.T, handler http.HandlerFunc) (string, *atomic.Int64) {
+	t.Helper()
+	var conns atomic.Int64
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String(), &conns
+}
+
+// startHTTPProxy serves a listener with an HTTPEngine, with the routes and backend as the fallback, and returns the
+// engine and the URL of the proxy.
+func startHTTPProxy(t *testing.T, routes []Route, backend connector.BackendConnector, accessLog io.Writer, limits Limits) (*HTTPEngine, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng := NewHTTPEngine(routes, accessLog, limits)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			eng.Serve(conn, backend)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		eng.Close()
+	})
+	return eng, "http://" + ln.Addr().String()
+}
+
+func get(t *testing.T, client *http.Client, url, host string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	return string(body)
+}
+
+// Requests on one keep-alive client connection are forwarded one at a time, each over a pooled backend connection
+// that goes back to the pool after the response, so a single backend connection serves them all.
+func TestHTTPEngine_KeepAliveReusesBackendConnections(t *testing.T) {
+	backendAddr, backendConns := startHTTPBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	})
+	eng, proxyURL := startHTTPProxy(t, nil, newPoolConnector(t, backendAddr), nil, Limits{})
+	client := &http.Client{}
+
+	for i := range 20 {
+		if got, want := get(t, client, fmt.Sprintf("%s/%d", proxyURL, i), ""), fmt.Sprintf("hello /%d", i); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if n := eng.Stats().Connections.Load(); n != 1 {
+		t.Errorf("%d client connections, want 1 kept alive", n)
+	}
+	if n := eng.Stats().Requests.Load(); n != 20 {
+		t.Errorf("%d requests, want 20", n)
+	}
+	if n := backendConns.Load(); n != 1 {
+		t.Errorf("%d backend connections, want 1 reused", n)
+	}
+}
+
+// A chunked request body reaches the backend, and a response body of unknown length comes back chunked.
+func TestHTTPEngine_Chunked(t *testing.T) {
+	backendAddr, _ := startHTTPBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			http.Error(w, "request not chunked", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Flushing before the end makes the response chunked.
+		w.Write([]byte("echo:"))
+		w.(http.Flusher).Flush()
+		w.Write(body)
+	})
+	_, proxyURL := startHTTPProxy(t, nil, connector.NewAlwaysDialConnector(backendAddr, 0), nil, Limits{})
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	// A body of unknown length is sent chunked.
+	resp, err := http.Post(proxyURL, "application/octet-stream", io.MultiReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s", resp.Status, body)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("response transfer encoding %v, want chunked", resp.TransferEncoding)
+	}
+	if want := append([]byte("echo:"), data...); !bytes.Equal(body, want) {
+		t.Errorf("got %d bytes back, want the %d sent", len(body), len(want))
+	}
+}
+
+func TestHTTPEngine_XForwardedFor(t *testing.T) {
+	backendAddr, _ := startHTTPBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	})
+	_, proxyURL := startHTTPProxy(t, nil, connector.NewAlwaysDialConnector(backendAddr, 0), nil, Limits{})
+
+	req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if got, want := string(body), "10.0.0.1, 127.0.0.1"; got != want {
+		t.Errorf("X-Forwarded-For %q, want %q", got, want)
+	}
+}
+
+func TestHTTPEngine_Routing(t *testing.T) {
+	backend := func(name string) connector.BackendConnector {
+		addr, _ := startHTTPBackend(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(name)) })
+		return connector.NewAlwaysDialConnector(addr, 0)
+	}
+	routes := []Route{
+		{Prefix: "/static", Backend: backend("static")},
+		{Prefix: "/static/images", Backend: backend("images")},
+		{Host: "api.example.com", Prefix: "/", Backend: backend("api")},
+	}
+	accessLog := &lines{}
+	_, proxyURL := startHTTPProxy(t, routes, backend("default"), accessLog, Limits{})
+	client := &http.Client{}
+
+	for _, tc := range []struct {
+		host, path, want string
+	}{
+		{"", "/", "default"},
+		{"", "/static/app.js", "static"},
+		{"", "/static/images/logo.png", "images"},
+		{"api.example.com", "/users", "api"},
+		{"API.example.com:8080", "/static/app.js", "api"},
+		{"www.example.com", "/users", "default"},
+	} {
+		if got := get(t, client, proxyURL+tc.path, tc.host); got != tc.want {
+			t.Errorf("%s%s went to %s, want %s", tc.host, tc.path, got, tc.want)
+		}
+	}
+	if entries := accessLog.get(); len(entries) != 6 || !strings.Contains(entries[1], `"GET /static/app.js HTTP/1.1" 200 6`) ||
+		!strings.Contains(entries[1], "upstream=127.0.0.1:") {
+		t.Errorf("access log:\n%s", strings.Join(entries, "\n"))
+	}
+}
+
+func TestHTTPEngine_BackendDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := ln.Addr().String()
+	ln.Close()
+	eng, proxyURL := startHTTPProxy(t, nil, connector.NewAlwaysDialConnector(backendAddr, 0), nil, Limits{})
+
+	resp, err := http.Get(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("%s, want 502", resp.Status)
+	}
+	if n := eng.Stats().ConnectErrors.Load(); n != 1 {
+		t.Errorf("%d connect errors, want 1", n)
+	}
+}
+
+// An HTTP/1.0 client gets a response of unknown length up to the end of the connection, as it can't take it chunked.
+func TestHTTPEngine_HTTP10Client(t *testing.T) {
+	backendAddr, _ := startHTTPBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("streamed"))
+		w.(http.Flusher).Flush()
+	})
+	_, proxyURL := startHTTPProxy(t, nil, connector.NewAlwaysDialConnector(backendAddr, 0), nil, Limits{})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "streamed" || len(resp.TransferEncoding) != 0 || !resp.Close {
+		t.Errorf("body %q, transfer encoding %v, close %v: want the body up to the end of the connection",
+			body, resp.TransferEncoding, resp.Close)
+	}
+}
+
+// lines collects the lines of a log.Logger.
+type lines struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *lines) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func (l *lines) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.entries)
+}
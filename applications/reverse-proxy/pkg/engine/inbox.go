@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// inbox queues work for an event loop from other goroutines, and wakes the loop up through an eventfd, which the loop
+// waits on along with its sockets. The eventfd is blocking: the loop only reads it once it is known to be readable.
+type inbox struct {
+	fd      int
+	mu      sync.Mutex
+	pending []func()
+	done    bool // the loop stopped and closed fd
+}
+
+func newInbox() (*inbox, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &inbox{fd: fd}, nil
+}
+
+// post queues f to run on the loop and wakes it up. It reports false if the loop has stopped, in which case f will
+// never run.
+func (in *inbox) post(f func()) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.done {
+		return false
+	}
+	in.pending = append(in.pending, f)
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	unix.Write(in.fd, one[:])
+	return true
+}
+
+// take returns what was posted since the last call, for the loop to run. The loop has read the eventfd's counter.
+func (in *inbox) take() []func() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	pending := in.pending
+	in.pending = nil
+	return pending
+}
+
+// close is called by the loop as it stops: whatever is posted from then on is refused.
+func (in *inbox) close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.done = true
+	unix.Close(in.fd)
+}
+
+// connectBackend gets a backend connection for a client socket an engine owns and gc admitted, and posts attach with it
+// to the loop through the inbox. clientConn is the connection the client fd was dup'ed from, if any. The client is
+// closed and released if that fails.
+func connectBackend(in *inbox, gc *guarded, clientFd int, clientConn net.Conn, clientAddr net.Addr,
+	backend connector.BackendConnector, attach func(backendFd int, backendConn net.Conn)) {
+	closeClient := func(err error) {
+		gc.release(err)
+		unix.Close(clientFd)
+		if clientConn != nil {
+			clientConn.Close()
+		}
+	}
+	backendConn, err := backend.Get(clientAddr)
+	if err != nil {
+		gc.g.connectFailed(err)
+		log.Printf("backend connect failed: %v", err)
+		closeClient(err)
+		return
+	}
+	backendFd, err := dupFd(backendConn)
+	if err != nil {
+		closeClient(err)
+		releaseBackend(backend, backendConn)
+		return
+	}
+	if !in.post(func() { attach(backendFd, backendConn) }) {
+		unix.Close(backendFd)
+		closeClient(nil)
+		releaseBackend(backend, backendConn)
+	}
+}
@@ -0,0 +1,375 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/pool"
+)
+
+var (
+	ErrTooManyConns      = errors.New("too many connections")
+	ErrTooManyConnsPerIP = errors.New("too many connections from the client's address")
+	ErrIdleTimeout       = errors.New("idle timeout")
+	ErrLifetimeExceeded  = errors.New("max lifetime exceeded")
+	ErrHeaderTimeout     = errors.New("request header timeout")
+)
+
+// What happens to the client connections beyond Limits.MaxConns.
+const (
+	// OverloadReject closes them as soon as they are accepted.
+	OverloadReject = "reject"
+	// OverloadQueue stops accepting until a connection closes, so that they wait in the listening socket's backlog,
+	// and the kernel drops the SYNs of new ones once that is full.
+	OverloadQueue = "queue"
+)
+
+// Limits bound the client connections of an engine, so that idle, slow or too many clients can't pin its fds,
+// goroutines and backend connections. The zero value has no limits.
+type Limits struct {
+	// MaxConns bounds the client connections open at once, 0 for no limit. What happens to the others is up to Overload.
+	MaxConns int
+	// Overload is OverloadReject (the default) or OverloadQueue.
+	Overload string
+	// MaxConnsPerIP bounds the client connections open at once from one address, 0 for no limit. Those beyond it are
+	// rejected, whatever Overload.
+	MaxConnsPerIP int
+	// IdleTimeout closes connections nothing has been received on or sent to the client for this long, 0 to disable.
+	IdleTimeout time.Duration
+	// MaxLifetime closes connections open for longer, 0 to disable.
+	MaxLifetime time.Duration
+	// HeaderTimeout bounds how long the HTTPEngine waits for the headers of a request once its first byte has come in,
+	// so that a client can't hold a connection by trickling them in (slowloris), 0 to disable.
+	HeaderTimeout time.Duration
+}
+
+func (l Limits) Validate() error {
+	if l.MaxConns < 0 || l.MaxConnsPerIP < 0 {
+		return fmt.Errorf("max connections must not be negative")
+	}
+	if l.Overload != "" && l.Overload != OverloadReject && l.Overload != OverloadQueue {
+		return fmt.Errorf("unknown overload policy %q (want %s or %s)", l.Overload, OverloadReject, OverloadQueue)
+	}
+	if l.IdleTimeout < 0 || l.MaxLifetime < 0 || l.HeaderTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
+}
+
+// guard enforces the Limits of an engine. Client connections are admitted before the engine connects them to a
+// backend, and released when it closes them. In between, the guard closes the ones that have been idle or open for too
+// long: it checks them every sweep interval, and aborts them in the engine's own way, which then closes them as if
+// they had failed.
+//
+// Idleness is read from the kernel's TCP_INFO of the client socket, which records when data was last received on it
+// and sent on it. So the engines don't have to keep track of it as they move the data, and the splice(2) of the
+// GoroutineEngine and the io_uring operations of the UringEngine don't have to be interrupted for it.
+type guard struct {
+	limits Limits
+	stats  *Stats
+
+	mu       sync.Mutex
+	room     *sync.Cond // signalled when a connection is released under MaxConns
+	active   int
+	perIP    map[string]int
+	conns    map[*guarded]struct{} // the ones with timeouts to enforce
+	whenFree []func()
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// guarded is a client connection admitted by a guard.
+type guarded struct {
+	g     *guard
+	ip    string
+	start time.Time
+
+	mu      sync.Mutex
+	idle    func() (time.Duration, error)
+	abort   func()
+	done    bool
+	expired error
+}
+
+func newGuard(limits Limits, stats *Stats) *guard {
+	g := &guard{limits: limits, stats: stats, perIP: make(map[string]int), conns: make(map[*guarded]struct{})}
+	g.room = sync.NewCond(&g.mu)
+	if interval := g.sweepInterval(); interval > 0 {
+		g.stop = make(chan struct{})
+		go g.sweep(interval)
+	}
+	return g
+}
+
+// sweepInterval is a tenth of the shortest timeout, within [10ms, 1s], so that connections are closed within 10% of it.
+func (g *guard) sweepInterval() time.Duration {
+	shortest := time.Duration(0)
+	for _, d := range []time.Duration{g.limits.IdleTimeout, g.limits.MaxLifetime} {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	if shortest == 0 {
+		return 0
+	}
+	return min(max(shortest/10, 10*time.Millisecond), time.Second)
+}
+
+func (g *guard) close() {
+	if g.stop != nil {
+		g.stopOnce.Do(func() { close(g.stop) })
+	}
+}
+
+// queues reports whether the connections beyond MaxConns are left in the backlog, rather than rejected.
+func (g *guard) queues() bool {
+	return g.limits.MaxConns > 0 && g.limits.Overload == OverloadQueue
+}
+
+// admit admits a client connection that was accepted, or returns why it is rejected. Under OverloadQueue, it waits for
+// a connection to be released if there are MaxConns already: the caller is the accept loop, which stops accepting
+// meanwhile.
+func (g *guard) admit(addr net.Addr) (*guarded, error) {
+	if !g.reserve(g.queues()) {
+		g.stats.Accepted.Add(1)
+		g.stats.RejectedMaxConns.Add(1)
+		return nil, ErrTooManyConns
+	}
+	return g.admitReserved(addr)
+}
+
+// reserve takes one of the MaxConns for a connection, waiting for one to be released if wait is set.
+func (g *guard) reserve(wait bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.limits.MaxConns > 0 && g.active >= g.limits.MaxConns {
+		if !wait {
+			return false
+		}
+		g.room.Wait()
+	}
+	g.active++
+	g.stats.Active.Add(1)
+	return true
+}
+
+// unreserve gives back what reserve took, when nothing was accepted with it.
+func (g *guard) unreserve() {
+	g.mu.Lock()
+	g.active--
+	g.stats.Active.Add(-1)
+	g.mu.Unlock()
+	g.freed()
+}
+
+// admitReserved admits a client connection accepted with a reservation, unless there are MaxConnsPerIP from its
+// address already, in which case the reservation is given back.
+func (g *guard) admitReserved(addr net.Addr) (*guarded, error) {
+	g.stats.Accepted.Add(1)
+	gc := &guarded{g: g, start: time.Now()}
+	if g.limits.MaxConnsPerIP > 0 && addr != nil {
+		gc.ip = addr.String()
+		if host, _, err := net.SplitHostPort(gc.ip); err == nil {
+			gc.ip = host
+		}
+		g.mu.Lock()
+		if g.perIP[gc.ip] >= g.limits.MaxConnsPerIP {
+			g.mu.Unlock()
+			g.unreserve()
+			g.stats.RejectedPerIP.Add(1)
+			return nil, ErrTooManyConnsPerIP
+		}
+		g.perIP[gc.ip]++
+		g.mu.Unlock()
+	}
+	return gc, nil
+}
+
+// reserveOrNotify is reserve for engines that accept themselves, which reserve a connection before accepting it, so
+// that under OverloadQueue they don't accept what they can't admit. If there is no room, they stop accepting, and
+// resume is called once, when a connection is released.
+func (g *guard) reserveOrNotify(resume func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active >= g.limits.MaxConns {
+		g.whenFree = append(g.whenFree, resume)
+		return false
+	}
+	g.active++
+	g.stats.Active.Add(1)
+	return true
+}
+
+func (g *guard) freed() {
+	g.mu.Lock()
+	g.room.Signal()
+	whenFree := g.whenFree
+	g.whenFree = nil
+	g.mu.Unlock()
+	for _, f := range whenFree {
+		f()
+	}
+}
+
+// connectFailed counts a failure to get a backend connection, and whether it was a timeout. A pool that is exhausted
+// fails with a timeout too, but that is the pool's wait, counted by the pool.
+func (g *guard) connectFailed(err error) {
+	g.stats.ConnectErrors.Add(1)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, pool.ErrExhausted) {
+		g.stats.ConnectTimeouts.Add(1)
+	}
+}
+
+// track has the guard enforce the timeouts on the connection once the engine is proxying it. idle reports how long
+// the client socket has been idle, and abort makes the engine close the connection.
+func (gc *guarded) track(idle func() (time.Duration, error), abort func()) {
+	if gc.g.stop == nil {
+		return
+	}
+	gc.mu.Lock()
+	gc.idle, gc.abort = idle, abort
+	gc.mu.Unlock()
+	gc.g.mu.Lock()
+	gc.g.conns[gc] = struct{}{}
+	gc.g.mu.Unlock()
+}
+
+// release is called by the engine as it closes the connection, before it closes the sockets (which abort and idle
+// use). It returns the error the connection ended with: why the guard aborted it, if it did, else err.
+func (gc *guarded) release(err error) error {
+	gc.mu.Lock()
+	gc.done = true
+	if gc.expired != nil {
+		err = gc.expired
+	}
+	gc.mu.Unlock()
+
+	g := gc.g
+	g.mu.Lock()
+	delete(g.conns, gc)
+	g.active--
+	g.stats.Active.Add(-1)
+	if gc.ip != "" {
+		if g.perIP[gc.ip]--; g.perIP[gc.ip] <= 0 {
+			delete(g.perIP, gc.ip)
+		}
+	}
+	g.mu.Unlock()
+	g.freed()
+	return err
+}
+
+// expire aborts the connection for err, unless it has been released or aborted already.
+func (gc *guarded) expire(err error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.expireLocked(err)
+}
+
+func (gc *guarded) expireLocked(err error) {
+	if gc.done || gc.expired != nil {
+		return
+	}
+	gc.expired = err
+	if err == ErrLifetimeExceeded {
+		gc.g.stats.LifetimeTimeouts.Add(1)
+	} else {
+		gc.g.stats.IdleTimeouts.Add(1)
+	}
+	if gc.abort != nil {
+		gc.abort()
+	}
+}
+
+func (g *guard) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var conns []*guarded
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+		g.mu.Lock()
+		conns = conns[:0]
+		for gc := range g.conns {
+			conns = append(conns, gc)
+		}
+		g.mu.Unlock()
+		now := time.Now()
+		for _, gc := range conns {
+			gc.check(now)
+		}
+	}
+}
+
+func (gc *guarded) check(now time.Time) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.done || gc.expired != nil {
+		return
+	}
+	limits := gc.g.limits
+	if limits.MaxLifetime > 0 && now.Sub(gc.start) >= limits.MaxLifetime {
+		gc.expireLocked(ErrLifetimeExceeded)
+		return
+	}
+	if limits.IdleTimeout > 0 {
+		idle, err := gc.idle()
+		if err == nil && min(idle, now.Sub(gc.start)) >= limits.IdleTimeout {
+			gc.expireLocked(ErrIdleTimeout)
+		}
+	}
+}
+
+// tcpIdle is how long ago data was last received on or sent to the socket, as the kernel keeps track of it, with a
+// millisecond resolution.
+func tcpIdle(fd int) (time.Duration, error) {
+	info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(min(info.Last_data_recv, info.Last_data_sent)) * time.Millisecond, nil
+}
+
+// connIdle is tcpIdle for the socket of a connection the Go netpoller owns.
+func connIdle(c net.Conn) func() (time.Duration, error) {
+	return func() (time.Duration, error) {
+		sc, ok := c.(syscall.Conn)
+		if !ok {
+			return 0, errors.ErrUnsupported
+		}
+		raw, err := sc.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		var idle time.Duration
+		var idleErr error
+		if err := raw.Control(func(fd uintptr) { idle, idleErr = tcpIdle(int(fd)) }); err != nil {
+			return 0, err
+		}
+		return idle, idleErr
+	}
+}
+
+// shutdownFds aborts a connection an event loop owns: its reads see EOF and its writes fail, which the loop handles
+// as it would if the peers had done it.
+func shutdownFds(fds ...int) func() {
+	return func() {
+		for _, fd := range fds {
+			unix.Shutdown(fd, unix.SHUT_RDWR)
+		}
+	}
+}
+
+// aLongTimeAgo is a deadline in the past, which fails the reads and writes blocked on a connection at once.
+var aLongTimeAgo = time.Unix(1, 0)
@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// greet writes "hi" to every client once it is connected, so that the client can tell that the proxy has admitted it,
+// and then echoes.
+func greet(conn net.Conn) {
+	conn.Write([]byte("hi"))
+	echo(conn)
+}
+
+// forEachLimitedEngine runs test for each engine with the limits, proxying to a greet backend through connections
+// handed to Serve, and through Listen for the engines that accept themselves.
+func forEachLimitedEngine(t *testing.T, limits Limits, test func(t *testing.T, eng Engine, addr string)) {
+	for name, newEngine := range engines {
+		for _, listen := range []bool{false, true} {
+			how := "serve"
+			if listen {
+				how = "listen"
+			}
+			t.Run(name+"/"+how, func(t *testing.T) {
+				skipUnsupported(t, name)
+				eng, err := newEngine(limits)
+				if err != nil {
+					t.Fatal(err)
+				}
+				backendAddr := startBackend(t, greet)
+				if !listen {
+					test(t, eng, startProxy(t, eng, backendAddr))
+					return
+				}
+				le, ok := eng.(ListeningEngine)
+				if !ok {
+					if c, ok := eng.(io.Closer); ok {
+						c.Close()
+					}
+					t.Skip("not a listening engine")
+				}
+				eng.Start()
+				t.Cleanup(func() { eng.(io.Closer).Close() })
+				addr, err := le.Listen("127.0.0.1:0", connector.NewAlwaysDialConnector(backendAddr, 0))
+				if err != nil {
+					t.Fatal(err)
+				}
+				test(t, eng, addr.String())
+			})
+		}
+	}
+}
+
+// connState is what a client connection to a greet backend through the proxy sees.
+type connState int
+
+const (
+	admitted connState = iota // greeted
+	waiting                   // neither greeted nor closed, yet
+	closed                    // closed without a greeting
+)
+
+func (s connState) String() string {
+	return [...]string{"admitted", "waiting", "closed"}[s]
+}
+
+// dialFrom connects to addr from the local IP.
+func dialFrom(t *testing.T, ip, addr string) net.Conn {
+	t.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// state reads the greeting, for up to wait.
+func state(t *testing.T, conn net.Conn, wait time.Duration) connState {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	switch {
+	case err == nil && string(buf) == "hi":
+		return admitted
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return waiting
+	case err == io.EOF || errors.Is(err, net.ErrClosed) || isReset(err):
+		return closed
+	}
+	t.Fatalf("read %q: %v", buf, err)
+	return 0
+}
+
+func isReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}
+
+func expectState(t *testing.T, conn net.Conn, wait time.Duration, want connState) {
+	t.Helper()
+	if got := state(t, conn, wait); got != want {
+		t.Fatalf("connection %s, want %s", got, want)
+	}
+}
+
+// waitFor polls cond for up to 5s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEngine_MaxConnsReject(t *testing.T) {
+	forEachLimitedEngine(t, Limits{MaxConns: 2}, func(t *testing.T, eng Engine, addr string) {
+		first, second := dialFrom(t, "127.0.0.1", addr), dialFrom(t, "127.0.0.1", addr)
+		expectState(t, first, 5*time.Second, admitted)
+		expectState(t, second, 5*time.Second, admitted)
+		expectState(t, dialFrom(t, "127.0.0.1", addr), 5*time.Second, closed)
+
+		first.Close()
+		waitFor(t, "the first connection to be released", func() bool { return eng.Stats().Active.Load() == 1 })
+		expectState(t, dialFrom(t, "127.0.0.1", addr), 5*time.Second, admitted)
+		if n := eng.Stats().RejectedMaxConns.Load(); n != 1 {
+			t.Errorf("%d connections rejected, want 1", n)
+		}
+		if n := eng.Stats().Accepted.Load(); n != 4 {
+			t.Errorf("%d connections accepted, want 4", n)
+		}
+	})
+}
+
+func TestEngine_MaxConnsQueue(t *testing.T) {
+	forEachLimitedEngine(t, Limits{MaxConns: 1, Overload: OverloadQueue}, func(t *testing.T, eng Engine, addr string) {
+		first := dialFrom(t, "127.0.0.1", addr)
+		expectState(t, first, 5*time.Second, admitted)
+		// The handshake is done by the kernel, and the connection waits in the backlog.
+		second := dialFrom(t, "127.0.0.1", addr)
+		expectState(t, second, 200*time.Millisecond, waiting)
+
+		first.Close()
+		expectState(t, second, 5*time.Second, admitted)
+		if n := eng.Stats().RejectedMaxConns.Load(); n != 0 {
+			t.Errorf("%d connections rejected, want none", n)
+		}
+	})
+}
+
+func TestEngine_MaxConnsPerIP(t *testing.T) {
+	forEachLimitedEngine(t, Limits{MaxConnsPerIP: 1}, func(t *testing.T, eng Engine, addr string) {
+		first := dialFrom(t, "127.0.0.1", addr)
+		expectState(t, first, 5*time.Second, admitted)
+		expectState(t, dialFrom(t, "127.0.0.1", addr), 5*time.Second, closed)
+		expectState(t, dialFrom(t, "127.0.0.2", addr), 5*time.Second, admitted)
+
+		first.Close()
+		waitFor(t, "the first connection to be released", func() bool { return eng.Stats().Active.Load() == 1 })
+		expectState(t, dialFrom(t, "127.0.0.1", addr), 5*time.Second, admitted)
+		if n := eng.Stats().RejectedPerIP.Load(); n != 1 {
+			t.Errorf("%d connections rejected, want 1", n)
+		}
+	})
+}
+
+// An idle connection is closed after the idle timeout, while one that keeps exchanging data less often than that stays
+// open, whichever way the data goes.
+func TestEngine_IdleTimeout(t *testing.T) {
+	// The busy connection exchanges data 10 times per idle timeout, so that a loaded machine doesn't stretch a gap past it.
+	forEachLimitedEngine(t, Limits{IdleTimeout: time.Second}, func(t *testing.T, eng Engine, addr string) {
+		idle, busy := dialFrom(t, "127.0.0.1", addr), dialFrom(t, "127.0.0.1", addr)
+		expectState(t, idle, 5*time.Second, admitted)
+		expectState(t, busy, 5*time.Second, admitted)
+
+		start := time.Now()
+		for time.Since(start) < 2*time.Second {
+			time.Sleep(100 * time.Millisecond)
+			if _, err := busy.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(busy, buf); err != nil {
+				t.Fatalf("busy connection: %v", err)
+			}
+		}
+		expectState(t, idle, 2*time.Second, closed)
+		if n := eng.Stats().IdleTimeouts.Load(); n != 1 {
+			t.Errorf("%d idle timeouts, want 1", n)
+		}
+	})
+}
+
+func TestEngine_MaxLifetime(t *testing.T) {
+	forEachLimitedEngine(t, Limits{MaxLifetime: 300 * time.Millisecond}, func(t *testing.T, eng Engine, addr string) {
+		conn := dialFrom(t, "127.0.0.1", addr)
+		expectState(t, conn, 5*time.Second, admitted)
+		start := time.Now()
+		expectState(t, conn, 5*time.Second, closed)
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("closed after %v, before the max lifetime", elapsed)
+		}
+		waitFor(t, "the connection to be released", func() bool { return eng.Stats().Active.Load() == 0 })
+		if n := eng.Stats().LifetimeTimeouts.Load(); n != 1 {
+			t.Errorf("%d lifetime timeouts, want 1", n)
+		}
+		if n := eng.Stats().TimeoutErrors.Load(); n != 1 {
+			t.Errorf("%d timeout errors, want 1", n)
+		}
+	})
+}
+
+// A client that trickles the headers of its request in is cut off after the header timeout (slowloris), while one
+// that keeps its connection open between requests is closed quietly after the idle timeout.
+func TestHTTPEngine_Timeouts(t *testing.T) {
+	backendAddr, _ := startHTTPBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	limits := Limits{IdleTimeout: 300 * time.Millisecond, HeaderTimeout: 300 * time.Millisecond}
+	eng, proxyURL := startHTTPProxy(t, nil, connector.NewAlwaysDialConnector(backendAddr, 0), nil, limits)
+	addr := strings.TrimPrefix(proxyURL, "http://")
+
+	slow := dialFrom(t, "127.0.0.1", addr)
+	start := time.Now()
+	go func() {
+		fmt.Fprint(slow, "GET / HTTP/1.1\r\n")
+		for range 20 {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := fmt.Fprint(slow, "X-Slow: 1\r\n"); err != nil {
+				return
+			}
+		}
+	}()
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := slow.Read(make([]byte, 1)); err != io.EOF && !isReset(err) {
+		t.Fatalf("slow client: %v, want it closed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("slow client closed after %v", elapsed)
+	}
+
+	keepAlive := dialFrom(t, "127.0.0.1", addr)
+	fmt.Fprint(keepAlive, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	r := bufio.NewReader(keepAlive)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	keepAlive.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("idle keep-alive connection: %v, want it closed", err)
+	}
+
+	waitFor(t, "the connections to be released", func() bool { return eng.Stats().Active.Load() == 0 })
+	if n := eng.Stats().IdleTimeouts.Load(); n != 2 {
+		t.Errorf("%d idle timeouts, want 2", n)
+	}
+	if n := eng.Stats().Errors.Load(); n != 1 {
+		t.Errorf("%d errors, want only the slow client's", n)
+	}
+}
@@ -0,0 +1,333 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal io_uring, just what the UringEngine uses: the submission and completion rings, and provided buffer rings.
+// The layouts and constants are those of include/uapi/linux/io_uring.h.
+
+const (
+	opRead        = 22
+	opAccept      = 13
+	opAsyncCancel = 14
+	opSend        = 26
+	opRecv        = 27
+
+	sqeIOLink       = 1 << 2
+	sqeBufferSelect = 1 << 5
+
+	recvMultishot   = 1 << 1 // in the ioprio of a recv
+	acceptMultishot = 1 << 0 // in the ioprio of an accept
+
+	asyncCancelAll = 1 << 0
+	asyncCancelFd  = 1 << 1
+
+	cqeFBuffer     = 1 << 0
+	cqeFMore       = 1 << 1
+	cqeBufferShift = 16
+
+	setupCQSize        = 1 << 3
+	setupSubmitAll     = 1 << 7
+	setupCoopTaskrun   = 1 << 8
+	enterGetEvents     = 1 << 0
+	featSingleMmap     = 1 << 0
+	featNoDrop         = 1 << 1
+	featFastPoll       = 1 << 5
+	offSQRing          = 0
+	offSQEs            = 0x10000000
+	registerProbe      = 8
+	registerPbufRing   = 22
+	unregisterPbufRing = 23
+	probeOpSupported   = 1 << 0
+)
+
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32 // msg_flags, accept_flags, cancel_flags, ...
+	userData    uint64
+	bufGroup    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type sqOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type cqOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqOffsets
+	cqOff                                                                  cqOffsets
+}
+
+type ring struct {
+	fd      int
+	mem     []byte // the submission and completion rings, in one mapping
+	sqesMem []byte
+
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqEntries      uint32
+	sqes           []sqe
+	tail           uint32 // the submission tail the kernel hasn't been told about yet
+
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []cqe
+}
+
+func newRing(entries uint32, flags uint32) (*ring, error) {
+	p := uringParams{flags: flags}
+	if flags&setupCQSize != 0 {
+		p.cqEntries = 8 * entries
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &ring{fd: int(fd)}
+	const required = featSingleMmap | featNoDrop | featFastPoll
+	if p.features&required != required {
+		unix.Close(r.fd)
+		return nil, fmt.Errorf("io_uring features %#x, want %#x", p.features, required)
+	}
+
+	size := max(p.sqOff.array+p.sqEntries*4, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(cqe{})))
+	var err error
+	if r.mem, err = unix.Mmap(r.fd, offSQRing, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		unix.Close(r.fd)
+		return nil, err
+	}
+	if r.sqesMem, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries)*int(unsafe.Sizeof(sqe{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		unix.Munmap(r.mem)
+		unix.Close(r.fd)
+		return nil, err
+	}
+
+	r.sqHead = r.u32(p.sqOff.head)
+	r.sqTail = r.u32(p.sqOff.tail)
+	r.sqMask = *r.u32(p.sqOff.ringMask)
+	r.sqEntries = p.sqEntries
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&r.sqesMem[0])), p.sqEntries)
+	r.tail = *r.sqTail
+	// The SQEs are always submitted in the order they sit in, so the indirection array is set up once, as identity.
+	array := unsafe.Slice(r.u32(p.sqOff.array), p.sqEntries)
+	for i := range array {
+		array[i] = uint32(i)
+	}
+
+	r.cqHead = r.u32(p.cqOff.head)
+	r.cqTail = r.u32(p.cqOff.tail)
+	r.cqMask = *r.u32(p.cqOff.ringMask)
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&r.mem[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+func (r *ring) u32(off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.mem[off]))
+}
+
+// sqe returns the next submission entry, cleared, submitting the queued ones first if the ring is full.
+func (r *ring) sqe() *sqe {
+	r.reserve(1)
+	s := &r.sqes[r.tail&r.sqMask]
+	*s = sqe{}
+	r.tail++
+	return s
+}
+
+// reserve makes room for n entries, which must be consecutive for a chain of linked ones.
+func (r *ring) reserve(n uint32) {
+	for r.sqEntries-(r.tail-atomic.LoadUint32(r.sqHead)) < n {
+		r.enter(0)
+	}
+}
+
+// enter submits the queued entries and waits until at least wait completions are available.
+func (r *ring) enter(wait uint32) error {
+	atomic.StoreUint32(r.sqTail, r.tail)
+	submit := r.tail - atomic.LoadUint32(r.sqHead)
+	var flags uintptr
+	if wait > 0 {
+		flags = enterGetEvents
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submit), uintptr(wait), flags, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// complete hands the available completions to f, in order.
+func (r *ring) complete(f func(*cqe)) {
+	head := *r.cqHead
+	for tail := atomic.LoadUint32(r.cqTail); head != tail; head++ {
+		f(&r.cqes[head&r.cqMask])
+		// Let the kernel reuse the entry as soon as it is handled, as f may submit and wait for room.
+		atomic.StoreUint32(r.cqHead, head+1)
+	}
+}
+
+func (r *ring) register(op uintptr, arg unsafe.Pointer, n uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), op, uintptr(arg), n, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (r *ring) close() {
+	unix.Munmap(r.sqesMem)
+	unix.Munmap(r.mem)
+	unix.Close(r.fd)
+}
+
+// bufRing is a provided buffer ring: buffers the kernel picks from for the receives of its group as the data arrives,
+// instead of buffers fixed when the receive is submitted. The ring takes the first page of its mapping and the
+// buffers the rest, so none of it is Go memory the kernel would write to behind the garbage collector's back.
+type bufRing struct {
+	mem     []byte
+	group   uint16
+	size    int // of each buffer
+	entries uint16
+	tail    uint16
+}
+
+type bufReg struct {
+	ringAddr    uint64
+	ringEntries uint32
+	bgid        uint16
+	flags       uint16
+	_           [3]uint64
+}
+
+func newBufRing(r *ring, group uint16, entries uint16, size int) (*bufRing, error) {
+	page := os.Getpagesize()
+	mem, err := unix.Mmap(-1, 0, page+int(entries)*size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, err
+	}
+	reg := bufReg{ringAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))), ringEntries: uint32(entries), bgid: group}
+	if err := r.register(registerPbufRing, unsafe.Pointer(&reg), 1); err != nil {
+		unix.Munmap(mem)
+		return nil, fmt.Errorf("register buffer ring: %w", err)
+	}
+	b := &bufRing{mem: mem, group: group, size: size, entries: entries}
+	for bid := range entries {
+		b.provide(bid)
+	}
+	return b, nil
+}
+
+// provide gives buffer bid (back) to the kernel.
+func (b *bufRing) provide(bid uint16) {
+	page := os.Getpagesize()
+	// struct io_uring_buf: addr, len, bid, and a reserved field, which in the first entry is the ring's tail.
+	entry := unsafe.Pointer(&b.mem[int(b.tail&(b.entries-1))*16])
+	*(*uint64)(entry) = uint64(uintptr(unsafe.Pointer(&b.mem[page+int(bid)*b.size])))
+	*(*uint32)(unsafe.Add(entry, 8)) = uint32(b.size)
+	*(*uint16)(unsafe.Add(entry, 12)) = bid
+	b.tail++
+	// The tail is published with a release store. Go has none for 16 bits, so it is made together with the bid of the
+	// first entry next to it, which only ever changes here (little-endian: the bid is the low half).
+	firstBid := uint32(*(*uint16)(unsafe.Pointer(&b.mem[12])))
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b.mem[12])), firstBid|uint32(b.tail)<<16)
+}
+
+func (b *bufRing) buf(bid uint16, n int) []byte {
+	off := os.Getpagesize() + int(bid)*b.size
+	return b.mem[off : off+n]
+}
+
+func (b *bufRing) addr(bid uint16) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&b.buf(bid, 1)[0])))
+}
+
+func (b *bufRing) close(r *ring) {
+	reg := bufReg{bgid: b.group}
+	r.register(unregisterPbufRing, unsafe.Pointer(&reg), 1)
+	unix.Munmap(b.mem)
+}
+
+// ErrUringUnsupported is returned when io_uring, or the parts of it the UringEngine uses, is not available: kernels
+// before 6.0, or with io_uring disabled (the kernel.io_uring_disabled sysctl, or a seccomp filter, as in some
+// container runtimes).
+var ErrUringUnsupported = errors.New("io_uring not supported")
+
+// UringSupported reports whether the UringEngine can run, and why not otherwise.
+var UringSupported = sync.OnceValue(func() error {
+	if major, minor, ok := kernelVersion(); ok && major < 6 {
+		// Multishot receives came with 6.0, and aren't covered by the probe.
+		return fmt.Errorf("%w: kernel %d.%d, want 6.0 or later", ErrUringUnsupported, major, minor)
+	}
+	r, err := newRing(8, 0)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUringUnsupported, err)
+	}
+	defer r.close()
+
+	var probe struct {
+		lastOp, opsLen uint8
+		_              uint16
+		_              [3]uint32
+		ops            [256]struct {
+			op    uint8
+			_     uint8
+			flags uint16
+			_     uint32
+		}
+	}
+	if err := r.register(registerProbe, unsafe.Pointer(&probe), 256); err != nil {
+		return fmt.Errorf("%w: probe: %w", ErrUringUnsupported, err)
+	}
+	for _, op := range []uint8{opRead, opAccept, opAsyncCancel, opSend, opRecv} {
+		if op > probe.lastOp || probe.ops[op].flags&probeOpSupported == 0 {
+			return fmt.Errorf("%w: opcode %d", ErrUringUnsupported, op)
+		}
+	}
+	// Provided buffer rings (and multishot accepts) came with 5.19.
+	b, err := newBufRing(r, 0, 1, os.Getpagesize())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUringUnsupported, err)
+	}
+	b.close(r)
+	return nil
+})
+
+func kernelVersion() (major, minor int, ok bool) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return 0, 0, false
+	}
+	_, err := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &major, &minor)
+	return major, minor, err == nil
+}
@@ -0,0 +1,381 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+// ListeningEngine is an engine that accepts connections itself, rather than being handed them by an accept loop.
+type ListeningEngine interface {
+	Engine
+	// Listen starts accepting connections on addr and proxying them to backend, and returns the address it listens on.
+	Listen(addr string, backend connector.BackendConnector) (net.Addr, error)
+}
+
+type ShardedConfig struct {
+	// Loops is the number of event loops, GOMAXPROCS if 0.
+	Loops int
+	// LockOSThread wires each loop to an OS thread of its own, so that the Go scheduler doesn't move it around (or run
+	// other goroutines on its thread in between).
+	LockOSThread bool
+	// Affinity pins each loop's thread to one CPU, round-robin over the CPUs the process may run on. Implies
+	// LockOSThread.
+	Affinity bool
+	// Limits are enforced over all the loops together.
+	Limits Limits
+}
+
+// ShardedEpollEngine runs one edge-triggered epoll loop per core instead of the single one of the EpollEngine. Each loop
+// has its own epoll instance and owns the connections registered with it, so they are looked up and closed without a
+// lock. Connections are spread over the loops by the kernel: Listen opens one SO_REUSEPORT listening socket per loop,
+// and each loop accepts from its own. Connections handed to Serve go round-robin.
+//
+// Dialing the backend blocks, so it happens on a goroutine of its own, which then hands the connection over to the
+// loop through its inbox.
+type ShardedEpollEngine struct {
+	cfg       ShardedConfig
+	loops     []*eventLoop
+	guard     *guard
+	stats     Stats // the guard's counts, the loops count the rest
+	next      atomic.Uint64
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    atomic.Bool
+}
+
+type eventLoop struct {
+	poller
+	id    int
+	cpu   int // -1 if not pinned
+	guard *guard
+
+	inbox *inbox
+
+	// Only touched by the loop itself.
+	conns     map[int]*ProxyConn
+	listeners map[int]connector.BackendConnector
+	stats     Stats
+	stopped   bool
+}
+
+func NewShardedEpollEngine(cfg ShardedConfig) (*ShardedEpollEngine, error) {
+	if cfg.Loops <= 0 {
+		cfg.Loops = runtime.GOMAXPROCS(0)
+	}
+	var cpus []int
+	if cfg.Affinity {
+		cfg.LockOSThread = true
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			return nil, fmt.Errorf("get cpu affinity: %w", err)
+		}
+		for cpu := 0; len(cpus) < set.Count(); cpu++ {
+			if set.IsSet(cpu) {
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+
+	e := &ShardedEpollEngine{cfg: cfg}
+	e.guard = newGuard(cfg.Limits, &e.stats)
+	for i := 0; i < cfg.Loops; i++ {
+		l, err := newEventLoop(i, e.guard)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		if cfg.Affinity {
+			l.cpu = cpus[i%len(cpus)]
+		}
+		e.loops = append(e.loops, l)
+	}
+	return e, nil
+}
+
+func newEventLoop(id int, g *guard) (*eventLoop, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	in, err := newInbox()
+	if err != nil {
+		unix.Close(epfd)
+		return nil, err
+	}
+	// Level-triggered, so that work posted before the loop runs is picked up when it does.
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, in.fd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(in.fd)}); err != nil {
+		unix.Close(in.fd)
+		unix.Close(epfd)
+		return nil, err
+	}
+	l := &eventLoop{
+		id:        id,
+		cpu:       -1,
+		guard:     g,
+		inbox:     in,
+		conns:     make(map[int]*ProxyConn),
+		listeners: make(map[int]connector.BackendConnector),
+	}
+	l.poller = poller{epfd: epfd, stats: &l.stats}
+	return l, nil
+}
+
+func (e *ShardedEpollEngine) Start() {
+	for _, l := range e.loops {
+		go l.run(e.cfg.LockOSThread)
+	}
+}
+
+// Stats sums up the stats of the loops, as of the call.
+func (e *ShardedEpollEngine) Stats() *Stats {
+	total := &Stats{}
+	total.add(&e.stats)
+	for _, l := range e.loops {
+		total.add(&l.stats)
+	}
+	return total
+}
+
+// LoopStats returns the stats of each loop, to see how evenly the connections are spread.
+func (e *ShardedEpollEngine) LoopStats() []*Stats {
+	stats := make([]*Stats, len(e.loops))
+	for i, l := range e.loops {
+		stats[i] = &l.stats
+	}
+	return stats
+}
+
+// Close stops the loops and the listeners. Connections still open are left as they are.
+func (e *ShardedEpollEngine) Close() error {
+	if !e.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	e.mu.Lock()
+	for _, ln := range e.listeners {
+		ln.Close()
+	}
+	e.mu.Unlock()
+	for _, l := range e.loops {
+		l.inbox.post(l.stop)
+	}
+	e.guard.close()
+	return nil
+}
+
+func (e *ShardedEpollEngine) Listen(addr string, backend connector.BackendConnector) (net.Addr, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var listenAddr net.Addr
+	for _, l := range e.loops {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		e.listeners = append(e.listeners, ln)
+		if listenAddr == nil {
+			// With port 0, the other loops join the port the first one got.
+			listenAddr = ln.Addr()
+			addr = listenAddr.String()
+		}
+		fd, err := dupFd(ln)
+		if err != nil {
+			return nil, err
+		}
+		if !l.inbox.post(func() { l.listen(fd, backend) }) {
+			unix.Close(fd)
+		}
+	}
+	return listenAddr, nil
+}
+
+func (e *ShardedEpollEngine) Serve(client net.Conn, backend connector.BackendConnector) error {
+	gc, err := e.guard.admit(client.RemoteAddr())
+	if err != nil {
+		client.Close()
+		return err
+	}
+	l := e.loops[e.next.Add(1)%uint64(len(e.loops))]
+	fd, err := dupFd(client)
+	if err != nil {
+		gc.release(err)
+		client.Close()
+		return err
+	}
+	go l.connect(gc, fd, client, client.RemoteAddr(), backend)
+	return nil
+}
+
+func (l *eventLoop) run(lockOSThread bool) {
+	if lockOSThread {
+		runtime.LockOSThread()
+		// The thread is left locked when the loop stops, so that the runtime throws it away with its affinity.
+	}
+	if l.cpu >= 0 {
+		var set unix.CPUSet
+		set.Set(l.cpu)
+		if err := unix.SchedSetaffinity(0, &set); err != nil {
+			log.Printf("loop %d: set cpu affinity to %d: %v", l.id, l.cpu, err)
+		}
+	}
+
+	events := make([]unix.EpollEvent, 128)
+	for !l.stopped {
+		n, err := unix.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err != unix.EINTR {
+				log.Printf("loop %d: epoll wait error: %v", l.id, err)
+			}
+			continue
+		}
+		for i := 0; i < n; i++ {
+			l.handleEvent(int(events[i].Fd), events[i].Events)
+		}
+	}
+	// Only now, as what was posted along with the stop may still have used it.
+	unix.Close(l.epfd)
+}
+
+func (l *eventLoop) handleEvent(fd int, events uint32) {
+	if fd == l.inbox.fd {
+		l.runPending()
+		return
+	}
+	if backend, ok := l.listeners[fd]; ok {
+		l.accept(fd, backend)
+		return
+	}
+	pc, ok := l.conns[fd]
+	if !ok {
+		return
+	}
+	if done, err := l.handle(pc, fd, events); done {
+		delete(l.conns, pc.client.fd)
+		delete(l.conns, pc.backend.fd)
+		l.close(pc, err)
+	}
+}
+
+func (l *eventLoop) runPending() {
+	var buf [8]byte
+	unix.Read(l.inbox.fd, buf[:])
+	for _, f := range l.inbox.take() {
+		f()
+	}
+}
+
+func (l *eventLoop) listen(fd int, backend connector.BackendConnector) {
+	if err := unix.EpollCtl(l.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLET, Fd: int32(fd)}); err != nil {
+		log.Printf("loop %d: register listener: %v", l.id, err)
+		unix.Close(fd)
+		return
+	}
+	l.listeners[fd] = backend
+}
+
+// accept takes the pending connections off the listening socket, until EAGAIN as it is edge-triggered. When the
+// connections beyond the max are queued, it stops at the max instead, and carries on once one is released.
+func (l *eventLoop) accept(fd int, backend connector.BackendConnector) {
+	queues := l.guard.queues()
+	for {
+		if queues && !l.guard.reserveOrNotify(func() { l.inbox.post(func() { l.resume(fd, backend) }) }) {
+			return
+		}
+		clientFd, sa, err := unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		if err != nil && queues {
+			l.guard.unreserve()
+		}
+		switch err {
+		case nil:
+		case unix.EAGAIN:
+			return
+		case unix.EINTR, unix.ECONNABORTED:
+			continue
+		default:
+			// Out of fds, most likely: the connection stays in the backlog, to be accepted with the next one.
+			log.Printf("loop %d: accept error: %v", l.id, err)
+			return
+		}
+		addr := sockaddrToTCPAddr(sa)
+		var gc *guarded
+		if queues {
+			gc, err = l.guard.admitReserved(addr)
+		} else {
+			gc, err = l.guard.admit(addr)
+		}
+		if err != nil {
+			unix.Close(clientFd)
+			continue
+		}
+		// Like the net package does for the connections it accepts.
+		unix.SetsockoptInt(clientFd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+		go l.connect(gc, clientFd, nil, addr, backend)
+	}
+}
+
+// resume accepts again on a listener accept stopped at the max, unless it has been closed since.
+func (l *eventLoop) resume(fd int, backend connector.BackendConnector) {
+	if _, ok := l.listeners[fd]; ok && !l.stopped {
+		l.accept(fd, backend)
+	}
+}
+
+// connect gets a backend connection for the client's fd and hands both over to the loop. clientConn is the connection
+// the fd was dup'ed from, if any.
+func (l *eventLoop) connect(gc *guarded, clientFd int, clientConn net.Conn, clientAddr net.Addr, backend connector.BackendConnector) {
+	connectBackend(l.inbox, gc, clientFd, clientConn, clientAddr, backend, func(backendFd int, backendConn net.Conn) {
+		pc := newProxyConn(clientFd, backendFd, &l.stats)
+		pc.clientAddr, pc.clientConn, pc.backendConn, pc.connector = clientAddr, clientConn, backendConn, backend
+		pc.guard(gc)
+		l.attach(pc)
+	})
+}
+
+func (l *eventLoop) attach(pc *ProxyConn) {
+	l.stats.Connections.Add(1)
+	l.conns[pc.client.fd] = pc
+	l.conns[pc.backend.fd] = pc
+	if err := l.register(pc); err != nil {
+		delete(l.conns, pc.client.fd)
+		delete(l.conns, pc.backend.fd)
+		l.close(pc, err)
+	}
+}
+
+func (l *eventLoop) stop() {
+	l.stopped = true
+	for fd := range l.listeners {
+		unix.Close(fd)
+	}
+	l.inbox.close()
+}
+
+func sockaddrToTCPAddr(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}
+	case *unix.SockaddrInet6:
+		return &net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+type Stats struct {
+	Connections atomic.Uint64 // client connections served
+	Upstream    atomic.Uint64 // bytes copied from clients to backends
+	Downstream  atomic.Uint64 // bytes copied from backends to clients
+	Errors      atomic.Uint64 // connections that ended with an error rather than EOF in both directions
+	Requests    atomic.Uint64 // HTTP requests proxied, by the HTTPEngine
+
+	// Errors by type. The others are I/O errors other than resets.
+	ConnectErrors atomic.Uint64 // client connections, or HTTP requests, no backend connection could be had for
+	TimeoutErrors atomic.Uint64 // Errors that were timeouts
+	ResetErrors   atomic.Uint64 // Errors that were resets or broken pipes
+
+	Accepted         atomic.Uint64 // client connections accepted, admitted or not
+	Active           atomic.Int64  // client connections admitted and not closed yet
+	RejectedMaxConns atomic.Uint64 // client connections closed on accept, beyond Limits.MaxConns
+	RejectedPerIP    atomic.Uint64 // client connections closed on accept, beyond Limits.MaxConnsPerIP
+	ConnectTimeouts  atomic.Uint64 // backend connections that timed out
+	IdleTimeouts     atomic.Uint64 // connections closed after Limits.IdleTimeout, or Limits.HeaderTimeout
+	LifetimeTimeouts atomic.Uint64 // connections closed after Limits.MaxLifetime
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("connections=%d upstream_bytes=%d downstream_bytes=%d errors=%d requests=%d connect_errors=%d "+
+		"timeout_errors=%d reset_errors=%d accepted=%d active=%d rejected_max_conns=%d rejected_per_ip=%d "+
+		"connect_timeouts=%d idle_timeouts=%d lifetime_timeouts=%d",
+		s.Connections.Load(), s.Upstream.Load(), s.Downstream.Load(), s.Errors.Load(), s.Requests.Load(),
+		s.ConnectErrors.Load(), s.TimeoutErrors.Load(), s.ResetErrors.Load(), s.Accepted.Load(), s.Active.Load(),
+		s.RejectedMaxConns.Load(), s.RejectedPerIP.Load(), s.ConnectTimeouts.Load(), s.IdleTimeouts.Load(),
+		s.LifetimeTimeouts.Load())
+}
+
+// add adds the counts of o to s.
+func (s *Stats) add(o *Stats) {
+	s.Connections.Add(o.Connections.Load())
+	s.Upstream.Add(o.Upstream.Load())
+	s.Downstream.Add(o.Downstream.Load())
+	s.Errors.Add(o.Errors.Load())
+	s.Requests.Add(o.Requests.Load())
+	s.ConnectErrors.Add(o.ConnectErrors.Load())
+	s.TimeoutErrors.Add(o.TimeoutErrors.Load())
+	s.ResetErrors.Add(o.ResetErrors.Load())
+	s.Accepted.Add(o.Accepted.Load())
+	s.Active.Add(o.Active.Load())
+	s.RejectedMaxConns.Add(o.RejectedMaxConns.Load())
+	s.RejectedPerIP.Add(o.RejectedPerIP.Load())
+	s.ConnectTimeouts.Add(o.ConnectTimeouts.Load())
+	s.IdleTimeouts.Add(o.IdleTimeouts.Load())
+	s.LifetimeTimeouts.Add(o.LifetimeTimeouts.Load())
+}
+
+// countError counts a connection that ended with err, by type.
+func (s *Stats) countError(err error) {
+	s.Errors.Add(1)
+	switch {
+	case errors.Is(err, ErrIdleTimeout), errors.Is(err, ErrLifetimeExceeded), errors.Is(err, ErrHeaderTimeout),
+		errors.Is(err, os.ErrDeadlineExceeded):
+		s.TimeoutErrors.Add(1)
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		s.ResetErrors.Add(1)
+	}
+}
@@ -0,0 +1,571 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+)
+
+const (
+	// Each direction of a connection gets a provided buffer ring of uringBuffers buffers, as much memory as a direction
+	// of the EpollEngine.
+	uringBuffers    = 4
+	uringBufferSize = bufferSize / uringBuffers
+	uringEntries    = 1024
+	// Buffer rings of closed connections are kept registered for new ones, up to this many.
+	uringIdleBufRings = 1024
+)
+
+// The kind of operation a completion is for, in the low byte of its user data. The direction (0 up, 1 down) is in the
+// next byte and the connection (or listener) id above.
+const (
+	uringWake = iota + 1
+	uringAccept
+	uringRecv
+	uringSend
+	uringCancel
+)
+
+// UringEngine proxies with io_uring: the kernel does the socket I/O, and the loop only submits the operations and
+// handles their completions, with a single io_uring_enter to do both.
+//
+// Listen accepts with one multishot accept, which keeps completing with a new connection until it is cancelled. Each
+// direction of a connection has a multishot receive, which also keeps completing until EOF or an error, into
+// provided buffers: a buffer ring per direction that the kernel picks from as the data arrives. What is received is
+// sent on in order by a chain of linked sends, one per buffer, each buffer going back to the ring once its send has
+// completed. The next chain is submitted when the previous one is done. When the buffers of a direction are all
+// waiting to be sent, the receive ends with ENOBUFS and is submitted again once they are back, so a slow reader holds
+// back its peer, as in the EpollEngine.
+//
+// When the connections beyond the max are queued, the accept is a single shot one instead, submitted again only as long
+// as there is room for another connection.
+//
+// The engine needs io_uring from Linux 6.0 (see UringSupported), which some container runtimes also disable.
+type UringEngine struct {
+	ring    *ring
+	inbox   *inbox
+	guard   *guard
+	wakeBuf []byte // the eventfd's counter is read into it, outside of Go memory
+
+	// Only touched by the loop.
+	conns     map[uint32]*uringConn
+	nextID    uint32
+	groups    []uint16 // buffer group ids free for new buffer rings
+	nextGroup int
+	idle      []*bufRing
+	listeners map[uint32]*uringListener
+	stopped   bool
+
+	mu    sync.Mutex
+	lns   []net.Listener
+	stats Stats
+
+	closed atomic.Bool
+}
+
+type uringListener struct {
+	fd       int
+	backend  connector.BackendConnector
+	reserved bool // the accept in flight took a connection of the max, see guard.reserveOrNotify
+}
+
+type uringConn struct {
+	id              uint32
+	client, backend int
+	up, down        *uringDirection
+
+	clientAddr  net.Addr
+	clientConn  net.Conn // nil if the engine accepted the client socket itself
+	backendConn net.Conn
+	connector   connector.BackendConnector
+	guarded     *guarded
+
+	inflight int // submitted operations that will still complete
+	closing  bool
+	err      error
+}
+
+type uringDirection struct {
+	dir      uint8
+	src, dst int
+	bufs     *bufRing
+	queue    []chunk // received, waiting for the sends in flight
+	sending  []chunk // sent in a linked chain, in order
+	armed    bool    // a multishot receive is in flight
+	eof      bool
+	shut     bool // the write side of dst has been shut down after eof: this direction is done
+	bytes    *atomic.Uint64
+}
+
+type chunk struct {
+	bid uint16
+	n   int
+}
+
+func NewUringEngine(limits Limits) (*UringEngine, error) {
+	if err := UringSupported(); err != nil {
+		return nil, err
+	}
+	r, err := newRing(uringEntries, setupCQSize|setupSubmitAll|setupCoopTaskrun)
+	if err != nil {
+		return nil, err
+	}
+	in, err := newInbox()
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	wakeBuf, err := unix.Mmap(-1, 0, 8, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		unix.Close(in.fd)
+		r.close()
+		return nil, err
+	}
+	e := &UringEngine{
+		ring:      r,
+		inbox:     in,
+		wakeBuf:   wakeBuf,
+		conns:     make(map[uint32]*uringConn),
+		listeners: make(map[uint32]*uringListener),
+	}
+	e.guard = newGuard(limits, &e.stats)
+	return e, nil
+}
+
+func (e *UringEngine) Start() {
+	go e.loop()
+}
+
+func (e *UringEngine) Stats() *Stats {
+	return &e.stats
+}
+
+// Close stops the loop and the listeners. Connections still open are left as they are.
+func (e *UringEngine) Close() error {
+	if !e.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	e.mu.Lock()
+	for _, ln := range e.lns {
+		ln.Close()
+	}
+	e.mu.Unlock()
+	e.inbox.post(e.stop)
+	e.guard.close()
+	return nil
+}
+
+func (e *UringEngine) Listen(addr string, backend connector.BackendConnector) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.lns = append(e.lns, ln)
+	e.mu.Unlock()
+	fd, err := dupFd(ln)
+	if err != nil {
+		return nil, err
+	}
+	if !e.inbox.post(func() { e.listen(fd, backend) }) {
+		unix.Close(fd)
+	}
+	return ln.Addr(), nil
+}
+
+func (e *UringEngine) Serve(client net.Conn, backend connector.BackendConnector) error {
+	gc, err := e.guard.admit(client.RemoteAddr())
+	if err != nil {
+		client.Close()
+		return err
+	}
+	fd, err := dupFd(client)
+	if err != nil {
+		gc.release(err)
+		client.Close()
+		return err
+	}
+	go e.connect(gc, fd, client, client.RemoteAddr(), backend)
+	return nil
+}
+
+func (e *UringEngine) connect(gc *guarded, clientFd int, clientConn net.Conn, clientAddr net.Addr, backend connector.BackendConnector) {
+	connectBackend(e.inbox, gc, clientFd, clientConn, clientAddr, backend, func(backendFd int, backendConn net.Conn) {
+		e.attach(gc, clientFd, backendFd, clientAddr, clientConn, backendConn, backend)
+	})
+}
+
+func (e *UringEngine) loop() {
+	// Completions are run as task work of the thread that submitted the operations, when it next enters the kernel
+	// (IORING_SETUP_COOP_TASKRUN): that has to be the thread waiting for them.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	e.armWake()
+	for !e.stopped {
+		if err := e.ring.enter(1); err != nil && err != unix.EINTR && err != unix.EBUSY {
+			log.Printf("io_uring enter error: %v", err)
+		}
+		e.ring.complete(e.complete)
+	}
+	e.ring.close()
+	unix.Munmap(e.wakeBuf)
+}
+
+func userData(id uint32, dir, op uint8) uint64 {
+	return uint64(id)<<16 | uint64(dir)<<8 | uint64(op)
+}
+
+func (e *UringEngine) complete(c *cqe) {
+	id, dir, op := uint32(c.userData>>16), uint8(c.userData>>8), uint8(c.userData)
+	switch op {
+	case uringWake:
+		e.runPending()
+		return
+	case uringAccept:
+		e.accepted(id, c)
+		return
+	}
+
+	uc, ok := e.conns[id]
+	if !ok {
+		return
+	}
+	if c.flags&cqeFMore == 0 {
+		uc.inflight--
+	}
+	d := uc.up
+	if dir == 1 {
+		d = uc.down
+	}
+	switch op {
+	case uringRecv:
+		e.received(uc, d, c)
+	case uringSend:
+		e.sent(uc, d, c)
+	}
+	if !uc.closing && uc.up.shut && uc.down.shut {
+		e.fail(uc, nil)
+	}
+	if uc.closing && uc.inflight == 0 {
+		e.finish(uc)
+	}
+}
+
+func (e *UringEngine) armWake() {
+	s := e.ring.sqe()
+	s.opcode = opRead
+	s.fd = int32(e.inbox.fd)
+	s.addr = uint64(uintptr(unsafe.Pointer(&e.wakeBuf[0])))
+	s.len = 8
+	s.userData = userData(0, 0, uringWake)
+}
+
+func (e *UringEngine) runPending() {
+	for _, f := range e.inbox.take() {
+		f()
+	}
+	if !e.stopped {
+		e.armWake()
+	}
+}
+
+func (e *UringEngine) listen(fd int, backend connector.BackendConnector) {
+	id := e.newID()
+	ln := &uringListener{fd: fd, backend: backend}
+	e.listeners[id] = ln
+	e.armAccept(id, ln)
+}
+
+// newID returns an id no connection or listener has, for the user data of their operations.
+func (e *UringEngine) newID() uint32 {
+	e.nextID++
+	for e.nextID == 0 || e.conns[e.nextID] != nil || e.listeners[e.nextID] != nil {
+		e.nextID++
+	}
+	return e.nextID
+}
+
+// armAccept submits the accept of a listener: a multishot one, or when the connections beyond the max are queued, a
+// single shot one for a connection it reserves, if there is room for one. If there isn't, it is submitted once there
+// is.
+func (e *UringEngine) armAccept(id uint32, ln *uringListener) {
+	queues := e.guard.queues()
+	if queues {
+		if !e.guard.reserveOrNotify(func() { e.inbox.post(func() { e.resume(id) }) }) {
+			return
+		}
+		ln.reserved = true
+	}
+	s := e.ring.sqe()
+	s.opcode = opAccept
+	s.fd = int32(ln.fd)
+	if !queues {
+		s.ioprio = acceptMultishot
+	}
+	s.opFlags = unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC
+	s.userData = userData(id, 0, uringAccept)
+}
+
+func (e *UringEngine) resume(id uint32) {
+	if ln, ok := e.listeners[id]; ok && !e.stopped && !ln.reserved {
+		e.armAccept(id, ln)
+	}
+}
+
+func (e *UringEngine) accepted(id uint32, c *cqe) {
+	ln, ok := e.listeners[id]
+	if !ok {
+		if c.res >= 0 {
+			unix.Close(int(c.res))
+		}
+		return
+	}
+	reserved := ln.reserved
+	ln.reserved = false
+	if c.res >= 0 {
+		fd := int(c.res)
+		var addr net.Addr
+		if sa, err := unix.Getpeername(fd); err == nil {
+			addr = sockaddrToTCPAddr(sa)
+		}
+		var gc *guarded
+		var err error
+		if reserved {
+			gc, err = e.guard.admitReserved(addr)
+		} else {
+			gc, err = e.guard.admit(addr)
+		}
+		if err != nil {
+			unix.Close(fd)
+		} else {
+			// Like the net package does for the connections it accepts.
+			unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+			go e.connect(gc, fd, nil, addr, ln.backend)
+		}
+	} else {
+		if reserved {
+			e.guard.unreserve()
+		}
+		if err := unix.Errno(-c.res); err != unix.ECONNABORTED && err != unix.ECANCELED {
+			log.Printf("accept error: %v", err)
+		}
+	}
+	if c.flags&cqeFMore == 0 && !e.stopped {
+		e.armAccept(id, ln)
+	}
+}
+
+func (e *UringEngine) attach(gc *guarded, clientFd, backendFd int, clientAddr net.Addr, clientConn, backendConn net.Conn,
+	backend connector.BackendConnector) {
+	uc := &uringConn{
+		client: clientFd, backend: backendFd,
+		clientAddr: clientAddr, clientConn: clientConn, backendConn: backendConn, connector: backend, guarded: gc,
+	}
+	// Shutting down the sockets completes the receives with EOF, and fails the sends.
+	gc.track(func() (time.Duration, error) { return tcpIdle(clientFd) }, shutdownFds(clientFd, backendFd))
+	uc.up = &uringDirection{dir: 0, src: clientFd, dst: backendFd, bytes: &e.stats.Upstream}
+	uc.down = &uringDirection{dir: 1, src: backendFd, dst: clientFd, bytes: &e.stats.Downstream}
+	var err error
+	if uc.up.bufs, err = e.bufRing(); err == nil {
+		uc.down.bufs, err = e.bufRing()
+	}
+	uc.id = e.newID()
+	e.conns[uc.id] = uc
+	e.stats.Connections.Add(1)
+	if err != nil {
+		uc.closing, uc.err = true, err
+		e.finish(uc)
+		return
+	}
+	e.recv(uc, uc.up)
+	e.recv(uc, uc.down)
+}
+
+// bufRing returns an idle buffer ring, or registers a new one.
+func (e *UringEngine) bufRing() (*bufRing, error) {
+	if n := len(e.idle); n > 0 {
+		b := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		return b, nil
+	}
+	var group uint16
+	if n := len(e.groups); n > 0 {
+		group = e.groups[n-1]
+		e.groups = e.groups[:n-1]
+	} else if e.nextGroup <= 0xffff {
+		group = uint16(e.nextGroup)
+		e.nextGroup++
+	} else {
+		return nil, fmt.Errorf("out of buffer groups")
+	}
+	b, err := newBufRing(e.ring, group, uringBuffers, uringBufferSize)
+	if err != nil {
+		e.groups = append(e.groups, group)
+		return nil, err
+	}
+	return b, nil
+}
+
+func (e *UringEngine) recv(uc *uringConn, d *uringDirection) {
+	s := e.ring.sqe()
+	s.opcode = opRecv
+	s.fd = int32(d.src)
+	s.ioprio = recvMultishot
+	s.flags = sqeBufferSelect
+	s.bufGroup = d.bufs.group
+	s.userData = userData(uc.id, d.dir, uringRecv)
+	d.armed = true
+	uc.inflight++
+}
+
+func (e *UringEngine) received(uc *uringConn, d *uringDirection, c *cqe) {
+	if c.flags&cqeFMore == 0 {
+		d.armed = false
+	}
+	if c.flags&cqeFBuffer != 0 {
+		bid := uint16(c.flags >> cqeBufferShift)
+		if uc.closing || c.res <= 0 {
+			d.bufs.provide(bid)
+		} else {
+			d.queue = append(d.queue, chunk{bid: bid, n: int(c.res)})
+		}
+	}
+	switch {
+	case uc.closing:
+		return
+	case c.res == 0:
+		d.eof = true
+	case c.res < 0 && unix.Errno(-c.res) != unix.ENOBUFS:
+		e.fail(uc, unix.Errno(-c.res))
+		return
+	}
+	e.flush(uc, d)
+}
+
+// flush submits what was received as a chain of linked sends, unless one is in flight. Once all is sent, it shuts down
+// the destination after EOF, or receives again if the receive had to stop.
+func (e *UringEngine) flush(uc *uringConn, d *uringDirection) {
+	if len(d.sending) > 0 || uc.closing {
+		return
+	}
+	if len(d.queue) > 0 {
+		e.ring.reserve(uint32(len(d.queue)))
+		for i, ch := range d.queue {
+			s := e.ring.sqe()
+			s.opcode = opSend
+			s.fd = int32(d.dst)
+			s.addr = d.bufs.addr(ch.bid)
+			s.len = uint32(ch.n)
+			// A short send is completed by the kernel rather than breaking the chain.
+			s.opFlags = unix.MSG_WAITALL | unix.MSG_NOSIGNAL
+			if i < len(d.queue)-1 {
+				s.flags = sqeIOLink
+			}
+			s.userData = userData(uc.id, d.dir, uringSend)
+			uc.inflight++
+		}
+		d.sending, d.queue = d.queue, d.sending[:0]
+		return
+	}
+	switch {
+	case d.eof && !d.shut:
+		d.shut = true
+		if err := unix.Shutdown(d.dst, unix.SHUT_WR); err != nil && err != unix.ENOTCONN {
+			e.fail(uc, err)
+		}
+	case !d.eof && !d.armed:
+		e.recv(uc, d)
+	}
+}
+
+func (e *UringEngine) sent(uc *uringConn, d *uringDirection, c *cqe) {
+	ch := d.sending[0]
+	d.sending = d.sending[1:]
+	d.bufs.provide(ch.bid)
+	if uc.closing {
+		return
+	}
+	if c.res < 0 {
+		e.fail(uc, unix.Errno(-c.res))
+		return
+	}
+	d.bytes.Add(uint64(c.res))
+	if int(c.res) != ch.n {
+		e.fail(uc, io.ErrShortWrite)
+		return
+	}
+	if len(d.sending) == 0 {
+		e.flush(uc, d)
+	}
+}
+
+// fail starts closing the connection, after err if not nil: what is still in flight on its sockets is cancelled, and
+// the connection finished once it has all completed.
+func (e *UringEngine) fail(uc *uringConn, err error) {
+	if uc.closing {
+		return
+	}
+	uc.closing, uc.err = true, err
+	if uc.inflight == 0 {
+		return
+	}
+	for _, fd := range []int{uc.client, uc.backend} {
+		s := e.ring.sqe()
+		s.opcode = opAsyncCancel
+		s.fd = int32(fd)
+		s.opFlags = asyncCancelFd | asyncCancelAll
+		s.userData = userData(uc.id, 0, uringCancel)
+		uc.inflight++
+	}
+}
+
+// finish closes a connection nothing is in flight for anymore.
+func (e *UringEngine) finish(uc *uringConn) {
+	uc.err = uc.guarded.release(uc.err)
+	if uc.err != nil {
+		e.stats.countError(uc.err)
+		log.Printf("proxy error for client %s: %v", uc.clientAddr, uc.err)
+	}
+	delete(e.conns, uc.id)
+	unix.Close(uc.client)
+	unix.Close(uc.backend)
+	if uc.clientConn != nil {
+		uc.clientConn.Close()
+	}
+	releaseBackend(uc.connector, uc.backendConn)
+
+	for _, d := range []*uringDirection{uc.up, uc.down} {
+		if d.bufs == nil {
+			continue
+		}
+		// Buffers received but not sent go back, so that the ring is whole for the next connection.
+		for _, ch := range append(d.queue, d.sending...) {
+			d.bufs.provide(ch.bid)
+		}
+		if len(e.idle) < uringIdleBufRings {
+			e.idle = append(e.idle, d.bufs)
+		} else {
+			d.bufs.close(e.ring)
+			e.groups = append(e.groups, d.bufs.group)
+		}
+	}
+}
+
+func (e *UringEngine) stop() {
+	e.stopped = true
+	for _, ln := range e.listeners {
+		unix.Close(ln.fd)
+	}
+	e.inbox.close()
+}
@@ -1,39 +1,374 @@
 package pool
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
+// ErrExhausted is returned by Get when no connection could be checked out before the context was done: all MaxOpen
+// connections were in use. The backend itself may be perfectly healthy.
+var ErrExhausted = errors.New("connection pool exhausted")
+
+var ErrClosed = errors.New("connection pool closed")
+
+type Config struct {
+	// MinIdle connections are kept dialed ahead of demand, by the background maintenance rather than the constructor,
+	// so a backend that is down at startup doesn't fail the pool.
+	MinIdle int
+	// MaxOpen bounds the connections open to the backend, checked out and idle ones together. Get waits for one to be
+	// returned beyond that.
+	MaxOpen     int
+	DialTimeout time.Duration
+	// CheckoutTimeout bounds how long the PoolConnector waits in Get. Callers of ConnPool.Get pass their own context.
+	CheckoutTimeout time.Duration
+	// IdleTimeout closes connections that sat idle for longer, down to MinIdle. 0 disables it.
+	IdleTimeout time.Duration
+	// MaxLifetime closes connections older than this when they are idle, whatever MinIdle, so that they are spread
+	// over backend instances that come and go behind the address. 0 disables it.
+	MaxLifetime time.Duration
+	// MaintenanceInterval is how often idle connections are expired, validated and topped up to MinIdle.
+	MaintenanceInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MinIdle:             10,
+		MaxOpen:             1000,
+		DialTimeout:         2 * time.Second,
+		CheckoutTimeout:     time.Second,
+		IdleTimeout:         time.Minute,
+		MaxLifetime:         30 * time.Minute,
+		MaintenanceInterval: time.Second,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.MaxOpen <= 0 {
+		return fmt.Errorf("max open must be positive")
+	}
+	if c.MinIdle < 0 || c.MinIdle > c.MaxOpen {
+		return fmt.Errorf("min idle must be between 0 and max open (%d)", c.MaxOpen)
+	}
+	if c.DialTimeout <= 0 || c.CheckoutTimeout <= 0 || c.MaintenanceInterval <= 0 {
+		return fmt.Errorf("dial timeout, checkout timeout and maintenance interval must be positive")
+	}
+	if c.IdleTimeout < 0 || c.MaxLifetime < 0 {
+		return fmt.Errorf("idle timeout and max lifetime must not be negative")
+	}
+	return nil
+}
+
+type pooledConn struct {
+	net.Conn
+	createdAt  time.Time
+	returnedAt time.Time
+}
+
+// ConnPool is a bounded pool of connections to one backend. Connections are dialed lazily, when Get finds none idle
+// (and in the background to keep MinIdle), validated on checkout and on return, and closed when idle or old for too
+// long. Idle connections are reused most recently returned first, so that the idle timeout can trim the surplus.
 type ConnPool struct {
 	backendAddr string
-	pool        chan net.Conn
+	cfg         Config
+	dialer      net.Dialer
+
+	mu      sync.Mutex
+	idle    []*pooledConn
+	inUse   map[net.Conn]*pooledConn
+	open    int                // idle, in use and being dialed
+	waiters []chan *pooledConn // FIFO; nil is sent when a slot frees up rather than a connection
+	closed  bool
+	done    chan struct{}
+
+	stats Stats
 }
 
-func NewConnPool(backendAddr string, size int) (*ConnPool, error) {
+func NewConnPool(backendAddr string, cfg Config) (*ConnPool, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	cp := &ConnPool{
 		backendAddr: backendAddr,
-		pool:        make(chan net.Conn, size),
+		cfg:         cfg,
+		dialer:      net.Dialer{Timeout: cfg.DialTimeout},
+		inUse:       make(map[net.Conn]*pooledConn),
+		done:        make(chan struct{}),
 	}
-	for i := 0; i < size; i++ {
-		conn, err := net.Dial("tcp", backendAddr)
-		if err != nil {
-			return nil, err
+	go cp.maintain()
+	return cp, nil
+}
+
+// Get checks out an idle connection, dials a new one if fewer than MaxOpen are open, or waits for one to be returned
+// until ctx is done.
+func (cp *ConnPool) Get(ctx context.Context) (net.Conn, error) {
+	start := time.Now()
+	cp.stats.gets.Add(1)
+	waited := false
+	defer func() {
+		if waited {
+			cp.stats.waits.Add(1)
+			cp.stats.waitTime.Add(int64(time.Since(start)))
+		}
+	}()
+
+	for {
+		cp.mu.Lock()
+		if cp.closed {
+			cp.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if n := len(cp.idle); n > 0 {
+			pc := cp.idle[n-1]
+			cp.idle = cp.idle[:n-1]
+			if !cp.reusable(pc, time.Now()) {
+				cp.closeLocked(pc)
+				cp.mu.Unlock()
+				continue
+			}
+			cp.inUse[pc.Conn] = pc
+			cp.mu.Unlock()
+			cp.stats.hits.Add(1)
+			return pc.Conn, nil
+		}
+		if cp.open < cp.cfg.MaxOpen {
+			cp.open++
+			cp.mu.Unlock()
+			pc, err := cp.dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			cp.mu.Lock()
+			cp.inUse[pc.Conn] = pc
+			cp.mu.Unlock()
+			return pc.Conn, nil
+		}
+
+		ch := make(chan *pooledConn, 1)
+		cp.waiters = append(cp.waiters, ch)
+		cp.mu.Unlock()
+		waited = true
+
+		select {
+		case pc := <-ch:
+			if pc == nil {
+				continue // a slot freed up, go dial
+			}
+			return pc.Conn, nil
+		case <-ctx.Done():
+			cp.mu.Lock()
+			if i := slices.Index(cp.waiters, ch); i >= 0 {
+				cp.waiters = slices.Delete(cp.waiters, i, i+1)
+			}
+			cp.mu.Unlock()
+			// A handoff may have raced with the cancellation: pass it on rather than leak it.
+			select {
+			case pc := <-ch:
+				if pc != nil {
+					cp.Return(pc.Conn)
+				} else {
+					cp.mu.Lock()
+					cp.releaseLocked()
+					cp.mu.Unlock()
+				}
+			default:
+			}
+			cp.stats.timeouts.Add(1)
+			return nil, fmt.Errorf("%w: waited %v: %w", ErrExhausted, time.Since(start).Round(time.Millisecond), ctx.Err())
 		}
-		cp.pool <- conn
 	}
-	return cp, nil
 }
 
-func (cp *ConnPool) Get() (net.Conn, error) {
-	conn := <-cp.pool
-	return conn, nil
+// dial opens a connection in a slot already counted in open, and gives the slot back if it fails.
+func (cp *ConnPool) dial(ctx context.Context) (*pooledConn, error) {
+	cp.stats.dials.Add(1)
+	start := time.Now()
+	conn, err := cp.dialer.DialContext(ctx, "tcp", cp.backendAddr)
+	cp.stats.dialTime.Add(int64(time.Since(start)))
+	if err != nil {
+		cp.stats.dialErrors.Add(1)
+		cp.mu.Lock()
+		cp.open--
+		cp.releaseLocked()
+		cp.mu.Unlock()
+		return nil, err
+	}
+	now := time.Now()
+	return &pooledConn{Conn: conn, createdAt: now, returnedAt: now}, nil
 }
 
+// Return puts a connection back, or closes it if it broke or outlived MaxLifetime. Connections the pool didn't hand out
+// are closed.
 func (cp *ConnPool) Return(conn net.Conn) {
-	select {
-	case cp.pool <- conn:
-	default:
-		// Pool is full somehow - close excess connections
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	pc, ok := cp.inUse[conn]
+	if !ok {
+		conn.Close()
+		return
+	}
+	delete(cp.inUse, conn)
+
+	now := time.Now()
+	if cp.closed || !cp.reusable(pc, now) {
+		cp.closeLocked(pc)
+		return
+	}
+	pc.returnedAt = now
+	if len(cp.waiters) > 0 {
+		ch := cp.waiters[0]
+		cp.waiters = cp.waiters[1:]
+		cp.inUse[conn] = pc
+		ch <- pc
+		return
+	}
+	cp.idle = append(cp.idle, pc)
+}
+
+// Discard closes a connection the caller knows can't be reused, e.g. one it shut down, and frees its slot. Unlike
+// Return, it doesn't probe the connection, so it isn't counted as broken.
+func (cp *ConnPool) Discard(conn net.Conn) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	pc, ok := cp.inUse[conn]
+	if !ok {
 		conn.Close()
+		return
+	}
+	delete(cp.inUse, conn)
+	cp.closeLocked(pc)
+}
+
+func (cp *ConnPool) reusable(pc *pooledConn, now time.Time) bool {
+	if cp.cfg.MaxLifetime > 0 && now.Sub(pc.createdAt) >= cp.cfg.MaxLifetime {
+		cp.stats.expired.Add(1)
+		return false
+	}
+	if !Alive(pc.Conn) {
+		cp.stats.broken.Add(1)
+		return false
+	}
+	return true
+}
+
+// closeLocked closes a connection that is neither idle nor in use anymore and frees its slot.
+func (cp *ConnPool) closeLocked(pc *pooledConn) {
+	pc.Conn.Close()
+	cp.open--
+	cp.releaseLocked()
+}
+
+// releaseLocked tells the first waiter that a slot is free, so that it dials a connection of its own.
+func (cp *ConnPool) releaseLocked() {
+	if len(cp.waiters) > 0 {
+		ch := cp.waiters[0]
+		cp.waiters = cp.waiters[1:]
+		ch <- nil
+	}
+}
+
+func (cp *ConnPool) maintain() {
+	ticker := time.NewTicker(cp.cfg.MaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		cp.evict(time.Now())
+		cp.fill()
+		select {
+		case <-cp.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// evict closes the idle connections that are broken, past MaxLifetime, or past IdleTimeout beyond MinIdle.
+func (cp *ConnPool) evict(now time.Time) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	// idle is ordered by return time, oldest first, so the idle timeout trims from the front.
+	kept := cp.idle[:0]
+	surplus := len(cp.idle) - cp.cfg.MinIdle
+	for _, pc := range cp.idle {
+		switch {
+		case surplus > 0 && cp.cfg.IdleTimeout > 0 && now.Sub(pc.returnedAt) >= cp.cfg.IdleTimeout:
+			surplus--
+			cp.stats.idleClosed.Add(1)
+		case !cp.reusable(pc, now):
+		default:
+			kept = append(kept, pc)
+			continue
+		}
+		cp.closeLocked(pc)
+	}
+	clear(cp.idle[len(kept):])
+	cp.idle = kept
+}
+
+// fill dials connections until MinIdle are idle, stopping at the first failure: the next round will try again.
+func (cp *ConnPool) fill() {
+	for {
+		cp.mu.Lock()
+		if cp.closed || len(cp.idle) >= cp.cfg.MinIdle || cp.open >= cp.cfg.MaxOpen {
+			cp.mu.Unlock()
+			return
+		}
+		cp.open++
+		cp.mu.Unlock()
+
+		pc, err := cp.dial(context.Background())
+		if err != nil {
+			return
+		}
+		cp.mu.Lock()
+		cp.inUse[pc.Conn] = pc
+		cp.mu.Unlock()
+		cp.Return(pc.Conn)
+	}
+}
+
+// Close closes the idle connections and stops the maintenance. Connections in use are closed when they are returned.
+func (cp *ConnPool) Close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.closed {
+		return
+	}
+	cp.closed = true
+	close(cp.done)
+	for _, pc := range cp.idle {
+		cp.closeLocked(pc)
+	}
+	cp.idle = nil
+	// Wake the waiters, to find the pool closed.
+	for len(cp.waiters) > 0 {
+		cp.releaseLocked()
+	}
+}
+
+// Alive peeks at the socket without blocking: a connection is reusable if there is nothing to read yet. EOF means the
+// peer closed it, an error that it is broken, and unread data that it is still carrying the previous client's traffic.
+func Alive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
 	}
+	alive := false
+	var buf [1]byte
+	err = raw.Read(func(fd uintptr) bool {
+		_, _, err := unix.Recvfrom(int(fd), buf[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		alive = err == unix.EAGAIN || err == unix.EWOULDBLOCK
+		return true
+	})
+	return err == nil && alive
 }
@@ -0,0 +1,455 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer listens on a local port and hands every connection it accepts to the channel, for the test to write to
+// or close.
+func startServer(t *testing.T) (string, chan net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		for {
+			select {
+			case conn := <-accepted:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return ln.Addr().String(), accepted
+}
+
+// testConfig has no MinIdle, and maintenance that only runs at start, so that the tests run it by hand.
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.MinIdle = 0
+	cfg.MaxOpen = 2
+	cfg.MaintenanceInterval = time.Hour
+	return cfg
+}
+
+func newPool(t *testing.T, addr string, cfg Config) *ConnPool {
+	t.Helper()
+	cp, err := NewConnPool(addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cp.Close)
+	return cp
+}
+
+func get(t *testing.T, cp *ConnPool) net.Conn {
+	t.Helper()
+	conn, err := cp.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// waiting reports how many Gets are waiting for a connection.
+func (cp *ConnPool) waiting() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return len(cp.waiters)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		valid  bool
+	}{
+		{"default", func(c *Config) {}, true},
+		{"no max open", func(c *Config) { c.MaxOpen = 0 }, false},
+		{"min idle above max open", func(c *Config) { c.MinIdle = c.MaxOpen + 1 }, false},
+		{"negative min idle", func(c *Config) { c.MinIdle = -1 }, false},
+		{"no dial timeout", func(c *Config) { c.DialTimeout = 0 }, false},
+		{"no checkout timeout", func(c *Config) { c.CheckoutTimeout = 0 }, false},
+		{"no maintenance interval", func(c *Config) { c.MaintenanceInterval = 0 }, false},
+		{"no idle timeout", func(c *Config) { c.IdleTimeout = 0 }, true},
+		{"negative max lifetime", func(c *Config) { c.MaxLifetime = -time.Second }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.modify(&cfg)
+			if err := cfg.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestConnPool_ReusesReturnedConnections(t *testing.T) {
+	addr, _ := startServer(t)
+	cp := newPool(t, addr, testConfig())
+
+	first := get(t, cp)
+	cp.Return(first)
+	if again := get(t, cp); again != first {
+		t.Error("got a new connection, want the returned one")
+	}
+	s := cp.Stats()
+	if s.Gets != 2 || s.Hits != 1 || s.Dials != 1 || s.Open != 1 || s.InUse != 1 || s.Idle != 0 {
+		t.Errorf("stats %s", s)
+	}
+	if s.Utilisation() != 0.5 {
+		t.Errorf("utilisation %.2f, want 0.50", s.Utilisation())
+	}
+}
+
+// Beyond MaxOpen, Get waits until its context is done, and fails with ErrExhausted.
+func TestConnPool_MaxOpen(t *testing.T) {
+	addr, _ := startServer(t)
+	cp := newPool(t, addr, testConfig())
+	get(t, cp)
+	get(t, cp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cp.Get(ctx)
+	if !errors.Is(err, ErrExhausted) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get: %v, want ErrExhausted after the deadline", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("gave up after %v, before the deadline", waited)
+	}
+	s := cp.Stats()
+	if s.Open != 2 || s.InUse != 2 || s.Dials != 2 || s.Waits != 1 || s.Timeouts != 1 {
+		t.Errorf("stats %s", s)
+	}
+	if s.WaitTime < 50*time.Millisecond {
+		t.Errorf("wait time %v, want the 50ms waited", s.WaitTime)
+	}
+	if s.Utilisation() != 1 {
+		t.Errorf("utilisation %.2f, want 1", s.Utilisation())
+	}
+	if cp.waiting() != 0 {
+		t.Error("the timed out Get is still waiting")
+	}
+}
+
+// A connection returned while Gets wait goes to the first of them, rather than to the idle ones.
+func TestConnPool_HandsReturnedConnectionToWaiter(t *testing.T) {
+	addr, _ := startServer(t)
+	cfg := testConfig()
+	cfg.MaxOpen = 1
+	cp := newPool(t, addr, cfg)
+	first := get(t, cp)
+
+	got := make(chan net.Conn)
+	go func() {
+		conn, err := cp.Get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- conn
+	}()
+	waitFor(t, "the Get to wait", func() bool { return cp.waiting() == 1 })
+	time.Sleep(20 * time.Millisecond)
+	cp.Return(first)
+
+	if conn := <-got; conn != first {
+		t.Error("the waiter got a new connection, want the returned one")
+	}
+	s := cp.Stats()
+	if s.Dials != 1 || s.Waits != 1 || s.Idle != 0 || s.InUse != 1 {
+		t.Errorf("stats %s", s)
+	}
+	if s.WaitTime < 20*time.Millisecond {
+		t.Errorf("wait time %v, want the 20ms waited", s.WaitTime)
+	}
+}
+
+// A broken connection returned while Gets wait is closed, and its slot goes to the first waiter, which dials.
+func TestConnPool_HandsSlotOfBrokenConnectionToWaiter(t *testing.T) {
+	addr, accepted := startServer(t)
+	cfg := testConfig()
+	cfg.MaxOpen = 1
+	cp := newPool(t, addr, cfg)
+	first := get(t, cp)
+	(<-accepted).Close()
+
+	got := make(chan net.Conn)
+	go func() {
+		conn, err := cp.Get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- conn
+	}()
+	waitFor(t, "the Get to wait", func() bool { return cp.waiting() == 1 })
+	waitFor(t, "the backend's close", func() bool { return !Alive(first) })
+	cp.Return(first)
+
+	if conn := <-got; conn == first {
+		t.Error("the waiter got the broken connection")
+	}
+	s := cp.Stats()
+	if s.Dials != 2 || s.Broken != 1 || s.Open != 1 {
+		t.Errorf("stats %s", s)
+	}
+}
+
+func TestConnPool_MinIdle(t *testing.T) {
+	addr, accepted := startServer(t)
+	cfg := testConfig()
+	cfg.MinIdle, cfg.MaxOpen = 3, 4
+	cfg.MaintenanceInterval = 10 * time.Millisecond
+	cp := newPool(t, addr, cfg)
+
+	waitFor(t, "min idle connections", func() bool { return cp.Stats().Idle == 3 })
+	// Checking one out has the maintenance dial another.
+	get(t, cp)
+	waitFor(t, "min idle connections", func() bool { return cp.Stats().Idle == 3 })
+	// The pool doesn't go beyond max open to keep min idle.
+	get(t, cp)
+	time.Sleep(50 * time.Millisecond)
+	s := cp.Stats()
+	if s.Open != 4 || s.Idle != 2 || s.Dials != 4 || s.Hits != 2 {
+		t.Errorf("stats %s", s)
+	}
+	if n := len(accepted); n != 4 {
+		t.Errorf("backend accepted %d connections, want 4", n)
+	}
+}
+
+// A backend that is down doesn't fail the pool: the maintenance keeps trying.
+func TestConnPool_MinIdleBackendDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	cfg := testConfig()
+	cfg.MinIdle = 1
+	cfg.MaintenanceInterval = 10 * time.Millisecond
+	cp := newPool(t, addr, cfg)
+
+	waitFor(t, "failed dials", func() bool { return cp.Stats().DialErrors >= 2 })
+	if _, err := cp.Get(context.Background()); err == nil {
+		t.Fatal("Get succeeded with the backend down")
+	}
+	if s := cp.Stats(); s.Open != 0 {
+		t.Errorf("%d open after failed dials", s.Open)
+	}
+}
+
+// Idle connections beyond MinIdle are closed after IdleTimeout, those returned least recently first.
+func TestConnPool_IdleTimeout(t *testing.T) {
+	addr, _ := startServer(t)
+	cfg := testConfig()
+	cfg.MinIdle, cfg.MaxOpen = 1, 3
+	cfg.IdleTimeout = time.Minute
+	cp := newPool(t, addr, cfg)
+	conns := []net.Conn{get(t, cp), get(t, cp), get(t, cp)}
+	for _, conn := range conns {
+		cp.Return(conn)
+	}
+
+	cp.evict(time.Now().Add(30 * time.Second))
+	if s := cp.Stats(); s.Idle != 3 || s.IdleClosed != 0 {
+		t.Fatalf("before the idle timeout: stats %s", s)
+	}
+	cp.evict(time.Now().Add(2 * time.Minute))
+	s := cp.Stats()
+	if s.Idle != 1 || s.Open != 1 || s.IdleClosed != 2 {
+		t.Fatalf("after the idle timeout: stats %s", s)
+	}
+	if kept := get(t, cp); kept != conns[2] {
+		t.Error("kept an older connection, want the one returned last")
+	}
+}
+
+// Connections past MaxLifetime are closed when idle, whatever MinIdle, and when returned.
+func TestConnPool_MaxLifetime(t *testing.T) {
+	addr, _ := startServer(t)
+	cfg := testConfig()
+	cfg.MinIdle = 2
+	cfg.MaxLifetime = time.Hour
+	cp := newPool(t, addr, cfg)
+	old, kept := get(t, cp), get(t, cp)
+	cp.Return(old)
+
+	cp.evict(time.Now().Add(2 * time.Hour))
+	if s := cp.Stats(); s.Idle != 0 || s.Open != 1 || s.Expired != 1 {
+		t.Fatalf("stats %s", s)
+	}
+
+	cp.mu.Lock()
+	cp.inUse[kept].createdAt = time.Now().Add(-2 * time.Hour)
+	cp.mu.Unlock()
+	cp.Return(kept)
+	if s := cp.Stats(); s.Idle != 0 || s.Open != 0 || s.Expired != 2 {
+		t.Errorf("stats %s", s)
+	}
+}
+
+// Connections the backend closed, or that have unread data, are found out by the MSG_PEEK and closed: on return, on
+// checkout and by the maintenance.
+func TestConnPool_BrokenConnections(t *testing.T) {
+	addr, accepted := startServer(t)
+	cp := newPool(t, addr, testConfig())
+
+	closedConn := get(t, cp)
+	(<-accepted).Close()
+	dirtyConn := get(t, cp)
+	server := <-accepted
+	if !Alive(dirtyConn) {
+		t.Fatal("a fresh connection isn't alive")
+	}
+	server.Write([]byte("left over"))
+	waitFor(t, "the backend's close", func() bool { return !Alive(closedConn) })
+	waitFor(t, "the left over data", func() bool { return !Alive(dirtyConn) })
+
+	// On return.
+	cp.Return(dirtyConn)
+	if s := cp.Stats(); s.Broken != 1 || s.Open != 1 || s.Idle != 0 {
+		t.Fatalf("on return: stats %s", s)
+	}
+
+	// On checkout: the backend closes an idle connection.
+	idleConn := get(t, cp)
+	cp.Return(idleConn)
+	(<-accepted).Close()
+	waitFor(t, "the backend's close", func() bool { return !Alive(idleConn) })
+	if conn := get(t, cp); conn == idleConn {
+		t.Fatal("checked out a connection the backend closed")
+	}
+	if s := cp.Stats(); s.Broken != 2 || s.Dials != 4 {
+		t.Fatalf("on checkout: stats %s", s)
+	}
+
+	// By the maintenance.
+	cp.mu.Lock()
+	cp.idle = append(cp.idle, cp.inUse[closedConn])
+	delete(cp.inUse, closedConn)
+	cp.mu.Unlock()
+	cp.evict(time.Now())
+	if s := cp.Stats(); s.Broken != 3 || s.Idle != 0 || s.Open != 1 {
+		t.Errorf("by the maintenance: stats %s", s)
+	}
+}
+
+func TestConnPool_Close(t *testing.T) {
+	addr, _ := startServer(t)
+	cfg := testConfig()
+	cfg.MaxOpen = 2
+	cp := newPool(t, addr, cfg)
+	idle, inUse := get(t, cp), get(t, cp)
+	cp.Return(idle)
+	cp.Get(context.Background()) // takes idle back
+	cp.Return(idle)
+
+	// Fill the pool again, so that a Get waits.
+	get(t, cp)
+	errs := make(chan error)
+	go func() {
+		_, err := cp.Get(context.Background())
+		errs <- err
+	}()
+	waitFor(t, "the Get to wait", func() bool { return cp.waiting() == 1 })
+
+	cp.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("waiting Get: %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't wake the waiting Get")
+	}
+	if _, err := cp.Get(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get after Close: %v, want ErrClosed", err)
+	}
+
+	cp.Return(inUse)
+	if _, err := inUse.Write([]byte("x")); err == nil {
+		t.Error("a connection returned after Close is still open")
+	}
+	if s := cp.Stats(); s.Idle != 0 || s.InUse != 1 || s.Open != 1 {
+		t.Errorf("stats %s", s)
+	}
+	cp.Close()
+}
+
+// A discarded connection is closed without the liveness check, and its slot goes to the first waiter, which dials.
+func TestConnPool_Discard(t *testing.T) {
+	addr, _ := startServer(t)
+	cfg := testConfig()
+	cfg.MaxOpen = 1
+	cp := newPool(t, addr, cfg)
+	first := get(t, cp)
+
+	got := make(chan net.Conn)
+	go func() {
+		conn, err := cp.Get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- conn
+	}()
+	waitFor(t, "the Get to wait", func() bool { return cp.waiting() == 1 })
+	first.(*net.TCPConn).CloseWrite()
+	cp.Discard(first)
+
+	if conn := <-got; conn == first {
+		t.Error("the waiter got the discarded connection")
+	}
+	if _, err := first.Write([]byte("x")); err == nil {
+		t.Error("the discarded connection is still open")
+	}
+	if s := cp.Stats(); s.Dials != 2 || s.Open != 1 || s.Broken != 0 || s.Expired != 0 {
+		t.Errorf("stats %s", s)
+	}
+}
+
+// Connections the pool didn't hand out are closed on return, and not counted.
+func TestConnPool_ReturnForeignConnection(t *testing.T) {
+	addr, _ := startServer(t)
+	cp := newPool(t, addr, testConfig())
+	foreign, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Return(foreign)
+	if _, err := foreign.Write([]byte("x")); err == nil {
+		t.Error("a foreign connection is still open")
+	}
+	if s := cp.Stats(); s.Open != 0 || s.Idle != 0 || s.Broken != 0 {
+		t.Errorf("stats %s", s)
+	}
+}
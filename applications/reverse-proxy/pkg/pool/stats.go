@@ -0,0 +1,64 @@
+package pool
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type Stats struct {
+	gets       atomic.Uint64
+	hits       atomic.Uint64 // checked out from the idle connections, without dialing
+	dials      atomic.Uint64
+	dialErrors atomic.Uint64
+	dialTime   atomic.Int64  // nanoseconds, summed over the dials
+	waits      atomic.Uint64 // Gets that found MaxOpen connections open and had to wait
+	waitTime   atomic.Int64  // nanoseconds, summed over the waits
+	timeouts   atomic.Uint64 // waits that ended with ErrExhausted
+	broken     atomic.Uint64 // closed because the backend closed them or they had unread data
+	expired    atomic.Uint64 // closed for MaxLifetime
+	idleClosed atomic.Uint64 // closed for IdleTimeout
+}
+
+// Snapshot is a point in time copy of the pool's counters, together with its current occupancy.
+type Snapshot struct {
+	Gets, Hits, Dials, DialErrors, Waits, Timeouts uint64
+	WaitTime, DialTime                             time.Duration
+	Broken, Expired, IdleClosed                    uint64
+
+	Open, Idle, InUse, MaxOpen int
+}
+
+// Utilisation is the fraction of MaxOpen checked out.
+func (s Snapshot) Utilisation() float64 {
+	return float64(s.InUse) / float64(s.MaxOpen)
+}
+
+func (s Snapshot) String() string {
+	return fmt.Sprintf("gets=%d hits=%d dials=%d dial_errors=%d dial_time=%v waits=%d wait_time=%v timeouts=%d broken=%d expired=%d idle_closed=%d open=%d idle=%d in_use=%d utilisation=%.2f",
+		s.Gets, s.Hits, s.Dials, s.DialErrors, s.DialTime, s.Waits, s.WaitTime, s.Timeouts, s.Broken, s.Expired, s.IdleClosed,
+		s.Open, s.Idle, s.InUse, s.Utilisation())
+}
+
+func (cp *ConnPool) Stats() Snapshot {
+	cp.mu.Lock()
+	open, idle, inUse := cp.open, len(cp.idle), len(cp.inUse)
+	cp.mu.Unlock()
+	return Snapshot{
+		Gets:       cp.stats.gets.Load(),
+		Hits:       cp.stats.hits.Load(),
+		Dials:      cp.stats.dials.Load(),
+		DialErrors: cp.stats.dialErrors.Load(),
+		Waits:      cp.stats.waits.Load(),
+		Timeouts:   cp.stats.timeouts.Load(),
+		WaitTime:   time.Duration(cp.stats.waitTime.Load()),
+		DialTime:   time.Duration(cp.stats.dialTime.Load()),
+		Broken:     cp.stats.broken.Load(),
+		Expired:    cp.stats.expired.Load(),
+		IdleClosed: cp.stats.idleClosed.Load(),
+		Open:       open,
+		Idle:       idle,
+		InUse:      inUse,
+		MaxOpen:    cp.cfg.MaxOpen,
+	}
+}
@@ -0,0 +1,369 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/balancer"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/connector"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/engine"
+	"github.com/VladMinzatu/performance-handbook/reverse-proxy/pkg/pool"
+)
+
+type TelemetryMetrics struct {
+	meter metric.Meter
+
+	// Engine metrics, labelled by engine
+	accepted    metric.Int64ObservableCounter
+	connections metric.Int64ObservableCounter
+	requests    metric.Int64ObservableCounter
+	bytes       metric.Int64ObservableCounter
+	errors      metric.Int64ObservableCounter
+	active      metric.Int64ObservableGauge
+	rejected    metric.Int64ObservableCounter
+	timeouts    metric.Int64ObservableCounter
+
+	// Backend metrics, observed from the balancer's counters when scraped
+	backendActiveConnections metric.Int64ObservableGauge
+	backendConnections       metric.Int64ObservableCounter
+	backendHealthy           metric.Int64ObservableGauge
+	backendTransitions       metric.Int64ObservableCounter
+	backendConnectDuration   metric.Float64Histogram
+
+	// Pool metrics, for the backends reached through a PoolConnector
+	poolConnections metric.Int64ObservableGauge
+	poolUtilisation metric.Float64ObservableGauge
+	poolGets        metric.Int64ObservableCounter
+	poolDials       metric.Int64ObservableCounter
+	poolDialErrors  metric.Int64ObservableCounter
+	poolDialTime    metric.Float64ObservableCounter
+	poolWaits       metric.Int64ObservableCounter
+	poolWaitTime    metric.Float64ObservableCounter
+	poolTimeouts    metric.Int64ObservableCounter
+	poolClosed      metric.Int64ObservableCounter
+}
+
+// ObserveEngine reports the connections accepted and proxied by the engine, its requests, bytes per direction and
+// errors by type, and the connections its limits rejected or timed out, labelled with its name. The stats
+// are taken at every collection, as engines with several loops sum them up on the fly.
+func (t *TelemetryMetrics) ObserveEngine(name string, eng engine.Engine) error {
+	_, err := t.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		stats := eng.Stats()
+		engineAttr := attribute.String("engine", name)
+		o.ObserveInt64(t.accepted, int64(stats.Accepted.Load()), metric.WithAttributes(engineAttr))
+		o.ObserveInt64(t.connections, int64(stats.Connections.Load()), metric.WithAttributes(engineAttr))
+		o.ObserveInt64(t.requests, int64(stats.Requests.Load()), metric.WithAttributes(engineAttr))
+		withErrorType := func(errorType string) metric.ObserveOption {
+			return metric.WithAttributes(engineAttr, attribute.String("type", errorType))
+		}
+		errors, timeouts, resets := stats.Errors.Load(), stats.TimeoutErrors.Load(), stats.ResetErrors.Load()
+		o.ObserveInt64(t.errors, int64(stats.ConnectErrors.Load()), withErrorType("connect"))
+		o.ObserveInt64(t.errors, int64(timeouts), withErrorType("timeout"))
+		o.ObserveInt64(t.errors, int64(resets), withErrorType("reset"))
+		o.ObserveInt64(t.errors, int64(errors-timeouts-resets), withErrorType("other"))
+		o.ObserveInt64(t.bytes, int64(stats.Upstream.Load()),
+			metric.WithAttributes(engineAttr, attribute.String("direction", "upstream")))
+		o.ObserveInt64(t.bytes, int64(stats.Downstream.Load()),
+			metric.WithAttributes(engineAttr, attribute.String("direction", "downstream")))
+		o.ObserveInt64(t.active, stats.Active.Load(), metric.WithAttributes(engineAttr))
+		withReason := func(reason string) metric.ObserveOption {
+			return metric.WithAttributes(engineAttr, attribute.String("reason", reason))
+		}
+		o.ObserveInt64(t.rejected, int64(stats.RejectedMaxConns.Load()), withReason("max_conns"))
+		o.ObserveInt64(t.rejected, int64(stats.RejectedPerIP.Load()), withReason("per_ip"))
+		withType := func(timeout string) metric.ObserveOption {
+			return metric.WithAttributes(engineAttr, attribute.String("type", timeout))
+		}
+		o.ObserveInt64(t.timeouts, int64(stats.ConnectTimeouts.Load()), withType("connect"))
+		o.ObserveInt64(t.timeouts, int64(stats.IdleTimeouts.Load()), withType("idle"))
+		o.ObserveInt64(t.timeouts, int64(stats.LifetimeTimeouts.Load()), withType("lifetime"))
+		return nil
+	}, t.accepted, t.connections, t.requests, t.bytes, t.errors, t.active, t.rejected, t.timeouts)
+	return err
+}
+
+// ObserveBackends reports the connection counts, connect latencies and health of the balancer's backends, and the stats
+// of their pools, labelled by backend address. It must be called before the balancer is used.
+func (t *TelemetryMetrics) ObserveBackends(lb *balancer.Balancer) error {
+	lb.OnConnect(func(b *balancer.Backend, took time.Duration, err error) {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		t.backendConnectDuration.Record(context.Background(), took.Seconds(),
+			metric.WithAttributes(attribute.String("backend", b.Addr), attribute.String("outcome", outcome)))
+	})
+	_, err := t.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		for _, b := range lb.Backends() {
+			attrs := metric.WithAttributes(attribute.String("backend", b.Addr))
+			o.ObserveInt64(t.backendActiveConnections, b.Active(), attrs)
+			o.ObserveInt64(t.backendConnections, int64(b.Total()), attrs)
+			healthy := int64(0)
+			if b.State() == balancer.StateHealthy {
+				healthy = 1
+			}
+			o.ObserveInt64(t.backendHealthy, healthy, attrs)
+			for _, state := range balancer.States() {
+				o.ObserveInt64(t.backendTransitions, int64(b.Transitions(state)),
+					metric.WithAttributes(attribute.String("backend", b.Addr), attribute.String("state", state.String())))
+			}
+			if pc, ok := b.Connector().(*connector.PoolConnector); ok {
+				t.observePool(o, b.Addr, pc.Stats())
+			}
+		}
+		return nil
+	}, t.backendActiveConnections, t.backendConnections, t.backendHealthy, t.backendTransitions,
+		t.poolConnections, t.poolUtilisation, t.poolGets, t.poolDials, t.poolDialErrors, t.poolDialTime, t.poolWaits, t.poolWaitTime,
+		t.poolTimeouts, t.poolClosed)
+	return err
+}
+
+func (t *TelemetryMetrics) observePool(o metric.Observer, backend string, s pool.Snapshot) {
+	attrs := metric.WithAttributes(attribute.String("backend", backend))
+	withState := func(state string) metric.ObserveOption {
+		return metric.WithAttributes(attribute.String("backend", backend), attribute.String("state", state))
+	}
+	o.ObserveInt64(t.poolConnections, int64(s.Idle), withState("idle"))
+	o.ObserveInt64(t.poolConnections, int64(s.InUse), withState("in_use"))
+	o.ObserveInt64(t.poolConnections, int64(s.Open-s.Idle-s.InUse), withState("dialing"))
+	o.ObserveFloat64(t.poolUtilisation, s.Utilisation(), attrs)
+	o.ObserveInt64(t.poolGets, int64(s.Gets), attrs)
+	o.ObserveInt64(t.poolDials, int64(s.Dials), attrs)
+	o.ObserveInt64(t.poolDialErrors, int64(s.DialErrors), attrs)
+	o.ObserveFloat64(t.poolDialTime, s.DialTime.Seconds(), attrs)
+	o.ObserveInt64(t.poolWaits, int64(s.Waits), attrs)
+	o.ObserveFloat64(t.poolWaitTime, s.WaitTime.Seconds(), attrs)
+	o.ObserveInt64(t.poolTimeouts, int64(s.Timeouts), attrs)
+	withReason := func(reason string) metric.ObserveOption {
+		return metric.WithAttributes(attribute.String("backend", backend), attribute.String("reason", reason))
+	}
+	o.ObserveInt64(t.poolClosed, int64(s.Broken), withReason("broken"))
+	o.ObserveInt64(t.poolClosed, int64(s.Expired), withReason("max_lifetime"))
+	o.ObserveInt64(t.poolClosed, int64(s.IdleClosed), withReason("idle_timeout"))
+}
+
+func InitMetrics() (*TelemetryMetrics, error) {
+	promExporter, err := prometheus.New()
+	if err != nil {
+		return nil, err
+	}
+
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(promExporter))
+	otel.SetMeterProvider(mp)
+
+	meter := otel.GetMeterProvider().Meter("reverse_proxy")
+	accepted, err := meter.Int64ObservableCounter("proxy_accepted_connections",
+		metric.WithDescription("Number of client connections accepted, including those the connection limits rejected"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	connections, err := meter.Int64ObservableCounter("proxy_connections",
+		metric.WithDescription("Number of client connections proxied to a backend"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	requests, err := meter.Int64ObservableCounter("proxy_requests",
+		metric.WithDescription("Number of HTTP requests proxied to a backend, by the http engine"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := meter.Int64ObservableCounter("proxy_bytes",
+		metric.WithDescription("Bytes proxied, upstream (client to backend) and downstream"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	errors, err := meter.Int64ObservableCounter("proxy_connection_errors",
+		metric.WithDescription("Number of proxied connections that ended with an error, and of client connections or HTTP requests no backend connection could be had for, by type"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := meter.Int64ObservableGauge("proxy_active_connections",
+		metric.WithDescription("Number of client connections currently open"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rejected, err := meter.Int64ObservableCounter("proxy_rejected_connections",
+		metric.WithDescription("Number of client connections closed on accept by the connection limits, by reason"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts, err := meter.Int64ObservableCounter("proxy_timeouts",
+		metric.WithDescription("Number of backend connects and client connections that timed out, by type"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	backendActiveConnections, err := meter.Int64ObservableGauge("proxy_backend_active_connections",
+		metric.WithDescription("Number of connections currently open to the backend"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	backendConnections, err := meter.Int64ObservableCounter("proxy_backend_connections",
+		metric.WithDescription("Number of connections handed out to the backend since start"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	backendHealthy, err := meter.Int64ObservableGauge("proxy_backend_healthy",
+		metric.WithDescription("Whether the backend is in rotation (1) or out of it, unhealthy or ejected (0)"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	backendTransitions, err := meter.Int64ObservableCounter("proxy_backend_state_transitions",
+		metric.WithDescription("Number of times the backend has entered each health state"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	backendConnectDuration, err := meter.Float64Histogram("proxy_backend_connect_duration",
+		metric.WithDescription("Time to get a connection to the backend: a dial, or a checkout from the pool"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(
+			0.00005, // 50us
+			0.0001,
+			0.00025,
+			0.0005,
+			0.001, // 1ms
+			0.0025,
+			0.005,
+			0.01,
+			0.025,
+			0.05,
+			0.1,
+			0.25,
+			0.5,
+			1.0,
+			2.5,
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolConnections, err := meter.Int64ObservableGauge("proxy_pool_connections",
+		metric.WithDescription("Number of pooled connections to the backend, by state"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolUtilisation, err := meter.Float64ObservableGauge("proxy_pool_utilisation",
+		metric.WithDescription("Fraction of the pool's max open connections checked out"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolGets, err := meter.Int64ObservableCounter("proxy_pool_gets",
+		metric.WithDescription("Number of connection checkouts"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolDials, err := meter.Int64ObservableCounter("proxy_pool_dials",
+		metric.WithDescription("Number of connections dialed by the pool"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolDialErrors, err := meter.Int64ObservableCounter("proxy_pool_dial_errors",
+		metric.WithDescription("Number of failed dials by the pool"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolDialTime, err := meter.Float64ObservableCounter("proxy_pool_dial",
+		metric.WithDescription("Time spent dialing connections for the pool"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolWaits, err := meter.Int64ObservableCounter("proxy_pool_waits",
+		metric.WithDescription("Number of checkouts that had to wait for a connection to be returned"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolWaitTime, err := meter.Float64ObservableCounter("proxy_pool_wait",
+		metric.WithDescription("Time spent waiting for a connection to be returned"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolTimeouts, err := meter.Int64ObservableCounter("proxy_pool_checkout_timeouts",
+		metric.WithDescription("Number of checkouts that timed out with the pool exhausted"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	poolClosed, err := meter.Int64ObservableCounter("proxy_pool_closed",
+		metric.WithDescription("Number of pooled connections closed, by reason"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TelemetryMetrics{
+		meter:                    meter,
+		accepted:                 accepted,
+		connections:              connections,
+		requests:                 requests,
+		bytes:                    bytes,
+		errors:                   errors,
+		active:                   active,
+		rejected:                 rejected,
+		timeouts:                 timeouts,
+		backendActiveConnections: backendActiveConnections,
+		backendConnections:       backendConnections,
+		backendHealthy:           backendHealthy,
+		backendTransitions:       backendTransitions,
+		backendConnectDuration:   backendConnectDuration,
+		poolConnections:          poolConnections,
+		poolUtilisation:          poolUtilisation,
+		poolGets:                 poolGets,
+		poolDials:                poolDials,
+		poolDialErrors:           poolDialErrors,
+		poolDialTime:             poolDialTime,
+		poolWaits:                poolWaits,
+		poolWaitTime:             poolWaitTime,
+		poolTimeouts:             poolTimeouts,
+		poolClosed:               poolClosed,
+	}, nil
+}